@@ -0,0 +1,267 @@
+// Package acpi builds the ACPI tables of a hardware-reduced machine: the
+// RSDP pointing to an XSDT, which lists the FADT, the MADT and optionally
+// the SRAT and SLIT of NUMA machines, and the DSDT given by the FADT.
+//
+// refs https://uefi.org/specs/ACPI/6.5/05_ACPI_Software_Programming_Model.html
+package acpi
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// OEMID identifies gokvm as the maker of the tables.
+	OEMID = "GOKVM"
+
+	headerSize = 36
+	rsdpSize   = 36
+	fadtSize   = 276
+
+	// apicAddr is the address of the local APIC of each CPU.
+	apicAddr = 0xfee0_0000
+
+	// ioapicAddr is the address of the only IOAPIC, whose pins are
+	// the GSIs from 0.
+	ioapicAddr = 0xfec0_0000
+
+	// sleepControlPort is where the guest writes SLP_TYP and SLP_EN
+	// to enter a sleep state, see iodev.ACPIShutDown.
+	sleepControlPort = 0x600
+)
+
+// ErrTooLarge indicates the tables do not fit in the space given.
+var ErrTooLarge = errors.New("ACPI tables too large")
+
+const (
+	fadtHWReduced = 1 << 20
+
+	madtPCATCompat = 1 << 0
+
+	madtLocalAPIC = 0
+	madtIOAPIC    = 1
+
+	lapicEnabled       = 1 << 0
+	lapicOnlineCapable = 1 << 1
+
+	sratLocalAPIC = 0
+	sratMemory    = 1
+
+	sratEnabled      = 1 << 0
+	sratHotpluggable = 1 << 1
+)
+
+// checksum returns the byte which makes the bytes of b sum up to 0.
+func checksum(b []byte) byte {
+	var sum byte
+
+	for _, c := range b {
+		sum += c
+	}
+
+	return -sum
+}
+
+// table prefixes body with the header of a table with the signature sig
+// and fills in its checksum.
+func table(sig string, rev byte, body []byte) []byte {
+	b := make([]byte, headerSize, headerSize+len(body))
+
+	copy(b, sig)
+	binary.LittleEndian.PutUint32(b[4:], uint32(headerSize+len(body)))
+	b[8] = rev
+	copy(b[10:16], OEMID)
+	copy(b[16:24], OEMID)
+	binary.LittleEndian.PutUint32(b[24:], 1)
+	copy(b[28:32], OEMID)
+	binary.LittleEndian.PutUint32(b[32:], 1)
+
+	b = append(b, body...)
+	b[9] = checksum(b)
+
+	return b
+}
+
+// rsdp returns the root pointer to the XSDT at xsdt.
+func rsdp(xsdt uint64) []byte {
+	b := make([]byte, rsdpSize)
+
+	copy(b, "RSD PTR ")
+	copy(b[9:15], OEMID)
+	b[15] = 2 // revision
+	binary.LittleEndian.PutUint32(b[20:], rsdpSize)
+	binary.LittleEndian.PutUint64(b[24:], xsdt)
+
+	// The first checksum covers the 20 bytes of ACPI 1.0.
+	b[8] = checksum(b[:20])
+	b[32] = checksum(b)
+
+	return b
+}
+
+// xsdt lists the tables at addrs.
+func xsdt(addrs ...uint64) []byte {
+	var body []byte
+
+	for _, a := range addrs {
+		body = binary.LittleEndian.AppendUint64(body, a)
+	}
+
+	return table("XSDT", 1, body)
+}
+
+// gas returns a generic address structure of an IO port of one byte.
+func gas(port uint64) []byte {
+	b := []byte{1, 8, 0, 1} // SystemIO, 8 bits from bit 0, byte access
+
+	return binary.LittleEndian.AppendUint64(b, port)
+}
+
+// fadt returns the FADT of a hardware-reduced machine with its DSDT at
+// dsdt. The only fixed hardware left is the sleep control register.
+func fadt(dsdt uint64) []byte {
+	b := make([]byte, fadtSize-headerSize)
+	at := func(off int) []byte { return b[off-headerSize:] }
+
+	binary.LittleEndian.PutUint32(at(112), fadtHWReduced)
+	at(131)[0] = 5 // minor version
+	binary.LittleEndian.PutUint64(at(140), dsdt)
+	copy(at(244), gas(sleepControlPort))
+	copy(at(256), gas(sleepControlPort))
+
+	return table("FACP", 6, b)
+}
+
+// LocalAPIC is the MADT entry of a CPU. A CPU which is not Enabled at
+// boot may still be brought up later if it is OnlineCapable.
+type LocalAPIC struct {
+	UID, APICID   uint8
+	Enabled       bool
+	OnlineCapable bool
+}
+
+// Bytes returns the MADT entry, which is also the _MAT of the CPU in
+// the DSDT.
+func (l LocalAPIC) Bytes() []byte {
+	var flags uint32
+	if l.Enabled {
+		flags |= lapicEnabled
+	}
+
+	if l.OnlineCapable {
+		flags |= lapicOnlineCapable
+	}
+
+	return binary.LittleEndian.AppendUint32([]byte{madtLocalAPIC, 8, l.UID, l.APICID}, flags)
+}
+
+// madt returns the MADT of the CPUs and the IOAPIC.
+func madt(cpus []LocalAPIC) []byte {
+	body := binary.LittleEndian.AppendUint32(nil, apicAddr)
+	body = binary.LittleEndian.AppendUint32(body, madtPCATCompat)
+
+	for _, c := range cpus {
+		body = append(body, c.Bytes()...)
+	}
+
+	ioapic := []byte{madtIOAPIC, 12, 0, 0}
+	ioapic = binary.LittleEndian.AppendUint32(ioapic, ioapicAddr)
+	ioapic = binary.LittleEndian.AppendUint32(ioapic, 0) // GSI base
+
+	return table("APIC", 5, append(body, ioapic...))
+}
+
+// CPUAffinity places the CPU of APICID in the proximity domain Node.
+type CPUAffinity struct {
+	Node   uint32
+	APICID uint8
+}
+
+// MemAffinity places the memory from Base to Base+Size in the proximity
+// domain Node.
+type MemAffinity struct {
+	Node         uint32
+	Base, Size   uint64
+	Hotpluggable bool
+}
+
+// SRAT returns the table placing cpus and mem in proximity domains, the
+// NUMA nodes of the guest.
+func SRAT(cpus []CPUAffinity, mem []MemAffinity) []byte {
+	// The first field is reserved as 1 for compatibility.
+	body := make([]byte, 12)
+	body[0] = 1
+
+	for _, c := range cpus {
+		e := make([]byte, 16)
+		e[0], e[1] = sratLocalAPIC, 16
+		e[2], e[3] = byte(c.Node), c.APICID
+		binary.LittleEndian.PutUint32(e[4:], sratEnabled)
+		e[9], e[10], e[11] = byte(c.Node>>8), byte(c.Node>>16), byte(c.Node>>24)
+		body = append(body, e...)
+	}
+
+	for _, m := range mem {
+		flags := uint32(sratEnabled)
+		if m.Hotpluggable {
+			flags |= sratHotpluggable
+		}
+
+		e := make([]byte, 40)
+		e[0], e[1] = sratMemory, 40
+		binary.LittleEndian.PutUint32(e[2:], m.Node)
+		binary.LittleEndian.PutUint64(e[8:], m.Base)
+		binary.LittleEndian.PutUint64(e[16:], m.Size)
+		binary.LittleEndian.PutUint32(e[28:], flags)
+		body = append(body, e...)
+	}
+
+	return table("SRAT", 3, body)
+}
+
+// SLIT returns the table of the distances between the proximity domains,
+// dist[i][j] from i to j, where 10 is the distance of a domain to itself.
+func SLIT(dist [][]uint8) []byte {
+	body := binary.LittleEndian.AppendUint64(nil, uint64(len(dist)))
+
+	for _, d := range dist {
+		body = append(body, d...)
+	}
+
+	return table("SLIT", 1, body)
+}
+
+// Build lays out the tables for address addr, with the RSDP first. aml
+// is the definition block of the DSDT and cpus the CPUs of the MADT.
+// The XSDT lists tables, e.g. an SRAT, after the FADT and the MADT. The
+// result must fit in size bytes.
+func Build(addr uint64, size int, aml []byte, cpus []LocalAPIC, tables ...[]byte) ([]byte, error) {
+	b := make([]byte, rsdpSize)
+
+	add := func(t []byte) uint64 {
+		// Tables are 8 byte aligned.
+		for len(b)%8 != 0 {
+			b = append(b, 0)
+		}
+
+		a := addr + uint64(len(b))
+		b = append(b, t...)
+
+		return a
+	}
+
+	dsdt := add(table("DSDT", 2, aml))
+	addrs := []uint64{add(fadt(dsdt)), add(madt(cpus))}
+
+	for _, t := range tables {
+		addrs = append(addrs, add(t))
+	}
+
+	copy(b, rsdp(add(xsdt(addrs...))))
+
+	if len(b) > size {
+		return nil, ErrTooLarge
+	}
+
+	return b, nil
+}
@@ -0,0 +1,146 @@
+package acpi_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+)
+
+const addr = 0xe0000
+
+// sum adds up the bytes of b, which is 0 for a valid checksum.
+func sum(b []byte) byte {
+	var s byte
+
+	for _, c := range b {
+		s += c
+	}
+
+	return s
+}
+
+// tableAt returns the table at a of the tables b built for addr, and
+// checks its signature and checksum.
+func tableAt(t *testing.T, b []byte, a uint64, sig string) []byte {
+	t.Helper()
+
+	off := a - addr
+	if off+36 > uint64(len(b)) || string(b[off:off+4]) != sig {
+		t.Fatalf("no %s at %#x", sig, a)
+	}
+
+	tb := b[off : off+uint64(binary.LittleEndian.Uint32(b[off+4:]))]
+	if sum(tb) != 0 {
+		t.Errorf("%s: bad checksum", sig)
+	}
+
+	if !bytes.HasPrefix(tb[10:], []byte(acpi.OEMID)) {
+		t.Errorf("%s: got OEM ID %q", sig, tb[10:16])
+	}
+
+	return tb
+}
+
+func TestBuild(t *testing.T) {
+	t.Parallel()
+
+	aml := []byte{0x08, '_', 'S', '5', '_', 0x12, 0x04, 0x01, 0x0a, 0x05}
+	cpus := []acpi.LocalAPIC{
+		{UID: 0, APICID: 0, Enabled: true},
+		{UID: 1, APICID: 1, OnlineCapable: true},
+	}
+
+	b, err := acpi.Build(addr, 0x10000, aml, cpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b[:8]) != "RSD PTR " || b[15] != 2 {
+		t.Fatalf("no RSDP of revision 2 first: % x", b[:16])
+	}
+
+	if sum(b[:20]) != 0 || sum(b[:36]) != 0 {
+		t.Errorf("RSDP: bad checksum")
+	}
+
+	xsdt := tableAt(t, b, binary.LittleEndian.Uint64(b[24:]), "XSDT")
+	if len(xsdt) != 36+2*8 {
+		t.Fatalf("XSDT: got %d bytes, want 2 tables", len(xsdt))
+	}
+
+	fadt := tableAt(t, b, binary.LittleEndian.Uint64(xsdt[36:]), "FACP")
+	if len(fadt) != 276 || binary.LittleEndian.Uint32(fadt[112:])&(1<<20) == 0 {
+		t.Errorf("FADT: got %d bytes, want 276 and hardware reduced", len(fadt))
+	}
+
+	dsdt := tableAt(t, b, binary.LittleEndian.Uint64(fadt[140:]), "DSDT")
+	if !bytes.Equal(dsdt[36:], aml) {
+		t.Errorf("DSDT: got % x, want % x", dsdt[36:], aml)
+	}
+
+	madt := tableAt(t, b, binary.LittleEndian.Uint64(xsdt[44:]), "APIC")
+	entries := madt[44:]
+
+	for i, c := range cpus {
+		e := entries[8*i : 8*i+8]
+		if !bytes.Equal(e, c.Bytes()) {
+			t.Errorf("MADT: got entry % x for CPU %d, want % x", e, i, c.Bytes())
+		}
+	}
+
+	if flags := binary.LittleEndian.Uint32(entries[12:]); flags != 2 {
+		t.Errorf("MADT: got flags %#x for the CPU not present, want online capable", flags)
+	}
+
+	if ioapic := entries[16:]; len(ioapic) != 12 || ioapic[0] != 1 {
+		t.Errorf("MADT: got % x, want the IOAPIC last", ioapic)
+	}
+
+	if _, err := acpi.Build(addr, 0x100, aml, cpus); !errors.Is(err, acpi.ErrTooLarge) {
+		t.Errorf("0x100 bytes: got %v, want %v", err, acpi.ErrTooLarge)
+	}
+}
+
+func TestBuildNUMA(t *testing.T) {
+	t.Parallel()
+
+	srat := acpi.SRAT(
+		[]acpi.CPUAffinity{{Node: 0, APICID: 0}, {Node: 1, APICID: 2}},
+		[]acpi.MemAffinity{{Node: 0, Size: 1 << 30}, {Node: 1, Base: 1 << 30, Size: 1 << 30}},
+	)
+	slit := acpi.SLIT([][]uint8{{10, 20}, {20, 10}})
+
+	b, err := acpi.Build(addr, 0x10000, nil, []acpi.LocalAPIC{{Enabled: true}, {UID: 1, APICID: 2, Enabled: true}},
+		srat, slit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xsdt := tableAt(t, b, binary.LittleEndian.Uint64(b[24:]), "XSDT")
+	if len(xsdt) != 36+4*8 {
+		t.Fatalf("XSDT: got %d bytes, want 4 tables", len(xsdt))
+	}
+
+	srat = tableAt(t, b, binary.LittleEndian.Uint64(xsdt[52:]), "SRAT")
+	if len(srat) != 48+2*16+2*40 {
+		t.Fatalf("SRAT: got %d bytes, want 2 CPUs and 2 ranges", len(srat))
+	}
+
+	if cpu := srat[64:80]; cpu[0] != 0 || cpu[2] != 1 || cpu[3] != 2 || cpu[4] != 1 {
+		t.Errorf("SRAT: got % x, want APIC ID 2 enabled in node 1", cpu)
+	}
+
+	mem := srat[120:160]
+	if mem[0] != 1 || binary.LittleEndian.Uint32(mem[2:]) != 1 || binary.LittleEndian.Uint64(mem[8:]) != 1<<30 ||
+		binary.LittleEndian.Uint64(mem[16:]) != 1<<30 || binary.LittleEndian.Uint32(mem[28:]) != 1 {
+		t.Errorf("SRAT: got % x, want 1 GiB from 1 GiB enabled in node 1", mem)
+	}
+
+	slit = tableAt(t, b, binary.LittleEndian.Uint64(xsdt[60:]), "SLIT")
+	if want := []byte{2, 0, 0, 0, 0, 0, 0, 0, 10, 20, 20, 10}; !bytes.Equal(slit[36:], want) {
+		t.Errorf("SLIT: got % x, want % x", slit[36:], want)
+	}
+}
@@ -0,0 +1,387 @@
+// Package aml encodes the ACPI Machine Language of the DSDT, in which
+// devices describe themselves and their methods to the guest.
+//
+// Each function returns the encoding of one term, and terms nest by
+// passing them to the functions of the enclosing ones:
+//
+//	aml.Device("\\_SB.CPUS",
+//		aml.Name("_HID", aml.String("ACPI0010")),
+//		aml.Method("CSTA", 1, true, aml.Return(aml.Int(0xf))),
+//	)
+//
+// refs https://uefi.org/specs/ACPI/6.5/20_AML_Specification.html
+package aml
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const (
+	zeroOp        = 0x00
+	oneOp         = 0x01
+	nameOp        = 0x08
+	bytePrefix    = 0x0a
+	wordPrefix    = 0x0b
+	dWordPrefix   = 0x0c
+	stringPrefix  = 0x0d
+	qWordPrefix   = 0x0e
+	scopeOp       = 0x10
+	bufferOp      = 0x11
+	packageOp     = 0x12
+	methodOp      = 0x14
+	dualNamePre   = 0x2e
+	multiNamePre  = 0x2f
+	extOpPrefix   = 0x5b
+	rootChar      = 0x5c
+	parentPrefix  = 0x5e
+	local0Op      = 0x60
+	arg0Op        = 0x68
+	storeOp       = 0x70
+	incrementOp   = 0x75
+	andOp         = 0x7b
+	notifyOp      = 0x86
+	lNotOp        = 0x92
+	lEqualOp      = 0x93
+	lLessOp       = 0x95
+	ifOp          = 0xa0
+	whileOp       = 0xa2
+	returnOp      = 0xa4
+	mutexOp       = 0x01 // after extOpPrefix
+	acquireOp     = 0x23 // after extOpPrefix
+	releaseOp     = 0x27 // after extOpPrefix
+	opRegionOp    = 0x80 // after extOpPrefix
+	fieldOp       = 0x81 // after extOpPrefix
+	deviceOp      = 0x82 // after extOpPrefix
+	nullName      = 0x00
+	endTag        = 0x79 // with its length of 1
+	extendedIRQ   = 0x89
+	nameSegLength = 4
+)
+
+// Region spaces of OpRegion.
+const (
+	SystemMemory = 0
+	SystemIO     = 1
+)
+
+// Flags of Field: the access width, or'ed with the rule for the bits of
+// the access outside of the field being written.
+const (
+	AnyAcc   = 0
+	ByteAcc  = 1
+	WordAcc  = 2
+	DWordAcc = 3
+
+	Preserve     = 0 << 5
+	WriteAsOnes  = 1 << 5
+	WriteAsZeros = 2 << 5
+)
+
+// cat concatenates terms.
+func cat(terms ...[]byte) []byte {
+	var b []byte
+
+	for _, t := range terms {
+		b = append(b, t...)
+	}
+
+	return b
+}
+
+// length encodes v in the form of a PkgLength: 6 bits in one byte, or
+// the low 4 bits in the first byte followed by up to 3 more bytes.
+func length(v int) []byte {
+	if v <= 0x3f {
+		return []byte{byte(v)}
+	}
+
+	for n := 1; n <= 3; n++ {
+		if v < 1<<(4+8*n) {
+			b := []byte{byte(n)<<6 | byte(v&0xf)}
+			for i := 0; i < n; i++ {
+				b = append(b, byte(v>>(4+8*i)))
+			}
+
+			return b
+		}
+	}
+
+	panic("aml: length too large")
+}
+
+// pkgLength encodes the PkgLength of n bytes which follow it. Unlike
+// the length of a field, it counts its own bytes too.
+func pkgLength(n int) []byte {
+	for size := 1; ; size++ {
+		if b := length(n + size); len(b) == size {
+			return b
+		}
+	}
+}
+
+// pkg prefixes the terms with their PkgLength.
+func pkg(terms ...[]byte) []byte {
+	b := cat(terms...)
+
+	return append(pkgLength(len(b)), b...)
+}
+
+// nameSeg pads a name segment like "GED" with underscores.
+func nameSeg(s string) []byte {
+	if len(s) > nameSegLength {
+		panic("aml: name segment " + s + " is longer than 4 characters")
+	}
+
+	return []byte(s + strings.Repeat("_", nameSegLength-len(s)))
+}
+
+// Path encodes a name like "_HID", "^CSTA" or "\\_SB.CPUS.CSCN".
+func Path(name string) []byte {
+	var b []byte
+
+	for strings.HasPrefix(name, "^") {
+		b = append(b, parentPrefix)
+		name = name[1:]
+	}
+
+	if strings.HasPrefix(name, "\\") {
+		b = append(b, rootChar)
+		name = name[1:]
+	}
+
+	if name == "" {
+		return append(b, nullName)
+	}
+
+	segs := strings.Split(name, ".")
+
+	switch len(segs) {
+	case 1:
+	case 2:
+		b = append(b, dualNamePre)
+	default:
+		b = append(b, multiNamePre, byte(len(segs)))
+	}
+
+	for _, s := range segs {
+		b = append(b, nameSeg(s)...)
+	}
+
+	return b
+}
+
+// Int encodes v in the shortest form.
+func Int(v uint64) []byte {
+	switch {
+	case v == 0:
+		return []byte{zeroOp}
+	case v == 1:
+		return []byte{oneOp}
+	case v <= 0xff:
+		return []byte{bytePrefix, byte(v)}
+	case v <= 0xffff:
+		return binary.LittleEndian.AppendUint16([]byte{wordPrefix}, uint16(v))
+	case v <= 0xffff_ffff:
+		return binary.LittleEndian.AppendUint32([]byte{dWordPrefix}, uint32(v))
+	default:
+		return binary.LittleEndian.AppendUint64([]byte{qWordPrefix}, v)
+	}
+}
+
+// String encodes an ASCII string.
+func String(s string) []byte {
+	return append(append([]byte{stringPrefix}, s...), 0)
+}
+
+// EISAID encodes a compressed EISA ID like "PNP0A05" as an integer.
+func EISAID(id string) []byte {
+	if len(id) != 7 {
+		panic("aml: EISA ID " + id + " is not 7 characters long")
+	}
+
+	hex := func(c byte) uint32 {
+		switch {
+		case c >= '0' && c <= '9':
+			return uint32(c - '0')
+		default:
+			return uint32(c-'A') + 10
+		}
+	}
+
+	v := uint32(id[0]-'@')<<26 | uint32(id[1]-'@')<<21 | uint32(id[2]-'@')<<16 |
+		hex(id[3])<<12 | hex(id[4])<<8 | hex(id[5])<<4 | hex(id[6])
+
+	// The ID is stored big endian.
+	return Int(uint64(v>>24 | v>>8&0xff00 | v<<8&0xff0000 | v<<24))
+}
+
+// Buffer encodes b as a buffer object.
+func Buffer(b []byte) []byte {
+	return cat([]byte{bufferOp}, pkg(Int(uint64(len(b))), b))
+}
+
+// Package encodes a package of the elements.
+func Package(elems ...[]byte) []byte {
+	return cat([]byte{packageOp}, pkg(append([]byte{byte(len(elems))}, cat(elems...)...)))
+}
+
+// Local encodes the local variable Local0 to Local7.
+func Local(n int) []byte {
+	return []byte{local0Op + byte(n)}
+}
+
+// Arg encodes the method argument Arg0 to Arg6.
+func Arg(n int) []byte {
+	return []byte{arg0Op + byte(n)}
+}
+
+// Name declares the object name holding obj.
+func Name(name string, obj []byte) []byte {
+	return cat([]byte{nameOp}, Path(name), obj)
+}
+
+// Scope opens the namespace scope name with the terms in it.
+func Scope(name string, terms ...[]byte) []byte {
+	return cat([]byte{scopeOp}, pkg(Path(name), cat(terms...)))
+}
+
+// Device declares the device name with the terms in it.
+func Device(name string, terms ...[]byte) []byte {
+	return cat([]byte{extOpPrefix, deviceOp}, pkg(Path(name), cat(terms...)))
+}
+
+// Method declares the method name taking args arguments. The guest runs
+// a serialized method on one thread at a time.
+func Method(name string, args int, serialized bool, terms ...[]byte) []byte {
+	flags := byte(args & 0x7)
+	if serialized {
+		flags |= 1 << 3
+	}
+
+	return cat([]byte{methodOp}, pkg(Path(name), []byte{flags}, cat(terms...)))
+}
+
+// Call invokes the method name with args.
+func Call(name string, args ...[]byte) []byte {
+	return cat(Path(name), cat(args...))
+}
+
+// Mutex declares the mutex name at the sync level.
+func Mutex(name string, level int) []byte {
+	return cat([]byte{extOpPrefix, mutexOp}, Path(name), []byte{byte(level & 0xf)})
+}
+
+// Acquire takes the mutex name, waiting for it at most timeout
+// milliseconds, or forever for 0xffff.
+func Acquire(name string, timeout uint16) []byte {
+	return binary.LittleEndian.AppendUint16(cat([]byte{extOpPrefix, acquireOp}, Path(name)), timeout)
+}
+
+// Release releases the mutex name.
+func Release(name string) []byte {
+	return cat([]byte{extOpPrefix, releaseOp}, Path(name))
+}
+
+// OpRegion declares the region name of size bytes at offset in space,
+// one of SystemMemory and SystemIO.
+func OpRegion(name string, space byte, offset, size uint64) []byte {
+	return cat([]byte{extOpPrefix, opRegionOp}, Path(name), []byte{space}, Int(offset), Int(size))
+}
+
+// FieldUnit is a field of Bits bits of a region, or bits skipped if
+// Name is empty.
+type FieldUnit struct {
+	Name string
+	Bits int
+}
+
+// Field declares the units of the region name, laid out in order from
+// its start. flags is one access width or'ed with one update rule.
+func Field(region string, flags byte, units ...FieldUnit) []byte {
+	var list []byte
+
+	for _, u := range units {
+		if u.Name == "" {
+			list = append(list, 0)
+		} else {
+			list = append(list, nameSeg(u.Name)...)
+		}
+
+		list = append(list, length(u.Bits)...)
+	}
+
+	return cat([]byte{extOpPrefix, fieldOp}, pkg(Path(region), []byte{flags}, list))
+}
+
+// Store stores src to dst.
+func Store(src, dst []byte) []byte {
+	return cat([]byte{storeOp}, src, dst)
+}
+
+// Increment adds 1 to x.
+func Increment(x []byte) []byte {
+	return cat([]byte{incrementOp}, x)
+}
+
+// And returns the bitwise and of a and b.
+func And(a, b []byte) []byte {
+	return cat([]byte{andOp}, a, b, []byte{nullName})
+}
+
+// Equal is true if a equals b.
+func Equal(a, b []byte) []byte {
+	return cat([]byte{lEqualOp}, a, b)
+}
+
+// Less is true if a is less than b.
+func Less(a, b []byte) []byte {
+	return cat([]byte{lLessOp}, a, b)
+}
+
+// Not is true if a is false.
+func Not(a []byte) []byte {
+	return cat([]byte{lNotOp}, a)
+}
+
+// If runs the terms if pred is true.
+func If(pred []byte, terms ...[]byte) []byte {
+	return cat([]byte{ifOp}, pkg(pred, cat(terms...)))
+}
+
+// While runs the terms as long as pred is true.
+func While(pred []byte, terms ...[]byte) []byte {
+	return cat([]byte{whileOp}, pkg(pred, cat(terms...)))
+}
+
+// Notify sends the notification value to the device obj, e.g. 1 for a
+// device check.
+func Notify(obj, value []byte) []byte {
+	return cat([]byte{notifyOp}, obj, value)
+}
+
+// Return returns v from a method.
+func Return(v []byte) []byte {
+	return cat([]byte{returnOp}, v)
+}
+
+// Flags of Interrupt.
+const (
+	Consumer  = 1 << 0
+	Edge      = 1 << 1
+	ActiveLow = 1 << 2
+	Shared    = 1 << 3
+)
+
+// Interrupt encodes an extended interrupt descriptor of a resource
+// template for the GSI irq.
+func Interrupt(flags byte, irq uint32) []byte {
+	return binary.LittleEndian.AppendUint32([]byte{extendedIRQ, 6, 0, flags, 1}, irq)
+}
+
+// ResourceTemplate encodes a buffer of the resource descriptors, e.g.
+// for _CRS.
+func ResourceTemplate(descs ...[]byte) []byte {
+	// A checksum of 0 means the template has none.
+	return Buffer(cat(cat(descs...), []byte{endTag, 0}))
+}
@@ -0,0 +1,136 @@
+package aml_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/aml"
+)
+
+// Each term is named by its ASL, the PkgLength following an opcode
+// counts the bytes up to the end of the term.
+func TestEncode(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{
+			name: "Name (_S5, Package () {5})",
+			got:  aml.Name("_S5", aml.Package(aml.Int(5))),
+			want: []byte{0x08, '_', 'S', '5', '_', 0x12, 0x04, 0x01, 0x0a, 0x05},
+		},
+		{
+			name: "Name (_HID, EisaId (\"PNP0A03\"))",
+			got:  aml.Name("_HID", aml.EISAID("PNP0A03")),
+			want: []byte{0x08, '_', 'H', 'I', 'D', 0x0c, 0x41, 0xd0, 0x0a, 0x03},
+		},
+		{
+			name: "Name (_UID, \"ab\")",
+			got:  aml.Name("_UID", aml.String("ab")),
+			want: []byte{0x08, '_', 'U', 'I', 'D', 0x0d, 'a', 'b', 0},
+		},
+		{
+			name: "\\_SB.CPUS.CSCN ()",
+			got:  aml.Call("\\_SB.CPUS.CSCN"),
+			want: []byte{0x5c, 0x2f, 0x03, '_', 'S', 'B', '_', 'C', 'P', 'U', 'S', 'C', 'S', 'C', 'N'},
+		},
+		{
+			name: "^C000",
+			got:  aml.Path("^C000"),
+			want: []byte{0x5e, 'C', '0', '0', '0'},
+		},
+		{
+			name: "Method (_STA, 0, NotSerialized) { Return (0x0F) }",
+			got:  aml.Method("_STA", 0, false, aml.Return(aml.Int(0xf))),
+			want: []byte{0x14, 0x09, '_', 'S', 'T', 'A', 0x00, 0xa4, 0x0a, 0x0f},
+		},
+		{
+			name: "Method (CSTA, 1, Serialized) { Store (Arg0, Local0) }",
+			got:  aml.Method("CSTA", 1, true, aml.Store(aml.Arg(0), aml.Local(0))),
+			want: []byte{0x14, 0x09, 'C', 'S', 'T', 'A', 0x09, 0x70, 0x68, 0x60},
+		},
+		{
+			name: "If (LEqual (And (Local0, One), One)) { Increment (Local1) }",
+			got:  aml.If(aml.Equal(aml.And(aml.Local(0), aml.Int(1)), aml.Int(1)), aml.Increment(aml.Local(1))),
+			want: []byte{0xa0, 0x09, 0x93, 0x7b, 0x60, 0x01, 0x00, 0x01, 0x75, 0x61},
+		},
+		{
+			name: "While (LLess (Local0, 0x10)) { Notify (C000, One) }",
+			got:  aml.While(aml.Less(aml.Local(0), aml.Int(0x10)), aml.Notify(aml.Path("C000"), aml.Int(1))),
+			want: []byte{0xa2, 0x0b, 0x95, 0x60, 0x0a, 0x10, 0x86, 'C', '0', '0', '0', 0x01},
+		},
+		{
+			name: "Mutex (CPLK, 0) and Acquire (CPLK, 0xFFFF) and Release (CPLK)",
+			got:  bytes.Join([][]byte{aml.Mutex("CPLK", 0), aml.Acquire("CPLK", 0xffff), aml.Release("CPLK")}, nil),
+			want: []byte{
+				0x5b, 0x01, 'C', 'P', 'L', 'K', 0x00,
+				0x5b, 0x23, 'C', 'P', 'L', 'K', 0xff, 0xff,
+				0x5b, 0x27, 'C', 'P', 'L', 'K',
+			},
+		},
+		{
+			name: "OperationRegion (PRST, SystemIO, 0x0620, 0x08)",
+			got:  aml.OpRegion("PRST", aml.SystemIO, 0x620, 8),
+			want: []byte{0x5b, 0x80, 'P', 'R', 'S', 'T', 0x01, 0x0b, 0x20, 0x06, 0x0a, 0x08},
+		},
+		{
+			name: "Field (PRST, ByteAcc, NoLock, WriteAsZeros) { Offset (4), CPEN, 1 }",
+			got: aml.Field("PRST", aml.ByteAcc|aml.WriteAsZeros,
+				aml.FieldUnit{Bits: 32}, aml.FieldUnit{Name: "CPEN", Bits: 1}),
+			want: []byte{0x5b, 0x81, 0x0d, 'P', 'R', 'S', 'T', 0x41, 0x00, 0x20, 'C', 'P', 'E', 'N', 0x01},
+		},
+		{
+			name: "ResourceTemplate () { Interrupt (ResourceConsumer, Edge, ActiveHigh, Exclusive) {6} }",
+			got:  aml.ResourceTemplate(aml.Interrupt(aml.Consumer|aml.Edge, 6)),
+			want: []byte{
+				0x11, 0x0e, 0x0a, 0x0b,
+				0x89, 0x06, 0x00, 0x03, 0x01, 0x06, 0x00, 0x00, 0x00,
+				0x79, 0x00,
+			},
+		},
+		{
+			name: "Device (GED) { Name (_UID, Zero) }",
+			got:  aml.Device("GED", aml.Name("_UID", aml.Int(0))),
+			want: []byte{0x5b, 0x82, 0x0b, 'G', 'E', 'D', '_', 0x08, '_', 'U', 'I', 'D', 0x00},
+		},
+		{
+			name: "Scope (\\) {}",
+			got:  aml.Scope("\\"),
+			want: []byte{0x10, 0x03, 0x5c, 0x00},
+		},
+	} {
+		if !bytes.Equal(tt.got, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestPkgLength(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		size int
+		want []byte
+	}{
+		// The length counts itself, so that 0x3e bytes take one byte
+		// and 0x3f bytes two.
+		{size: 0x3e, want: []byte{0x3f}},
+		{size: 0x3f, want: []byte{0x41, 0x04}},
+		{size: 0xffd, want: []byte{0x4f, 0xff}},
+		{size: 0xffe, want: []byte{0x81, 0x00, 0x01}},
+	} {
+		// The root path takes 2 of the bytes of the scope.
+		b := aml.Scope("\\", make([]byte, tt.size-2))
+
+		if got := b[1 : 1+len(tt.want)]; !bytes.Equal(got, tt.want) {
+			t.Errorf("%#x bytes: got % x, want % x", tt.size, got, tt.want)
+		}
+
+		if len(b) != 1+len(tt.want)+tt.size {
+			t.Errorf("%#x bytes: got %#x bytes in all", tt.size, len(b))
+		}
+	}
+}
@@ -20,6 +20,7 @@ const (
 	E820Max      = 128
 	E820Ram      = 1
 	E820Reserved = 2
+	E820ACPI     = 3
 
 	RealModeIvtBegin = 0x00000000
 	EBDAStart        = 0x0009fc00
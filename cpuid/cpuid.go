@@ -2,7 +2,7 @@ package cpuid
 
 import (
 	"errors"
-	"math/bits"
+	"fmt"
 
 	"github.com/bobuhiro11/gokvm/kvm"
 )
@@ -13,36 +13,74 @@ func CPUID(leaf uint32) (uint32, uint32, uint32, uint32) {
 	return cpuid_low(leaf, 0)
 }
 
-type CPUIDPatch struct {
+// ErrInvalidTweak indicates a Tweak names an unknown register or bit.
+var ErrInvalidTweak = errors.New("invalid cpuid tweak")
+
+// flagSignificantIndex is KVM_CPUID_FLAG_SIGNIFCANT_INDEX. Leaves without
+// it ignore the index, i.e. ECX on input.
+const flagSignificantIndex = 1
+
+// Tweak sets or clears one bit of a CPUID leaf before the leaf is
+// handed to a vCPU.
+type Tweak struct {
 	Function uint32
 	Index    uint32
-	Flags    uint32
-	EAXBit   uint8
-	EBXBit   uint8
-	ECXBit   uint8
-	EDXBit   uint8
+	Register string // one of eax, ebx, ecx and edx
+	Bit      uint8
+	Set      bool
+}
+
+// Validate checks the register name and the bit number.
+func (t Tweak) Validate() error {
+	switch t.Register {
+	case "eax", "ebx", "ecx", "edx":
+	default:
+		return fmt.Errorf("register %q: %w", t.Register, ErrInvalidTweak)
+	}
+
+	if t.Bit > 31 {
+		return fmt.Errorf("bit %d: %w", t.Bit, ErrInvalidTweak)
+	}
+
+	return nil
 }
 
-var errInvalidPatchset = errors.New("invalid patch. Only 1 bit allowed")
-
-// patchCPUID patches CPUIDs before vcpu generation.
-func Patch(ids *kvm.CPUID, patches []*CPUIDPatch) error {
-	for _, id := range ids.Entries {
-		for _, patch := range patches {
-			if bits.OnesCount8(patch.EAXBit)+
-				bits.OnesCount8(patch.EBXBit)+
-				bits.OnesCount8(patch.ECXBit)+
-				bits.OnesCount8(patch.EDXBit)+
-				bits.OnesCount32(patch.Flags) != 1 {
-				return errInvalidPatchset
+func (t Tweak) reg(e *kvm.CPUIDEntry2) *uint32 {
+	switch t.Register {
+	case "eax":
+		return &e.Eax
+	case "ebx":
+		return &e.Ebx
+	case "ecx":
+		return &e.Ecx
+	default:
+		return &e.Edx
+	}
+}
+
+// Apply applies tweaks to the matching entries of ids. A tweak for a leaf
+// which is not in ids has no effect.
+func Apply(ids *kvm.CPUID, tweaks []Tweak) error {
+	for _, t := range tweaks {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+
+		for i := 0; i < int(ids.Nent); i++ {
+			e := &ids.Entries[i]
+
+			if e.Function != t.Function {
+				continue
+			}
+
+			if e.Flags&flagSignificantIndex != 0 && e.Index != t.Index {
+				continue
 			}
 
-			if id.Function == patch.Function && id.Index == patch.Index {
-				id.Flags |= 1 << patch.Flags
-				id.Eax |= 1 << patch.EAXBit
-				id.Ebx |= 1 << patch.EBXBit
-				id.Ecx |= 1 << patch.ECXBit
-				id.Edx |= 1 << patch.EDXBit
+			if t.Set {
+				*t.reg(e) |= 1 << t.Bit
+			} else {
+				*t.reg(e) &^= 1 << t.Bit
 			}
 		}
 	}
@@ -1,9 +1,11 @@
 package cpuid_test
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/bobuhiro11/gokvm/cpuid"
+	"github.com/bobuhiro11/gokvm/kvm"
 )
 
 func TestCPUID(t *testing.T) {
@@ -26,3 +28,196 @@ func TestCPUID(t *testing.T) {
 		t.Fatalf("Unknown CPU vender found: %s", string(s))
 	}
 }
+
+func TestApply(t *testing.T) {
+	t.Parallel()
+
+	ids := &kvm.CPUID{
+		Nent: 3,
+		Entries: []kvm.CPUIDEntry2{
+			{Function: 1, Ecx: 0x1, Edx: 0x10},
+			{Function: 7, Index: 0, Flags: 1, Ebx: 0x100},
+			{Function: 7, Index: 1, Flags: 1, Ebx: 0x100},
+		},
+	}
+
+	tweaks := []cpuid.Tweak{
+		{Function: 1, Index: 3, Register: "ecx", Bit: 31, Set: true},
+		{Function: 1, Register: "edx", Bit: 4},
+		{Function: 7, Index: 1, Register: "ebx", Bit: 8},
+		{Function: 0x8000_0001, Register: "eax", Bit: 1, Set: true},
+	}
+
+	if err := cpuid.Apply(ids, tweaks); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids.Entries[0].Ecx != 0x8000_0001 || ids.Entries[0].Edx != 0 {
+		t.Errorf("leaf 1: got ecx=%#x edx=%#x", ids.Entries[0].Ecx, ids.Entries[0].Edx)
+	}
+
+	if ids.Entries[1].Ebx != 0x100 || ids.Entries[2].Ebx != 0 {
+		t.Errorf("leaf 7: got subleaf 0 ebx=%#x, subleaf 1 ebx=%#x", ids.Entries[1].Ebx, ids.Entries[2].Ebx)
+	}
+
+	for _, tw := range []cpuid.Tweak{{Register: "esp"}, {Register: "eax", Bit: 32}} {
+		if err := cpuid.Apply(ids, []cpuid.Tweak{tw}); !errors.Is(err, cpuid.ErrInvalidTweak) {
+			t.Errorf("Apply(%+v): got %v, want %v", tw, err, cpuid.ErrInvalidTweak)
+		}
+	}
+}
+
+func TestTopology(t *testing.T) {
+	t.Parallel()
+
+	topo := cpuid.Topology{Sockets: 2, Cores: 3, Threads: 2}
+	if n := topo.CPUs(); n != 12 {
+		t.Errorf("CPUs: got %d, want 12", n)
+	}
+
+	// The thread takes 1 bit of the APIC ID and the core 2.
+	if s, c, th := topo.Location(7); s != 1 || c != 0 || th != 1 {
+		t.Errorf("Location(7): got socket %d, core %d, thread %d, want 1, 0, 1", s, c, th)
+	}
+
+	if id := topo.APICID(7); id != 9 {
+		t.Errorf("APICID(7): got %d, want 9", id)
+	}
+
+	if id := (cpuid.Topology{}).APICID(5); id != 5 {
+		t.Errorf("zero value: got APIC ID %d for vCPU 5, want 5", id)
+	}
+
+	ids := &kvm.CPUID{
+		Nent: 6,
+		Entries: []kvm.CPUIDEntry2{
+			{Function: 1, Ebx: 0xff_ff_0800},
+			{Function: 4, Index: 0, Flags: 1, Eax: 0x21},
+			{Function: 4, Index: 3, Flags: 1, Eax: 0x63},
+			{Function: 4, Index: 4, Flags: 1},
+			{Function: 0xb, Index: 0, Flags: 1, Edx: 0x20},
+			{Function: 0xb, Index: 1, Flags: 1, Edx: 0x20},
+		},
+	}
+
+	topo.Apply(ids, 7)
+
+	e := ids.Entries
+	if ids.Nent != 7 || len(e) != 7 {
+		t.Fatalf("got %d entries, want 7", ids.Nent)
+	}
+
+	if e[0].Ebx != 0x09_08_0800 || e[0].Edx != 1<<28 {
+		t.Errorf("leaf 1: got ebx=%#x edx=%#x, want APIC ID 9 of 8 and HTT", e[0].Ebx, e[0].Edx)
+	}
+
+	if e[1].Eax != 3<<26|1<<14|0x21 || e[2].Eax != 3<<26|7<<14|0x63 || e[3].Eax != 0 {
+		t.Errorf("leaf 4: got L1 eax=%#x, L3 eax=%#x, none eax=%#x", e[1].Eax, e[2].Eax, e[3].Eax)
+	}
+
+	want := []kvm.CPUIDEntry2{
+		{Function: 0xb, Index: 0, Flags: 1, Eax: 1, Ebx: 2, Ecx: 0x100, Edx: 9},
+		{Function: 0xb, Index: 1, Flags: 1, Eax: 3, Ebx: 6, Ecx: 0x201, Edx: 9},
+		{Function: 0xb, Index: 2, Flags: 1, Ecx: 2, Edx: 9},
+	}
+
+	for i, w := range want {
+		if e[4+i] != w {
+			t.Errorf("leaf 0xb: got subleaf %+v, want %+v", e[4+i], w)
+		}
+	}
+}
+
+func TestModel(t *testing.T) {
+	t.Parallel()
+
+	// A host with SSE3 (pni), VMX, AVX, PCID, AVX2, INVPCID, FSRM and
+	// TSC_ADJUST, but no AVX-512, whose XSAVE state components are those
+	// of x87, SSE, AVX and PKRU, and CET for the supervisor.
+	host := func() *kvm.CPUID {
+		return &kvm.CPUID{
+			Nent: 7,
+			Entries: []kvm.CPUIDEntry2{
+				{Function: 1, Ecx: 1<<0 | 1<<5 | 1<<17 | 1<<28 | 1<<31},
+				{Function: 7, Index: 0, Flags: 1, Ebx: 1<<1 | 1<<5 | 1<<10, Edx: 1 << 4},
+				{Function: 0xd, Index: 0, Flags: 1, Eax: 0x207, Ecx: 0xa88},
+				{Function: 0xd, Index: 1, Flags: 1, Ecx: 1 << 11},
+				{Function: 0xd, Index: 2, Flags: 1, Eax: 0x100, Ebx: 0x240},
+				{Function: 0xd, Index: 9, Flags: 1, Eax: 0x8, Ebx: 0xa80},
+				{Function: 0xd, Index: 11, Flags: 1, Eax: 0x10, Ecx: 1},
+			},
+		}
+	}
+
+	for _, tt := range []struct {
+		model     string
+		ecx, ebx  uint32
+		edx       uint32
+		xcr0, xss uint32
+		size      uint32
+		nent      uint32
+	}{
+		{
+			model: "host", ecx: 1<<0 | 1<<5 | 1<<17 | 1<<28 | 1<<31, ebx: 1<<1 | 1<<5 | 1<<10, edx: 1 << 4,
+			xcr0: 0x207, xss: 1 << 11, size: 0xa88, nent: 7,
+		},
+		{
+			model: cpuid.DefaultModel, ecx: 1<<0 | 1<<5 | 1<<17 | 1<<28 | 1<<31, ebx: 1<<1 | 1<<5 | 1<<10,
+			xcr0: 0x207, xss: 1 << 11, size: 0xa88, nent: 7,
+		},
+		{
+			model: "host,-avx,-invpcid", ecx: 1<<0 | 1<<5 | 1<<17 | 1<<31, ebx: 1<<1 | 1<<5, edx: 1 << 4,
+			xcr0: 0x207, xss: 1 << 11, size: 0xa88, nent: 7,
+		},
+		// The other models clear what is not in the table but for the
+		// hypervisor bit, 31, and leave out the state of AVX and PKRU.
+		{model: "custom,+pcid", ecx: 1<<17 | 1<<31, xcr0: 0x3, size: 0x240, nent: 4},
+		{model: "custom,+avx,+avx2,-avx2", ecx: 1<<28 | 1<<31, xcr0: 0x7, size: 0x340, nent: 5},
+	} {
+		m, err := cpuid.ParseModel(tt.model)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.model, err)
+		}
+
+		ids := host()
+		if err := m.Apply(ids); err != nil {
+			t.Fatalf("%s: %v", tt.model, err)
+		}
+
+		if e := ids.Entries; e[0].Ecx != tt.ecx || e[1].Ebx != tt.ebx || e[1].Edx != tt.edx {
+			t.Errorf("%s: got ecx=%#x ebx=%#x edx=%#x, want %#x %#x %#x", tt.model, e[0].Ecx, e[1].Ebx, e[1].Edx,
+				tt.ecx, tt.ebx, tt.edx)
+		}
+
+		if ids.Nent != tt.nent || len(ids.Entries) != int(tt.nent) {
+			t.Fatalf("%s: got %d entries, want %d", tt.model, ids.Nent, tt.nent)
+		}
+
+		if e := ids.Entries; e[2].Eax != tt.xcr0 || e[2].Ecx != tt.size || e[3].Ecx != tt.xss {
+			t.Errorf("%s: got leaf 0xd xcr0=%#x size=%#x xss=%#x, want %#x %#x %#x", tt.model, e[2].Eax, e[2].Ecx,
+				e[3].Ecx, tt.xcr0, tt.size, tt.xss)
+		}
+
+		if s := m.String(); s != tt.model {
+			t.Errorf("%s: String got %q", tt.model, s)
+		}
+	}
+
+	// The host lacks CX16 of baseline-v2, and AVX-512.
+	for _, model := range []string{"baseline-v2", "host,+avx512f"} {
+		m, err := cpuid.ParseModel(model)
+		if err != nil {
+			t.Fatalf("%s: %v", model, err)
+		}
+
+		if err := m.Apply(host()); !errors.Is(err, cpuid.ErrUnsupportedFeature) {
+			t.Errorf("%s: got %v, want %v", model, err, cpuid.ErrUnsupportedFeature)
+		}
+	}
+
+	for _, model := range []string{"", "skylake", "host,avx", "host,+avx3", "baseline-v3,-"} {
+		if _, err := cpuid.ParseModel(model); !errors.Is(err, cpuid.ErrInvalidModel) {
+			t.Errorf("%q: got %v, want %v", model, err, cpuid.ErrInvalidModel)
+		}
+	}
+}
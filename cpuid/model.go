@@ -0,0 +1,339 @@
+package cpuid
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+const (
+	// ModelHost passes the features of the host CPU through.
+	ModelHost = "host"
+
+	// ModelCustom has none of Features, only those added to it.
+	ModelCustom = "custom"
+
+	// DefaultModel is the CPU model of a VM unless told otherwise.
+	DefaultModel = ModelHost + ",-fsrm"
+)
+
+// leafXSAVE is the CPUID leaf of the XSAVE state components.
+const leafXSAVE = 0xd
+
+var (
+	// ErrInvalidModel indicates an unknown CPU model or feature.
+	ErrInvalidModel = errors.New("invalid CPU model, want MODEL[,+FEATURE|,-FEATURE...]")
+
+	// ErrUnsupportedFeature indicates a feature of a CPU model which the
+	// host, or KVM, does not support.
+	ErrUnsupportedFeature = errors.New("CPU feature not supported by the host")
+)
+
+// Feature is an optional feature of x86 CPUs, which one bit of a CPUID
+// leaf reports. Name is the one of /proc/cpuinfo.
+type Feature struct {
+	Name     string
+	Function uint32
+	Index    uint32
+	Register string
+	Bit      uint8
+}
+
+// Features are the features which CPU models set and clear. The host
+// model passes the other bits of their leaves through, the others clear
+// them but for those of passedThrough.
+var Features = []Feature{
+	{Name: "pni", Function: 1, Register: "ecx", Bit: 0},
+	{Name: "pclmulqdq", Function: 1, Register: "ecx", Bit: 1},
+	{Name: "ssse3", Function: 1, Register: "ecx", Bit: 9},
+	{Name: "fma", Function: 1, Register: "ecx", Bit: 12},
+	{Name: "cx16", Function: 1, Register: "ecx", Bit: 13},
+	{Name: "pcid", Function: 1, Register: "ecx", Bit: 17},
+	{Name: "sse4_1", Function: 1, Register: "ecx", Bit: 19},
+	{Name: "sse4_2", Function: 1, Register: "ecx", Bit: 20},
+	{Name: "movbe", Function: 1, Register: "ecx", Bit: 22},
+	{Name: "popcnt", Function: 1, Register: "ecx", Bit: 23},
+	{Name: "aes", Function: 1, Register: "ecx", Bit: 25},
+	{Name: "xsave", Function: 1, Register: "ecx", Bit: 26},
+	{Name: "avx", Function: 1, Register: "ecx", Bit: 28},
+	{Name: "f16c", Function: 1, Register: "ecx", Bit: 29},
+	{Name: "rdrand", Function: 1, Register: "ecx", Bit: 30},
+	{Name: "fsgsbase", Function: 7, Register: "ebx", Bit: 0},
+	{Name: "bmi1", Function: 7, Register: "ebx", Bit: 3},
+	{Name: "hle", Function: 7, Register: "ebx", Bit: 4},
+	{Name: "avx2", Function: 7, Register: "ebx", Bit: 5},
+	{Name: "smep", Function: 7, Register: "ebx", Bit: 7},
+	{Name: "bmi2", Function: 7, Register: "ebx", Bit: 8},
+	{Name: "erms", Function: 7, Register: "ebx", Bit: 9},
+	{Name: "invpcid", Function: 7, Register: "ebx", Bit: 10},
+	{Name: "rtm", Function: 7, Register: "ebx", Bit: 11},
+	{Name: "avx512f", Function: 7, Register: "ebx", Bit: 16},
+	{Name: "avx512dq", Function: 7, Register: "ebx", Bit: 17},
+	{Name: "rdseed", Function: 7, Register: "ebx", Bit: 18},
+	{Name: "adx", Function: 7, Register: "ebx", Bit: 19},
+	{Name: "smap", Function: 7, Register: "ebx", Bit: 20},
+	{Name: "avx512ifma", Function: 7, Register: "ebx", Bit: 21},
+	{Name: "clflushopt", Function: 7, Register: "ebx", Bit: 23},
+	{Name: "clwb", Function: 7, Register: "ebx", Bit: 24},
+	{Name: "avx512cd", Function: 7, Register: "ebx", Bit: 28},
+	{Name: "sha_ni", Function: 7, Register: "ebx", Bit: 29},
+	{Name: "avx512bw", Function: 7, Register: "ebx", Bit: 30},
+	{Name: "avx512vl", Function: 7, Register: "ebx", Bit: 31},
+	{Name: "avx512vbmi", Function: 7, Register: "ecx", Bit: 1},
+	{Name: "umip", Function: 7, Register: "ecx", Bit: 2},
+	{Name: "pku", Function: 7, Register: "ecx", Bit: 3},
+	{Name: "avx512_vbmi2", Function: 7, Register: "ecx", Bit: 6},
+	{Name: "gfni", Function: 7, Register: "ecx", Bit: 8},
+	{Name: "vaes", Function: 7, Register: "ecx", Bit: 9},
+	{Name: "vpclmulqdq", Function: 7, Register: "ecx", Bit: 10},
+	{Name: "avx512_vnni", Function: 7, Register: "ecx", Bit: 11},
+	{Name: "avx512_bitalg", Function: 7, Register: "ecx", Bit: 12},
+	{Name: "avx512_vpopcntdq", Function: 7, Register: "ecx", Bit: 14},
+	{Name: "rdpid", Function: 7, Register: "ecx", Bit: 22},
+	{Name: "fsrm", Function: 7, Register: "edx", Bit: 4},
+	{Name: "avx512_vp2intersect", Function: 7, Register: "edx", Bit: 8},
+	{Name: "serialize", Function: 7, Register: "edx", Bit: 14},
+	{Name: "avx512_fp16", Function: 7, Register: "edx", Bit: 23},
+	{Name: "avx_vnni", Function: 7, Index: 1, Register: "eax", Bit: 4},
+	{Name: "avx512_bf16", Function: 7, Index: 1, Register: "eax", Bit: 5},
+	{Name: "xsaveopt", Function: 0xd, Index: 1, Register: "eax", Bit: 0},
+	{Name: "xsavec", Function: 0xd, Index: 1, Register: "eax", Bit: 1},
+	{Name: "xsaves", Function: 0xd, Index: 1, Register: "eax", Bit: 3},
+	{Name: "lahf_lm", Function: 0x80000001, Register: "ecx", Bit: 0},
+	{Name: "abm", Function: 0x80000001, Register: "ecx", Bit: 5},
+	{Name: "3dnowprefetch", Function: 0x80000001, Register: "ecx", Bit: 8},
+	{Name: "pdpe1gb", Function: 0x80000001, Register: "edx", Bit: 26},
+	{Name: "rdtscp", Function: 0x80000001, Register: "edx", Bit: 27},
+}
+
+// passedThrough are the bits of the leaves of Features which every model
+// passes through from the host: those of KVM itself, those following the
+// state of the guest, and those the guest needs to mitigate the flaws of
+// the host CPU.
+var passedThrough = []Feature{
+	{Name: "x2apic", Function: 1, Register: "ecx", Bit: 21},
+	{Name: "tsc_deadline_timer", Function: 1, Register: "ecx", Bit: 24},
+	{Name: "osxsave", Function: 1, Register: "ecx", Bit: 27},
+	{Name: "hypervisor", Function: 1, Register: "ecx", Bit: 31},
+	{Name: "ospke", Function: 7, Register: "ecx", Bit: 4},
+	{Name: "md_clear", Function: 7, Register: "edx", Bit: 10},
+	{Name: "spec_ctrl", Function: 7, Register: "edx", Bit: 26},
+	{Name: "intel_stibp", Function: 7, Register: "edx", Bit: 27},
+	{Name: "flush_l1d", Function: 7, Register: "edx", Bit: 28},
+	{Name: "arch_capabilities", Function: 7, Register: "edx", Bit: 29},
+	{Name: "spec_ctrl_ssbd", Function: 7, Register: "edx", Bit: 31},
+	{Name: "syscall", Function: 0x80000001, Register: "edx", Bit: 11},
+	{Name: "nx", Function: 0x80000001, Register: "edx", Bit: 20},
+	{Name: "lm", Function: 0x80000001, Register: "edx", Bit: 29},
+}
+
+// xsaveComponents are the XSAVE state components of features, on top of
+// those of x87 and SSE, which every model has.
+var xsaveComponents = map[string]uint64{
+	"avx":     1 << 2,
+	"avx512f": 1<<5 | 1<<6 | 1<<7,
+	"pku":     1 << 9,
+}
+
+// The baselines are the x86-64 microarchitecture levels of the psABI,
+// which Nehalem, Haswell and Skylake-X or their AMD peers first met.
+var (
+	baselineV2 = []string{"cx16", "lahf_lm", "popcnt", "pni", "sse4_1", "sse4_2", "ssse3"}
+	baselineV3 = append(slices.Clip(baselineV2),
+		"avx", "avx2", "bmi1", "bmi2", "f16c", "fma", "abm", "movbe", "xsave")
+	baselineV4 = append(slices.Clip(baselineV3), "avx512f", "avx512bw", "avx512cd", "avx512dq", "avx512vl")
+
+	models = map[string][]string{
+		"baseline-v2": baselineV2,
+		"baseline-v3": baselineV3,
+		"baseline-v4": baselineV4,
+		ModelCustom:   nil,
+	}
+)
+
+// Model is the CPU model a guest sees: ModelHost, ModelCustom or one of
+// baseline-v2 to baseline-v4, with the features of Add and without those
+// of Remove, which wins. Apart from the host one, a model sets exactly
+// its own features, and leaf 0xD tells only of their state components,
+// so that the guest sees the same CPU on any host which has them.
+type Model struct {
+	Name        string
+	Add, Remove []string
+}
+
+// ParseModel parses a model written as in DefaultModel.
+func ParseModel(s string) (Model, error) {
+	opts := strings.Split(s, ",")
+	m := Model{Name: opts[0]}
+
+	for _, opt := range opts[1:] {
+		switch {
+		case strings.HasPrefix(opt, "+"):
+			m.Add = append(m.Add, opt[1:])
+		case strings.HasPrefix(opt, "-"):
+			m.Remove = append(m.Remove, opt[1:])
+		default:
+			return m, fmt.Errorf("%w: %q", ErrInvalidModel, s)
+		}
+	}
+
+	if err := m.Validate(); err != nil {
+		return m, fmt.Errorf("%q: %w", s, err)
+	}
+
+	return m, nil
+}
+
+// Validate checks the names of the model and of its features.
+func (m Model) Validate() error {
+	if _, ok := models[m.Name]; !ok && m.Name != ModelHost {
+		return fmt.Errorf("model %q: %w", m.Name, ErrInvalidModel)
+	}
+
+	for _, name := range append(slices.Clip(m.Add), m.Remove...) {
+		if !slices.ContainsFunc(Features, func(f Feature) bool { return f.Name == name }) {
+			return fmt.Errorf("feature %q: %w", name, ErrInvalidModel)
+		}
+	}
+
+	return nil
+}
+
+func (m Model) String() string {
+	s := m.Name
+
+	for _, name := range m.Add {
+		s += ",+" + name
+	}
+
+	for _, name := range m.Remove {
+		s += ",-" + name
+	}
+
+	return s
+}
+
+// Apply gives ids, the CPUID leaves KVM supports, the features of the
+// model, which must all be among them.
+func (m Model) Apply(ids *kvm.CPUID) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+
+	tweaks := make([]Tweak, 0, len(Features))
+	xcr0 := uint64(1<<0 | 1<<1)
+
+	for _, f := range Features {
+		on := f.in(ids)
+		if m.Name != ModelHost {
+			on = slices.Contains(models[m.Name], f.Name)
+		}
+
+		on = (on || slices.Contains(m.Add, f.Name)) && !slices.Contains(m.Remove, f.Name)
+
+		if on && !f.in(ids) {
+			return fmt.Errorf("%s: %w", f.Name, ErrUnsupportedFeature)
+		}
+
+		tweaks = append(tweaks, Tweak{Function: f.Function, Index: f.Index, Register: f.Register, Bit: f.Bit, Set: on})
+
+		if on {
+			xcr0 |= xsaveComponents[f.Name]
+		}
+	}
+
+	if err := Apply(ids, tweaks); err != nil {
+		return err
+	}
+
+	if m.Name != ModelHost {
+		deny(ids)
+		trimXSAVE(ids, xcr0)
+	}
+
+	return nil
+}
+
+// deny clears the bits of the leaves of Features which are neither in
+// Features nor in passedThrough.
+func deny(ids *kvm.CPUID) {
+	type register struct {
+		function, index uint32
+		name            string
+	}
+
+	known := map[register]uint32{}
+
+	for _, f := range append(slices.Clip(Features), passedThrough...) {
+		known[register{f.Function, f.Index, f.Register}] |= 1 << f.Bit
+	}
+
+	for i := 0; i < int(ids.Nent); i++ {
+		e := &ids.Entries[i]
+
+		for r, bits := range known {
+			if e.Function == r.function && (e.Flags&flagSignificantIndex == 0 || e.Index == r.index) {
+				*Tweak{Register: r.name}.reg(e) &= bits
+			}
+		}
+	}
+}
+
+// trimXSAVE leaves out of leaf 0xD the user state components which are
+// not in xcr0, and every supervisor one.
+func trimXSAVE(ids *kvm.CPUID, xcr0 uint64) {
+	// The legacy region and the XSAVE header.
+	size := uint32(512 + 64)
+	entries := make([]kvm.CPUIDEntry2, 0, ids.Nent)
+
+	for _, e := range ids.Entries[:ids.Nent] {
+		if e.Function == leafXSAVE && e.Index >= 2 && e.Index < 64 {
+			if xcr0&(1<<e.Index) == 0 {
+				continue
+			}
+
+			// The size and the offset of the component.
+			size = max(size, e.Eax+e.Ebx)
+		}
+
+		entries = append(entries, e)
+	}
+
+	for i := range entries {
+		e := &entries[i]
+
+		if e.Function != leafXSAVE {
+			continue
+		}
+
+		switch e.Index {
+		case 0:
+			e.Eax &= uint32(xcr0)
+			e.Ecx = size
+			e.Edx &= uint32(xcr0 >> 32)
+		case 1:
+			e.Ecx, e.Edx = 0, 0
+		}
+	}
+
+	ids.Entries = entries
+	ids.Nent = uint32(len(entries))
+}
+
+// in tells whether f is set in ids.
+func (f Feature) in(ids *kvm.CPUID) bool {
+	t := Tweak{Register: f.Register}
+
+	for i := 0; i < int(ids.Nent); i++ {
+		e := &ids.Entries[i]
+
+		if e.Function == f.Function && (e.Flags&flagSignificantIndex == 0 || e.Index == f.Index) {
+			return *t.reg(e)&(1<<f.Bit) != 0
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,135 @@
+package cpuid
+
+import (
+	"math/bits"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// Topology is the layout of the vCPUs of a VM in Sockets of Cores of
+// Threads. vCPUs are numbered thread first: with 2 threads, vCPUs 0
+// and 1 are the threads of the first core. A count of 0 is taken as 1,
+// so the zero value puts every vCPU in a socket of its own.
+type Topology struct {
+	Sockets, Cores, Threads int
+}
+
+// CPUs returns the number of vCPUs of the topology, 0 for the zero
+// value, which has room for any number.
+func (t Topology) CPUs() int {
+	return t.Sockets * max(t.Cores, 1) * max(t.Threads, 1)
+}
+
+// threadBits and coreBits are the widths of the thread and core fields
+// of an APIC ID, which are rounded up to powers of 2.
+func (t Topology) threadBits() int {
+	return bits.Len(uint(max(t.Threads, 1) - 1))
+}
+
+func (t Topology) coreBits() int {
+	return bits.Len(uint(max(t.Cores, 1) - 1))
+}
+
+// Location returns where cpu is in the topology.
+func (t Topology) Location(cpu int) (socket, core, thread int) {
+	threads, cores := max(t.Threads, 1), max(t.Cores, 1)
+
+	return cpu / (threads * cores), cpu / threads % cores, cpu % threads
+}
+
+// APICID returns the APIC ID of cpu, made of its socket, core and
+// thread numbers, which is also the vCPU ID KVM creates it with.
+func (t Topology) APICID(cpu int) uint32 {
+	socket, core, thread := t.Location(cpu)
+
+	return uint32(socket<<(t.coreBits()+t.threadBits()) | core<<t.threadBits() | thread)
+}
+
+// CPUID leaves describing the topology.
+const (
+	leafFeatures     = 0x1
+	leafCache        = 0x4
+	leafTopology     = 0xb
+	leafTopologyV2   = 0x1f
+	leafAMDSize      = 0x80000008
+	leafAMDTopology  = 0x8000001e
+	featureHTT       = 1 << 28
+	topologyLevelSMT = 1
+	topologyLevelCPU = 2
+)
+
+// Apply describes the topology to cpu in ids: its APIC ID in leaves 1,
+// 0xB and 0x1F, the threads and cores of its package, which ones share
+// each cache in leaf 4, and the AMD leaves 0x80000008 and 0x8000001E.
+// Leaves which are not in ids are left out.
+func (t Topology) Apply(ids *kvm.CPUID, cpu int) {
+	apicID := t.APICID(cpu)
+	socket, core, _ := t.Location(cpu)
+	threadBits, pkgBits := t.threadBits(), t.coreBits()+t.threadBits()
+
+	var entries []kvm.CPUIDEntry2
+
+	for _, e := range ids.Entries[:ids.Nent] {
+		switch e.Function {
+		case leafFeatures:
+			// The count of APIC IDs of a package takes 8 bits.
+			e.Ebx = e.Ebx&0xffff | apicID<<24 | uint32(min(1<<pkgBits, 0xff))<<16
+			if pkgBits > 0 {
+				e.Edx |= featureHTT
+			} else {
+				e.Edx &^= featureHTT
+			}
+		case leafCache:
+			// Caches up to L2 belong to a core, L3 to the package.
+			if e.Eax&0x1f == 0 {
+				break
+			}
+
+			sharing := threadBits
+			if e.Eax>>5&0x7 > 2 {
+				sharing = pkgBits
+			}
+
+			e.Eax = e.Eax&0x3fff | uint32(1<<t.coreBits()-1)<<26 | uint32(1<<sharing-1)<<14
+		case leafTopology, leafTopologyV2:
+			if e.Index != 0 {
+				continue
+			}
+
+			entries = append(entries, t.levels(e.Function, apicID)...)
+
+			continue
+		case leafAMDSize:
+			e.Ecx = e.Ecx&^0xf0ff | uint32(pkgBits)<<12 | uint32(1<<pkgBits-1)
+		case leafAMDTopology:
+			e.Eax = apicID
+			e.Ebx = e.Ebx&^0xffff | uint32(max(t.Threads, 1)-1)<<8 | uint32(core)
+			e.Ecx = e.Ecx&^0x7ff | uint32(socket&0xff)
+		}
+
+		entries = append(entries, e)
+	}
+
+	ids.Entries = entries
+	ids.Nent = uint32(len(entries))
+}
+
+// levels returns the subleaves of the extended topology leaf fn: the
+// threads of a core, the threads of a package, and the last one, which
+// is invalid.
+func (t Topology) levels(fn, apicID uint32) []kvm.CPUIDEntry2 {
+	threads, cores := uint32(max(t.Threads, 1)), uint32(max(t.Cores, 1))
+
+	level := func(i, shift, n, typ uint32) kvm.CPUIDEntry2 {
+		return kvm.CPUIDEntry2{
+			Function: fn, Index: i, Flags: flagSignificantIndex,
+			Eax: shift, Ebx: n, Ecx: typ<<8 | i, Edx: apicID,
+		}
+	}
+
+	return []kvm.CPUIDEntry2{
+		level(0, uint32(t.threadBits()), threads, topologyLevelSMT),
+		level(1, uint32(t.coreBits()+t.threadBits()), threads*cores, topologyLevelCPU),
+		level(2, 0, 0, 0),
+	}
+}
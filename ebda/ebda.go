@@ -96,7 +96,19 @@ func (e *EBDA) Bytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// New returns the EBDA of nCPUs CPUs whose APIC IDs are their numbers.
 func New(nCPUs int) (*EBDA, error) {
+	apicIDs := make([]uint8, nCPUs)
+	for i := range apicIDs {
+		apicIDs[i] = uint8(i)
+	}
+
+	return NewAPICIDs(apicIDs)
+}
+
+// NewAPICIDs returns the EBDA of the CPUs with apicIDs, the first being
+// the boot processor.
+func NewAPICIDs(apicIDs []uint8) (*EBDA, error) {
 	e := &EBDA{}
 
 	mpfIntel, err := newMPFIntel()
@@ -106,7 +118,7 @@ func New(nCPUs int) (*EBDA, error) {
 
 	e.mpfIntel = *mpfIntel
 
-	mpcTable, err := newMPCTable(nCPUs)
+	mpcTable, err := newMPCTable(apicIDs)
 	if err != nil {
 		return e, err
 	}
@@ -164,7 +176,7 @@ func apicAddr(apic uint32) uint32 {
 	return apicDefaultPhysBase + apic*apicBaseAddrStep
 }
 
-func newMPCTable(nCPUs int) (*mpcTable, error) {
+func newMPCTable(apicIDs []uint8) (*mpcTable, error) {
 	m := &mpcTable{}
 	m.signature = mpcTableSignature
 	m.length = uint16(unsafe.Sizeof(mpcTable{})) // this field must contain the size of entries.
@@ -173,14 +185,14 @@ func newMPCTable(nCPUs int) (*mpcTable, error) {
 	m.OEMId = [8]byte{0x47, 0x4F, 0x4B, 0x56, 0x4D, 0x00, 0x00, 0x00} // "GOKVM   "
 	m.oemCount = maxVCPUs                                             // This must be the number of entries
 
-	if nCPUs > maxVCPUs {
+	if len(apicIDs) > maxVCPUs {
 		return nil, errorVCPUNumExceed
 	}
 
 	var err error
 
-	for i := 0; i < nCPUs; i++ {
-		m.mpcCPU[i] = *newMPCCpu(i)
+	for i, id := range apicIDs {
+		m.mpcCPU[i] = *newMPCCpu(i, id)
 	}
 
 	m.checkSum, err = m.calcCheckSum()
@@ -228,7 +240,7 @@ type mpcCPU struct {
 	_           [2]uint32 // reserved
 }
 
-func newMPCCpu(i int) *mpcCPU {
+func newMPCCpu(i int, apicID uint8) *mpcCPU {
 	m := &mpcCPU{}
 
 	f := uint8(cpuFlagEnabled)
@@ -238,7 +250,7 @@ func newMPCCpu(i int) *mpcCPU {
 	}
 
 	m.typ = mpEntryTypeProcessor
-	m.apicID = uint8(i)
+	m.apicID = apicID
 	m.apicVer = mpAPICVersion
 	m.cpuFlag = f
 	m.sig = (cpuStepping << 16)
@@ -23,3 +23,29 @@ func TestNew(t *testing.T) {
 		t.Fatalf("Invalid size: %v", len(bytes))
 	}
 }
+
+func TestNewAPICIDs(t *testing.T) {
+	t.Parallel()
+
+	m, err := ebda.NewAPICIDs([]uint8{0, 2, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bytes, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The processor entries of 20 bytes follow the MP floating pointer
+	// and the header of the MP table.
+	for i, want := range []uint8{0, 2, 8} {
+		if id := bytes[48+16+44+20*i+1]; id != want {
+			t.Errorf("CPU %d: got APIC ID %d, want %d", i, id, want)
+		}
+	}
+
+	if _, err := ebda.NewAPICIDs(make([]uint8, 65)); err == nil {
+		t.Errorf("65 CPUs: got nil, want an error")
+	}
+}
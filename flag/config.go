@@ -0,0 +1,657 @@
+package flag
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bobuhiro11/gokvm/cpuid"
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/sched"
+	"github.com/bobuhiro11/gokvm/serial"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+const (
+	// maxCPUs is the number of vCPUs the MP table can describe.
+	maxCPUs = 64
+
+	// maxPossibleCPUs is the number of vCPUs a VM can have with
+	// hotplug, as the local APIC ID 0xff is the broadcast address.
+	maxPossibleCPUs = 255
+
+	// maxDevices is the number of PCI slots left next to the host bridge.
+	maxDevices = 31
+)
+
+var (
+	// ErrInvalidConfig is wrapped by every validation error of a config file.
+	ErrInvalidConfig = errors.New("invalid config")
+
+	// ErrUnsupportedConfigFormat indicates a config file which is not JSON.
+	ErrUnsupportedConfigFormat = errors.New("unsupported config format, only .json is supported")
+)
+
+// Disk describes a virtio block device, or a LUN of the virtio SCSI
+// controller.
+type Disk struct {
+	Path string `json:"path"`
+
+	// ReadOnly fails the writes of the guest, and Snapshot keeps them
+	// until the VM exits without writing the file.
+	ReadOnly bool `json:"read_only,omitempty"`
+	Snapshot bool `json:"snapshot,omitempty"`
+}
+
+// NIC describes a virtio net device attached to a tap interface.
+// MAC is optional, the guest picks a random one if it is empty.
+type NIC struct {
+	Tap string `json:"tap"`
+	MAC string `json:"mac,omitempty"`
+}
+
+// Serial describes the backend of a serial port, e.g. "pty" or
+// "unix:/run/vm.sock", see serial.ParseSpec. The entries of the list
+// are COM1 to COM4 in order.
+type Serial struct {
+	Backend string `json:"backend"`
+}
+
+// VPort describes a port of the virtio console, e.g. a named port for a
+// guest agent. Console makes it an hvc console. Backend is the same as
+// the one of Serial.
+type VPort struct {
+	Name    string `json:"name,omitempty"`
+	Console bool   `json:"console,omitempty"`
+	Backend string `json:"backend"`
+}
+
+// Vsock describes a virtio socket device for the guest at CID, served on
+// the host by unix sockets at UDSPath, see virtio.Vsock.
+type Vsock struct {
+	CID     uint64 `json:"cid,omitempty"`
+	UDSPath string `json:"uds_path"`
+}
+
+// Rng describes a virtio entropy device reading the file at Source, or
+// crypto/rand of the host if it is empty.
+type Rng struct {
+	Source string `json:"source,omitempty"`
+}
+
+// MemoryBacking describes how the guest memory is backed on the host:
+// by the file at Path, or in a directory like a hugetlbfs mount, or by
+// huge pages, and whether it is allocated up front.
+type MemoryBacking struct {
+	Path      string `json:"path,omitempty"`
+	Hugepages bool   `json:"hugepages,omitempty"`
+	Prealloc  bool   `json:"prealloc,omitempty"`
+}
+
+// Share describes a host directory served to the guest by a virtio 9p
+// device, which the guest mounts by Tag.
+type Share struct {
+	Tag      string `json:"tag"`
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+}
+
+// CPUIDTweak sets or clears one bit of a CPUID leaf.
+type CPUIDTweak struct {
+	Function uint32 `json:"function"`
+	Index    uint32 `json:"index,omitempty"`
+	Register string `json:"register"`
+	Bit      uint8  `json:"bit"`
+	Set      bool   `json:"set"`
+}
+
+// SMP lays out the vCPUs in sockets of cores of threads, each 1 if left
+// out.
+type SMP struct {
+	Sockets int `json:"sockets,omitempty"`
+	Cores   int `json:"cores,omitempty"`
+	Threads int `json:"threads,omitempty"`
+}
+
+// NUMA describes a NUMA node of the guest with the vCPUs CPUs and Memory,
+// a size like the one of VMConfig. The memory is bound to the host NUMA
+// nodes HostNodes, if any.
+type NUMA struct {
+	CPUs      []int  `json:"cpus,omitempty"`
+	Memory    string `json:"memory"`
+	HostNodes []int  `json:"host_nodes,omitempty"`
+}
+
+// Sched describes how the host runs the threads of the VM: the vCPUs on
+// the host CPUs of VCPUAffinity, keyed by vCPU, with the SCHED_FIFO
+// VCPUPriority if not 0, and the IO threads of the devices on the host
+// CPUs IOAffinity.
+type Sched struct {
+	VCPUAffinity map[int][]int `json:"vcpu_affinity,omitempty"`
+	VCPUPriority int           `json:"vcpu_priority,omitempty"`
+	IOAffinity   []int         `json:"io_affinity,omitempty"`
+}
+
+// VMConfig is the schema of the file given to boot --config. Relative
+// paths are resolved against the directory of the file.
+type VMConfig struct {
+	Device     string         `json:"device,omitempty"`
+	Kernel     string         `json:"kernel,omitempty"`
+	Firmware   string         `json:"firmware,omitempty"`
+	Initrd     string         `json:"initrd,omitempty"`
+	Cmdline    string         `json:"cmdline,omitempty"`
+	CPUs       int            `json:"cpus,omitempty"`
+	MaxCPUs    int            `json:"max_cpus,omitempty"`
+	SMP        *SMP           `json:"smp,omitempty"`
+	NUMA       []NUMA         `json:"numa,omitempty"`
+	Sched      *Sched         `json:"sched,omitempty"`
+	Memory     string         `json:"memory,omitempty"`
+	MemBack    *MemoryBacking `json:"memory_backing,omitempty"`
+	MemHotplug string         `json:"memory_hotplug,omitempty"`
+	Disks      []Disk         `json:"disks,omitempty"`
+	SCSI       []Disk         `json:"scsi,omitempty"`
+	NICs       []NIC          `json:"nics,omitempty"`
+	Serial     []Serial       `json:"serial,omitempty"`
+	VPorts     []VPort        `json:"vports,omitempty"`
+	Vsock      *Vsock         `json:"vsock,omitempty"`
+	Rng        *Rng           `json:"rng,omitempty"`
+	Balloon    bool           `json:"balloon,omitempty"`
+	Shares     []Share        `json:"shares,omitempty"`
+	QueueSize  uint           `json:"queue_size,omitempty"`
+	CPUID      []CPUIDTweak   `json:"cpuid,omitempty"`
+	CPUModel   string         `json:"cpu_model,omitempty"`
+	QMP        string         `json:"qmp,omitempty"`
+}
+
+// LoadConfig reads and validates the config file at path.
+func LoadConfig(path string) (*VMConfig, error) {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".json" {
+		return nil, fmt.Errorf("%s: %w", path, ErrUnsupportedConfigFormat)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &VMConfig{}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s%s: %w", path, position(b, err), err)
+	}
+
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: trailing data after the top-level object: %w", path, ErrInvalidConfig)
+	}
+
+	c.resolvePaths(filepath.Dir(path))
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return c, nil
+}
+
+// position returns ":line:column" of a JSON decoding error, if known.
+// encoding/json gives no offset for unknown fields, so the first
+// occurrence of the key is reported instead.
+func position(b []byte, err error) string {
+	var (
+		offset int64
+		syn    *json.SyntaxError
+		typ    *json.UnmarshalTypeError
+	)
+
+	const unknownField = "json: unknown field "
+
+	switch {
+	case errors.As(err, &syn):
+		offset = syn.Offset
+	case errors.As(err, &typ):
+		offset = typ.Offset
+	case strings.HasPrefix(err.Error(), unknownField):
+		i := bytes.Index(b, []byte(strings.TrimPrefix(err.Error(), unknownField)))
+		if i < 0 {
+			return ""
+		}
+
+		offset = int64(i) + 1
+	default:
+		return ""
+	}
+
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+
+	before := b[:offset]
+	line := bytes.Count(before, []byte{'\n'}) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+
+	return fmt.Sprintf(":%d:%d", line, col)
+}
+
+func (c *VMConfig) resolvePaths(dir string) {
+	abs := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+
+		return filepath.Join(dir, p)
+	}
+
+	c.Kernel = abs(c.Kernel)
+	c.Firmware = abs(c.Firmware)
+	c.Initrd = abs(c.Initrd)
+
+	if c.MemBack != nil {
+		c.MemBack.Path = abs(c.MemBack.Path)
+	}
+
+	for i := range c.Disks {
+		c.Disks[i].Path = abs(c.Disks[i].Path)
+	}
+
+	for i := range c.SCSI {
+		c.SCSI[i].Path = abs(c.SCSI[i].Path)
+	}
+
+	if c.Rng != nil {
+		c.Rng.Source = abs(c.Rng.Source)
+	}
+
+	for i := range c.Shares {
+		c.Shares[i].Path = abs(c.Shares[i].Path)
+	}
+}
+
+// Validate checks the config and reports every problem found, each
+// prefixed with the name of the offending field.
+func (c *VMConfig) Validate() error {
+	var errs []error
+
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s: %w", field, fmt.Sprintf(format, args...), ErrInvalidConfig))
+	}
+
+	exists := func(field, path string) {
+		if path == "" {
+			return
+		}
+
+		if _, err := os.Stat(path); err != nil {
+			invalid(field, "%v", err)
+		}
+	}
+
+	if c.Kernel != "" && c.Firmware != "" {
+		invalid("firmware", "kernel and firmware are mutually exclusive")
+	}
+
+	exists("kernel", c.Kernel)
+	exists("firmware", c.Firmware)
+	exists("initrd", c.Initrd)
+
+	if c.CPUs < 0 || c.CPUs > maxCPUs {
+		invalid("cpus", "%d is out of range 1-%d", c.CPUs, maxCPUs)
+	}
+
+	if c.MaxCPUs != 0 && (c.MaxCPUs < max(c.CPUs, 1) || c.MaxCPUs > maxPossibleCPUs) {
+		invalid("max_cpus", "%d is out of range %d-%d", c.MaxCPUs, max(c.CPUs, 1), maxPossibleCPUs)
+	}
+
+	if c.SMP != nil {
+		t := c.SMP.topology()
+
+		switch {
+		case c.SMP.Sockets < 0 || c.SMP.Cores < 0 || c.SMP.Threads < 0:
+			invalid("smp", "negative count in %+v", *c.SMP)
+		case t.CPUs() > maxPossibleCPUs || t.APICID(t.CPUs()-1) >= maxPossibleCPUs:
+			invalid("smp", "%+v has APIC IDs beyond %d", *c.SMP, maxPossibleCPUs-1)
+		case c.MaxCPUs != 0 && c.MaxCPUs != t.CPUs():
+			invalid("max_cpus", "%d, the topology has %d", c.MaxCPUs, t.CPUs())
+		case c.CPUs > t.CPUs():
+			invalid("cpus", "%d, the topology has %d", c.CPUs, t.CPUs())
+		}
+	}
+
+	for i, n := range c.NUMA {
+		if size, err := ParseSize(n.Memory, "g"); err != nil {
+			invalid(fmt.Sprintf("numa[%d].memory", i), "%v", err)
+		} else if size <= 0 {
+			invalid(fmt.Sprintf("numa[%d].memory", i), "must not be empty")
+		}
+
+		for _, cpu := range n.CPUs {
+			if cpu < 0 || cpu >= maxPossibleCPUs {
+				invalid(fmt.Sprintf("numa[%d].cpus", i), "%d is out of range 0-%d", cpu, maxPossibleCPUs-1)
+			}
+		}
+
+		for _, h := range n.HostNodes {
+			if h < 0 || h >= memory.MaxHostNodes {
+				invalid(fmt.Sprintf("numa[%d].host_nodes", i), "%d is out of range 0-%d", h, memory.MaxHostNodes-1)
+			}
+		}
+	}
+
+	if c.Sched != nil {
+		vcpus := make([]int, 0, len(c.Sched.VCPUAffinity))
+		for cpu := range c.Sched.VCPUAffinity {
+			vcpus = append(vcpus, cpu)
+		}
+
+		sort.Ints(vcpus)
+
+		for _, cpu := range vcpus {
+			field := fmt.Sprintf("sched.vcpu_affinity[%d]", cpu)
+
+			if cpu < 0 || cpu >= maxPossibleCPUs {
+				invalid(field, "vcpu %d is out of range 0-%d", cpu, maxPossibleCPUs-1)
+			}
+
+			if err := (sched.Policy{CPUs: c.Sched.VCPUAffinity[cpu]}).Check(); err != nil {
+				invalid(field, "%v", err)
+			}
+		}
+
+		if err := (sched.Policy{Priority: c.Sched.VCPUPriority}).Check(); err != nil {
+			invalid("sched.vcpu_priority", "%v", err)
+		}
+
+		if err := (sched.Policy{CPUs: c.Sched.IOAffinity}).Check(); err != nil {
+			invalid("sched.io_affinity", "%v", err)
+		}
+	}
+
+	if c.Memory != "" {
+		if _, err := ParseSize(c.Memory, "g"); err != nil {
+			invalid("memory", "%v", err)
+		}
+	}
+
+	if c.MemHotplug != "" {
+		if size, err := ParseSize(c.MemHotplug, "g"); err != nil {
+			invalid("memory_hotplug", "%v", err)
+		} else if size%virtio.MemBlockSize != 0 {
+			invalid("memory_hotplug", "%s is not a multiple of %dM", c.MemHotplug, virtio.MemBlockSize>>20)
+		}
+	}
+
+	if c.MemBack != nil && c.MemBack.Path != "" {
+		exists("memory_backing.path", filepath.Dir(c.MemBack.Path))
+
+		if c.MemBack.Hugepages {
+			invalid("memory_backing.hugepages", "path and hugepages are mutually exclusive")
+		}
+	}
+
+	if c.QueueSize != 0 {
+		if c.QueueSize > virtio.MaxQueueSize || virtio.CheckQueueSize(uint16(c.QueueSize)) != nil {
+			invalid("queue_size", "%d is not a power of 2 from %d to %d", c.QueueSize,
+				virtio.MinQueueSize, virtio.MaxQueueSize)
+		}
+	}
+
+	n := len(c.Disks) + len(c.NICs) + len(c.Shares)
+	if len(c.VPorts) > 0 {
+		n++
+	}
+
+	if len(c.SCSI) > 0 {
+		n++
+	}
+
+	if c.Vsock != nil {
+		n++
+	}
+
+	if c.Rng != nil {
+		n++
+	}
+
+	if c.Balloon {
+		n++
+	}
+
+	if c.MemHotplug != "" {
+		n++
+	}
+
+	if n > maxDevices {
+		invalid("disks", "%d virtio devices exceed the %d PCI slots", n, maxDevices)
+	}
+
+	for i, d := range c.Disks {
+		field := fmt.Sprintf("disks[%d].path", i)
+
+		if d.Path == "" {
+			invalid(field, "must not be empty")
+		}
+
+		exists(field, d.Path)
+
+		if d.ReadOnly && d.Snapshot {
+			invalid(fmt.Sprintf("disks[%d].snapshot", i), "read_only and snapshot are mutually exclusive")
+		}
+	}
+
+	if len(c.SCSI) > virtio.MaxSCSILUNs {
+		invalid("scsi", "%d LUNs exceed %d", len(c.SCSI), virtio.MaxSCSILUNs)
+	}
+
+	for i, d := range c.SCSI {
+		field := fmt.Sprintf("scsi[%d].path", i)
+
+		if d.Path == "" {
+			invalid(field, "must not be empty")
+		}
+
+		exists(field, d.Path)
+
+		if d.ReadOnly && d.Snapshot {
+			invalid(fmt.Sprintf("scsi[%d].snapshot", i), "read_only and snapshot are mutually exclusive")
+		}
+	}
+
+	taps := map[string]bool{}
+
+	for i, n := range c.NICs {
+		if n.Tap == "" {
+			invalid(fmt.Sprintf("nics[%d].tap", i), "must not be empty")
+		} else if taps[n.Tap] {
+			invalid(fmt.Sprintf("nics[%d].tap", i), "%q is used twice", n.Tap)
+		}
+
+		taps[n.Tap] = true
+
+		if n.MAC == "" {
+			continue
+		}
+
+		if mac, err := net.ParseMAC(n.MAC); err != nil || len(mac) != 6 {
+			invalid(fmt.Sprintf("nics[%d].mac", i), "%q is not an EUI-48 address", n.MAC)
+		} else if mac[0]&1 != 0 {
+			invalid(fmt.Sprintf("nics[%d].mac", i), "%q is a multicast address", n.MAC)
+		}
+	}
+
+	specs := make([]serial.Spec, len(c.Serial))
+
+	for i, s := range c.Serial {
+		var err error
+
+		if specs[i], err = serial.ParseSpec(s.Backend); err != nil {
+			invalid(fmt.Sprintf("serial[%d].backend", i), "%v", err)
+		}
+	}
+
+	vspecs := make([]serial.Spec, len(c.VPorts))
+
+	for i, p := range c.VPorts {
+		var err error
+
+		if vspecs[i], err = serial.ParseSpec(p.Backend); err != nil {
+			invalid(fmt.Sprintf("vports[%d].backend", i), "%v", err)
+		}
+	}
+
+	if err := checkSerials(specs, vspecs); err != nil {
+		invalid("serial", "%v", err)
+	}
+
+	if c.Vsock != nil {
+		if c.Vsock.UDSPath == "" {
+			invalid("vsock.uds_path", "must not be empty")
+		}
+
+		if cid := c.Vsock.CID; cid != 0 && (cid <= virtio.VsockHostCID || cid >= 0xffffffff) {
+			invalid("vsock.cid", "%d is out of range 3-%d", cid, uint32(0xfffffffe))
+		}
+	}
+
+	if c.Rng != nil {
+		exists("rng.source", c.Rng.Source)
+	}
+
+	for i, sh := range c.Shares {
+		field := fmt.Sprintf("shares[%d].path", i)
+
+		if sh.Path == "" {
+			invalid(field, "must not be empty")
+		}
+
+		exists(field, sh.Path)
+	}
+
+	if err := checkShares(c.Shares); err != nil {
+		invalid("shares", "%v", err)
+	}
+
+	for i, t := range c.CPUID {
+		if err := t.tweak().Validate(); err != nil {
+			invalid(fmt.Sprintf("cpuid[%d]", i), "%v", err)
+		}
+	}
+
+	if c.CPUModel != "" {
+		if _, err := cpuid.ParseModel(c.CPUModel); err != nil {
+			invalid("cpu_model", "%v", err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t CPUIDTweak) tweak() cpuid.Tweak {
+	return cpuid.Tweak{
+		Function: t.Function,
+		Index:    t.Index,
+		Register: t.Register,
+		Bit:      t.Bit,
+		Set:      t.Set,
+	}
+}
+
+// topology returns the topology of s, with the counts left out as 1.
+func (s SMP) topology() cpuid.Topology {
+	return cpuid.Topology{Sockets: max(s.Sockets, 1), Cores: max(s.Cores, 1), Threads: max(s.Threads, 1)}
+}
+
+// apply copies every value set in the file to b. msize and mhotplug are
+// the raw values of the memory size flags, and cpuModel the one of -cpu.
+func (c *VMConfig) apply(b *BootArgs, msize, mhotplug, cpuModel *string) {
+	set := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+
+	set(&b.Dev, c.Device)
+	set(&b.Kernel, c.Kernel)
+	set(&b.Kernel, c.Firmware)
+	set(&b.Initrd, c.Initrd)
+	set(&b.Params, c.Cmdline)
+	set(&b.QMPSocket, c.QMP)
+	set(msize, c.Memory)
+	set(mhotplug, c.MemHotplug)
+	set(cpuModel, c.CPUModel)
+
+	b.Serials = nil
+
+	for _, s := range c.Serial {
+		b.Serials = append(b.Serials, s.Backend)
+	}
+
+	if c.CPUs != 0 {
+		b.NCPUs = c.CPUs
+	}
+
+	if c.MaxCPUs != 0 {
+		b.MaxCPUs = c.MaxCPUs
+	}
+
+	if c.SMP != nil {
+		b.Topology = c.SMP.topology()
+	}
+
+	for _, n := range c.NUMA {
+		size, _ := ParseSize(n.Memory, "g")
+		b.NUMA = append(b.NUMA, NUMANode{CPUs: n.CPUs, Size: size, HostNodes: n.HostNodes})
+	}
+
+	if c.Sched != nil {
+		b.VCPUAffinity = c.Sched.VCPUAffinity
+		b.VCPUPriority = c.Sched.VCPUPriority
+		b.IOAffinity = c.Sched.IOAffinity
+	}
+
+	if c.QueueSize != 0 {
+		b.QueueSize = c.QueueSize
+	}
+
+	if c.MemBack != nil {
+		set(&b.MemPath, c.MemBack.Path)
+
+		b.MemHugepages = b.MemHugepages || c.MemBack.Hugepages
+		b.MemPrealloc = b.MemPrealloc || c.MemBack.Prealloc
+	}
+
+	b.Disks = c.Disks
+	b.SCSI = c.SCSI
+	b.NICs = c.NICs
+	b.VPorts = c.VPorts
+	b.Shares = c.Shares
+
+	if c.Vsock != nil {
+		b.VsockPath = c.Vsock.UDSPath
+
+		if c.Vsock.CID != 0 {
+			b.VsockCID = c.Vsock.CID
+		}
+	}
+
+	if c.Rng != nil {
+		b.Rng = true
+		b.RngSource = c.Rng.Source
+	}
+
+	if c.Balloon {
+		b.Balloon = true
+	}
+
+	for _, t := range c.CPUID {
+		b.CPUID = append(b.CPUID, t.tweak())
+	}
+}
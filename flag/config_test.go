@@ -0,0 +1,270 @@
+package flag_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/flag"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+const vmJSON = `{
+	"kernel": "bzImage",
+	"initrd": "initrd",
+	"cmdline": "console=ttyS0",
+	"cpus": 4,
+	"max_cpus": 8,
+	"smp": {"sockets": 2, "cores": 2, "threads": 2},
+	"numa": [{"cpus": [0, 1, 2, 3], "memory": "1G", "host_nodes": [0]}, {"cpus": [4, 5, 6, 7], "memory": "1G"}],
+	"sched": {"vcpu_affinity": {"0": [2], "1": [3, 4]}, "vcpu_priority": 10, "io_affinity": [5]},
+	"memory": "2G",
+	"memory_backing": {"path": "ram", "prealloc": true},
+	"memory_hotplug": "1G",
+	"disks": [{"path": "a.img"}, {"path": "b.img", "snapshot": true}],
+	"scsi": [{"path": "a.img"}, {"path": "/dev/null"}],
+	"nics": [{"tap": "tap0", "mac": "52:54:00:12:34:56"}, {"tap": "tap1"}],
+	"serial": [{"backend": "pty,timestamps"}, {"backend": "null"}],
+	"vports": [{"console": true, "backend": "null"}, {"name": "agent", "backend": "unix:/tmp/agent.sock"}],
+	"vsock": {"uds_path": "/tmp/vsock.sock"},
+	"rng": {"source": "entropy"},
+	"balloon": true,
+	"queue_size": 256,
+	"shares": [{"tag": "src", "path": "."}, {"tag": "out", "path": "/tmp", "read_only": true}],
+	"cpuid": [{"function": 7, "register": "edx", "bit": 4, "set": false}],
+	"cpu_model": "baseline-v3,+pcid",
+	"qmp": "/tmp/vm.sock"
+}`
+
+func TestBootArgsFromConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := writeFiles(t, map[string]string{
+		"vm.json": vmJSON, "bzImage": "", "initrd": "", "a.img": "", "b.img": "", "entropy": "",
+	})
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-config", filepath.Join(dir, "vm.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Kernel != filepath.Join(dir, "bzImage") {
+		t.Errorf("kernel: got %v, want a path relative to the config file", c.Kernel)
+	}
+
+	if c.Params != "console=ttyS0" || c.NCPUs != 4 || c.MemSize != 2<<30 || c.QMPSocket != "/tmp/vm.sock" {
+		t.Errorf("got %+v", c)
+	}
+
+	if c.MaxCPUs != 8 {
+		t.Errorf("max cpus: got %d, want 8", c.MaxCPUs)
+	}
+
+	if c.Topology.Sockets != 2 || c.Topology.Cores != 2 || c.Topology.Threads != 2 {
+		t.Errorf("smp: got %+v", c.Topology)
+	}
+
+	if len(c.NUMA) != 2 || c.NUMA[0].Size != 1<<30 || len(c.NUMA[0].HostNodes) != 1 || c.NUMA[1].CPUs[0] != 4 {
+		t.Errorf("numa: got %+v", c.NUMA)
+	}
+
+	if !reflect.DeepEqual(c.VCPUAffinity, map[int][]int{0: {2}, 1: {3, 4}}) || c.VCPUPriority != 10 ||
+		!reflect.DeepEqual(c.IOAffinity, []int{5}) {
+		t.Errorf("sched: got %v priority %d, io %v", c.VCPUAffinity, c.VCPUPriority, c.IOAffinity)
+	}
+
+	if c.MemPath != filepath.Join(dir, "ram") || c.MemHugepages || !c.MemPrealloc {
+		t.Errorf("memory backing: got path %q hugepages %v prealloc %v", c.MemPath, c.MemHugepages, c.MemPrealloc)
+	}
+
+	if c.MemHotplug != 1<<30 {
+		t.Errorf("memory hotplug: got %#x, want 1 GiB", c.MemHotplug)
+	}
+
+	if len(c.Disks) != 2 || c.Disks[1].Path != filepath.Join(dir, "b.img") || !c.Disks[1].Snapshot {
+		t.Errorf("disks: got %v", c.Disks)
+	}
+
+	if len(c.SCSI) != 2 || c.SCSI[0].Path != filepath.Join(dir, "a.img") || c.SCSI[1].Path != "/dev/null" {
+		t.Errorf("scsi: got %v", c.SCSI)
+	}
+
+	if c.VsockPath != "/tmp/vsock.sock" || c.VsockCID != 3 {
+		t.Errorf("vsock: got %q at CID %d", c.VsockPath, c.VsockCID)
+	}
+
+	if !c.Balloon {
+		t.Errorf("balloon: got %v, want true", c.Balloon)
+	}
+
+	if c.QueueSize != 256 {
+		t.Errorf("queue size: got %d, want 256", c.QueueSize)
+	}
+
+	if len(c.Shares) != 2 || c.Shares[0].Path != dir || !c.Shares[1].ReadOnly {
+		t.Errorf("shares: got %+v", c.Shares)
+	}
+
+	if !c.Rng || c.RngSource != filepath.Join(dir, "entropy") {
+		t.Errorf("rng: got %v and %q", c.Rng, c.RngSource)
+	}
+
+	if len(c.VPorts) != 2 || !c.VPorts[0].Console || c.VPorts[1].Name != "agent" {
+		t.Errorf("vports: got %+v", c.VPorts)
+	}
+
+	if len(c.Serials) != 2 || c.Serials[0] != "pty,timestamps" || c.Serials[1] != "null" {
+		t.Errorf("serials: got %v", c.Serials)
+	}
+
+	if len(c.NICs) != 2 || c.NICs[0].MAC != "52:54:00:12:34:56" || c.NICs[1].Tap != "tap1" {
+		t.Errorf("nics: got %v", c.NICs)
+	}
+
+	if len(c.CPUID) != 1 || c.CPUID[0].Function != 7 || c.CPUID[0].Register != "edx" {
+		t.Errorf("cpuid: got %v", c.CPUID)
+	}
+
+	if c.CPUModel.String() != "baseline-v3,+pcid" {
+		t.Errorf("cpu model: got %s", c.CPUModel)
+	}
+}
+
+func TestFlagsOverrideConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := writeFiles(t, map[string]string{
+		"vm.json": vmJSON, "bzImage": "", "initrd": "", "a.img": "", "b.img": "", "entropy": "",
+	})
+
+	c, _, err := flag.ParseArgs([]string{
+		"gokvm", "boot", "-c", "2", "-m", "512M", "-d", "c.img", "-serial", "stdio",
+		"-config", filepath.Join(dir, "vm.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.NCPUs != 2 || c.MemSize != 512<<20 {
+		t.Errorf("got cpus %d mem %#x, want 2 and %#x", c.NCPUs, c.MemSize, 512<<20)
+	}
+
+	if len(c.Disks) != 1 || c.Disks[0].Path != "c.img" {
+		t.Errorf("disks: got %v, want only c.img", c.Disks)
+	}
+
+	if len(c.NICs) != 2 || len(c.SCSI) != 2 {
+		t.Errorf("nics and scsi: got %v and %v, want the ones of the file", c.NICs, c.SCSI)
+	}
+
+	if len(c.Serials) != 1 || c.Serials[0] != "stdio" {
+		t.Errorf("serials: got %v, want only stdio", c.Serials)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	dir := writeFiles(t, map[string]string{
+		"vm.yaml":   "kernel: bzImage\n",
+		"typo.json": "{\n  \"kernel\": \"x\",\n  \"dsks\": []\n}",
+		"type.json": "{\n  \"cpus\": \"four\"\n}",
+		"many.json": `{"kernel": "k", "firmware": "f", "cpus": 65, "max_cpus": 256, "memory": "1T", "queue_size": 1000,
+			"nics": [{"tap": "t", "mac": "01:00:5e:00:00:01"}]}`,
+		"cpuid.json": `{"cpuid": [{"function": 1, "register": "esp", "bit": 1}], "cpu_model": "host,+avx3"}`,
+		"trail.json": `{} {}`,
+		"tty.json":   `{"serial": [{"backend": "telnet:23"}]}`,
+		"com5.json": `{"serial": [{"backend": "null"}, {"backend": "null"},
+			{"backend": "null"}, {"backend": "null"}, {"backend": "pty"}]}`,
+		"stdio.json": `{"serial": [{"backend": "stdio"}, {"backend": "stdio,timestamps"}]}`,
+		"vsock.json": `{"vsock": {"cid": 2}}`,
+		"rng.json":   `{"rng": {"source": "nonexistent"}}`,
+		"scsi.json":  `{"scsi": [{"path": "/dev/null"}, {"path": ""}, {"path": "nonexistent"}]}`,
+		"disk.json":  `{"disks": [{"path": "/dev/null", "read_only": true, "snapshot": true}]}`,
+		"share.json": `{"shares": [{"tag": "a", "path": "/"}, {"tag": "a", "path": "nonexistent"}]}`,
+		"mem.json":   `{"memory_backing": {"path": "none/ram", "hugepages": true}, "memory_hotplug": "100M"}`,
+		"vport.json": `{"serial": [{"backend": "stdio"}], "vports": [{"name": "a", "backend": "stdio"}, {"backend": "x"}]}`,
+		"numa.json": `{"cpus": 4, "smp": {"sockets": 1, "cores": 2},
+			"numa": [{"cpus": [300], "memory": "x", "host_nodes": [-1]}]}`,
+		"sched.json": `{"sched": {"vcpu_affinity": {"300": [0], "1": [-1]}, "vcpu_priority": 100, "io_affinity": [1024]}}`,
+	})
+
+	for _, tt := range []struct {
+		file string
+		err  error
+		want []string
+	}{
+		{file: "vm.yaml", err: flag.ErrUnsupportedConfigFormat},
+		{file: "typo.json", want: []string{"typo.json:3:", `unknown field "dsks"`}},
+		{file: "type.json", want: []string{"type.json:2:"}},
+		{
+			file: "many.json",
+			err:  flag.ErrInvalidConfig,
+			want: []string{
+				"firmware: kernel and firmware", "kernel: stat", "cpus: 65", "max_cpus: 256", "memory:",
+				"queue_size: 1000", "nics[0].mac",
+			},
+		},
+		{file: "cpuid.json", err: flag.ErrInvalidConfig, want: []string{"cpuid[0]", "esp", "cpu_model", "avx3"}},
+		{file: "trail.json", err: flag.ErrInvalidConfig},
+		{file: "tty.json", err: flag.ErrInvalidConfig, want: []string{"serial[0].backend", "telnet"}},
+		{file: "com5.json", err: flag.ErrInvalidConfig, want: []string{"serial: ", "COM4"}},
+		{file: "stdio.json", err: flag.ErrInvalidConfig, want: []string{"serial: ", "stdio"}},
+		{file: "vsock.json", err: flag.ErrInvalidConfig, want: []string{"vsock.uds_path", "vsock.cid: 2"}},
+		{file: "share.json", err: flag.ErrInvalidConfig, want: []string{"shares[1].path", "used twice"}},
+		{file: "rng.json", err: flag.ErrInvalidConfig, want: []string{"rng.source: stat"}},
+		{file: "scsi.json", err: flag.ErrInvalidConfig, want: []string{"scsi[1].path: must not", "scsi[2].path: stat"}},
+		{file: "disk.json", err: flag.ErrInvalidConfig, want: []string{"disks[0].snapshot", "mutually exclusive"}},
+		{
+			file: "mem.json",
+			err:  flag.ErrInvalidConfig,
+			want: []string{"memory_backing.path: stat", "memory_backing.hugepages", "memory_hotplug: 100M"},
+		},
+		{file: "vport.json", err: flag.ErrInvalidConfig, want: []string{"vports[1].backend", "serial: ", "stdio"}},
+		{
+			file: "numa.json",
+			err:  flag.ErrInvalidConfig,
+			want: []string{"cpus: 4, the topology has 2", "numa[0].memory", "numa[0].cpus: 300", "numa[0].host_nodes: -1"},
+		},
+		{
+			file: "sched.json",
+			err:  flag.ErrInvalidConfig,
+			want: []string{
+				"sched.vcpu_affinity[1]", "sched.vcpu_affinity[300]: vcpu 300", "sched.vcpu_priority", "sched.io_affinity",
+			},
+		},
+	} {
+		_, err := flag.LoadConfig(filepath.Join(dir, tt.file))
+		if err == nil {
+			t.Errorf("%s: got nil, want err", tt.file)
+
+			continue
+		}
+
+		if tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.file, err, tt.err)
+		}
+
+		for _, w := range tt.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("%s: %q does not mention %q", tt.file, err, w)
+			}
+		}
+	}
+}
@@ -6,25 +6,130 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+
+	"github.com/bobuhiro11/gokvm/cpuid"
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/sched"
+	"github.com/bobuhiro11/gokvm/serial"
+	"github.com/bobuhiro11/gokvm/virtio"
 )
 
 var ErrorInvalidSubcommands = errors.New("expected 'boot' or 'probe' subcommands")
 
+// ErrInvalidVPort indicates a -vport flag not written as NAME=BACKEND.
+var ErrInvalidVPort = errors.New("invalid vport, want NAME=BACKEND")
+
+// ErrInvalidShare indicates a -share flag not written as TAG=PATH[,ro],
+// or shares whose tags are too long or used twice.
+var ErrInvalidShare = errors.New("invalid share, want TAG=PATH[,ro]")
+
+// ErrInvalidSerials indicates serial ports which can not be set up
+// together, see checkSerials.
+var ErrInvalidSerials = errors.New("invalid serial ports")
+
+// ErrInvalidCPUs indicates a -c flag not written as N[,maxcpus=M], or
+// out of range.
+var ErrInvalidCPUs = errors.New("invalid cpus, want N[,maxcpus=M]")
+
+// ErrInvalidSMP indicates a -smp flag not written as
+// sockets=S,cores=C,threads=T, or with more vCPUs than a VM can have.
+var ErrInvalidSMP = errors.New("invalid smp, want sockets=S,cores=C,threads=T")
+
+// ErrInvalidNUMA indicates a -numa flag not written as
+// node,cpus=CPUS,mem=SIZE[,hostnodes=NODES].
+var ErrInvalidNUMA = errors.New("invalid numa, want node,cpus=CPUS,mem=SIZE[,hostnodes=NODES]")
+
+// ErrInvalidVCPUAffinity indicates a -vcpu-affinity flag not written as
+// VCPU:CPUS[,VCPU:CPUS...], or naming a vCPU beyond maxcpus.
+var ErrInvalidVCPUAffinity = errors.New("invalid vcpu-affinity, want VCPU:CPUS[,VCPU:CPUS...]")
+
+// ErrInvalidIOAffinity indicates a -io-affinity flag not written as
+// CPUS[,CPUS...].
+var ErrInvalidIOAffinity = errors.New("invalid io-affinity, want CPUS[,CPUS...]")
+
 type BootArgs struct {
 	Kernel     string
 	MemSize    int
 	NCPUs      int
+	MaxCPUs    int
 	Dev        string
 	Initrd     string
 	Params     string
 	TapIfName  string
 	Disk       string
 	TraceCount int
+	QMPSocket  string
+	Config     string
+
+	// Serials holds the backend spec of COM1 onwards, see
+	// serial.ParseSpec.
+	Serials []string
+
+	// VPorts are the ports of the virtio console, if any.
+	VPorts []VPort
+
+	// VsockPath is where the host side of the virtio socket device
+	// of the guest at VsockCID listens. It is empty for no device.
+	VsockPath string
+	VsockCID  uint64
+
+	// Rng adds a virtio entropy device reading RngSource, or crypto/rand
+	// if it is empty.
+	Rng       bool
+	RngSource string
+
+	// Balloon adds a virtio memory balloon device.
+	Balloon bool
+
+	// Shares are the host directories served to the guest by virtio
+	// 9p devices.
+	Shares []Share
+
+	// QueueSize is the size of the queues of every virtio device.
+	QueueSize uint
+
+	// MemPath is a file, or a directory like a hugetlbfs mount, backing
+	// the guest memory. MemHugepages backs it with huge pages instead,
+	// and MemPrealloc allocates it up front.
+	MemPath      string
+	MemHugepages bool
+	MemPrealloc  bool
+
+	// MemHotplug is the size of the region of a virtio-mem device, or 0
+	// for none.
+	MemHotplug int
+
+	// SCSI holds the LUNs of a virtio SCSI controller, which is left
+	// out if there is none.
+	SCSI []Disk
+
+	// Topology lays out the vCPUs in sockets, cores and threads. It is
+	// the zero value, a socket per vCPU, unless -smp is given.
+	Topology cpuid.Topology
+
+	// NUMA are the NUMA nodes of the guest, if any.
+	NUMA []NUMANode
+
+	// VCPUAffinity pins the threads of the vCPUs, by number, to host
+	// CPUs, which VCPUPriority runs with SCHED_FIFO if not 0. IOAffinity
+	// pins the IO threads of the devices, see sched.Policy.
+	VCPUAffinity map[int][]int
+	VCPUPriority int
+	IOAffinity   []int
+
+	// Disks and NICs hold every device, from -d, -t or the config file.
+	Disks []Disk
+	NICs  []NIC
+	CPUID []cpuid.Tweak
+
+	// CPUModel is the CPU the guest sees, cpuid.DefaultModel unless
+	// -cpu is given.
+	CPUModel cpuid.Model
 }
 
 func parseBootArgs(args []string) (*BootArgs, error) {
 	bootCmd := flag.NewFlagSet("boot subcommand", flag.ExitOnError)
-	c := &BootArgs{}
+	c := &BootArgs{NCPUs: 1}
 
 	bootCmd.StringVar(&c.Dev, "D", "/dev/kvm", "path of kvm device")
 	bootCmd.StringVar(&c.Kernel, "k", "./bzImage", "kernel image path")
@@ -41,32 +146,575 @@ func parseBootArgs(args []string) (*BootArgs, error) {
 		"kernel command-line parameters")
 	bootCmd.StringVar(&c.TapIfName, "t", "", `name of tap interface. `+
 		`If the string is an empty, no tap intarface is created. (default"")`)
-	bootCmd.StringVar(&c.Disk, "d", "", "path of disk file (for /dev/vda)")
+	bootCmd.StringVar(&c.Disk, "d", "", "path of disk file (for /dev/vda), "+
+		"followed by ,ro to make it read-only or by ,snapshot to drop the writes of the guest at exit")
+
+	var luns stringList
+
+	bootCmd.Var(&luns, "scsi", "path of a disk file served as a LUN of a virtio SCSI controller "+
+		"(for /dev/sda), followed by ,ro or ,snapshot like -d. Repeat it for more LUNs, numbered from 0 in order.")
+
+	bootCmd.StringVar(&c.QMPSocket, "qmp", "", "path of unix socket for the QMP-style control API. "+
+		`If the string is an empty, no socket is created. (default"")`)
 
-	bootCmd.IntVar(&c.NCPUs, "c", 1, "number of cpus")
+	var serials stringList
+
+	bootCmd.Var(&serials, "serial", "backend of a serial port: "+
+		"stdio, null, pty, file:PATH, unix:PATH or tcp:HOST:PORT, "+
+		`optionally followed by ",timestamps" to prefix each output line with the time. `+
+		"Repeat it for COM2 to COM4. (default stdio)")
+
+	var vports stringList
+
+	bootCmd.Var(&vports, "vport", "port of the virtio console as NAME=BACKEND, "+
+		"with the same backends as -serial. The NAME hvc makes the port an hvc console. "+
+		"Repeat it for more ports.")
+
+	bootCmd.StringVar(&c.VsockPath, "vsock", "", "path of the unix socket of a virtio socket device. "+
+		"Connections of the guest to the host port P go to the socket at PATH_P, and clients "+
+		`of PATH write "CONNECT P\n" to connect to the port P of the guest. (default"")`)
+	bootCmd.Uint64Var(&c.VsockCID, "vsock-cid", 3, "CID of the guest for -vsock")
+
+	bootCmd.BoolVar(&c.Rng, "rng", false, "add a virtio entropy device backed by crypto/rand of the host")
+	bootCmd.StringVar(&c.RngSource, "rng-source", "", "path of the file a virtio entropy device reads, "+
+		`e.g. /dev/hwrng. It implies -rng. (default"")`)
+
+	bootCmd.BoolVar(&c.Balloon, "balloon", false, "add a virtio memory balloon device, "+
+		"resized with the balloon command of -qmp. Free pages reported by the guest go back to the host.")
+
+	var shares stringList
+
+	bootCmd.Var(&shares, "share", "host directory served to the guest by a virtio 9p device as TAG=PATH, "+
+		`or TAG=PATH,ro to make it read-only. The guest mounts it with "mount -t 9p -o trans=virtio TAG DIR". `+
+		"Repeat it for more directories.")
+
+	bootCmd.UintVar(&c.QueueSize, "queue-size", virtio.QueueSize, "size of the queues of the virtio devices, "+
+		"a power of 2 from 4 to 1024. Larger queues let more requests be in flight.")
+
+	bootCmd.StringVar(&c.Config, "config", "", "path of a JSON file describing the VM. "+
+		"Flags given on the command line override values of the file.")
+
+	bootCmd.Var(&cpusValue{n: &c.NCPUs, max: &c.MaxCPUs}, "c", "number of cpus, optionally followed by "+
+		",maxcpus=M to add cpus up to M at runtime with the device_add command of -qmp. "+
+		"The guest sees the added cpus through ACPI, so -p must not have noacpi. (default 1)")
+
+	cpuModel := bootCmd.String("cpu", cpuid.DefaultModel, "CPU model of the guest as "+
+		"MODEL[,+FEATURE|,-FEATURE...]: host passes the host cpu through, baseline-v2 to baseline-v4 are "+
+		"the x86-64 levels and custom has no optional feature. Features are named as in /proc/cpuinfo, "+
+		"e.g. avx, avx512f, pcid or invpcid. The boot fails if the host lacks one of the model.")
+	smp := bootCmd.String("smp", "", "topology of the cpus as sockets=S,cores=C,threads=T, "+
+		"each 1 if left out. The topology has maxcpus of -c, which default to all of its cpus, "+
+		`as do the cpus at boot. (default"")`)
+
+	var numa stringList
+
+	bootCmd.Var(&numa, "numa", "NUMA node of the guest as node,cpus=CPUS,mem=SIZE[,hostnodes=NODES], "+
+		"CPUS and NODES being N or N-M and repeatable, e.g. cpus=0-1,cpus=4, and SIZE number[gGmM] like -m. "+
+		"The memory of the nodes follows in their order and adds up to -m, "+
+		"bound to the host NUMA nodes NODES if given. Cpus in no node are in the first one. "+
+		"Repeat it for more nodes. The guest sees the nodes through ACPI, so -p must not have noacpi.")
+
+	vcpuAffinity := bootCmd.String("vcpu-affinity", "", "host cpus the threads of the vcpus run on "+
+		"as VCPU:CPUS[,VCPU:CPUS...], CPUS being N or N-M and repeatable, e.g. 0:2,1:3-4,1:6. "+
+		`The vcpus left out run anywhere. (default"")`)
+	bootCmd.IntVar(&c.VCPUPriority, "vcpu-priority", 0, fmt.Sprintf("SCHED_FIFO priority of the threads "+
+		"of the vcpus, 1 to %d, which needs CAP_SYS_NICE. 0 keeps the default policy.", sched.MaxPriority))
+	ioAffinity := bootCmd.String("io-affinity", "", "host cpus the IO threads of the devices run on "+
+		`as CPUS[,CPUS...], CPUS being N or N-M, each device thread getting a thread of its own. (default"")`)
 
 	msize := bootCmd.String("m", "1G",
 		"memory size: as number[gGmM], optional units, defaults to G")
+	bootCmd.StringVar(&c.MemPath, "mem-path", "", "path of a file backing the guest memory, shared with it, "+
+		"or of a directory like a hugetlbfs mount to create one in. "+
+		`The memory size must be a multiple of the huge page size on hugetlbfs. (default"")`)
+	bootCmd.BoolVar(&c.MemHugepages, "mem-hugepages", false, "back the guest memory with huge pages "+
+		"when -mem-path is not given")
+	bootCmd.BoolVar(&c.MemPrealloc, "mem-prealloc", false, "allocate the guest memory at start, "+
+		"so that a lack of huge pages fails the boot rather than the guest")
+	mhotplug := bootCmd.String("mem-hotplug", "0", "size of the memory the guest can hotplug through "+
+		"a virtio-mem device, a multiple of 128M as number[gGmM] like -m. "+
+		"The resize-memory command of -qmp sets how much of it the guest plugs. 0 means no device.")
 	tc := bootCmd.String("T", "0",
 		"how many instructions to skip between trace prints -- 0 means tracing disabled")
 
-	var err error
+	var (
+		err       error
+		cpusGiven bool
+	)
 
 	if err = bootCmd.Parse(args); err != nil {
 		return nil, err
 	}
 
+	if len(c.Config) > 0 {
+		vc, err := LoadConfig(c.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		vc.apply(c, msize, mhotplug, cpuModel)
+
+		cpusGiven = vc.CPUs != 0
+
+		// Parse again, so that flags take precedence over the file.
+		serials = nil
+		vports = nil
+		shares = nil
+		luns = nil
+		numa = nil
+
+		if err = bootCmd.Parse(args); err != nil {
+			return nil, err
+		}
+	}
+
+	bootCmd.Visit(func(f *flag.Flag) {
+		switch {
+		case f.Name == "d" && len(c.Disk) > 0:
+			c.Disks = []Disk{parseDisk(c.Disk)}
+		case f.Name == "d":
+			c.Disks = nil
+		case f.Name == "t" && len(c.TapIfName) > 0:
+			c.NICs = []NIC{{Tap: c.TapIfName}}
+		case f.Name == "t":
+			c.NICs = nil
+		case f.Name == "serial":
+			c.Serials = serials
+		case f.Name == "vport":
+			c.VPorts = nil
+		case f.Name == "share":
+			c.Shares = nil
+		case f.Name == "scsi":
+			c.SCSI = nil
+		case f.Name == "numa":
+			c.NUMA = nil
+		case f.Name == "c":
+			cpusGiven = true
+		case f.Name == "rng-source" && len(c.RngSource) > 0:
+			c.Rng = true
+		}
+	})
+
+	for _, s := range vports {
+		p, err := parseVPort(s)
+		if err != nil {
+			return nil, err
+		}
+
+		c.VPorts = append(c.VPorts, p)
+	}
+
+	for _, s := range shares {
+		sh, err := parseShare(s)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Shares = append(c.Shares, sh)
+	}
+
+	if err = checkShares(c.Shares); err != nil {
+		return nil, err
+	}
+
+	for _, l := range luns {
+		c.SCSI = append(c.SCSI, parseDisk(l))
+	}
+
+	if len(c.SCSI) > virtio.MaxSCSILUNs {
+		return nil, fmt.Errorf("%d SCSI LUNs:%w", len(c.SCSI), virtio.ErrInvalidLUNs)
+	}
+
+	if c.QueueSize > virtio.MaxQueueSize || virtio.CheckQueueSize(uint16(c.QueueSize)) != nil {
+		return nil, fmt.Errorf("queue-size %d:%w", c.QueueSize, virtio.ErrInvalidQueueSize)
+	}
+
+	if c.CPUModel, err = cpuid.ParseModel(*cpuModel); err != nil {
+		return nil, err
+	}
+
+	if *smp != "" {
+		if c.Topology, err = parseSMP(*smp); err != nil {
+			return nil, err
+		}
+	}
+
+	if n := c.Topology.CPUs(); n != 0 {
+		if c.MaxCPUs == 0 {
+			c.MaxCPUs = n
+		}
+
+		if !cpusGiven {
+			c.NCPUs = min(n, maxCPUs)
+		}
+
+		if c.MaxCPUs != n {
+			return nil, fmt.Errorf("maxcpus %d, the topology has %d:%w", c.MaxCPUs, n, ErrInvalidCPUs)
+		}
+	}
+
+	if c.MaxCPUs == 0 {
+		c.MaxCPUs = c.NCPUs
+	}
+
+	for _, s := range numa {
+		n, err := parseNUMA(s)
+		if err != nil {
+			return nil, err
+		}
+
+		c.NUMA = append(c.NUMA, n)
+	}
+
+	if c.NCPUs < 1 || c.NCPUs > maxCPUs || c.MaxCPUs < c.NCPUs || c.MaxCPUs > maxPossibleCPUs {
+		return nil, fmt.Errorf("%d cpus of at most %d, at most %d of %d:%w", c.NCPUs, c.MaxCPUs,
+			maxCPUs, maxPossibleCPUs, ErrInvalidCPUs)
+	}
+
+	if *vcpuAffinity != "" {
+		if c.VCPUAffinity, err = parseVCPUAffinity(*vcpuAffinity); err != nil {
+			return nil, err
+		}
+	}
+
+	for cpu := range c.VCPUAffinity {
+		if cpu >= c.MaxCPUs {
+			return nil, fmt.Errorf("%w: vcpu %d of %d", ErrInvalidVCPUAffinity, cpu, c.MaxCPUs)
+		}
+	}
+
+	if c.VCPUPriority < 0 || c.VCPUPriority > sched.MaxPriority {
+		return nil, fmt.Errorf("vcpu-priority %d:%w", c.VCPUPriority, sched.ErrInvalidPriority)
+	}
+
+	if *ioAffinity != "" {
+		c.IOAffinity = nil
+
+		for _, cpus := range strings.Split(*ioAffinity, ",") {
+			if c.IOAffinity, err = appendRange(c.IOAffinity, cpus, sched.MaxCPUs); err != nil {
+				return nil, fmt.Errorf("%w: %q: %v", ErrInvalidIOAffinity, *ioAffinity, err)
+			}
+		}
+	}
+
 	if c.MemSize, err = ParseSize(*msize, "g"); err != nil {
 		return nil, err
 	}
 
+	if c.MemHotplug, err = ParseSize(*mhotplug, "g"); err != nil {
+		return nil, err
+	}
+
+	if c.MemHotplug%virtio.MemBlockSize != 0 {
+		return nil, fmt.Errorf("mem-hotplug %d:%w", c.MemHotplug, virtio.ErrInvalidMemRegion)
+	}
+
 	if c.TraceCount, err = ParseSize(*tc, ""); err != nil {
 		return nil, err
 	}
 
+	if c.VsockCID <= virtio.VsockHostCID || c.VsockCID >= 0xffffffff {
+		return nil, fmt.Errorf("vsock-cid %d:%w", c.VsockCID, virtio.ErrInvalidCID)
+	}
+
+	if len(c.Serials) == 0 {
+		c.Serials = []string{serial.KindStdio}
+	}
+
+	specs := make([]serial.Spec, len(c.Serials))
+
+	for i, s := range c.Serials {
+		if specs[i], err = serial.ParseSpec(s); err != nil {
+			return nil, err
+		}
+	}
+
+	vspecs := make([]serial.Spec, len(c.VPorts))
+
+	for i, p := range c.VPorts {
+		if vspecs[i], err = serial.ParseSpec(p.Backend); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = checkSerials(specs, vspecs); err != nil {
+		return nil, err
+	}
+
 	return c, nil
 }
 
+// stringList is the value of a flag which may be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+
+	return nil
+}
+
+// cpusValue is the value of -c, which sets the number of vCPUs at boot
+// and, if given, how many the VM can have.
+type cpusValue struct {
+	n, max *int
+}
+
+func (v *cpusValue) String() string {
+	if v.n == nil {
+		return ""
+	}
+
+	if *v.max == 0 {
+		return strconv.Itoa(*v.n)
+	}
+
+	return fmt.Sprintf("%d,maxcpus=%d", *v.n, *v.max)
+}
+
+func (v *cpusValue) Set(s string) error {
+	n, opt, hasOpt := strings.Cut(s, ",")
+
+	nCPUs, err := strconv.Atoi(n)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidCPUs, s)
+	}
+
+	*v.n = nCPUs
+
+	if !hasOpt {
+		return nil
+	}
+
+	m, ok := strings.CutPrefix(opt, "maxcpus=")
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidCPUs, s)
+	}
+
+	if *v.max, err = strconv.Atoi(m); err != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidCPUs, s)
+	}
+
+	return nil
+}
+
+// parseSMP parses the value of -smp.
+func parseSMP(s string) (cpuid.Topology, error) {
+	t := cpuid.Topology{Sockets: 1, Cores: 1, Threads: 1}
+
+	for _, opt := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(opt, "=")
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return t, fmt.Errorf("%w: %q", ErrInvalidSMP, s)
+		}
+
+		switch k {
+		case "sockets":
+			t.Sockets = n
+		case "cores":
+			t.Cores = n
+		case "threads":
+			t.Threads = n
+		default:
+			return t, fmt.Errorf("%w: %q", ErrInvalidSMP, s)
+		}
+	}
+
+	// The largest APIC ID must not be the broadcast one.
+	if t.CPUs() > maxPossibleCPUs || t.APICID(t.CPUs()-1) >= maxPossibleCPUs {
+		return t, fmt.Errorf("%w: %q has APIC IDs beyond %d", ErrInvalidSMP, s, maxPossibleCPUs-1)
+	}
+
+	return t, nil
+}
+
+// NUMANode is a NUMA node of the guest, see machine.NUMANode.
+type NUMANode struct {
+	CPUs      []int
+	Size      int
+	HostNodes []int
+}
+
+// parseNUMA parses the value of -numa.
+func parseNUMA(s string) (NUMANode, error) {
+	var n NUMANode
+
+	opts := strings.Split(s, ",")
+	if opts[0] != "node" {
+		return n, fmt.Errorf("%w: %q", ErrInvalidNUMA, s)
+	}
+
+	for _, opt := range opts[1:] {
+		var err error
+
+		switch k, v, _ := strings.Cut(opt, "="); k {
+		case "cpus":
+			n.CPUs, err = appendRange(n.CPUs, v, maxPossibleCPUs)
+		case "mem":
+			n.Size, err = ParseSize(v, "g")
+		case "hostnodes":
+			n.HostNodes, err = appendRange(n.HostNodes, v, memory.MaxHostNodes)
+		default:
+			err = strconv.ErrSyntax
+		}
+
+		if err != nil {
+			return n, fmt.Errorf("%w: %q: %v", ErrInvalidNUMA, s, err)
+		}
+	}
+
+	if n.Size == 0 {
+		return n, fmt.Errorf("%w: %q has no mem", ErrInvalidNUMA, s)
+	}
+
+	return n, nil
+}
+
+// parseVCPUAffinity parses the value of -vcpu-affinity.
+func parseVCPUAffinity(s string) (map[int][]int, error) {
+	a := make(map[int][]int)
+
+	for _, pair := range strings.Split(s, ",") {
+		v, cpus, ok := strings.Cut(pair, ":")
+
+		cpu, err := strconv.Atoi(v)
+		if !ok || err != nil || cpu < 0 || cpu >= maxPossibleCPUs {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidVCPUAffinity, s)
+		}
+
+		if a[cpu], err = appendRange(a[cpu], cpus, sched.MaxCPUs); err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", ErrInvalidVCPUAffinity, s, err)
+		}
+	}
+
+	return a, nil
+}
+
+// appendRange appends the numbers of s, written as N or N-M, to l. They
+// must be below limit.
+func appendRange(l []int, s string, limit int) ([]int, error) {
+	first, last, isRange := strings.Cut(s, "-")
+
+	lo, err := strconv.Atoi(first)
+	if err != nil {
+		return l, err
+	}
+
+	hi := lo
+
+	if isRange {
+		if hi, err = strconv.Atoi(last); err != nil {
+			return l, err
+		}
+	}
+
+	if lo < 0 || hi < lo || hi >= limit {
+		return l, strconv.ErrRange
+	}
+
+	for i := lo; i <= hi; i++ {
+		l = append(l, i)
+	}
+
+	return l, nil
+}
+
+// parseVPort parses the value of -vport.
+func parseVPort(s string) (VPort, error) {
+	name, backend, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return VPort{}, fmt.Errorf("%w: %q", ErrInvalidVPort, s)
+	}
+
+	if name == "hvc" {
+		return VPort{Console: true, Backend: backend}, nil
+	}
+
+	return VPort{Name: name, Backend: backend}, nil
+}
+
+// parseDisk parses the value of -d or -scsi. A path ending with
+// neither suffix is taken as is.
+func parseDisk(s string) Disk {
+	if p, ok := strings.CutSuffix(s, ",ro"); ok && p != "" {
+		return Disk{Path: p, ReadOnly: true}
+	}
+
+	if p, ok := strings.CutSuffix(s, ",snapshot"); ok && p != "" {
+		return Disk{Path: p, Snapshot: true}
+	}
+
+	return Disk{Path: s}
+}
+
+// parseShare parses the value of -share.
+func parseShare(s string) (Share, error) {
+	tag, path, ok := strings.Cut(s, "=")
+	if !ok || path == "" {
+		return Share{}, fmt.Errorf("%w: %q", ErrInvalidShare, s)
+	}
+
+	sh := Share{Tag: tag, Path: path}
+
+	if p, ro := strings.CutSuffix(path, ",ro"); ro && p != "" {
+		sh.Path = p
+		sh.ReadOnly = true
+	}
+
+	return sh, nil
+}
+
+// checkShares checks that the tags of the shares are valid and unique.
+func checkShares(shares []Share) error {
+	tags := map[string]bool{}
+
+	for _, sh := range shares {
+		if sh.Tag == "" || len(sh.Tag) > virtio.P9MaxTagLen {
+			return fmt.Errorf("%w: tag %q must be 1 to %d bytes", ErrInvalidShare, sh.Tag, virtio.P9MaxTagLen)
+		}
+
+		if tags[sh.Tag] {
+			return fmt.Errorf("%w: tag %q is used twice", ErrInvalidShare, sh.Tag)
+		}
+
+		tags[sh.Tag] = true
+	}
+
+	return nil
+}
+
+// checkSerials checks that there is a UART for each spec of a serial
+// port, and that only one of them or of the virtio console ports uses
+// the terminal.
+func checkSerials(serials, vports []serial.Spec) error {
+	if len(serials) > len(serial.Ports) {
+		return fmt.Errorf("%w: %d ports exceed COM1 to COM%d", ErrInvalidSerials, len(serials), len(serial.Ports))
+	}
+
+	if len(vports) > virtio.MaxConsolePorts {
+		return fmt.Errorf("%w: %d vports exceed %d", ErrInvalidSerials, len(vports), virtio.MaxConsolePorts)
+	}
+
+	stdio := 0
+
+	for _, s := range append(append([]serial.Spec{}, serials...), vports...) {
+		if s.Kind == serial.KindStdio {
+			stdio++
+		}
+	}
+
+	if stdio > 1 {
+		return fmt.Errorf("%w: only one port can use stdio", ErrInvalidSerials)
+	}
+
+	return nil
+}
+
 type ProbeArgs struct{}
 
 func parseProbeArgs(args []string) (*ProbeArgs, error) {
@@ -2,10 +2,15 @@ package flag_test
 
 import (
 	"errors"
+	"reflect"
 	"strconv"
 	"testing"
 
+	"github.com/bobuhiro11/gokvm/cpuid"
 	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/sched"
+	"github.com/bobuhiro11/gokvm/serial"
+	"github.com/bobuhiro11/gokvm/virtio"
 )
 
 func TestParsesize(t *testing.T) { // nolint:paralleltest
@@ -59,6 +64,8 @@ func TestParseBootArgs(t *testing.T) {
 		"1G",
 		"-T",
 		"1M",
+		"-qmp",
+		"/tmp/gokvm.sock",
 	}
 
 	c, _, err := flag.ParseArgs(args)
@@ -101,6 +108,10 @@ func TestParseBootArgs(t *testing.T) {
 	if c.TraceCount != 1<<20 {
 		t.Errorf("trace: got %#x, want %#x", c.TraceCount, 1<<20)
 	}
+
+	if c.QMPSocket != "/tmp/gokvm.sock" {
+		t.Errorf("qmp: got %v, want %v", c.QMPSocket, "/tmp/gokvm.sock")
+	}
 }
 
 func TestParseBootArgsWithDefaults(t *testing.T) {
@@ -158,6 +169,45 @@ func TestParseBootArgsWithDefaults(t *testing.T) {
 	if c.TraceCount != 0 {
 		t.Errorf("trace: got %#x, want %#x", c.TraceCount, 1<<20)
 	}
+
+	if len(c.Serials) != 1 || c.Serials[0] != "stdio" {
+		t.Errorf("serials: got %v, want stdio", c.Serials)
+	}
+
+	if c.VsockPath != "" || c.VsockCID != 3 {
+		t.Errorf("vsock: got %q at CID %d, want none at CID 3", c.VsockPath, c.VsockCID)
+	}
+
+	if c.Rng {
+		t.Errorf("rng: got %v, want false", c.Rng)
+	}
+
+	if c.Balloon {
+		t.Errorf("balloon: got %v, want false", c.Balloon)
+	}
+}
+
+func TestParseBootArgsSerials(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-serial", "stdio", "-serial", "pty", "-serial", "null"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Serials) != 3 || c.Serials[0] != "stdio" || c.Serials[1] != "pty" || c.Serials[2] != "null" {
+		t.Errorf("serials: got %v, want stdio, pty and null", c.Serials)
+	}
+
+	for _, args := range [][]string{
+		{"-serial", "null", "-serial", "null", "-serial", "null", "-serial", "null", "-serial", "null"},
+		{"-serial", "stdio", "-serial", "stdio"},
+	} {
+		_, _, err := flag.ParseArgs(append([]string{"gokvm", "boot"}, args...))
+		if !errors.Is(err, flag.ErrInvalidSerials) {
+			t.Errorf("%v: got %v, want %v", args, err, flag.ErrInvalidSerials)
+		}
+	}
 }
 
 func TestParseProbeArgs(t *testing.T) {
@@ -177,3 +227,392 @@ func TestParseProbeArgs(t *testing.T) {
 		t.Fatal("probeConfig is nil")
 	}
 }
+
+func TestParseBootArgsVPorts(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{
+		"gokvm", "boot", "-serial", "null", "-vport", "hvc=stdio", "-vport", "org.qemu.guest_agent.0=unix:/tmp/qga.sock",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []flag.VPort{
+		{Console: true, Backend: "stdio"},
+		{Name: "org.qemu.guest_agent.0", Backend: "unix:/tmp/qga.sock"},
+	}
+
+	if len(c.VPorts) != len(want) || c.VPorts[0] != want[0] || c.VPorts[1] != want[1] {
+		t.Errorf("vports: got %+v, want %+v", c.VPorts, want)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		err  error
+	}{
+		{args: []string{"-vport", "stdio"}, err: flag.ErrInvalidVPort},
+		{args: []string{"-vport", "=null"}, err: flag.ErrInvalidVPort},
+		{args: []string{"-vport", "hvc=telnet"}, err: serial.ErrInvalidSpec},
+		{args: []string{"-vport", "hvc=stdio"}, err: flag.ErrInvalidSerials}, // COM1 is stdio too
+	} {
+		_, _, err := flag.ParseArgs(append([]string{"gokvm", "boot"}, tt.args...))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%v: got %v, want %v", tt.args, err, tt.err)
+		}
+	}
+}
+
+func TestParseBootArgsVsock(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-vsock", "/tmp/vsock.sock", "-vsock-cid", "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.VsockPath != "/tmp/vsock.sock" || c.VsockCID != 42 {
+		t.Errorf("vsock: got %q at CID %d, want %q at CID 42", c.VsockPath, c.VsockCID, "/tmp/vsock.sock")
+	}
+
+	if _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-vsock-cid", "2"}); !errors.Is(err,
+		virtio.ErrInvalidCID) {
+		t.Errorf("CID 2: got %v, want %v", err, virtio.ErrInvalidCID)
+	}
+}
+
+func TestParseBootArgsBalloon(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-balloon"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Balloon {
+		t.Errorf("balloon: got %v, want true", c.Balloon)
+	}
+}
+
+func TestParseBootArgsQueueSize(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.QueueSize != virtio.QueueSize {
+		t.Errorf("queue size: got %d, want %d", c.QueueSize, virtio.QueueSize)
+	}
+
+	if c, _, err = flag.ParseArgs([]string{"gokvm", "boot", "-queue-size", "1024"}); err != nil || c.QueueSize != 1024 {
+		t.Errorf("queue size: got %v and %v, want 1024", c, err)
+	}
+
+	for _, size := range []string{"0", "100", "2048", "65540"} {
+		if _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-queue-size", size}); !errors.Is(err,
+			virtio.ErrInvalidQueueSize) {
+			t.Errorf("%s: got %v, want %v", size, err, virtio.ErrInvalidQueueSize)
+		}
+	}
+}
+
+func TestParseBootArgsMemBacking(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-mem-path", "/dev/hugepages", "-mem-prealloc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.MemPath != "/dev/hugepages" || c.MemHugepages || !c.MemPrealloc {
+		t.Errorf("got path %q hugepages %v prealloc %v", c.MemPath, c.MemHugepages, c.MemPrealloc)
+	}
+
+	if c, _, err = flag.ParseArgs([]string{"gokvm", "boot", "-mem-hugepages"}); err != nil || !c.MemHugepages {
+		t.Errorf("hugepages: got %v and %v, want true", c, err)
+	}
+}
+
+func TestParseBootArgsMemHotplug(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-mem-hotplug", "2G"})
+	if err != nil || c.MemHotplug != 2<<30 {
+		t.Fatalf("got %v and %v, want 2 GiB", c, err)
+	}
+
+	if c, _, err = flag.ParseArgs([]string{"gokvm", "boot"}); err != nil || c.MemHotplug != 0 {
+		t.Errorf("default: got %v and %v, want 0", c, err)
+	}
+
+	if _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-mem-hotplug", "100M"}); !errors.Is(err,
+		virtio.ErrInvalidMemRegion) {
+		t.Errorf("100M: got %v, want %v", err, virtio.ErrInvalidMemRegion)
+	}
+}
+
+func TestParseBootArgsCPUs(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		arg        string
+		n, maxCPUs int
+	}{
+		{arg: "2", n: 2, maxCPUs: 2},
+		{arg: "2,maxcpus=8", n: 2, maxCPUs: 8},
+		{arg: "1,maxcpus=255", n: 1, maxCPUs: 255},
+	} {
+		c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-c", tt.arg})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.arg, err)
+		}
+
+		if c.NCPUs != tt.n || c.MaxCPUs != tt.maxCPUs {
+			t.Errorf("%s: got %d and %d, want %d and %d", tt.arg, c.NCPUs, c.MaxCPUs, tt.n, tt.maxCPUs)
+		}
+	}
+
+	// Malformed values make the flag set exit.
+	for _, arg := range []string{"0", "65", "4,maxcpus=2", "1,maxcpus=256"} {
+		if _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-c", arg}); !errors.Is(err, flag.ErrInvalidCPUs) {
+			t.Errorf("%s: got %v, want %v", arg, err, flag.ErrInvalidCPUs)
+		}
+	}
+}
+
+func TestParseBootArgsSMP(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		args       []string
+		topology   cpuid.Topology
+		n, maxCPUs int
+	}{
+		{
+			args:     []string{"-smp", "sockets=2,cores=2,threads=2"},
+			topology: cpuid.Topology{Sockets: 2, Cores: 2, Threads: 2},
+			n:        8,
+			maxCPUs:  8,
+		},
+		{
+			args:     []string{"-smp", "cores=4", "-c", "2"},
+			topology: cpuid.Topology{Sockets: 1, Cores: 4, Threads: 1},
+			n:        2,
+			maxCPUs:  4,
+		},
+		{
+			args:     []string{"-smp", "sockets=8,cores=8,threads=2"},
+			topology: cpuid.Topology{Sockets: 8, Cores: 8, Threads: 2},
+			n:        64,
+			maxCPUs:  128,
+		},
+	} {
+		c, _, err := flag.ParseArgs(append([]string{"gokvm", "boot"}, tt.args...))
+		if err != nil {
+			t.Fatalf("%v: %v", tt.args, err)
+		}
+
+		if c.Topology != tt.topology || c.NCPUs != tt.n || c.MaxCPUs != tt.maxCPUs {
+			t.Errorf("%v: got %+v, %d of %d cpus, want %+v, %d of %d", tt.args, c.Topology, c.NCPUs, c.MaxCPUs,
+				tt.topology, tt.n, tt.maxCPUs)
+		}
+	}
+
+	for _, tt := range []struct {
+		args []string
+		err  error
+	}{
+		{args: []string{"-smp", "sockets=2,dies=2"}, err: flag.ErrInvalidSMP},
+		{args: []string{"-smp", "cores=0"}, err: flag.ErrInvalidSMP},
+		{args: []string{"-smp", "sockets=4,cores=64"}, err: flag.ErrInvalidSMP},
+		{args: []string{"-smp", "cores=4", "-c", "2,maxcpus=8"}, err: flag.ErrInvalidCPUs},
+	} {
+		if _, _, err := flag.ParseArgs(append([]string{"gokvm", "boot"}, tt.args...)); !errors.Is(err, tt.err) {
+			t.Errorf("%v: got %v, want %v", tt.args, err, tt.err)
+		}
+	}
+}
+
+func TestParseBootArgsNUMA(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{
+		"gokvm", "boot", "-numa", "node,cpus=0-1,cpus=4,mem=512M,hostnodes=1", "-numa", "node,mem=512M",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.NUMA) != 2 || !reflect.DeepEqual(c.NUMA[0], flag.NUMANode{CPUs: []int{0, 1, 4}, Size: 512 << 20,
+		HostNodes: []int{1}}) || c.NUMA[1].Size != 512<<20 {
+		t.Errorf("got %+v", c.NUMA)
+	}
+
+	for _, arg := range []string{
+		"cpus=0,mem=1G", "node,cpus=0", "node,cpus=1-0,mem=1G", "node,cpus=255,mem=1G", "node,mem=1G,policy=bind",
+	} {
+		if _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-numa", arg}); !errors.Is(err, flag.ErrInvalidNUMA) {
+			t.Errorf("%s: got %v, want %v", arg, err, flag.ErrInvalidNUMA)
+		}
+	}
+}
+
+func TestParseBootArgsCPUModel(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.CPUModel.String() != cpuid.DefaultModel {
+		t.Errorf("got %s, want %s", c.CPUModel, cpuid.DefaultModel)
+	}
+
+	c, _, err = flag.ParseArgs([]string{"gokvm", "boot", "-cpu", "baseline-v3,+pcid,+invpcid,-avx2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := cpuid.Model{Name: "baseline-v3", Add: []string{"pcid", "invpcid"}, Remove: []string{"avx2"}}
+	if !reflect.DeepEqual(c.CPUModel, want) {
+		t.Errorf("got %+v, want %+v", c.CPUModel, want)
+	}
+
+	for _, arg := range []string{"haswell", "host,avx", "custom,+avx-512"} {
+		if _, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-cpu", arg}); !errors.Is(err, cpuid.ErrInvalidModel) {
+			t.Errorf("%s: got %v, want %v", arg, err, cpuid.ErrInvalidModel)
+		}
+	}
+}
+
+func TestParseBootArgsSched(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{
+		"gokvm", "boot", "-c", "2,maxcpus=4", "-vcpu-affinity", "0:2,3:4-5,3:7", "-vcpu-priority", "10",
+		"-io-affinity", "0-1,6",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c.VCPUAffinity, map[int][]int{0: {2}, 3: {4, 5, 7}}) || c.VCPUPriority != 10 {
+		t.Errorf("got %v priority %d", c.VCPUAffinity, c.VCPUPriority)
+	}
+
+	if !reflect.DeepEqual(c.IOAffinity, []int{0, 1, 6}) {
+		t.Errorf("io: got %v", c.IOAffinity)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"-vcpu-affinity", "0"}, flag.ErrInvalidVCPUAffinity},
+		{[]string{"-vcpu-affinity", "0:2,x:3"}, flag.ErrInvalidVCPUAffinity},
+		{[]string{"-vcpu-affinity", "0:1024"}, flag.ErrInvalidVCPUAffinity},
+		// vCPU 1 is beyond maxcpus.
+		{[]string{"-vcpu-affinity", "1:0"}, flag.ErrInvalidVCPUAffinity},
+		{[]string{"-vcpu-priority", "100"}, sched.ErrInvalidPriority},
+		{[]string{"-io-affinity", "1,"}, flag.ErrInvalidIOAffinity},
+	} {
+		if _, _, err := flag.ParseArgs(append([]string{"gokvm", "boot"}, tt.args...)); !errors.Is(err, tt.err) {
+			t.Errorf("%v: got %v, want %v", tt.args, err, tt.err)
+		}
+	}
+}
+
+func TestParseBootArgsRng(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		args   []string
+		rng    bool
+		source string
+	}{
+		{args: []string{"-rng"}, rng: true},
+		{args: []string{"-rng-source", "/dev/hwrng"}, rng: true, source: "/dev/hwrng"},
+		{args: []string{"-rng-source", ""}},
+	} {
+		c, _, err := flag.ParseArgs(append([]string{"gokvm", "boot"}, tt.args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Rng != tt.rng || c.RngSource != tt.source {
+			t.Errorf("%v: got %v and %q, want %v and %q", tt.args, c.Rng, c.RngSource, tt.rng, tt.source)
+		}
+	}
+}
+
+func TestParseBootArgsShares(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-share", "src=/src", "-share", "out=/tmp/out,ro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []flag.Share{{Tag: "src", Path: "/src"}, {Tag: "out", Path: "/tmp/out", ReadOnly: true}}
+
+	if len(c.Shares) != len(want) || c.Shares[0] != want[0] || c.Shares[1] != want[1] {
+		t.Errorf("shares: got %+v, want %+v", c.Shares, want)
+	}
+
+	for _, args := range [][]string{
+		{"-share", "src"},
+		{"-share", "src="},
+		{"-share", "=/src"},
+		{"-share", "src=/a", "-share", "src=/b"},
+	} {
+		_, _, err := flag.ParseArgs(append([]string{"gokvm", "boot"}, args...))
+		if !errors.Is(err, flag.ErrInvalidShare) {
+			t.Errorf("%v: got %v, want %v", args, err, flag.ErrInvalidShare)
+		}
+	}
+}
+
+func TestParseBootArgsSCSI(t *testing.T) {
+	t.Parallel()
+
+	c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-scsi", "a.img", "-d", "c.img", "-scsi", "b.img,ro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []flag.Disk{{Path: "a.img"}, {Path: "b.img", ReadOnly: true}}
+
+	if len(c.SCSI) != 2 || c.SCSI[0] != want[0] || c.SCSI[1] != want[1] {
+		t.Errorf("scsi: got %+v, want %+v", c.SCSI, want)
+	}
+
+	if len(c.Disks) != 1 || c.Disks[0].Path != "c.img" {
+		t.Errorf("disks: got %v, want only c.img", c.Disks)
+	}
+}
+
+func TestParseBootArgsDiskModes(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		arg  string
+		want flag.Disk
+	}{
+		{arg: "vda.img", want: flag.Disk{Path: "vda.img"}},
+		{arg: "vda.img,ro", want: flag.Disk{Path: "vda.img", ReadOnly: true}},
+		{arg: "vda.img,snapshot", want: flag.Disk{Path: "vda.img", Snapshot: true}},
+		{arg: ",ro", want: flag.Disk{Path: ",ro"}},
+	} {
+		c, _, err := flag.ParseArgs([]string{"gokvm", "boot", "-d", tt.arg})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(c.Disks) != 1 || c.Disks[0] != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.arg, c.Disks, tt.want)
+		}
+	}
+}
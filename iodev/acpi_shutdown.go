@@ -3,11 +3,14 @@ package iodev
 import "log"
 
 // This device is used by EDK2/CloudHv to let the host know about a shutdown.
-// No implementation of handling the event on host side yet.
+// It is also the sleep control register of the FADT of a hardware-reduced
+// machine, see acpi.Build.
 // See: https://github.com/cloud-hypervisor/edk2/blob/ch/OvmfPkg/Include/IndustryStandard/CloudHv.h
 
 type ACPIShutDown struct {
 	Port uint64
+	// Poweroff, if set, is called once the guest enters S5.
+	Poweroff func()
 	// ExitEvent  chan int
 	// ResetEvent chan int
 }
@@ -36,6 +39,10 @@ func (a *ACPIShutDown) Write(base uint64, data []byte) error {
 	if data[0] == (S5SleepVal<<SleepValBit)|(1<<SleepStatusENBit) {
 		// a.ExitEvent <- 1
 		log.Println("ACPI Shutdown signalled")
+
+		if a.Poweroff != nil {
+			a.Poweroff()
+		}
 	}
 
 	return nil
@@ -9,6 +9,9 @@ const (
 	indexOffset = uint64(0x70)
 	dataOffset  = uint64(0x71)
 	dataLen     = uint64(128)
+
+	// baseMemKiB is the conventional memory below the EBDA.
+	baseMemKiB = 640
 )
 
 type CMOS struct {
@@ -16,22 +19,47 @@ type CMOS struct {
 	Data  []uint8
 }
 
+// NewCMOS returns the CMOS RAM of a machine with memBelow4G bytes of
+// RAM from 0 and memAbove4G bytes from 4 GiB, which firmware reads
+// the memory size from.
 func NewCMOS(memBelow4G, memAbove4G uint64) *CMOS {
 	cmos := &CMOS{
 		Index: 0,
 		Data:  make([]uint8, dataLen),
 	}
 
-	// We assume 3G RAM at all times for now.....
-	extMem := uint16(0xBC00)
+	// Base memory in KiB.
+	baseMem := uint16(baseMemKiB)
+
+	cmos.Data[0x15] = uint8(baseMem)
+	cmos.Data[0x16] = uint8(baseMem >> 8)
+
+	// Extended memory from 1 MiB in KiB, at most 0xFFFF.
+	extMem := uint64(0)
+	if memBelow4G > 1<<20 {
+		extMem = min((memBelow4G-1<<20)>>10, 0xFFFF)
+	}
+
+	cmos.Data[0x17] = uint8(extMem)
+	cmos.Data[0x18] = uint8(extMem >> 8)
+	cmos.Data[0x30] = uint8(extMem)
+	cmos.Data[0x31] = uint8(extMem >> 8)
+
+	// Memory from 16 MiB in 64 KiB blocks, at most 0xFFFF.
+	extMem = 0
+	if memBelow4G > 16<<20 {
+		extMem = min((memBelow4G-16<<20)>>16, 0xFFFF)
+	}
 
 	cmos.Data[0x34] = uint8(extMem)
 	cmos.Data[0x35] = uint8(extMem >> 8)
 
-	// Only valid for PVH boot of firmware with 3G RAM fixed.....
-	cmos.Data[0x5b] = 0
-	cmos.Data[0x5c] = 0
-	cmos.Data[0x5d] = 0
+	// Memory from 4 GiB in 64 KiB blocks.
+	highMem := memAbove4G >> 16
+
+	cmos.Data[0x5b] = uint8(highMem)
+	cmos.Data[0x5c] = uint8(highMem >> 8)
+	cmos.Data[0x5d] = uint8(highMem >> 16)
 
 	return cmos
 }
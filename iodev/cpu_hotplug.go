@@ -0,0 +1,176 @@
+package iodev
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/acpi"
+	"github.com/bobuhiro11/gokvm/aml"
+)
+
+// CPUHotplugPort is the first port of the CPU hotplug controller.
+const CPUHotplugPort = 0x620
+
+const (
+	cpuSelect = 0 // CSEL, the CPU the status refers to
+	cpuStatus = 4 // CPEN and CINS of the selected CPU
+
+	cpuEnabled   = 1 << 0 // CPEN, the CPU is present
+	cpuInserting = 1 << 1 // CINS, the guest was not told yet, write 1 to clear
+)
+
+// CPUHotplug is the controller the DSDT uses to tell which of the
+// possible CPUs are present and which were added since the guest last
+// looked. The guest selects a CPU by writing its number to CSEL, then
+// reads its status. The GED tells the guest to look on a change.
+type CPUHotplug struct {
+	mu       sync.Mutex
+	selected uint32
+	status   []byte
+	cpus     []acpi.LocalAPIC
+}
+
+// NewCPUHotplug creates the controller of the possible CPUs, as they
+// are in the MADT. The enabled ones are present from the start.
+func NewCPUHotplug(cpus []acpi.LocalAPIC) *CPUHotplug {
+	c := &CPUHotplug{status: make([]byte, len(cpus)), cpus: cpus}
+
+	for i, l := range cpus {
+		if l.Enabled {
+			c.status[i] = cpuEnabled
+		}
+	}
+
+	return c
+}
+
+// Plug makes cpu present and tells the guest so on its next scan. A CPU
+// which is not possible is ignored.
+func (c *CPUHotplug) Plug(cpu int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cpu >= 0 && cpu < len(c.status) {
+		c.status[cpu] = cpuEnabled | cpuInserting
+	}
+}
+
+func (c *CPUHotplug) Read(base uint64, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch base - CPUHotplugPort {
+	case cpuSelect:
+		if len(data) != 4 {
+			return errDataLenInvalid
+		}
+
+		binary.LittleEndian.PutUint32(data, c.selected)
+	case cpuStatus:
+		data[0] = 0
+		if int(c.selected) < len(c.status) {
+			data[0] = c.status[c.selected]
+		}
+	default:
+		data[0] = 0
+	}
+
+	return nil
+}
+
+func (c *CPUHotplug) Write(base uint64, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch base - CPUHotplugPort {
+	case cpuSelect:
+		if len(data) != 4 {
+			return errDataLenInvalid
+		}
+
+		c.selected = binary.LittleEndian.Uint32(data)
+	case cpuStatus:
+		if int(c.selected) < len(c.status) && data[0]&cpuInserting != 0 {
+			c.status[c.selected] &^= cpuInserting
+		}
+	}
+
+	return nil
+}
+
+func (c *CPUHotplug) IOPort() uint64 {
+	return CPUHotplugPort
+}
+
+func (c *CPUHotplug) Size() uint64 {
+	return 0x8
+}
+
+// cpuName returns the name of the device of cpu in the DSDT.
+func cpuName(cpu int) string {
+	return fmt.Sprintf("C%03X", cpu)
+}
+
+// AML returns the container device of the possible CPUs for the DSDT.
+// Its CSCN method notifies the CPUs added since the last scan, whose
+// _STA then turn present.
+func (c *CPUHotplug) AML() []byte {
+	n := len(c.status)
+
+	// CTFY (cpu, event) notifies the device of cpu.
+	var notify [][]byte
+	for i := 0; i < n; i++ {
+		notify = append(notify, aml.If(aml.Equal(aml.Arg(0), aml.Int(uint64(i))),
+			aml.Notify(aml.Path(cpuName(i)), aml.Arg(1))))
+	}
+
+	terms := [][]byte{
+		aml.Name("_HID", aml.String("ACPI0010")),
+		aml.Name("_CID", aml.EISAID("PNP0A05")),
+		aml.Mutex("CPLK", 0),
+		aml.OpRegion("PRST", aml.SystemIO, CPUHotplugPort, 8),
+		aml.Field("PRST", aml.DWordAcc|aml.Preserve, aml.FieldUnit{Name: "CSEL", Bits: 32}),
+		aml.Field("PRST", aml.ByteAcc|aml.WriteAsZeros,
+			aml.FieldUnit{Bits: 32},
+			aml.FieldUnit{Name: "CPEN", Bits: 1},
+			aml.FieldUnit{Name: "CINS", Bits: 1},
+		),
+		aml.Method("CSTA", 1, true,
+			aml.Acquire("CPLK", 0xffff),
+			aml.Store(aml.Arg(0), aml.Path("CSEL")),
+			aml.Store(aml.Int(0), aml.Local(0)),
+			aml.If(aml.Equal(aml.Path("CPEN"), aml.Int(1)), aml.Store(aml.Int(0xf), aml.Local(0))),
+			aml.Release("CPLK"),
+			aml.Return(aml.Local(0)),
+		),
+		aml.Method("CTFY", 2, false, notify...),
+		aml.Method("CSCN", 0, true,
+			aml.Acquire("CPLK", 0xffff),
+			aml.Store(aml.Int(0), aml.Local(0)),
+			aml.While(aml.Less(aml.Local(0), aml.Int(uint64(n))),
+				aml.Store(aml.Local(0), aml.Path("CSEL")),
+				aml.If(aml.Equal(aml.Path("CINS"), aml.Int(1)),
+					aml.Call("CTFY", aml.Local(0), aml.Int(1)),
+					aml.Store(aml.Int(1), aml.Path("CINS")),
+				),
+				aml.Increment(aml.Local(0)),
+			),
+			aml.Release("CPLK"),
+		),
+	}
+
+	for i, lapic := range c.cpus {
+		// _MAT is the entry of the CPU once it is present.
+		lapic.Enabled = true
+
+		terms = append(terms, aml.Device(cpuName(i),
+			aml.Name("_HID", aml.String("ACPI0007")),
+			aml.Name("_UID", aml.Int(uint64(lapic.UID))),
+			aml.Method("_STA", 0, false, aml.Return(aml.Call("CSTA", aml.Int(uint64(i))))),
+			aml.Name("_MAT", aml.Buffer(lapic.Bytes())),
+		))
+	}
+
+	return aml.Device("\\_SB.CPUS", terms...)
+}
@@ -0,0 +1,115 @@
+package iodev
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/aml"
+)
+
+const (
+	// GEDPort is the port of the event register of the GED.
+	GEDPort = 0x610
+
+	// GEDIRQ is the interrupt of the GED.
+	GEDIRQ = 6
+
+	// GEDCPUHotplug is the event of a change of the CPUs, see
+	// CPUHotplug.
+	GEDCPUHotplug = 1 << 0
+
+	// GEDPowerButton is a press of the power button, which asks the
+	// guest to power off.
+	GEDPowerButton = 1 << 1
+)
+
+// GED is the ACPI Generic Event Device of a hardware-reduced machine,
+// which signals events with an interrupt instead of a GPE. The guest
+// reads the pending events from a 32 bit register, which clears them.
+//
+// refs https://uefi.org/specs/ACPI/6.5/05_ACPI_Software_Programming_Model.html#generic-event-device
+type GED struct {
+	mu      sync.Mutex
+	pending uint32
+
+	// Inject raises the interrupt of the GED.
+	Inject func(irq uint8) error
+
+	// cpuHotplug tells whether the machine has a CPUHotplug device.
+	cpuHotplug bool
+}
+
+// NewGED creates a GED which raises its interrupt with inject, for a
+// machine with a CPUHotplug device if cpuHotplug is set.
+func NewGED(inject func(irq uint8) error, cpuHotplug bool) *GED {
+	return &GED{Inject: inject, cpuHotplug: cpuHotplug}
+}
+
+// Notify sets the bits of event pending and interrupts the guest.
+func (g *GED) Notify(event uint32) error {
+	g.mu.Lock()
+	g.pending |= event
+	g.mu.Unlock()
+
+	return g.Inject(GEDIRQ)
+}
+
+func (g *GED) Read(base uint64, data []byte) error {
+	if len(data) != 4 {
+		return errDataLenInvalid
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	binary.LittleEndian.PutUint32(data, g.pending)
+	g.pending = 0
+
+	return nil
+}
+
+func (g *GED) Write(base uint64, data []byte) error {
+	return nil
+}
+
+func (g *GED) IOPort() uint64 {
+	return GEDPort
+}
+
+func (g *GED) Size() uint64 {
+	return 0x4
+}
+
+// AML returns the devices of the GED and of the power button for the
+// DSDT. The _EVT method of the GED notifies the power button on
+// GEDPowerButton and, on a machine with CPU hotplug, calls the scan
+// method of the CPU hotplug device on GEDCPUHotplug.
+func (g *GED) AML() []byte {
+	evt := [][]byte{
+		aml.Store(aml.Path("GDAT"), aml.Local(0)),
+		aml.If(aml.Equal(aml.And(aml.Local(0), aml.Int(GEDPowerButton)), aml.Int(GEDPowerButton)),
+			aml.Notify(aml.Path("\\_SB.PWRB"), aml.Int(0x80))),
+	}
+
+	if g.cpuHotplug {
+		evt = append(evt,
+			aml.If(aml.Equal(aml.And(aml.Local(0), aml.Int(GEDCPUHotplug)), aml.Int(GEDCPUHotplug)),
+				aml.Call("\\_SB.CPUS.CSCN")))
+	}
+
+	// A control method power button, as a hardware-reduced machine has
+	// no fixed one.
+	pwrb := aml.Device("\\_SB.PWRB",
+		aml.Name("_HID", aml.EISAID("PNP0C0C")),
+		aml.Name("_UID", aml.Int(0)),
+	)
+
+	return append(pwrb, aml.Device("\\_SB.GED",
+		aml.Name("_HID", aml.String("ACPI0013")),
+		aml.Name("_UID", aml.Int(0)),
+		aml.Name("_CRS", aml.ResourceTemplate(aml.Interrupt(aml.Consumer|aml.Edge, GEDIRQ))),
+		aml.OpRegion("GDST", aml.SystemIO, GEDPort, 4),
+		aml.Field("GDST", aml.DWordAcc|aml.Preserve, aml.FieldUnit{Name: "GDAT", Bits: 32}),
+		aml.Method("_EVT", 1, true, evt...),
+	)...)
+}
@@ -1,7 +1,8 @@
 package machine
 
 import (
-	"bytes"
+	"context"
+	"crypto/rand"
 	"debug/elf"
 	"encoding/binary"
 	"encoding/hex"
@@ -9,18 +10,28 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/acpi"
+	"github.com/bobuhiro11/gokvm/aml"
 	"github.com/bobuhiro11/gokvm/bootparam"
+	cpuidpkg "github.com/bobuhiro11/gokvm/cpuid"
 	"github.com/bobuhiro11/gokvm/ebda"
 	"github.com/bobuhiro11/gokvm/iodev"
 	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/memory"
 	"github.com/bobuhiro11/gokvm/pci"
 	"github.com/bobuhiro11/gokvm/pvh"
+	"github.com/bobuhiro11/gokvm/sched"
 	"github.com/bobuhiro11/gokvm/serial"
 	"github.com/bobuhiro11/gokvm/tap"
 	"github.com/bobuhiro11/gokvm/virtio"
@@ -34,12 +45,26 @@ const (
 	initrdAddr  = 0xf000000
 	highMemBase = 0x100000
 
-	serialIRQ    = 4
-	virtioNetIRQ = 9
-	virtioBlkIRQ = 10
+	// DebugExitPort is the port of a debug exit device like QEMU's
+	// isa-debug-exit. A write of v to it ends Start with exit code
+	// (v << 1) | 1.
+	DebugExitPort = 0x501
+
+	// Each virtio device gets its own range of IO ports for BAR0,
+	// starting at virtioIOPortStart.
+	virtioIOPortStart = 0x6200
+	virtioIOPortSize  = 0x100
+
+	// maxPCIDevices is the number of device numbers on PCI bus 0.
+	maxPCIDevices = 32
 
 	pageTableBase = 0x30_000
 
+	// The ACPI tables go below the BIOS area, where the guest looks
+	// for the RSDP without being told, see setupACPI.
+	acpiAddr = 0xe0000
+	acpiSize = 0x10000
+
 	MinMemSize = 1 << 25
 )
 
@@ -112,6 +137,13 @@ const (
 
 var ErrZeroSizeKernel = errors.New("kernel is 0 bytes")
 
+// ErrTripleFault indicates a vCPU shut down on a triple fault, which is
+// how a PC resets when nothing else did, e.g. for Linux with reboot=t.
+var ErrTripleFault = errors.New("vCPU shut down on a triple fault")
+
+// ErrNotLoaded indicates the machine was started before a kernel was loaded.
+var ErrNotLoaded = errors.New("no kernel or firmware loaded")
+
 // ErrWriteToCF9 indicates a write to cf9, the standard x86 reset port.
 var ErrWriteToCF9 = fmt.Errorf("power cycle via 0xcf9")
 
@@ -121,144 +153,1044 @@ var ErrBadVA = fmt.Errorf("bad virtual address")
 // ErrBadCPU indicates a cpu number is invalid.
 var ErrBadCPU = fmt.Errorf("bad cpu number")
 
+// ErrMaxCPUs indicates a vCPU added to a machine which has all of its
+// possible ones.
+var ErrMaxCPUs = fmt.Errorf("no more vCPUs possible")
+
+// MaxCPUs is the number of vCPUs a machine can have, as the local APIC
+// ID 0xff is the broadcast address.
+const MaxCPUs = 255
+
+// ErrBadNUMA indicates NUMA nodes which do not fit the vCPUs or the
+// memory of the machine.
+var ErrBadNUMA = fmt.Errorf("bad NUMA nodes")
+
+// numaAlign aligns the memory of each NUMA node, so that it can be
+// bound to host nodes.
+const numaAlign = 1 << 20
+
+// Distances between NUMA nodes in the SLIT, relative to 10 for a node
+// to itself.
+const (
+	numaLocal  = 10
+	numaRemote = 20
+)
+
 // ErrUnsupported indicates something we do not yet do.
 var ErrUnsupported = fmt.Errorf("unsupported")
 
-// ErrMemTooSmall indicates the requested memory size is too small.
-var ErrMemTooSmall = fmt.Errorf("mem request must be at least 1<<20")
+// ErrMemTooSmall indicates the requested memory size is too small.
+var ErrMemTooSmall = fmt.Errorf("mem request must be at least 1<<20")
+
+var ErrNotELF64File = fmt.Errorf("file is not ELF64")
+
+// ErrTooManyDevices indicates no PCI slot is left for a new device.
+var ErrTooManyDevices = fmt.Errorf("no free slot on PCI bus 0")
+
+// virtioIRQs are the legacy interrupt lines not used by the emulated
+// ISA devices. Virtio devices take them in turn and share them once
+// all are used, which legacy PCI interrupts allow.
+var virtioIRQs = []uint8{9, 10, 11, 5, 7, 14, 15}
+
+// ErrInvalidSerialPort indicates a serial port other than COM1 to COM4.
+var ErrInvalidSerialPort = fmt.Errorf("serial port out of range")
+
+// ErrNoBalloon indicates a balloon request to a machine without one.
+var ErrNoBalloon = fmt.Errorf("no balloon device")
+
+// ErrBalloonTarget indicates a balloon target above the memory size.
+var ErrBalloonTarget = fmt.Errorf("balloon target exceeds the memory size")
+
+// balloonStatsTimeout is how long BalloonStats waits for the guest.
+const balloonStatsTimeout = time.Second
+
+// ErrNoMemHotplug indicates a memory resize of a machine without a
+// virtio-mem device.
+var ErrNoMemHotplug = fmt.Errorf("no virtio-mem device")
+
+// ErrMemTarget indicates a memory size target below the boot memory
+// size.
+var ErrMemTarget = fmt.Errorf("memory size target below the boot memory size")
+
+// ErrNoMemSlots indicates a virtio-mem region with more blocks than KVM
+// has memory slots left for.
+var ErrNoMemSlots = fmt.Errorf("not enough KVM memory slots")
+
+// memHotplugAlign aligns the hotpluggable region of the virtio-mem
+// device, so that huge pages of any size fit in it.
+const memHotplugAlign = 1 << 30
+
+var errPTNoteHasNoFSize = fmt.Errorf("elf programm PT_NOTE has file size equel zero")
+
+type Machine struct {
+	// kvm is the KVM device, whose fd is kvmFd.
+	kvm         *os.File
+	kvmFd, vmFd uintptr
+
+	// vcpuFds and runs have room for every possible vCPU, of which
+	// the first nCPUs are created, see AddCPU.
+	vcpuFds []uintptr
+	nCPUs   atomic.Int32
+	cpuMu   sync.Mutex
+
+	// topo places the vCPUs in sockets, cores and threads, which
+	// gives their APIC IDs. nodes are the NUMA nodes, if any.
+	topo  cpuidpkg.Topology
+	nodes []NUMANode
+
+	mem            []byte
+	guestMem       *memory.GuestMemory
+	runs           []*kvm.RunData
+	pci            *pci.PCI
+	serials        [len(serial.Ports)]serialPort
+	devices        []iodev.Device
+	ioportHandlers [0x10000][2]func(port uint64, bytes []byte) error
+	rs             runState
+	cpuidTweaks    []cpuidpkg.Tweak
+	cpuModel       cpuidpkg.Model
+	balloon        *virtio.Balloon
+
+	// ged signals the events of an ACPI guest, see PowerButton, and
+	// cpuHotplug tells it about the vCPUs added by AddCPU, if the
+	// machine can have more vCPUs than it boots with.
+	ged        *iodev.GED
+	cpuHotplug *iodev.CPUHotplug
+
+	// memDev is the virtio-mem device, if any. Its region, mapped at
+	// memDevRAM on the host, starts at memDevAddr, and its blocks take
+	// the KVM memory slots from memDevSlot on.
+	memDev     *virtio.Mem
+	memDevRAM  []byte
+	memDevAddr uint64
+	memDevSlot uint32
+
+	// backing is how RAM is backed, which the region of the virtio-mem
+	// device follows.
+	backing memory.Backing
+
+	// queueSize is the size of the queues of the virtio devices added
+	// from now on, or 0 for virtio.QueueSize.
+	queueSize uint16
+
+	// vcpuSched has the policies of the host threads of the vCPUs, and
+	// ioSched the one of the IO threads of the devices added from now
+	// on, see SetVCPUSched and SetIOSched.
+	vcpuSched map[int]sched.Policy
+	ioSched   sched.Policy
+
+	// ioThreads counts the IO threads of the devices running, see goIO.
+	ioThreads sync.WaitGroup
+
+	// serialMu guards the IRQ levels of the serial ports, which drive
+	// the IRQ lines they share.
+	serialMu sync.Mutex
+
+	// traceOut receives the instructions traced by Start when
+	// traceCount > 0, see VCPU.
+	traceOut   io.Writer
+	traceCount int
+}
+
+// NUMANode is a NUMA node of the guest, with the vCPUs numbered CPUs and
+// Size bytes of memory. The memory of the nodes follows in their order
+// from address 0, the memory of each being bound to the host NUMA nodes
+// HostNodes, if any.
+type NUMANode struct {
+	CPUs      []int
+	Size      int
+	HostNodes []int
+}
+
+// serialPort is one of COM1 to COM4. COM1 is always present, the others
+// only once they were set with SetSerial.
+type serialPort struct {
+	uart    *serial.Serial
+	enabled bool
+	level   bool
+
+	// in is fed to the UART by Start and may be nil. A nil out
+	// keeps the guest output on stdout.
+	in  io.Reader
+	out io.Writer
+}
+
+// New creates a new KVM. This includes opening the kvm device, creating VM, creating
+// vCPUs, and attaching memory, disk (if needed), and tap (if needed).
+func New(kvmPath string, nCpus int, memSize int) (*Machine, error) {
+	return NewBacked(kvmPath, nCpus, memSize, memory.Backing{})
+}
+
+// NewBacked is New with RAM backed as b says, see memory.Alloc.
+func NewBacked(kvmPath string, nCpus int, memSize int, b memory.Backing) (*Machine, error) {
+	return newMachine(kvmPath, nCpus, memSize, b, cpuidpkg.Topology{}, nil)
+}
+
+// newMachine is NewBacked with the vCPUs laid out as topo says, which
+// then sets how many vCPUs the machine can have, and with NUMA nodes.
+func newMachine(
+	kvmPath string, nCpus, memSize int, b memory.Backing, topo cpuidpkg.Topology, nodes []NUMANode,
+) (_ *Machine, err error) {
+	if memSize < MinMemSize {
+		return nil, fmt.Errorf("memory size %d:%w", memSize, ErrMemTooSmall)
+	}
+
+	if n := topo.CPUs(); n != 0 && (n < nCpus || topo.APICID(n-1) >= MaxCPUs) {
+		return nil, fmt.Errorf("%d vCPUs in %+v:%w", nCpus, topo, ErrBadCPU)
+	}
+
+	binds, err := numaBinds(nodes, memSize)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Machine{topo: topo, nodes: nodes, backing: b}
+
+	b.Binds = append(append([]memory.Bind{}, b.Binds...), binds...)
+	m.cpuModel, _ = cpuidpkg.ParseModel(cpuidpkg.DefaultModel)
+
+	m.pci = pci.New(pci.NewBridge())
+
+	defer func() {
+		if err != nil {
+			m.Close()
+		}
+	}()
+
+	if err := m.initVMandVCPU(kvmPath, nCpus); err != nil {
+		return nil, err
+	}
+
+	m.nCPUs.Store(int32(nCpus))
+	m.initRunState()
+
+	// initCPUIDs here manually
+	for cpuNr := range m.runs {
+		if err := m.initCPUID(cpuNr); err != nil {
+			return nil, err
+		}
+	}
+
+	if n := topo.CPUs(); n > nCpus {
+		if err := m.SetMaxCPUs(n); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.mem, err = memory.Alloc(memSize, b); err != nil {
+		return nil, err
+	}
+
+	// RAM goes around the PCI hole, a KVM slot for each region.
+	if m.guestMem, err = memory.New(memory.Layout(m.mem)...); err != nil {
+		return nil, err
+	}
+
+	for i, r := range m.guestMem.Regions() {
+		err = kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
+			Slot: uint32(i), Flags: 0, GuestPhysAddr: r.GPA, MemorySize: uint64(len(r.Data)),
+			UserspaceAddr: uint64(uintptr(unsafe.Pointer(&r.Data[0]))),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Poison memory.
+	// 0 is valid instruction and if you start running in the middle of all those
+	// 0's it is impossible to diagnore.
+	for i := highMemBase; i < len(m.mem); i += len(Poison) {
+		copy(m.mem[i:], Poison)
+	}
+
+	return m, nil
+}
+
+// Close releases what the machine holds on the host. It closes the
+// devices, which stops their IO threads, and once those have returned it
+// closes the vCPUs and the VM, and unmaps the memory of the guest. The
+// machine must not run, Start having returned if it was called, and is
+// not to be used afterwards.
+func (m *Machine) Close() error {
+	var errs []error
+
+	for _, d := range m.pci.Devices {
+		if c, ok := d.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+
+	m.ioThreads.Wait()
+
+	if m.kvm == nil {
+		return errors.Join(errs...)
+	}
+
+	mmapSize, err := kvm.GetVCPUMMmapSize(m.kvmFd)
+	errs = append(errs, err)
+
+	for cpu, run := range m.runs {
+		if run != nil && err == nil {
+			errs = append(errs, closeVCPU(m.vcpuFds[cpu], run, mmapSize))
+		}
+	}
+
+	if m.vmFd != 0 {
+		errs = append(errs, syscall.Close(int(m.vmFd)))
+	}
+
+	errs = append(errs, m.kvm.Close())
+
+	for _, mem := range [][]byte{m.mem, m.memDevRAM} {
+		if mem != nil {
+			errs = append(errs, memory.Free(mem))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// numaBinds checks that nodes share memSize bytes of memory and vCPUs,
+// and returns where their memory is bound on the host.
+func numaBinds(nodes []NUMANode, memSize int) ([]memory.Bind, error) {
+	var (
+		binds []memory.Bind
+		off   int
+		cpus  = map[int]bool{}
+	)
+
+	for i, n := range nodes {
+		if n.Size <= 0 || n.Size%numaAlign != 0 {
+			return nil, fmt.Errorf("node %d of %#x bytes, not a multiple of %#x:%w", i, n.Size, numaAlign, ErrBadNUMA)
+		}
+
+		for _, cpu := range n.CPUs {
+			if cpu < 0 || cpus[cpu] {
+				return nil, fmt.Errorf("vCPU %d in node %d:%w", cpu, i, ErrBadNUMA)
+			}
+
+			cpus[cpu] = true
+		}
+
+		if len(n.HostNodes) > 0 {
+			binds = append(binds, memory.Bind{Offset: off, Size: n.Size, Nodes: n.HostNodes})
+		}
+
+		off += n.Size
+	}
+
+	if len(nodes) > 0 && off != memSize {
+		return nil, fmt.Errorf("nodes of %#x bytes of memory, want %#x:%w", off, memSize, ErrBadNUMA)
+	}
+
+	return binds, nil
+}
+
+// nextVirtioResources returns the IO port base and the IRQ for the
+// next virtio device. Slot 0 is used by the host bridge.
+func (m *Machine) nextVirtioResources() (uint64, uint8, error) {
+	if len(m.pci.Devices) >= maxPCIDevices {
+		return 0, 0, ErrTooManyDevices
+	}
+
+	i := len(m.pci.Devices) - 1
+
+	return virtioIOPortStart + uint64(i)*virtioIOPortSize, virtioIRQs[i%len(virtioIRQs)], nil
+}
+
+// SetQueueSize sets the size of the queues of the virtio devices added
+// from now on, see virtio.CheckQueueSize.
+func (m *Machine) SetQueueSize(size uint16) error {
+	if err := virtio.CheckQueueSize(size); err != nil {
+		return err
+	}
+
+	m.queueSize = size
+
+	return nil
+}
+
+// sizeQueues gives the queues of the virtio device v the size set by
+// SetQueueSize, if any.
+func (m *Machine) sizeQueues(v interface{ SetQueueSize(uint16) error }) error {
+	if m.queueSize == 0 {
+		return nil
+	}
+
+	return v.SetQueueSize(m.queueSize)
+}
+
+// SetIOSched runs the IO threads of the devices added from now on, and
+// the threads those start to serve requests and connections, on host
+// threads of their own following p, instead of goroutines.
+func (m *Machine) SetIOSched(p sched.Policy) error {
+	if err := p.Check(); err != nil {
+		return err
+	}
+
+	m.ioSched = p
+
+	return nil
+}
+
+// goIO starts f, the IO thread of a device, as set by SetIOSched.
+func (m *Machine) goIO(f func()) error {
+	m.ioThreads.Add(1)
+
+	err := sched.Go(m.ioSched, func() {
+		defer m.ioThreads.Done()
+
+		f()
+	})
+	if err != nil {
+		m.ioThreads.Done()
+	}
+
+	return err
+}
+
+// virtioDevice is a virtio device, whose Close stops its IO threads.
+type virtioDevice interface {
+	pci.Device
+	io.Closer
+	SetQueueSize(uint16) error
+}
+
+// plug sizes the queues of v, starts its IO threads and puts it on the
+// PCI bus. The threads v starts on its own, if any, follow the policy
+// of its IO threads. v is closed if that fails.
+func (m *Machine) plug(v virtioDevice, threads ...func()) error {
+	if s, ok := v.(interface{ SetIOSched(sched.Policy) }); ok {
+		s.SetIOSched(m.ioSched)
+	}
+
+	err := m.sizeQueues(v)
+
+	for _, f := range threads {
+		if err == nil {
+			err = m.goIO(f)
+		}
+	}
+
+	if err != nil {
+		v.Close()
+
+		return err
+	}
+
+	m.pci.Devices = append(m.pci.Devices, v)
+
+	return nil
+}
+
+// AddTapIf adds a virtio net device connected to the tap interface tapIfName.
+func (m *Machine) AddTapIf(tapIfName string) error {
+	return m.AddNIC(tapIfName, nil)
+}
+
+// AddNIC adds a virtio net device connected to the tap interface tapIfName.
+// If mac is nil, the guest chooses a random MAC address.
+func (m *Machine) AddNIC(tapIfName string, mac net.HardwareAddr) error {
+	ioport, irq, err := m.nextVirtioResources()
+	if err != nil {
+		return err
+	}
+
+	t, err := tap.New(tapIfName)
+	if err != nil {
+		return err
+	}
+
+	v := virtio.NewNet(ioport, irq, m, t, mac, m.guestMem)
+	return m.plug(v, v.TxThreadEntry, v.RxThreadEntry)
+}
+
+// AddDisk adds a virtio block device backed by the file at diskPath,
+// used in mode.
+func (m *Machine) AddDisk(diskPath string, mode virtio.DiskMode) error {
+	ioport, irq, err := m.nextVirtioResources()
+	if err != nil {
+		return err
+	}
+
+	v, err := virtio.NewBlk(diskPath, mode, ioport, irq, m, m.guestMem)
+	if err != nil {
+		return err
+	}
+
+	return m.plug(v, v.IOThreadEntry)
+}
+
+// AddSCSI adds a virtio SCSI controller with the given LUNs, numbered
+// in order.
+func (m *Machine) AddSCSI(luns []virtio.SCSILUN) error {
+	ioport, irq, err := m.nextVirtioResources()
+	if err != nil {
+		return err
+	}
+
+	v, err := virtio.NewSCSI(luns, ioport, irq, m, m.guestMem)
+	if err != nil {
+		return err
+	}
+
+	return m.plug(v, v.IOThreadEntry)
+}
+
+// AddConsole adds a virtio console device with the given ports.
+func (m *Machine) AddConsole(ports []virtio.ConsolePort) error {
+	ioport, irq, err := m.nextVirtioResources()
+	if err != nil {
+		return err
+	}
+
+	v, err := virtio.NewConsole(ioport, irq, m, ports, m.guestMem)
+	if err != nil {
+		return err
+	}
+
+	return m.plug(v, v.IOThreadEntry)
+}
+
+// AddVsock adds a virtio socket device for the guest at cid, whose host
+// side is served by unix sockets at udsPath, see virtio.Vsock.
+func (m *Machine) AddVsock(cid uint64, udsPath string) error {
+	ioport, irq, err := m.nextVirtioResources()
+	if err != nil {
+		return err
+	}
+
+	v, err := virtio.NewVsock(ioport, irq, m, cid, udsPath, m.guestMem)
+	if err != nil {
+		return err
+	}
+
+	return m.plug(v, v.IOThreadEntry)
+}
+
+// AddRng adds a virtio entropy device reading the file at source, or
+// crypto/rand if source is empty.
+func (m *Machine) AddRng(source string) error {
+	ioport, irq, err := m.nextVirtioResources()
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = rand.Reader
+
+	if source != "" {
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+
+		r = f
+	}
+
+	v := virtio.NewRng(ioport, irq, m, r, m.guestMem)
+
+	return m.plug(v, v.IOThreadEntry)
+}
+
+// AddShare adds a virtio 9p device, which serves the host directory
+// at path to the guest as tag, see virtio.P9.
+func (m *Machine) AddShare(tag, path string, readOnly bool) error {
+	ioport, irq, err := m.nextVirtioResources()
+	if err != nil {
+		return err
+	}
+
+	v, err := virtio.NewP9(ioport, irq, m, tag, path, readOnly, m.guestMem)
+	if err != nil {
+		return err
+	}
+
+	return m.plug(v, v.IOThreadEntry)
+}
+
+// AddBalloon adds a virtio memory balloon device, which can take back
+// memory of the guest at runtime, see SetBalloonTarget.
+func (m *Machine) AddBalloon() error {
+	ioport, irq, err := m.nextVirtioResources()
+	if err != nil {
+		return err
+	}
+
+	v := virtio.NewBalloon(ioport, irq, m, m.guestMem)
+
+	if err := m.plug(v, v.IOThreadEntry); err != nil {
+		return err
+	}
+
+	m.balloon = v
+
+	return nil
+}
+
+// SetBalloonTarget asks the guest to shrink or grow its memory to size
+// bytes, by inflating or deflating the balloon.
+func (m *Machine) SetBalloonTarget(size uint64) error {
+	if m.balloon == nil {
+		return ErrNoBalloon
+	}
+
+	if size > uint64(len(m.mem)) {
+		return fmt.Errorf("%d > %d: %w", size, len(m.mem), ErrBalloonTarget)
+	}
+
+	return m.balloon.Resize(uint32((uint64(len(m.mem)) - size) / virtio.BalloonPageSize))
+}
+
+// QueryBalloon returns the memory size of the guest in bytes, less
+// what is in the balloon.
+func (m *Machine) QueryBalloon() (uint64, error) {
+	if m.balloon == nil {
+		return 0, ErrNoBalloon
+	}
+
+	return uint64(len(m.mem)) - uint64(m.balloon.Actual())*virtio.BalloonPageSize, nil
+}
+
+// BalloonStats returns the memory statistics of the guest and when
+// they were received, see virtio.Balloon.Stats.
+func (m *Machine) BalloonStats() (map[string]uint64, time.Time, error) {
+	if m.balloon == nil {
+		return nil, time.Time{}, ErrNoBalloon
+	}
+
+	return m.balloon.Stats(balloonStatsTimeout)
+}
+
+// AddMemHotplug adds a virtio-mem device with a region of size bytes
+// above RAM, which the guest plugs at runtime, see ResizeMemory. The
+// region is backed like RAM, in a file of its own next to the one of RAM
+// if any, and each of its blocks takes a KVM memory slot.
+func (m *Machine) AddMemHotplug(size uint64) error {
+	if m.memDev != nil {
+		return fmt.Errorf("a second virtio-mem device: %w", ErrUnsupported)
+	}
+
+	if size == 0 || size%virtio.MemBlockSize != 0 {
+		return fmt.Errorf("%#x bytes: %w", size, virtio.ErrInvalidMemRegion)
+	}
+
+	ioport, irq, err := m.nextVirtioResources()
+	if err != nil {
+		return err
+	}
+
+	rs := m.guestMem.Regions()
+
+	slots, err := kvm.CheckExtension(m.kvmFd, kvm.CapNRMemSlots)
+	if err != nil {
+		return err
+	}
+
+	if blocks := size / virtio.MemBlockSize; uint64(len(rs))+blocks > uint64(slots) {
+		return fmt.Errorf("%d blocks after %d regions, %d slots:%w", blocks, len(rs), slots, ErrNoMemSlots)
+	}
+
+	region, err := memory.Alloc(int(size), m.memHotplugBacking())
+	if err != nil {
+		return err
+	}
+
+	addr := max(rs[len(rs)-1].End(), memory.HighStart)
+
+	m.memDevAddr = (addr + memHotplugAlign - 1) &^ (memHotplugAlign - 1)
+	m.memDevSlot = uint32(len(rs))
+
+	v, err := virtio.NewMem(ioport, irq, m, m, m.memDevAddr, region, m.guestMem)
+	if err != nil {
+		memory.Free(region)
+
+		return err
+	}
+
+	if err := m.plug(v, v.IOThreadEntry); err != nil {
+		memory.Free(region)
+
+		return err
+	}
+
+	m.memDev, m.memDevRAM = v, region
+
+	return nil
+}
+
+// memHotplugBacking returns the backing of the region of the virtio-mem
+// device: that of RAM, without its NUMA bindings, which are offsets in
+// RAM, and in the directory of the file backing RAM rather than in the
+// file itself.
+func (m *Machine) memHotplugBacking() memory.Backing {
+	b := m.backing
+	b.Binds = nil
+
+	if fi, err := os.Stat(b.Path); err == nil && !fi.IsDir() {
+		b.Path = filepath.Dir(b.Path)
+	}
+
+	return b
+}
+
+// PlugMem maps r, a block of the virtio-mem device, into the guest.
+func (m *Machine) PlugMem(r memory.Region) error {
+	err := kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
+		Slot: m.memDevSlot + uint32((r.GPA-m.memDevAddr)/virtio.MemBlockSize), Flags: 0,
+		GuestPhysAddr: r.GPA, MemorySize: uint64(len(r.Data)),
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&r.Data[0]))),
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.guestMem.Add(r)
+}
+
+// UnplugMem unmaps r, a block of the virtio-mem device plugged by
+// PlugMem, from the guest.
+func (m *Machine) UnplugMem(r memory.Region) error {
+	if err := m.guestMem.Remove(r.GPA); err != nil {
+		return err
+	}
+
+	// A size of 0 deletes the slot.
+	return kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
+		Slot: m.memDevSlot + uint32((r.GPA-m.memDevAddr)/virtio.MemBlockSize), Flags: 0,
+		GuestPhysAddr: r.GPA, MemorySize: 0,
+		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&r.Data[0]))),
+	})
+}
+
+// ResizeMemory asks the guest to grow or shrink its memory to size
+// bytes, by plugging or unplugging blocks of the virtio-mem device.
+func (m *Machine) ResizeMemory(size uint64) error {
+	if m.memDev == nil {
+		return ErrNoMemHotplug
+	}
+
+	if size < uint64(len(m.mem)) {
+		return fmt.Errorf("%d < %d: %w", size, len(m.mem), ErrMemTarget)
+	}
+
+	return m.memDev.Resize(size - uint64(len(m.mem)))
+}
+
+// QueryMemory returns the memory size of the guest at boot, and how
+// much it has plugged since then, in bytes.
+func (m *Machine) QueryMemory() (uint64, uint64, error) {
+	if m.memDev == nil {
+		return 0, 0, ErrNoMemHotplug
+	}
+
+	return uint64(len(m.mem)), m.memDev.Plugged(), nil
+}
+
+// Translate translates a virtual address for all active CPUs
+// and returns a []*Translate or error.
+func (m *Machine) Translate(vaddr uint64) ([]*kvm.Translation, error) {
+	t := make([]*kvm.Translation, 0, m.NumCPUs())
+
+	for cpu := 0; cpu < m.NumCPUs(); cpu++ {
+		tr := &kvm.Translation{
+			LinearAddress: vaddr,
+		}
+		if err := kvm.Translate(m.vcpuFds[cpu], tr); err != nil {
+			return t, err
+		}
+
+		t = append(t, tr)
+	}
+
+	return t, nil
+}
+
+// SetupRegs sets up the general purpose registers,
+// including a RIP and BP.
+func (m *Machine) SetupRegs(rip, bp uint64, amd64 bool) error {
+	for _, cpu := range m.vcpuFds[:m.NumCPUs()] {
+		if err := m.initRegs(cpu, rip, bp); err != nil {
+			return err
+		}
+
+		if err := m.initSregs(cpu, amd64); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NumCPUs returns the number of vCPUs of the VM.
+func (m *Machine) NumCPUs() int {
+	return int(m.nCPUs.Load())
+}
+
+// PossibleCPUs returns the number of vCPUs the VM can have, see
+// SetMaxCPUs.
+func (m *Machine) PossibleCPUs() int {
+	return len(m.vcpuFds)
+}
+
+// Topology returns where the vCPUs are in sockets, cores and threads.
+func (m *Machine) Topology() cpuidpkg.Topology {
+	return m.topo
+}
+
+// apicIDs returns the APIC IDs of the first n vCPUs.
+func (m *Machine) apicIDs(n int) []uint8 {
+	ids := make([]uint8, n)
+	for i := range ids {
+		ids[i] = uint8(m.topo.APICID(i))
+	}
+
+	return ids
+}
+
+// SetMaxCPUs lets the VM have up to n vCPUs, the ones beyond NumCPUs
+// being added at runtime by AddCPU. It must be called before a kernel
+// is loaded. The machine then describes its vCPUs with ACPI, which the
+// guest must not turn off with noacpi to see the added ones. A machine
+// with a topology can only have the vCPUs of the topology.
+func (m *Machine) SetMaxCPUs(n int) error {
+	if n < m.NumCPUs() || n > MaxCPUs {
+		return fmt.Errorf("%d possible vCPUs, out of range %d-%d:%w", n, m.NumCPUs(), MaxCPUs, ErrBadCPU)
+	}
+
+	if c := m.topo.CPUs(); c != 0 && n != c {
+		return fmt.Errorf("%d possible vCPUs, the topology has %d:%w", n, c, ErrBadCPU)
+	}
+
+	m.vcpuFds = append(m.vcpuFds[:m.NumCPUs():m.NumCPUs()], make([]uintptr, n-m.NumCPUs())...)
+	m.runs = append(m.runs[:m.NumCPUs():m.NumCPUs()], make([]*kvm.RunData, n-m.NumCPUs())...)
+	m.rs.tids = make([]int, n)
+
+	return nil
+}
+
+// SetVCPUSched makes the host thread running cpu follow p. It must be
+// called before Start.
+func (m *Machine) SetVCPUSched(cpu int, p sched.Policy) error {
+	if cpu < 0 || cpu >= m.PossibleCPUs() {
+		return fmt.Errorf("vCPU %d of %d:%w", cpu, m.PossibleCPUs(), ErrBadCPU)
+	}
+
+	if err := p.Check(); err != nil {
+		return err
+	}
+
+	if m.vcpuSched == nil {
+		m.vcpuSched = make(map[int]sched.Policy)
+	}
+
+	m.vcpuSched[cpu] = p
+
+	return nil
+}
+
+// AddCPU creates the next vCPU and returns its number. Once the machine
+// is started, the vCPU runs right away, waiting for the guest to bring
+// it up, and the guest is told about it.
+func (m *Machine) AddCPU() (int, error) {
+	m.cpuMu.Lock()
+	defer m.cpuMu.Unlock()
+
+	return m.addCPU()
+}
+
+// AddCPUAt creates the vCPU cpu like AddCPU, provided it is the next one,
+// so that a caller which checked where the next vCPU goes does not add
+// another one instead. It fails with ErrBadCPU otherwise.
+func (m *Machine) AddCPUAt(cpu int) error {
+	m.cpuMu.Lock()
+	defer m.cpuMu.Unlock()
+
+	if next := m.NumCPUs(); cpu != next {
+		return fmt.Errorf("vCPU %d, the next one is %d: %w", cpu, next, ErrBadCPU)
+	}
+
+	_, err := m.addCPU()
+
+	return err
+}
+
+// addCPU adds the next vCPU, see AddCPU. A vCPU which fails to set up is
+// kept for the next call to try again, as KVM does not free the ID of
+// a vCPU before the VM is closed.
+func (m *Machine) addCPU() (int, error) {
+	cpu := m.NumCPUs()
+	if cpu >= m.PossibleCPUs() {
+		return 0, fmt.Errorf("%d vCPUs: %w", cpu, ErrMaxCPUs)
+	}
+
+	if m.runs[cpu] == nil {
+		mmapSize, err := kvm.GetVCPUMMmapSize(m.kvmFd)
+		if err != nil {
+			return 0, err
+		}
+
+		if m.vcpuFds[cpu], m.runs[cpu], err = createVCPU(m.vmFd, mmapSize, int(m.topo.APICID(cpu))); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := m.initCPUID(cpu); err != nil {
+		return 0, err
+	}
+
+	if m.traceCount > 0 {
+		if err := kvm.SingleStep(m.vcpuFds[cpu], true); err != nil {
+			return 0, fmt.Errorf("single step %d:%w", cpu, err)
+		}
+	}
+
+	m.rs.mu.Lock()
+	m.nCPUs.Store(int32(cpu + 1))
+	m.rs.startCPU(cpu)
+	m.rs.mu.Unlock()
+
+	if m.cpuHotplug == nil {
+		return cpu, nil
+	}
+
+	m.cpuHotplug.Plug(cpu)
+
+	return cpu, m.ged.Notify(iodev.GEDCPUHotplug)
+}
 
-var ErrNotELF64File = fmt.Errorf("file is not ELF64")
+// PowerButton presses the ACPI power button, which asks the guest to
+// power off, and to enter S5 once it is done. It fails with ErrNotLoaded
+// before the ACPI tables are written by loading a kernel.
+func (m *Machine) PowerButton() error {
+	if m.ged == nil {
+		return ErrNotLoaded
+	}
 
-var errPTNoteHasNoFSize = fmt.Errorf("elf programm PT_NOTE has file size equel zero")
+	return m.ged.Notify(iodev.GEDPowerButton)
+}
 
-type Machine struct {
-	kvmFd, vmFd    uintptr
-	vcpuFds        []uintptr
-	mem            []byte
-	runs           []*kvm.RunData
-	pci            *pci.PCI
-	serial         *serial.Serial
-	devices        []iodev.Device
-	ioportHandlers [0x10000][2]func(port uint64, bytes []byte) error
+// RunData returns the kvm.RunData for the VM.
+func (m *Machine) RunData() []*kvm.RunData {
+	return m.runs[:m.NumCPUs()]
 }
 
-// New creates a new KVM. This includes opening the kvm device, creating VM, creating
-// vCPUs, and attaching memory, disk (if needed), and tap (if needed).
-func New(kvmPath string, nCpus int, memSize int) (*Machine, error) {
-	if memSize < MinMemSize {
-		return nil, fmt.Errorf("memory size %d:%w", memSize, ErrMemTooSmall)
+// setupACPI writes the ACPI tables of the machine, and adds the devices
+// they describe: the sleep control register, the GED and its power
+// button, and the CPU hotplug device if the machine can have more vCPUs
+// than it boots with. Its MADT has the vCPUs created so far enabled, and
+// the others online capable. NUMA machines get an SRAT and a SLIT.
+func (m *Machine) setupACPI() error {
+	m.AddDevice(&iodev.ACPIShutDown{Poweroff: func() { m.Shutdown(ExitPoweroff) }})
+
+	hotplug := m.PossibleCPUs() > m.NumCPUs()
+
+	cpus := make([]acpi.LocalAPIC, m.PossibleCPUs())
+	for i, id := range m.apicIDs(len(cpus)) {
+		cpus[i] = acpi.LocalAPIC{
+			UID: uint8(i), APICID: id,
+			Enabled: i < m.NumCPUs(), OnlineCapable: i >= m.NumCPUs(),
+		}
 	}
 
-	m := &Machine{}
+	m.ged = iodev.NewGED(m.InjectVirtioIRQ, hotplug)
 
-	m.pci = pci.New(pci.NewBridge())
+	dsdt := aml.Name("_S5", aml.Package(aml.Int(5)))
+	dsdt = append(dsdt, m.ged.AML()...)
 
-	var err error
+	if hotplug {
+		m.cpuHotplug = iodev.NewCPUHotplug(cpus)
 
-	m.kvmFd, m.vmFd, m.vcpuFds, m.runs, err = initVMandVCPU(kvmPath, nCpus)
-	if err != nil {
-		return nil, err
+		dsdt = append(dsdt, m.cpuHotplug.AML()...)
 	}
 
-	// initCPUIDs here manually
-	for cpuNr := range m.runs {
-		if err := m.initCPUID(cpuNr); err != nil {
-			return nil, err
+	var tables [][]byte
+
+	if len(m.nodes) > 0 {
+		srat, err := m.srat(cpus)
+		if err != nil {
+			return err
 		}
-	}
 
-	// Another coding anti-pattern reguired by golangci-lint.
-	// Would not pass review in Google.
-	if m.mem, err = syscall.Mmap(-1, 0, memSize,
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_SHARED|syscall.MAP_ANONYMOUS); err != nil {
-		return m, err
+		tables = append(tables, srat, m.slit())
 	}
 
-	err = kvm.SetUserMemoryRegion(m.vmFd, &kvm.UserspaceMemoryRegion{
-		Slot: 0, Flags: 0, GuestPhysAddr: 0, MemorySize: uint64(memSize),
-		UserspaceAddr: uint64(uintptr(unsafe.Pointer(&m.mem[0]))),
-	})
+	b, err := acpi.Build(acpiAddr, acpiSize, dsdt, cpus, tables...)
 	if err != nil {
-		return m, err
+		return err
 	}
 
-	// Poison memory.
-	// 0 is valid instruction and if you start running in the middle of all those
-	// 0's it is impossible to diagnore.
-	for i := highMemBase; i < len(m.mem); i += len(Poison) {
-		copy(m.mem[i:], Poison)
-	}
+	copy(m.mem[acpiAddr:], b)
 
-	return m, nil
-}
+	m.AddDevice(m.ged)
 
-func (m *Machine) AddTapIf(tapIfName string) error {
-	t, err := tap.New(tapIfName)
-	if err != nil {
-		return err
+	if hotplug {
+		m.AddDevice(m.cpuHotplug)
 	}
 
-	v := virtio.NewNet(virtioNetIRQ, m, t, m.mem)
-	go v.TxThreadEntry()
-	go v.RxThreadEntry()
-	// 00:01.0 for Virtio net
-	m.pci.Devices = append(m.pci.Devices, v)
-
 	return nil
 }
 
-func (m *Machine) AddDisk(diskPath string) error {
-	v, err := virtio.NewBlk(diskPath, virtioBlkIRQ, m, m.mem)
-	if err != nil {
-		return err
+// srat places cpus and the memory in the NUMA nodes. vCPUs in no node
+// are in node 0.
+func (m *Machine) srat(cpus []acpi.LocalAPIC) ([]byte, error) {
+	nodeOf := make([]uint32, len(cpus))
+
+	for i, n := range m.nodes {
+		for _, cpu := range n.CPUs {
+			if cpu >= len(cpus) {
+				return nil, fmt.Errorf("vCPU %d in node %d of %d vCPUs:%w", cpu, i, len(cpus), ErrBadNUMA)
+			}
+
+			nodeOf[cpu] = uint32(i)
+		}
 	}
 
-	go v.IOThreadEntry()
-	// 00:02.0 for Virtio blk
-	m.pci.Devices = append(m.pci.Devices, v)
+	affinities := make([]acpi.CPUAffinity, len(cpus))
+	for i, c := range cpus {
+		affinities[i] = acpi.CPUAffinity{Node: nodeOf[i], APICID: c.APICID}
+	}
 
-	return nil
-}
+	// The memory of a node may be split by the PCI hole.
+	var (
+		mem []acpi.MemAffinity
+		off int
+	)
 
-// Translate translates a virtual address for all active CPUs
-// and returns a []*Translate or error.
-func (m *Machine) Translate(vaddr uint64) ([]*kvm.Translation, error) {
-	t := make([]*kvm.Translation, 0, len(m.vcpuFds))
+	for i, n := range m.nodes {
+		regionOff := 0
 
-	for cpu := range m.vcpuFds {
-		tr := &kvm.Translation{
-			LinearAddress: vaddr,
-		}
-		if err := kvm.Translate(m.vcpuFds[cpu], tr); err != nil {
-			return t, err
+		for _, r := range memory.Layout(m.mem) {
+			start, end := max(off, regionOff), min(off+n.Size, regionOff+len(r.Data))
+			if start < end {
+				mem = append(mem, acpi.MemAffinity{
+					Node: uint32(i), Base: r.GPA + uint64(start-regionOff), Size: uint64(end - start),
+				})
+			}
+
+			regionOff += len(r.Data)
 		}
 
-		t = append(t, tr)
+		off += n.Size
 	}
 
-	return t, nil
+	return acpi.SRAT(affinities, mem), nil
 }
 
-// SetupRegs sets up the general purpose registers,
-// including a RIP and BP.
-func (m *Machine) SetupRegs(rip, bp uint64, amd64 bool) error {
-	for _, cpu := range m.vcpuFds {
-		if err := m.initRegs(cpu, rip, bp); err != nil {
-			return err
-		}
+// slit returns the distances between the NUMA nodes, which are all
+// equally far from each other.
+func (m *Machine) slit() []byte {
+	dist := make([][]uint8, len(m.nodes))
 
-		if err := m.initSregs(cpu, amd64); err != nil {
-			return err
+	for i := range dist {
+		dist[i] = make([]uint8, len(m.nodes))
+
+		for j := range dist[i] {
+			dist[i][j] = numaRemote
 		}
-	}
 
-	return nil
-}
+		dist[i][i] = numaLocal
+	}
 
-// RunData returns the kvm.RunData for the VM.
-func (m *Machine) RunData() []*kvm.RunData {
-	return m.runs
+	return acpi.SLIT(dist)
 }
 
 func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
@@ -273,7 +1205,7 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 	copy(m.mem[pvh.EBDAPointer:], edbabytes)
 
 	// Create EBDA/mptables - Required for booting into Linux with PVH.
-	e, err := ebda.New(len(m.vcpuFds))
+	e, err := ebda.NewAPICIDs(m.apicIDs(m.NumCPUs()))
 	if err != nil {
 		return err
 	}
@@ -326,7 +1258,7 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 		continue
 	}
 
-	for _, cpu := range m.vcpuFds {
+	for _, cpu := range m.vcpuFds[:m.NumCPUs()] {
 		if err := pvh.InitRegs(cpu, ripAddr); err != nil {
 			return err
 		}
@@ -336,7 +1268,11 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 		}
 	}
 
-	pvhstartinfo := pvh.NewStartInfo(bootparam.EBDAStart, cmdlineAddr)
+	if err := m.setupACPI(); err != nil {
+		return err
+	}
+
+	pvhstartinfo := pvh.NewStartInfo(acpiAddr, cmdlineAddr)
 
 	if initrd != nil {
 		initrdSize, err := initrd.ReadAt(m.mem[initrdAddr:], 0)
@@ -372,13 +1308,13 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 		bootparam.E820Ram)
 
 	memmapentries = append(memmapentries, entry0)
+	memmapentries = append(memmapentries, pvh.NewMemMapTableEntry(acpiAddr, acpiSize, bootparam.E820ACPI))
 
-	entry := pvh.NewMemMapTableEntry(
-		pvh.HighRAMStart,
-		uint64(len(m.mem)-pvh.HighRAMStart),
-		bootparam.E820Ram)
+	for _, r := range m.highRAM() {
+		entry := pvh.NewMemMapTableEntry(r.GPA, uint64(len(r.Data)), bootparam.E820Ram)
 
-	memmapentries = append(memmapentries, entry)
+		memmapentries = append(memmapentries, entry)
+	}
 
 	pvhstartinfo.MemMapEntries = uint32(len(memmapentries))
 
@@ -404,18 +1340,61 @@ func (m *Machine) LoadPVH(kern, initrd *os.File, cmdline string) error {
 
 	copy(m.mem[pvh.PVHInfoStart:], pvhstartinfob)
 
-	if m.serial, err = serial.New(m); err != nil {
+	if err = m.initSerial(); err != nil {
 		return err
 	}
 
 	m.AddDevice(&iodev.FWDebug{}) // Port 0x402
-	m.AddDevice(iodev.NewCMOS(0xC000000, 0x0))
+	m.AddDevice(iodev.NewCMOS(m.guestMem.Split()))
 	m.AddDevice(iodev.NewACPIPMTimer())
 	m.initIOPortHandlers()
 
 	return nil
 }
 
+// highRAM returns the RAM from highMemBase on, as the memory maps given
+// to the guest describe the first MiB apart.
+func (m *Machine) highRAM() []memory.Region {
+	rs := append([]memory.Region{}, m.guestMem.Regions()...)
+	rs[0] = memory.Region{GPA: highMemBase, Data: rs[0].Data[highMemBase:]}
+
+	return rs
+}
+
+// LoadKernel loads the kernel or firmware image at kernel, which may be
+// a PVH ELF, a vmlinux or a bzImage, with an optional initrd and params.
+func (m *Machine) LoadKernel(kernel, initrd, params string) error {
+	kern, err := os.Open(kernel)
+	if err != nil {
+		return err
+	}
+	defer kern.Close()
+
+	isPVH, err := pvh.CheckPVH(kern)
+	if err != nil {
+		return err
+	}
+
+	var initrdFile *os.File
+
+	if initrd != "" {
+		if initrdFile, err = os.Open(initrd); err != nil {
+			return err
+		}
+		defer initrdFile.Close()
+	}
+
+	if isPVH {
+		return m.LoadPVH(kern, initrdFile, params)
+	}
+
+	if initrdFile == nil {
+		return m.LoadLinux(kern, nil, params)
+	}
+
+	return m.LoadLinux(kern, initrdFile, params)
+}
+
 // LoadLinux loads a bzImage or ELF file, an optional initrd, and
 // optional params.
 func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
@@ -424,11 +1403,15 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 		err               error
 	)
 
-	e, err := ebda.New(len(m.vcpuFds))
+	e, err := ebda.NewAPICIDs(m.apicIDs(m.NumCPUs()))
 	if err != nil {
 		return err
 	}
 
+	if err := m.setupACPI(); err != nil {
+		return err
+	}
+
 	bytes, err := e.Bytes()
 	if err != nil {
 		return err
@@ -485,11 +1468,12 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 		bootparam.MBBIOSEnd-bootparam.MBBIOSBegin,
 		bootparam.E820Reserved,
 	)
-	bootParam.AddE820Entry(
-		highMemBase,
-		uint64(len(m.mem)-highMemBase),
-		bootparam.E820Ram,
-	)
+
+	bootParam.AddE820Entry(acpiAddr, acpiSize, bootparam.E820ACPI)
+
+	for _, r := range m.highRAM() {
+		bootParam.AddE820Entry(r.GPA, uint64(len(r.Data)), bootparam.E820Ram)
+	}
 
 	bootParam.Hdr.VidMode = 0xFFFF                                                                  // Proto ALL
 	bootParam.Hdr.TypeOfLoader = 0xFF                                                               // Proto 2.00+
@@ -561,11 +1545,11 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 		return err
 	}
 
-	if m.serial, err = serial.New(m); err != nil {
+	if err = m.initSerial(); err != nil {
 		return err
 	}
 
-	m.AddDevice(iodev.NewCMOS(0xC000_0000, 0x0))
+	m.AddDevice(iodev.NewCMOS(m.guestMem.Split()))
 	m.AddDevice(&iodev.Noop{Port: 0x80, Psize: 0xA0})
 	m.initIOPortHandlers()
 
@@ -574,7 +1558,7 @@ func (m *Machine) LoadLinux(kernel, initrd io.ReaderAt, params string) error {
 
 // GetInputChan returns a chan <- byte for serial.
 func (m *Machine) GetInputChan() chan<- byte {
-	return m.serial.GetInputChan()
+	return m.serials[0].uart.GetInputChan()
 }
 
 // GetRegs gets regs for vCPU.
@@ -762,6 +1746,10 @@ func (m *Machine) initCPUID(cpu int) error {
 		return err
 	}
 
+	if err := m.cpuModel.Apply(&cpuid); err != nil {
+		return fmt.Errorf("CPU model %s: %w", m.cpuModel, err)
+	}
+
 	// https://www.kernel.org/doc/html/latest/virt/kvm/cpuid.html
 	for i := 0; i < int(cpuid.Nent); i++ {
 		switch cpuid.Entries[i].Function {
@@ -774,15 +1762,17 @@ func (m *Machine) initCPUID(cpu int) error {
 			cpuid.Entries[i].Ecx = 0x564b4d56 // VMKV
 			cpuid.Entries[i].Edx = 0x4d       // M
 
-		case 7:
-			// Unset X86_FEATURE_FSRM (Fast Short Rep Mov)
-			cpuid.Entries[i].Edx &= ^(uint32(1) << 4)
-
 		default:
 			continue
 		}
 	}
 
+	m.topo.Apply(&cpuid, cpu)
+
+	if err := cpuidpkg.Apply(&cpuid, m.cpuidTweaks); err != nil {
+		return err
+	}
+
 	if err := kvm.SetCPUID2(m.vcpuFds[cpu], &cpuid); err != nil {
 		return err
 	}
@@ -790,9 +1780,41 @@ func (m *Machine) initCPUID(cpu int) error {
 	return nil
 }
 
+// SetCPUIDTweaks applies tweaks on top of the CPUID leaves of every vCPU.
+// It must be called before the vCPUs run for the first time.
+func (m *Machine) SetCPUIDTweaks(tweaks []cpuidpkg.Tweak) error {
+	m.cpuidTweaks = tweaks
+
+	for cpuNr := 0; cpuNr < m.NumCPUs(); cpuNr++ {
+		if err := m.initCPUID(cpuNr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetCPUModel sets the CPU model of every vCPU, cpuid.DefaultModel by
+// default. It must be called before the vCPUs run for the first time.
+func (m *Machine) SetCPUModel(model cpuidpkg.Model) error {
+	if err := model.Validate(); err != nil {
+		return err
+	}
+
+	m.cpuModel = model
+
+	for cpuNr := 0; cpuNr < m.NumCPUs(); cpuNr++ {
+		if err := m.initCPUID(cpuNr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // SingleStep enables single stepping the guest.
 func (m *Machine) SingleStep(onoff bool) error {
-	for cpu := range m.vcpuFds {
+	for cpu := 0; cpu < m.NumCPUs(); cpu++ {
 		if err := kvm.SingleStep(m.vcpuFds[cpu], onoff); err != nil {
 			return fmt.Errorf("single step %d:%w", cpu, err)
 		}
@@ -803,7 +1825,9 @@ func (m *Machine) SingleStep(onoff bool) error {
 
 // RunInfiniteLoop runs the guest cpu until there is an error.
 // If the error is ErrExitDebug, this function can be called again.
-func (m *Machine) RunInfiniteLoop(cpu int) error {
+// While the machine is paused the cpu is parked here, after Stop
+// the loop returns ErrStopped, and once ctx is done its error.
+func (m *Machine) RunInfiniteLoop(ctx context.Context, cpu int) error {
 	// https://www.kernel.org/doc/Documentation/virtual/kvm/api.txt
 	// - vcpu ioctls: These query and set attributes that control the operation
 	//   of a single virtual cpu.
@@ -821,7 +1845,27 @@ func (m *Machine) RunInfiniteLoop(cpu int) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
+	// A thread given a policy by SetVCPUSched is locked once more for
+	// good, so that it exits with the goroutine.
+	if p := m.vcpuSched[cpu]; !p.IsZero() {
+		runtime.LockOSThread()
+
+		if err := p.Apply(); err != nil {
+			return fmt.Errorf("vCPU %d: %w", cpu, err)
+		}
+	}
+
+	m.enterLoop(cpu)
+	defer m.leaveLoop(cpu)
+
+	stop := context.AfterFunc(ctx, func() { m.kickCPU(cpu) })
+	defer stop()
+
 	for {
+		if err := m.waitRunnable(ctx, cpu); err != nil {
+			return err
+		}
+
 		isContinue, err := m.RunOnce(cpu)
 		if isContinue {
 			if err != nil {
@@ -848,8 +1892,8 @@ func (m *Machine) RunOnce(cpu int) (bool, error) {
 	exit := kvm.ExitType(m.runs[cpu].ExitReason)
 
 	switch exit {
-	case kvm.EXITHLT:
-		return false, err
+	case kvm.EXITSHUTDOWN:
+		return false, ErrTripleFault
 	case kvm.EXITIO:
 		direction, size, port, count, offset := m.runs[cpu].IO()
 		f := m.ioportHandlers[port][direction]
@@ -874,6 +1918,8 @@ func (m *Machine) RunOnce(cpu int) (bool, error) {
 	case kvm.EXITDCR,
 		kvm.EXITEXCEPTION,
 		kvm.EXITFAILENTRY,
+		// The in-kernel irqchip handles HLT.
+		kvm.EXITHLT,
 		kvm.EXITHYPERCALL,
 		kvm.EXITINTERNALERROR,
 		kvm.EXITIRQWINDOWOPEN,
@@ -882,7 +1928,6 @@ func (m *Machine) RunOnce(cpu int) (bool, error) {
 		kvm.EXITS390RESET,
 		kvm.EXITS390SIEIC,
 		kvm.EXITSETTPR,
-		kvm.EXITSHUTDOWN,
 		kvm.EXITTPRACCESS:
 		if err != nil {
 			return false, err
@@ -945,6 +1990,10 @@ func (m *Machine) initIOPortHandlers() {
 		return fmt.Errorf("write %#x to cf9: %w", bytes, ErrWriteToCF9)
 	}
 
+	funcOutDebugExit := func(port uint64, bytes []byte) error {
+		return &DebugExitError{Code: int(bytes[0])<<1 | 1}
+	}
+
 	// In ubuntu 20.04 on wsl2, the output to IO port 0x64 continued
 	// infinitely. To deal with this issue, refer to kvmtool and
 	// configure the input to the Status Register of the PS2 controller.
@@ -963,17 +2012,36 @@ func (m *Machine) initIOPortHandlers() {
 	m.registerIOPortHandler(0xcf9, 0xcfa, funcNone, funcOutbCF9) // CF9
 	m.registerIOPortHandler(0x3c0, 0x3db, funcNone, funcNone)    // VGA
 	m.registerIOPortHandler(0x3b4, 0x3b6, funcNone, funcNone)    // VGA
-	m.registerIOPortHandler(0x2f8, 0x300, funcNone, funcNone)    // Serial port 2
-	m.registerIOPortHandler(0x3e8, 0x3f0, funcNone, funcNone)    // Serial port 3
-	m.registerIOPortHandler(0x2e8, 0x2f0, funcNone, funcNone)    // Serial port 4
 	m.registerIOPortHandler(0xcfe, 0xcff, funcNone, funcNone)    // unknown
 	m.registerIOPortHandler(0xcfa, 0xcfc, funcNone, funcNone)    // unknown
 	m.registerIOPortHandler(0xc000, 0xd000, funcNone, funcNone)  // PCI Configuration Space Access Mechanism #2
 	m.registerIOPortHandler(0x60, 0x70, funcInbPS2, funcNone)    // PS/2 Keyboard (Always 8042 Chip)
 	m.registerIOPortHandler(0xed, 0xee, funcNone, funcNone)      // 0xed is the new standard delay port.
 
-	// Serial port 1
-	m.registerIOPortHandler(serial.COM1Addr, serial.COM1Addr+8, m.serial.In, m.serial.Out)
+	m.registerIOPortHandler(DebugExitPort, DebugExitPort+2, funcNone, funcOutDebugExit)
+
+	// Serial ports. The ones without a UART read as nothing is there.
+	for i, p := range serial.Ports {
+		i := i
+
+		funcInSerial := func(port uint64, bytes []byte) error {
+			if u := m.serials[i].uart; u != nil {
+				return u.In(port, bytes)
+			}
+
+			return nil
+		}
+
+		funcOutSerial := func(port uint64, bytes []byte) error {
+			if u := m.serials[i].uart; u != nil {
+				return u.Out(port, bytes)
+			}
+
+			return nil
+		}
+
+		m.registerIOPortHandler(p.Addr, p.Addr+8, funcInSerial, funcOutSerial)
+	}
 
 	// PCI configuration
 	//
@@ -994,39 +2062,72 @@ func (m *Machine) initIOPortHandlers() {
 	}
 }
 
-// InjectSerialIRQ injects a serial interrupt.
-func (m *Machine) InjectSerialIRQ() error {
-	if err := kvm.IRQLineStatus(m.vmFd, serialIRQ, 0); err != nil {
-		return err
+// serialLine implements serial.IRQInjector for one serial port.
+type serialLine struct {
+	m    *Machine
+	port int
+}
+
+func (l serialLine) SetSerialIRQ(level bool) error {
+	return l.m.setSerialIRQ(l.port, level)
+}
+
+// setSerialIRQ sets the IRQ level of a serial port. The IRQ line is
+// raised while any of the ports sharing it is, so that the guest polls
+// them all.
+func (m *Machine) setSerialIRQ(port int, level bool) error {
+	m.serialMu.Lock()
+	defer m.serialMu.Unlock()
+
+	irq := serial.Ports[port].IRQ
+	line := func() bool {
+		for i, p := range serial.Ports {
+			if p.IRQ == irq && m.serials[i].level {
+				return true
+			}
+		}
+
+		return false
 	}
 
-	if err := kvm.IRQLineStatus(m.vmFd, serialIRQ, 1); err != nil {
-		return err
+	before := line()
+	m.serials[port].level = level
+
+	after := line()
+	if before == after {
+		return nil
 	}
 
-	return nil
+	var l uint32
+	if after {
+		l = 1
+	}
+
+	return kvm.IRQLineStatus(m.vmFd, uint32(irq), l)
 }
 
-// InjectViortNetIRQ injects a virtio net interrupt.
-func (m *Machine) InjectVirtioNetIRQ() error {
-	if err := kvm.IRQLineStatus(m.vmFd, virtioNetIRQ, 0); err != nil {
+// InjectSerialIRQ injects a serial interrupt.
+func (m *Machine) InjectSerialIRQ() error {
+	irq := uint32(serial.Ports[0].IRQ)
+
+	if err := kvm.IRQLineStatus(m.vmFd, irq, 0); err != nil {
 		return err
 	}
 
-	if err := kvm.IRQLineStatus(m.vmFd, virtioNetIRQ, 1); err != nil {
+	if err := kvm.IRQLineStatus(m.vmFd, irq, 1); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// InjectViortNetIRQ injects a virtio block interrupt.
-func (m *Machine) InjectVirtioBlkIRQ() error {
-	if err := kvm.IRQLineStatus(m.vmFd, virtioBlkIRQ, 0); err != nil {
+// InjectVirtioIRQ injects the interrupt of a virtio device.
+func (m *Machine) InjectVirtioIRQ(irq uint8) error {
+	if err := kvm.IRQLineStatus(m.vmFd, uint32(irq), 0); err != nil {
 		return err
 	}
 
-	if err := kvm.IRQLineStatus(m.vmFd, virtioBlkIRQ, 1); err != nil {
+	if err := kvm.IRQLineStatus(m.vmFd, uint32(irq), 1); err != nil {
 		return err
 	}
 
@@ -1035,20 +2136,12 @@ func (m *Machine) InjectVirtioBlkIRQ() error {
 
 // ReadAt implements io.ReadAt for the kvm guest pvh.
 func (m *Machine) ReadAt(b []byte, off int64) (int, error) {
-	mem := bytes.NewReader(m.mem)
-
-	return mem.ReadAt(b, off)
+	return m.guestMem.ReadAt(b, off)
 }
 
 // WriteAt implements io.WriteAt for the kvm guest pvh.
 func (m *Machine) WriteAt(b []byte, off int64) (int, error) {
-	if off > int64(len(m.mem)) {
-		return 0, syscall.EFBIG
-	}
-
-	n := copy(m.mem[off:], b)
-
-	return n, nil
+	return m.guestMem.WriteAt(b, off)
 }
 
 func showone(indent string, in interface{}) string {
@@ -1080,8 +2173,8 @@ func show(indent string, l ...interface{}) string {
 
 // CPUToFD translates a CPU number to an fd.
 func (m *Machine) CPUToFD(cpu int) (uintptr, error) {
-	if cpu > len(m.vcpuFds) {
-		return 0, fmt.Errorf("cpu %d out of range 0-%d:%w", cpu, len(m.vcpuFds), ErrBadCPU)
+	if cpu < 0 || cpu >= m.NumCPUs() {
+		return 0, fmt.Errorf("cpu %d out of range 0-%d:%w", cpu, m.NumCPUs()-1, ErrBadCPU)
 	}
 
 	return m.vcpuFds[cpu], nil
@@ -1103,7 +2196,7 @@ func (m *Machine) VtoP(cpu int, vaddr uint64) (int64, error) {
 
 	// There can exist a valid translation for memory that does not exist.
 	// For now, we call that an error.
-	if t.Valid == 0 || t.PhysicalAddress > uint64(len(m.mem)) {
+	if _, err := m.guestMem.Slice(t.PhysicalAddress, 1); t.Valid == 0 || err != nil {
 		return -1, fmt.Errorf("%#x:valid not set:%w", vaddr, ErrBadVA)
 	}
 
@@ -1186,69 +2279,86 @@ func GetReg(r *kvm.Regs, reg x86asm.Reg) (*uint64, error) {
 	return nil, fmt.Errorf("register %v%w", reg, ErrUnsupported)
 }
 
-// InitKVM takes care of the general kvm setup without dependencies to runtime target.
-func initVMandVCPU(
-	kvmPath string,
-	nCpus int,
-) (uintptr, uintptr, []uintptr, []*kvm.RunData, error) {
+// initVMandVCPU takes care of the general kvm setup without dependencies
+// to runtime target. What it sets up is left for Close on error.
+func (m *Machine) initVMandVCPU(kvmPath string, nCpus int) error {
 	var err error
 
-	devKVM, err := os.OpenFile(kvmPath, os.O_RDWR, 0o644)
-	if err != nil {
-		return 0, 0, nil, nil, err
+	if m.kvm, err = os.OpenFile(kvmPath, os.O_RDWR, 0o644); err != nil {
+		return err
 	}
 
-	kvmFd := devKVM.Fd()
-	vmFd := uintptr(0)
-	vcpuFds := make([]uintptr, nCpus)
-	runs := make([]*kvm.RunData, nCpus)
+	m.kvmFd = m.kvm.Fd()
+	m.vcpuFds = make([]uintptr, nCpus)
+	m.runs = make([]*kvm.RunData, nCpus)
 
-	if vmFd, err = kvm.CreateVM(kvmFd); err != nil {
-		return 0, 0, nil, nil, fmt.Errorf("CreateVM: %w", err)
+	if m.vmFd, err = kvm.CreateVM(m.kvmFd); err != nil {
+		return fmt.Errorf("CreateVM: %w", err)
 	}
 
-	if err := kvm.SetTSSAddr(vmFd, pvh.KVMTSSStart); err != nil {
-		return 0, 0, nil, nil, err
+	if err := kvm.SetTSSAddr(m.vmFd, pvh.KVMTSSStart); err != nil {
+		return err
 	}
 
-	if err := kvm.SetIdentityMapAddr(vmFd, pvh.KVMIdentityMapStart); err != nil {
-		return 0, 0, nil, nil, err
+	if err := kvm.SetIdentityMapAddr(m.vmFd, pvh.KVMIdentityMapStart); err != nil {
+		return err
 	}
 
-	if err := kvm.CreateIRQChip(vmFd); err != nil {
-		return 0, 0, nil, nil, err
+	if err := kvm.CreateIRQChip(m.vmFd); err != nil {
+		return err
 	}
 
-	if err := kvm.CreatePIT2(vmFd); err != nil {
-		return 0, 0, nil, nil, err
+	if err := kvm.CreatePIT2(m.vmFd); err != nil {
+		return err
 	}
 
-	mmapSize, err := kvm.GetVCPUMMmapSize(kvmFd)
+	mmapSize, err := kvm.GetVCPUMMmapSize(m.kvmFd)
 	if err != nil {
-		return 0, 0, nil, nil, err
+		return err
 	}
 
 	for cpu := 0; cpu < nCpus; cpu++ {
-		// Create vCPU
-		vcpuFds[cpu], err = kvm.CreateVCPU(vmFd, cpu)
-		if err != nil {
-			return 0, 0, nil, nil, err
+		if m.vcpuFds[cpu], m.runs[cpu], err = createVCPU(m.vmFd, mmapSize, int(m.topo.APICID(cpu))); err != nil {
+			return err
 		}
+	}
 
-		// init kvm_run structure
-		r, err := syscall.Mmap(int(vcpuFds[cpu]), 0, int(mmapSize),
-			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
-		if err != nil {
-			return 0, 0, nil, nil, err
-		}
+	return nil
+}
+
+// createVCPU creates the vCPU of ID id, its initial APIC ID, and maps its
+// kvm_run structure of mmapSize bytes.
+func createVCPU(vmFd, mmapSize uintptr, id int) (uintptr, *kvm.RunData, error) {
+	// Create vCPU
+	fd, err := kvm.CreateVCPU(vmFd, id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// init kvm_run structure
+	r, err := syscall.Mmap(int(fd), 0, int(mmapSize),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Close(int(fd))
 
-		runs[cpu] = (*kvm.RunData)(unsafe.Pointer(&r[0]))
+		return 0, nil, err
 	}
 
-	return kvmFd, vmFd, vcpuFds, runs, nil
+	return fd, (*kvm.RunData)(unsafe.Pointer(&r[0])), nil
+}
+
+// closeVCPU unmaps run, the kvm_run structure of mmapSize bytes of the
+// vCPU fd, and closes fd.
+func closeVCPU(fd uintptr, run *kvm.RunData, mmapSize uintptr) error {
+	err := syscall.Munmap(unsafe.Slice((*byte)(unsafe.Pointer(run)), mmapSize))
+
+	return errors.Join(err, syscall.Close(int(fd)))
 }
 
-func (m *Machine) VCPU(stdout io.Writer, cpu, traceCount int) error {
+// VCPU runs cpu until it fails, halts, the machine is stopped or ctx
+// is done. If traceCount > 0, every traceCount-th instruction executed
+// in single step mode is written to stdout.
+func (m *Machine) VCPU(ctx context.Context, stdout io.Writer, cpu, traceCount int) error {
 	trace := traceCount > 0
 
 	var err error
@@ -1256,12 +2366,12 @@ func (m *Machine) VCPU(stdout io.Writer, cpu, traceCount int) error {
 	// exit this loop after a certain number of instructions
 	// were run.
 	for tc := 0; ; tc++ {
-		err = m.RunInfiniteLoop(cpu)
+		err = m.RunInfiniteLoop(ctx, cpu)
 		if err == nil {
 			continue
 		}
 
-		if !errors.Is(err, kvm.ErrDebug) {
+		if !errors.Is(err, kvm.ErrDebug) || !trace {
 			return fmt.Errorf("CPU %d: %w", cpu, err)
 		}
 
@@ -1282,8 +2392,84 @@ func (m *Machine) VCPU(stdout io.Writer, cpu, traceCount int) error {
 	}
 }
 
-func (m *Machine) GetSerial() *serial.Serial {
-	return m.serial
+// GetSerial returns the UART of a serial port, 0 for COM1, or nil if
+// the port has none.
+func (m *Machine) GetSerial(port int) *serial.Serial {
+	if port < 0 || port >= len(m.serials) {
+		return nil
+	}
+
+	return m.serials[port].uart
+}
+
+// initSerial creates the UARTs of COM1 and of the ports set so far.
+func (m *Machine) initSerial() error {
+	for i := range m.serials {
+		if i == 0 || m.serials[i].enabled {
+			if err := m.newUART(i); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Machine) newUART(port int) error {
+	p := &m.serials[port]
+
+	s, err := serial.New(serial.Ports[port].Addr, serialLine{m: m, port: port})
+	if err != nil {
+		return err
+	}
+
+	if p.out != nil {
+		s.SetOutput(p.out)
+	}
+
+	p.uart = s
+
+	return nil
+}
+
+// SetTrace makes Start print every count-th instruction to out, see
+// VCPU. A count of 0 turns tracing off.
+func (m *Machine) SetTrace(out io.Writer, count int) error {
+	m.traceOut = out
+	m.traceCount = count
+
+	return m.SingleStep(count > 0)
+}
+
+// SetConsole connects COM1 to in and out instead of stdin and stdout.
+// in is read by Start and may be nil.
+func (m *Machine) SetConsole(in io.Reader, out io.Writer) {
+	_ = m.SetSerial(0, in, out)
+}
+
+// SetSerial adds the serial port, 0 for COM1 to 3 for COM4, and connects
+// it to in and out like SetConsole. A port must be set before Start.
+func (m *Machine) SetSerial(port int, in io.Reader, out io.Writer) error {
+	if port < 0 || port >= len(m.serials) {
+		return fmt.Errorf("COM%d: %w", port+1, ErrInvalidSerialPort)
+	}
+
+	p := &m.serials[port]
+	p.enabled = true
+	p.in = in
+	p.out = out
+
+	switch {
+	case p.uart != nil:
+		if out != nil {
+			p.uart.SetOutput(out)
+		}
+	case m.serials[0].uart != nil:
+		// Already loaded, so the port is late to be created.
+		return m.newUART(port)
+	}
+
+	return nil
 }
 
 func (m *Machine) AddDevice(dev iodev.Device) {
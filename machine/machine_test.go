@@ -2,18 +2,26 @@ package machine_test
 
 import (
 	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
-	"syscall"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/bobuhiro11/gokvm/cpuid"
 	"github.com/bobuhiro11/gokvm/kvm"
 	"github.com/bobuhiro11/gokvm/machine"
+	"github.com/bobuhiro11/gokvm/memory"
 	"github.com/bobuhiro11/gokvm/pvh"
+	"github.com/bobuhiro11/gokvm/sched"
+	"github.com/bobuhiro11/gokvm/virtio"
 	"golang.org/x/arch/x86/x86asm"
+	"golang.org/x/sys/unix"
 )
 
 func testNewAndLoadLinux(t *testing.T, kernel, tap, guestIPv4, hostIPv4, prefixLen string) { // nolint:thelper
@@ -30,7 +38,7 @@ func testNewAndLoadLinux(t *testing.T, kernel, tap, guestIPv4, hostIPv4, prefixL
 		t.Fatal(err)
 	}
 
-	if err := m.AddDisk("../vda.img"); err != nil {
+	if err := m.AddDisk("../vda.img", virtio.DiskSnapshot); err != nil {
 		t.Fatal(err)
 	}
 
@@ -72,7 +80,7 @@ func testNewAndLoadLinux(t *testing.T, kernel, tap, guestIPv4, hostIPv4, prefixL
 	m.RunData()
 
 	go func() {
-		if err = m.RunInfiniteLoop(0); err != nil {
+		if err = m.RunInfiniteLoop(context.Background(), 0); err != nil {
 			panic(err)
 		}
 	}()
@@ -147,7 +155,7 @@ func TestNewAndLoadEDK2PVH(t *testing.T) { // nolint:paralleltest
 	m.RunData()
 
 	go func() {
-		if err = m.RunInfiniteLoop(0); err != nil {
+		if err = m.RunInfiniteLoop(context.Background(), 0); err != nil {
 			panic(err)
 		}
 	}()
@@ -194,8 +202,9 @@ func TestHalt(t *testing.T) {
 
 	t.Logf("RunOnce: %v,%v", ok, err)
 
-	if !errors.Is(err, kvm.ErrUnexpectedExitReason) {
-		t.Errorf("Run: RunOnce(0) exit is %v, not %v", err, kvm.ErrUnexpectedExitReason)
+	// The poison ends with ud2, and without an IDT it triple faults.
+	if !errors.Is(err, machine.ErrTripleFault) {
+		t.Errorf("Run: RunOnce(0) exit is %v, not %v", err, machine.ErrTripleFault)
 	}
 
 	if s, err := m.GetSRegs(0); err != nil {
@@ -264,8 +273,8 @@ func TestReadWriteAt(t *testing.T) {
 		t.Fatalf("WriteAt(%#x, %#x): (%d, %v) != (%d, nil)", zeros, off, n, err, len(zeros))
 	}
 
-	if n, err := m.WriteAt(zeros[:], 1<<30); !errors.Is(err, syscall.EFBIG) {
-		t.Fatalf("WriteAt(_, 1<<30): (%d, %v) != (%d, %v)", n, err, 0, syscall.EFBIG)
+	if n, err := m.WriteAt(zeros[:], 1<<30); !errors.Is(err, memory.ErrOutOfRange) {
+		t.Fatalf("WriteAt(_, 1<<30): (%d, %v) != (%d, %v)", n, err, 0, memory.ErrOutOfRange)
 	}
 
 	var got [8]byte
@@ -479,8 +488,8 @@ func TestTranslate32(t *testing.T) {
 
 	t.Logf("Runonce: %v, %v", ok, err)
 
-	if !errors.Is(err, kvm.ErrUnexpectedExitReason) {
-		t.Errorf("Run: RunOnce(0) exit is %v, not %v", err, kvm.ErrUnexpectedExitReason)
+	if !errors.Is(err, machine.ErrTripleFault) {
+		t.Errorf("Run: RunOnce(0) exit is %v, not %v", err, machine.ErrTripleFault)
 	}
 
 	if r, err = m.GetRegs(0); err != nil {
@@ -619,3 +628,1139 @@ func TestGetReg(t *testing.T) { // nolint:paralleltest
 		t.Errorf("GetReg(r, x86asm.AL): got nil, want err")
 	}
 }
+
+func TestPauseResumeStop(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	// jmp $
+	if _, err := m.WriteAt([]byte{0xeb, 0xfe}, 0x1_00_000); err != nil {
+		t.Fatalf("WriteAt: got %v, want nil", err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	done := make(chan error)
+
+	go func() {
+		done <- m.RunInfiniteLoop(context.Background(), 0)
+	}()
+
+	for i := 0; i < 3; i++ {
+		if err := m.Pause(); err != nil {
+			t.Fatalf("Pause: got %v, want nil", err)
+		}
+
+		if !m.Paused() {
+			t.Errorf("Paused: got false, want true")
+		}
+
+		r, err := m.GetRegs(0)
+		if err != nil {
+			t.Fatalf("GetRegs: got %v, want nil", err)
+		}
+
+		if r.RIP != 0x1_00_000 {
+			t.Errorf("RIP: got %#x, want %#x", r.RIP, 0x1_00_000)
+		}
+
+		if err := m.Resume(); err != nil {
+			t.Fatalf("Resume: got %v, want nil", err)
+		}
+	}
+
+	m.Stop()
+
+	if err := <-done; !errors.Is(err, machine.ErrStopped) {
+		t.Errorf("RunInfiniteLoop: got %v, want %v", err, machine.ErrStopped)
+	}
+
+	if err := m.Resume(); !errors.Is(err, machine.ErrStopped) {
+		t.Errorf("Resume after Stop: got %v, want %v", err, machine.ErrStopped)
+	}
+}
+
+// writeELF writes a minimal ELF64 executable which loads code at 0x100000.
+func writeELF(t *testing.T, code []byte) string {
+	t.Helper()
+
+	const addr = 0x1_00_000
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     addr,
+		Phoff:     64,
+		Ehsize:    64,
+		Phentsize: 56,
+		Phnum:     1,
+		Shentsize: 64,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	prog := elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Flags:  uint32(elf.PF_R | elf.PF_X),
+		Off:    64 + 56,
+		Vaddr:  addr,
+		Paddr:  addr,
+		Filesz: uint64(len(code)),
+		Memsz:  uint64(len(code)),
+	}
+
+	var b bytes.Buffer
+
+	for _, v := range []interface{}{hdr, prog, code} {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "guest.elf")
+	if err := os.WriteFile(path, b.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestStart(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	kern := writeELF(t, []byte{
+		0x66, 0xba, 0xf8, 0x03, // mov dx, 0x3f8
+		0xb0, 'h', 0xee, // mov al, 'h'; out dx, al
+		0xb0, 'i', 0xee, // mov al, 'i'; out dx, al
+		0x66, 0xba, 0x01, 0x05, // mov dx, 0x501
+		0xb0, 0x03, 0xee, // mov al, 3; out dx, al
+		0xf4, // hlt
+	})
+
+	var out bytes.Buffer
+
+	m, err := machine.Build(
+		machine.WithCPUs(2),
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithKernel(kern, "", ""),
+		machine.WithConsole(nil, &out),
+	)
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	exit, err := m.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Start: got %v, want nil", err)
+	}
+
+	if want := (machine.Exit{Reason: machine.ExitDebug, Code: 3<<1 | 1}); exit != want {
+		t.Errorf("Start: got %+v, want %+v", exit, want)
+	}
+
+	if out.String() != "hi" {
+		t.Errorf("console: got %q, want %q", out.String(), "hi")
+	}
+}
+
+func TestAddCPU(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	// The guest waits for an event of the GED, then enters S5.
+	kern := writeELF(t, []byte{
+		0x66, 0xba, 0x10, 0x06, // mov dx, 0x610
+		0xed,       // in eax, dx
+		0x85, 0xc0, // test eax, eax
+		0x74, 0xfb, // jz in
+		0x66, 0xba, 0x00, 0x06, // mov dx, 0x600
+		0xb0, 0x34, 0xee, // mov al, (5 << 2) | (1 << 5); out dx, al
+		0xf4, // hlt
+	})
+
+	m, err := machine.Build(
+		machine.WithCPUs(1),
+		machine.WithMaxCPUs(3),
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithKernel(kern, "", ""),
+	)
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	rsdp := make([]byte, 8)
+	if _, err := m.ReadAt(rsdp, 0xe0000); err != nil || string(rsdp) != "RSD PTR " {
+		t.Errorf("RSDP: got %q, %v, want %q", rsdp, err, "RSD PTR ")
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		if cpu, err := m.AddCPU(); cpu != 1 || err != nil {
+			t.Errorf("AddCPU: got (%d, %v), want (1, nil)", cpu, err)
+		}
+	})
+
+	exit, err := m.Start(context.Background())
+	if err != nil || exit.Reason != machine.ExitPoweroff {
+		t.Fatalf("Start: got (%v, %v), want %v", exit.Reason, err, machine.ExitPoweroff)
+	}
+
+	if err := m.AddCPUAt(1); !errors.Is(err, machine.ErrBadCPU) {
+		t.Errorf("AddCPUAt(1): got %v, want %v", err, machine.ErrBadCPU)
+	}
+
+	if err := m.AddCPUAt(2); err != nil {
+		t.Errorf("AddCPUAt(2) after Start: got %v, want nil", err)
+	}
+
+	if _, err := m.AddCPU(); !errors.Is(err, machine.ErrMaxCPUs) {
+		t.Errorf("AddCPU beyond the max: got %v, want %v", err, machine.ErrMaxCPUs)
+	}
+
+	if n, p := m.NumCPUs(), m.PossibleCPUs(); n != 3 || p != 3 {
+		t.Errorf("got %d of %d vCPUs, want 3 of 3", n, p)
+	}
+
+	if _, err := m.CPUToFD(2); err != nil {
+		t.Errorf("m.CPUToFD(2): got %v, want nil", err)
+	}
+}
+
+func TestPowerButton(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	// The guest waits for an event of the GED, and enters S5 if it is
+	// the power button.
+	kern := writeELF(t, []byte{
+		0x66, 0xba, 0x10, 0x06, // mov dx, 0x610
+		0xed,       // in eax, dx
+		0x85, 0xc0, // test eax, eax
+		0x74, 0xfb, // jz in
+		0x83, 0xf8, 0x02, // cmp eax, 2
+		0x74, 0x02, // je s5
+		0x0f, 0x0b, // ud2
+		0x66, 0xba, 0x00, 0x06, // s5: mov dx, 0x600
+		0xb0, 0x34, 0xee, // mov al, (5 << 2) | (1 << 5); out dx, al
+		0xf4, // hlt
+	})
+
+	// Every machine has the ACPI tables, not only those with CPU
+	// hotplug or NUMA nodes.
+	m, err := machine.Build(
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithKernel(kern, "", ""),
+	)
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		if err := m.PowerButton(); err != nil {
+			t.Errorf("PowerButton: got %v, want nil", err)
+		}
+	})
+
+	exit, err := m.Start(context.Background())
+	if err != nil || exit.Reason != machine.ExitPoweroff {
+		t.Fatalf("Start: got (%v, %v), want %v", exit.Reason, err, machine.ExitPoweroff)
+	}
+
+	// The ACPI tables are written as the kernel is loaded.
+	m, err = machine.Build(machine.WithMemory(machine.MinMemSize))
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	if err := m.PowerButton(); !errors.Is(err, machine.ErrNotLoaded) {
+		t.Errorf("PowerButton before loading: got %v, want %v", err, machine.ErrNotLoaded)
+	}
+}
+
+func TestSetMaxCPUs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 2, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	for _, n := range []int{1, machine.MaxCPUs + 1} {
+		if err := m.SetMaxCPUs(n); !errors.Is(err, machine.ErrBadCPU) {
+			t.Errorf("SetMaxCPUs(%d): got %v, want %v", n, err, machine.ErrBadCPU)
+		}
+	}
+
+	if err := m.SetMaxCPUs(4); err != nil {
+		t.Fatalf("SetMaxCPUs(4): got %v, want nil", err)
+	}
+
+	if _, err := m.CPUToFD(2); !errors.Is(err, machine.ErrBadCPU) {
+		t.Errorf("m.CPUToFD(2) before AddCPU: got %v, want %v", err, machine.ErrBadCPU)
+	}
+
+	if len(m.RunData()) != 2 {
+		t.Errorf("RunData: got %d, want 2", len(m.RunData()))
+	}
+}
+
+func TestTopology(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	// The guest is not started, the tables are what counts.
+	kern := writeELF(t, bytes.Repeat([]byte{0xf4}, 16)) // hlt
+
+	m, err := machine.Build(
+		machine.WithCPUs(1),
+		machine.WithTopology(cpuid.Topology{Sockets: 2, Cores: 1, Threads: 3}),
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithNUMA(
+			machine.NUMANode{CPUs: []int{0, 1, 2}, Size: machine.MinMemSize / 2},
+			machine.NUMANode{CPUs: []int{3, 4, 5}, Size: machine.MinMemSize / 2},
+		),
+		machine.WithKernel(kern, "", ""),
+	)
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	if p := m.PossibleCPUs(); p != 6 {
+		t.Errorf("PossibleCPUs: got %d, want 6", p)
+	}
+
+	for cpu := 1; cpu <= 4; cpu++ {
+		if _, err := m.AddCPU(); err != nil {
+			t.Fatalf("AddCPU: got %v, want nil", err)
+		}
+	}
+
+	// vCPU 4 is the second thread of socket 1, whose threads take 2
+	// bits of the APIC ID.
+	fd, err := m.CPUToFD(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := kvm.CPUID{Nent: 100, Entries: make([]kvm.CPUIDEntry2, 100)}
+	if err := kvm.GetCPUID2(fd, &ids); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range ids.Entries[:ids.Nent] {
+		if e.Function == 0xb && e.Edx != 5 || e.Function == 1 && e.Ebx>>24 != 5 {
+			t.Errorf("leaf %#x.%d: got %+v, want APIC ID 5", e.Function, e.Index, e)
+		}
+	}
+
+	// The XSDT lists the FADT, the MADT, the SRAT and the SLIT.
+	rsdp := make([]byte, 36)
+	if _, err := m.ReadAt(rsdp, 0xe0000); err != nil {
+		t.Fatal(err)
+	}
+
+	xsdt := make([]byte, 36+4*8)
+	if _, err := m.ReadAt(xsdt, int64(binary.LittleEndian.Uint64(rsdp[24:]))); err != nil {
+		t.Fatal(err)
+	}
+
+	srat := make([]byte, 4)
+	if _, err := m.ReadAt(srat, int64(binary.LittleEndian.Uint64(xsdt[52:]))); err != nil || string(srat) != "SRAT" {
+		t.Errorf("XSDT: got %q, %v for the third table, want SRAT", srat, err)
+	}
+
+	if _, err := machine.Build(
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithNUMA(machine.NUMANode{Size: machine.MinMemSize / 2}),
+	); !errors.Is(err, machine.ErrBadNUMA) {
+		t.Errorf("Build with half the memory in nodes: got %v, want %v", err, machine.ErrBadNUMA)
+	}
+
+	if _, err := machine.Build(
+		machine.WithCPUs(2),
+		machine.WithMaxCPUs(3),
+		machine.WithTopology(cpuid.Topology{Sockets: 1, Cores: 2}),
+		machine.WithMemory(machine.MinMemSize),
+	); !errors.Is(err, machine.ErrBadCPU) {
+		t.Errorf("Build with 3 of 2 vCPUs of the topology: got %v, want %v", err, machine.ErrBadCPU)
+	}
+}
+
+func TestSerialPorts(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	kern := writeELF(t, []byte{
+		0x66, 0xba, 0xf8, 0x02, // mov dx, 0x2f8
+		0xb0, '2', 0xee, // mov al, '2'; out dx, al
+		0x66, 0xba, 0xe8, 0x02, // mov dx, 0x2e8
+		0xb0, '4', 0xee, // mov al, '4'; out dx, al
+		0x66, 0xba, 0x01, 0x05, // mov dx, 0x501
+		0xb0, 0x00, 0xee, // mov al, 0; out dx, al
+		0xf4, // hlt
+	})
+
+	var com1, com2, com4 bytes.Buffer
+
+	m, err := machine.Build(
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithConsole(nil, &com1),
+		machine.WithSerial(1, nil, &com2),
+		machine.WithKernel(kern, "", ""),
+	)
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	if m.GetSerial(3) != nil {
+		t.Errorf("GetSerial(3): got a UART before COM4 was set")
+	}
+
+	// COM4 is added after the kernel is loaded.
+	if err := m.SetSerial(3, nil, &com4); err != nil {
+		t.Fatalf("SetSerial: got %v, want nil", err)
+	}
+
+	if err := m.SetSerial(4, nil, nil); !errors.Is(err, machine.ErrInvalidSerialPort) {
+		t.Errorf("SetSerial(4): got %v, want %v", err, machine.ErrInvalidSerialPort)
+	}
+
+	if _, err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start: got %v, want nil", err)
+	}
+
+	if com1.String() != "" || com2.String() != "2" || com4.String() != "4" {
+		t.Errorf("got COM1 %q, COM2 %q, COM4 %q, want \"\", \"2\", \"4\"", &com1, &com2, &com4)
+	}
+}
+
+func TestAddConsole(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddConsole(nil); !errors.Is(err, virtio.ErrInvalidPort) {
+		t.Errorf("AddConsole(nil): got %v, want %v", err, virtio.ErrInvalidPort)
+	}
+
+	if err := m.AddConsole([]virtio.ConsolePort{{Console: true}, {Name: "agent"}}); err != nil {
+		t.Errorf("AddConsole: got %v, want nil", err)
+	}
+}
+
+func TestAddVsock(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "vsock.sock")
+
+	if err := m.AddVsock(1, path); !errors.Is(err, virtio.ErrInvalidCID) {
+		t.Errorf("AddVsock(1): got %v, want %v", err, virtio.ErrInvalidCID)
+	}
+
+	if err := m.AddVsock(3, path); err != nil {
+		t.Errorf("AddVsock: got %v, want nil", err)
+	}
+}
+
+func TestAddRng(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddRng(filepath.Join(t.TempDir(), "nonexistent")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("AddRng(nonexistent): got %v, want %v", err, os.ErrNotExist)
+	}
+
+	if err := m.AddRng(""); err != nil {
+		t.Errorf("AddRng: got %v, want nil", err)
+	}
+
+	if err := m.AddRng("/dev/urandom"); err != nil {
+		t.Errorf("AddRng(/dev/urandom): got %v, want nil", err)
+	}
+}
+
+func TestAddShare(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddShare("", t.TempDir(), false); !errors.Is(err, virtio.ErrInvalidTag) {
+		t.Errorf("AddShare with no tag: got %v, want %v", err, virtio.ErrInvalidTag)
+	}
+
+	if err := m.AddShare("share", t.TempDir(), true); err != nil {
+		t.Errorf("AddShare: got %v, want nil", err)
+	}
+}
+
+func TestAddSCSI(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AddSCSI(nil); !errors.Is(err, virtio.ErrInvalidLUNs) {
+		t.Errorf("AddSCSI with no LUN: got %v, want %v", err, virtio.ErrInvalidLUNs)
+	}
+
+	path := filepath.Join(t.TempDir(), "lun")
+	if err := os.WriteFile(path, make([]byte, 4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	luns := []virtio.SCSILUN{{Path: path}, {Path: path, Mode: virtio.DiskReadOnly}}
+	if err := m.AddSCSI(luns); err != nil {
+		t.Errorf("AddSCSI: got %v, want nil", err)
+	}
+}
+
+func TestAddBalloon(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetBalloonTarget(0); !errors.Is(err, machine.ErrNoBalloon) {
+		t.Errorf("SetBalloonTarget without a balloon: got %v, want %v", err, machine.ErrNoBalloon)
+	}
+
+	if err := m.AddBalloon(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetBalloonTarget(machine.MinMemSize + 1); !errors.Is(err, machine.ErrBalloonTarget) {
+		t.Errorf("SetBalloonTarget above the memory size: got %v, want %v", err, machine.ErrBalloonTarget)
+	}
+
+	if err := m.SetBalloonTarget(machine.MinMemSize / 2); err != nil {
+		t.Errorf("SetBalloonTarget: got %v, want nil", err)
+	}
+
+	// The guest has not inflated the balloon yet.
+	if size, err := m.QueryBalloon(); err != nil || size != machine.MinMemSize {
+		t.Errorf("QueryBalloon: got %d, %v, want %d", size, err, machine.MinMemSize)
+	}
+}
+
+func TestAddMemHotplug(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.ResizeMemory(machine.MinMemSize); !errors.Is(err, machine.ErrNoMemHotplug) {
+		t.Errorf("ResizeMemory without virtio-mem: got %v, want %v", err, machine.ErrNoMemHotplug)
+	}
+
+	if err := m.AddMemHotplug(virtio.MemBlockSize + 1); !errors.Is(err, virtio.ErrInvalidMemRegion) {
+		t.Errorf("AddMemHotplug of a partial block: got %v, want %v", err, virtio.ErrInvalidMemRegion)
+	}
+
+	// A block per KVM memory slot.
+	if err := m.AddMemHotplug(1 << 20 * virtio.MemBlockSize); !errors.Is(err, machine.ErrNoMemSlots) {
+		t.Errorf("AddMemHotplug of a block per MiB: got %v, want %v", err, machine.ErrNoMemSlots)
+	}
+
+	if err := m.AddMemHotplug(2 * virtio.MemBlockSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.ResizeMemory(machine.MinMemSize - 1); !errors.Is(err, machine.ErrMemTarget) {
+		t.Errorf("ResizeMemory below the boot memory: got %v, want %v", err, machine.ErrMemTarget)
+	}
+
+	if err := m.ResizeMemory(machine.MinMemSize + 3*virtio.MemBlockSize); !errors.Is(err, virtio.ErrInvalidMemSize) {
+		t.Errorf("ResizeMemory above the region: got %v, want %v", err, virtio.ErrInvalidMemSize)
+	}
+
+	if err := m.ResizeMemory(machine.MinMemSize + virtio.MemBlockSize); err != nil {
+		t.Errorf("ResizeMemory: got %v, want nil", err)
+	}
+
+	// The guest has not plugged anything yet.
+	if base, plugged, err := m.QueryMemory(); err != nil || base != machine.MinMemSize || plugged != 0 {
+		t.Errorf("QueryMemory: got %d, %d, %v, want %d, 0", base, plugged, err, machine.MinMemSize)
+	}
+
+	// A plugged block is guest memory, at 4 GiB above small RAM.
+	block, err := memory.Alloc(virtio.MemBlockSize, memory.Backing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := memory.Region{GPA: memory.HighStart, Data: block}
+
+	if err := m.PlugMem(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.WriteAt([]byte{1}, memory.HighStart); err != nil || block[0] != 1 {
+		t.Errorf("WriteAt to the plugged block: got %v and %d, want nil and 1", err, block[0])
+	}
+
+	if err := m.UnplugMem(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.WriteAt([]byte{1}, memory.HighStart); !errors.Is(err, memory.ErrOutOfRange) {
+		t.Errorf("WriteAt to the unplugged block: got %v, want %v", err, memory.ErrOutOfRange)
+	}
+}
+
+func TestAddMemHotplugBacking(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	m, err := machine.Build(
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithMemoryBacking(memory.Backing{Path: filepath.Join(dir, "ram")}),
+	)
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+	defer m.Close()
+
+	if err := m.AddMemHotplug(virtio.MemBlockSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// The region is in a file of its own next to the one of RAM.
+	maps, err := os.ReadFile("/proc/self/maps")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prefix := filepath.Join(dir, "gokvm-ram-"); !bytes.Contains(maps, []byte(prefix)) {
+		t.Errorf("no mapping of %s* in %s", prefix, maps)
+	}
+}
+
+func TestStartCancel(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	// jmp $, padded since CheckPVH reads every segment as a note.
+	kern := writeELF(t, append([]byte{0xeb, 0xfe}, bytes.Repeat([]byte{0xf4}, 14)...))
+
+	m, err := machine.Build(
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithKernel(kern, "", ""),
+	)
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	exit, err := m.Start(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Start: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if exit.Reason != machine.ExitStopped || exit.Code != 0 {
+		t.Errorf("Start: got %+v, want %v", exit, machine.ExitStopped)
+	}
+}
+
+func TestStartNotLoaded(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	if _, err := m.Start(context.Background()); !errors.Is(err, machine.ErrNotLoaded) {
+		t.Errorf("Start: got %v, want %v", err, machine.ErrNotLoaded)
+	}
+}
+
+func TestStartCrash(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	// mov al, [0xc0000000], where there is no RAM nor device.
+	kern := writeELF(t, append([]byte{0xa0, 0, 0, 0, 0xc0, 0, 0, 0, 0}, bytes.Repeat([]byte{0xf4}, 7)...))
+
+	m, err := machine.Build(
+		machine.WithCPUs(2),
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithKernel(kern, "", ""),
+	)
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	exit, err := m.Start(context.Background())
+	if !errors.Is(err, kvm.ErrUnexpectedExitReason) {
+		t.Errorf("Start: got %v, want %v", err, kvm.ErrUnexpectedExitReason)
+	}
+
+	if exit.Reason != machine.ExitCrash || exit.Code != 1 || exit.CPU != 0 || exit.KVMExit == kvm.EXITIO {
+		t.Errorf("Start: got %+v, want a crash of CPU 0", exit)
+	}
+}
+
+func TestStartPoweroff(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	// The guest enters S5.
+	kern := writeELF(t, []byte{
+		0x66, 0xba, 0x00, 0x06, // mov dx, 0x600
+		0xb0, 0x34, 0xee, // mov al, (5 << 2) | (1 << 5); out dx, al
+		0xf4, 0xf4, 0xf4, 0xf4, 0xf4, 0xf4, 0xf4, 0xf4, 0xf4, // hlt
+	})
+
+	m, err := machine.Build(
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithKernel(kern, "", ""),
+	)
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	exit, err := m.Start(context.Background())
+	if err != nil || exit != (machine.Exit{Reason: machine.ExitPoweroff}) {
+		t.Errorf("Start: got (%+v, %v), want %v", exit, err, machine.ExitPoweroff)
+	}
+}
+
+func TestStartTripleFault(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	// ud2, which triple faults without an IDT, padded since CheckPVH
+	// reads every segment as a note.
+	kern := writeELF(t, append([]byte{0x0f, 0x0b}, bytes.Repeat([]byte{0xf4}, 14)...))
+
+	m, err := machine.Build(
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithKernel(kern, "", ""),
+	)
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	exit, err := m.Start(context.Background())
+	if err != nil || exit != (machine.Exit{Reason: machine.ExitReset}) {
+		t.Errorf("Start: got (%+v, %v), want %v", exit, err, machine.ExitReset)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	kern := writeELF(t, append([]byte{0xeb, 0xfe}, bytes.Repeat([]byte{0xf4}, 14)...))
+
+	m, err := machine.Build(
+		machine.WithMemory(machine.MinMemSize),
+		machine.WithKernel(kern, "", ""),
+	)
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		m.Shutdown(machine.ExitPoweroff)
+		m.Shutdown(machine.ExitReset)
+	})
+
+	exit, err := m.Start(context.Background())
+	if err != nil {
+		t.Errorf("Start: got %v, want nil", err)
+	}
+
+	if exit.Reason != machine.ExitPoweroff {
+		t.Errorf("Start: got %v, want %v", exit.Reason, machine.ExitPoweroff)
+	}
+}
+
+func TestRunInfiniteLoopCancel(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatalf("Open: got %v, want nil", err)
+	}
+
+	// jmp $
+	if _, err := m.WriteAt([]byte{0xeb, 0xfe}, 0x1_00_000); err != nil {
+		t.Fatalf("WriteAt: got %v, want nil", err)
+	}
+
+	if err := m.SetupRegs(0x1_00_000, 0x10_000, true); err != nil {
+		t.Fatalf("SetupRegs: got %v, want nil", err)
+	}
+
+	for _, pause := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+
+		go func() {
+			done <- m.RunInfiniteLoop(ctx, 0)
+		}()
+
+		if pause {
+			if err := m.Pause(); err != nil {
+				t.Fatalf("Pause: got %v, want nil", err)
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("RunInfiniteLoop(pause %v): got %v, want %v", pause, err, context.Canceled)
+		}
+	}
+}
+
+func TestSetQueueSize(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetQueueSize(48); !errors.Is(err, virtio.ErrInvalidQueueSize) {
+		t.Errorf("SetQueueSize(48): got %v, want %v", err, virtio.ErrInvalidQueueSize)
+	}
+
+	if err := m.SetQueueSize(virtio.MaxQueueSize); err != nil {
+		t.Fatalf("SetQueueSize: got %v, want nil", err)
+	}
+
+	if err := m.AddRng(""); err != nil {
+		t.Errorf("AddRng: got %v, want nil", err)
+	}
+}
+
+func TestSched(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 1, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetVCPUSched(1, sched.Policy{CPUs: []int{0}}); !errors.Is(err, machine.ErrBadCPU) {
+		t.Errorf("SetVCPUSched(1): got %v, want %v", err, machine.ErrBadCPU)
+	}
+
+	if err := m.SetIOSched(sched.Policy{Priority: -1}); !errors.Is(err, sched.ErrInvalidPriority) {
+		t.Errorf("SetIOSched: got %v, want %v", err, sched.ErrInvalidPriority)
+	}
+
+	// No host has that many CPUs online.
+	offline := sched.Policy{CPUs: []int{sched.MaxCPUs - 1}}
+
+	if err := m.SetIOSched(offline); err != nil {
+		t.Fatalf("SetIOSched: got %v, want nil", err)
+	}
+
+	if err := m.AddRng(""); !errors.Is(err, unix.EINVAL) {
+		t.Errorf("AddRng on an offline CPU: got %v, want %v", err, unix.EINVAL)
+	}
+
+	if err := m.SetIOSched(sched.Policy{CPUs: []int{0}}); err != nil {
+		t.Fatalf("SetIOSched: got %v, want nil", err)
+	}
+
+	if err := m.AddRng(""); err != nil {
+		t.Errorf("AddRng: got %v, want nil", err)
+	}
+
+	if err := m.SetVCPUSched(0, offline); err != nil {
+		t.Fatalf("SetVCPUSched: got %v, want nil", err)
+	}
+
+	if err := m.RunInfiniteLoop(context.Background(), 0); !errors.Is(err, unix.EINVAL) {
+		t.Errorf("RunInfiniteLoop on an offline CPU: got %v, want %v", err, unix.EINVAL)
+	}
+}
+
+func TestCPUModel(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	t.Parallel()
+
+	m, err := machine.New("/dev/kvm", 2, machine.MinMemSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model, err := cpuid.ParseModel("host,-avx,-pcid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetCPUModel(model); err != nil {
+		t.Errorf("SetCPUModel(%s): got %v, want nil", model, err)
+	}
+
+	if err := m.SetCPUModel(cpuid.Model{Name: "pentium"}); !errors.Is(err, cpuid.ErrInvalidModel) {
+		t.Errorf("SetCPUModel(pentium): got %v, want %v", err, cpuid.ErrInvalidModel)
+	}
+
+	// A custom model with every feature is beyond any host.
+	all := cpuid.Model{Name: cpuid.ModelCustom}
+	for _, f := range cpuid.Features {
+		all.Add = append(all.Add, f.Name)
+	}
+
+	if err := m.SetCPUModel(all); !errors.Is(err, cpuid.ErrUnsupportedFeature) {
+		t.Errorf("SetCPUModel(every feature): got %v, want %v", err, cpuid.ErrUnsupportedFeature)
+	}
+
+	if _, err := machine.Build(
+		machine.WithMemory(machine.MinMemSize), machine.WithCPUModel(all),
+	); !errors.Is(err, cpuid.ErrUnsupportedFeature) {
+		t.Errorf("Build: got %v, want %v", err, cpuid.ErrUnsupportedFeature)
+	}
+}
+
+func TestClose(t *testing.T) { // nolint:paralleltest
+	if os.Getuid() != 0 {
+		t.Skipf("Skipping test since we are not root")
+	}
+
+	dir := t.TempDir()
+
+	disk := filepath.Join(dir, "disk")
+	if err := os.WriteFile(disk, make([]byte, 4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	build := func(opts ...machine.Option) (*machine.Machine, error) {
+		return machine.Build(append([]machine.Option{
+			machine.WithCPUs(2),
+			machine.WithMaxCPUs(3),
+			machine.WithMemory(machine.MinMemSize),
+			machine.WithDisk(disk, virtio.DiskSnapshot),
+			machine.WithSCSI(virtio.SCSILUN{Path: disk}),
+			machine.WithVsock(3, filepath.Join(dir, "vsock.sock")),
+			machine.WithRng(disk),
+			machine.WithShare("share", dir, true),
+			machine.WithBalloon(),
+			machine.WithMemHotplug(virtio.MemBlockSize),
+		}, opts...)...)
+	}
+
+	// Fewer fds may be open than before, as files left by other tests
+	// are finalized.
+	fds := func() int {
+		ents, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(ents)
+	}
+
+	// The first machine also opens what the runtime keeps open, such
+	// as the fds of the network poller.
+	for i := 0; i < 2; i++ {
+		before := fds()
+
+		m, err := build()
+		if err != nil {
+			t.Fatalf("Build: got %v, want nil", err)
+		}
+
+		if _, err := m.AddCPU(); err != nil {
+			t.Fatalf("AddCPU: got %v, want nil", err)
+		}
+
+		if err := m.Close(); err != nil {
+			t.Fatalf("Close: got %v, want nil", err)
+		}
+
+		if after := fds(); i > 0 && after > before {
+			t.Errorf("Close: %d fds open, want at most %d", after, before)
+		}
+	}
+
+	// Build closes what it made before it fails.
+	before := fds()
+
+	if _, err := build(machine.WithKernel(filepath.Join(dir, "missing"), "", "")); err == nil {
+		t.Fatal("Build: got nil, want an error for a missing kernel")
+	}
+
+	if after := fds(); after > before {
+		t.Errorf("Build failing: %d fds open, want at most %d", after, before)
+	}
+
+	// AddCPU keeps the vCPU it fails to set up for the next call, as KVM
+	// does not free its ID. The model is kept even though SetCPUModel
+	// fails, so that the new vCPU fails too.
+	m, err := build()
+	if err != nil {
+		t.Fatalf("Build: got %v, want nil", err)
+	}
+
+	all := cpuid.Model{Name: cpuid.ModelCustom}
+	for _, f := range cpuid.Features {
+		all.Add = append(all.Add, f.Name)
+	}
+
+	if err := m.SetCPUModel(all); !errors.Is(err, cpuid.ErrUnsupportedFeature) {
+		t.Fatalf("SetCPUModel(every feature): got %v, want %v", err, cpuid.ErrUnsupportedFeature)
+	}
+
+	before = fds()
+
+	for i := 0; i < 2; i++ {
+		if _, err := m.AddCPU(); !errors.Is(err, cpuid.ErrUnsupportedFeature) {
+			t.Errorf("AddCPU: got %v, want %v", err, cpuid.ErrUnsupportedFeature)
+		}
+	}
+
+	if after := fds(); after > before+1 {
+		t.Errorf("AddCPU failing twice: %d fds open, want at most %d", after, before+1)
+	}
+
+	if n := m.NumCPUs(); n != 2 {
+		t.Errorf("AddCPU failing: got %d vCPUs, want 2", n)
+	}
+
+	host, err := cpuid.ParseModel(cpuid.DefaultModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetCPUModel(host); err != nil {
+		t.Fatalf("SetCPUModel(%s): got %v, want nil", host, err)
+	}
+
+	if cpu, err := m.AddCPU(); cpu != 2 || err != nil {
+		t.Errorf("AddCPU after failing: got (%d, %v), want (2, nil)", cpu, err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Errorf("Close: got %v, want nil", err)
+	}
+}
@@ -0,0 +1,354 @@
+package machine
+
+import (
+	"io"
+	"net"
+
+	cpuidpkg "github.com/bobuhiro11/gokvm/cpuid"
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/sched"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// Option configures a machine created by Build.
+type Option func(*options)
+
+type nic struct {
+	tapIfName string
+	mac       net.HardwareAddr
+}
+
+type serialOpt struct {
+	port int
+	in   io.Reader
+	out  io.Writer
+}
+
+type options struct {
+	dev     string
+	nCPUs   int
+	maxCPUs int
+	memSize int
+	backing memory.Backing
+
+	topology cpuidpkg.Topology
+	nodes    []NUMANode
+
+	kernel, initrd, params string
+
+	disks []disk
+	luns  []virtio.SCSILUN
+	nics  []nic
+	cpuid []cpuidpkg.Tweak
+	model cpuidpkg.Model
+
+	serials []serialOpt
+	vports  []virtio.ConsolePort
+
+	vsockCID  uint64
+	vsockPath string
+
+	rng       bool
+	rngSource string
+
+	balloon    bool
+	memHotplug uint64
+	shares     []share
+
+	queueSize uint16
+
+	vcpuSched map[int]sched.Policy
+	ioSched   sched.Policy
+}
+
+type disk struct {
+	path string
+	mode virtio.DiskMode
+}
+
+type share struct {
+	tag, path string
+	readOnly  bool
+}
+
+// WithDevice sets the path of the KVM device, /dev/kvm by default.
+func WithDevice(path string) Option {
+	return func(o *options) { o.dev = path }
+}
+
+// WithCPUs sets the number of vCPUs, 1 by default.
+func WithCPUs(n int) Option {
+	return func(o *options) { o.nCPUs = n }
+}
+
+// WithMaxCPUs lets the machine have up to n vCPUs, of which those beyond
+// WithCPUs are added at runtime, see SetMaxCPUs.
+func WithMaxCPUs(n int) Option {
+	return func(o *options) { o.maxCPUs = n }
+}
+
+// WithTopology lays out the vCPUs in sockets, cores and threads. The
+// machine can then have the vCPUs of the topology, of which those
+// beyond WithCPUs are added at runtime.
+func WithTopology(t cpuidpkg.Topology) Option {
+	return func(o *options) { o.topology = t }
+}
+
+// WithNUMA splits the vCPUs and the memory of the machine in NUMA nodes,
+// which the guest sees through ACPI, see NUMANode.
+func WithNUMA(nodes ...NUMANode) Option {
+	return func(o *options) { o.nodes = append(o.nodes, nodes...) }
+}
+
+// WithMemory sets the guest memory size in bytes, 1GiB by default.
+func WithMemory(size int) Option {
+	return func(o *options) { o.memSize = size }
+}
+
+// WithMemoryBacking backs the guest memory as b says, anonymous memory
+// by default, see memory.Alloc.
+func WithMemoryBacking(b memory.Backing) Option {
+	return func(o *options) { o.backing = b }
+}
+
+// WithKernel loads the kernel or firmware image at kernel, see LoadKernel.
+// initrd and params may be empty.
+func WithKernel(kernel, initrd, params string) Option {
+	return func(o *options) {
+		o.kernel = kernel
+		o.initrd = initrd
+		o.params = params
+	}
+}
+
+// WithDisk adds a virtio block device backed by the file at path, used
+// in mode.
+func WithDisk(path string, mode virtio.DiskMode) Option {
+	return func(o *options) { o.disks = append(o.disks, disk{path: path, mode: mode}) }
+}
+
+// WithSCSI adds a virtio SCSI controller with the given LUNs, see
+// AddSCSI.
+func WithSCSI(luns ...virtio.SCSILUN) Option {
+	return func(o *options) { o.luns = append(o.luns, luns...) }
+}
+
+// WithNIC adds a virtio net device connected to a tap interface.
+// mac may be nil.
+func WithNIC(tapIfName string, mac net.HardwareAddr) Option {
+	return func(o *options) { o.nics = append(o.nics, nic{tapIfName: tapIfName, mac: mac}) }
+}
+
+// WithCPUID applies tweaks to the CPUID of every vCPU.
+func WithCPUID(tweaks ...cpuidpkg.Tweak) Option {
+	return func(o *options) { o.cpuid = append(o.cpuid, tweaks...) }
+}
+
+// WithCPUModel sets the CPU model of every vCPU, see SetCPUModel.
+func WithCPUModel(model cpuidpkg.Model) Option {
+	return func(o *options) { o.model = model }
+}
+
+// WithConsole connects COM1 to in and out, see SetConsole.
+func WithConsole(in io.Reader, out io.Writer) Option {
+	return WithSerial(0, in, out)
+}
+
+// WithSerial adds the serial port, 0 for COM1 to 3 for COM4, connected
+// to in and out, see SetSerial.
+func WithSerial(port int, in io.Reader, out io.Writer) Option {
+	return func(o *options) { o.serials = append(o.serials, serialOpt{port: port, in: in, out: out}) }
+}
+
+// WithVirtioConsole adds a virtio console device with the given ports,
+// see AddConsole.
+func WithVirtioConsole(ports ...virtio.ConsolePort) Option {
+	return func(o *options) { o.vports = ports }
+}
+
+// WithVsock adds a virtio socket device for the guest at cid, see
+// AddVsock.
+func WithVsock(cid uint64, udsPath string) Option {
+	return func(o *options) {
+		o.vsockCID = cid
+		o.vsockPath = udsPath
+	}
+}
+
+// WithRng adds a virtio entropy device, see AddRng.
+func WithRng(source string) Option {
+	return func(o *options) {
+		o.rng = true
+		o.rngSource = source
+	}
+}
+
+// WithBalloon adds a virtio memory balloon device, see AddBalloon.
+func WithBalloon() Option {
+	return func(o *options) { o.balloon = true }
+}
+
+// WithMemHotplug adds a virtio-mem device with a region of size bytes,
+// see AddMemHotplug.
+func WithMemHotplug(size uint64) Option {
+	return func(o *options) { o.memHotplug = size }
+}
+
+// WithShare adds a virtio 9p device serving the host directory at path,
+// see AddShare.
+func WithShare(tag, path string, readOnly bool) Option {
+	return func(o *options) { o.shares = append(o.shares, share{tag: tag, path: path, readOnly: readOnly}) }
+}
+
+// WithQueueSize sets the size of the queues of the virtio devices, see
+// SetQueueSize.
+func WithQueueSize(size uint16) Option {
+	return func(o *options) { o.queueSize = size }
+}
+
+// WithVCPUSched makes the host thread running cpu follow p, see
+// SetVCPUSched.
+func WithVCPUSched(cpu int, p sched.Policy) Option {
+	return func(o *options) {
+		if o.vcpuSched == nil {
+			o.vcpuSched = make(map[int]sched.Policy)
+		}
+
+		o.vcpuSched[cpu] = p
+	}
+}
+
+// WithIOSched runs the IO threads of the devices on host threads of
+// their own following p, see SetIOSched.
+func WithIOSched(p sched.Policy) Option {
+	return func(o *options) { o.ioSched = p }
+}
+
+// Build creates a machine with its devices and, if WithKernel is
+// given, loads the kernel so that the machine is ready for Start. The
+// machine is closed if a step fails, and is the caller's to Close
+// otherwise.
+func Build(opts ...Option) (_ *Machine, err error) {
+	o := &options{
+		dev:     "/dev/kvm",
+		nCPUs:   1,
+		memSize: 1 << 30,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	m, err := newMachine(o.dev, o.nCPUs, o.memSize, o.backing, o.topology, o.nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			m.Close()
+		}
+	}()
+
+	if o.maxCPUs != 0 {
+		if err := m.SetMaxCPUs(o.maxCPUs); err != nil {
+			return nil, err
+		}
+	}
+
+	for cpu, p := range o.vcpuSched {
+		if err := m.SetVCPUSched(cpu, p); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.SetIOSched(o.ioSched); err != nil {
+		return nil, err
+	}
+
+	if o.queueSize != 0 {
+		if err := m.SetQueueSize(o.queueSize); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range o.serials {
+		if err := m.SetSerial(s.port, s.in, s.out); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, n := range o.nics {
+		if err := m.AddNIC(n.tapIfName, n.mac); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, d := range o.disks {
+		if err := m.AddDisk(d.path, d.mode); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(o.luns) > 0 {
+		if err := m.AddSCSI(o.luns); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(o.vports) > 0 {
+		if err := m.AddConsole(o.vports); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.vsockPath != "" {
+		if err := m.AddVsock(o.vsockCID, o.vsockPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.rng {
+		if err := m.AddRng(o.rngSource); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, sh := range o.shares {
+		if err := m.AddShare(sh.tag, sh.path, sh.readOnly); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.balloon {
+		if err := m.AddBalloon(); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.memHotplug != 0 {
+		if err := m.AddMemHotplug(o.memHotplug); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.model.Name != "" {
+		if err := m.SetCPUModel(o.model); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(o.cpuid) > 0 {
+		if err := m.SetCPUIDTweaks(o.cpuid); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.kernel != "" {
+		if err := m.LoadKernel(o.kernel, o.initrd, o.params); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
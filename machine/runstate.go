@@ -0,0 +1,204 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+)
+
+// ErrStopped indicates the machine was stopped from the host side.
+var ErrStopped = errors.New("machine stopped")
+
+// kickSignal is sent to a vCPU thread to force KVM_RUN to return.
+// The Go runtime catches SIGUSR1 and ignores it unless someone asked
+// for it with signal.Notify, so it is safe to use here.
+const kickSignal = syscall.SIGUSR1
+
+// runState tracks whether vCPUs are allowed to enter the guest.
+// A vCPU parks in waitRunnable while the machine is paused and
+// returns ErrStopped once the machine is stopped.
+type runState struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	paused  bool
+	stopped bool
+
+	// reason is reported by Start once the machine is stopped.
+	reason ExitReason
+
+	// active counts vCPUs inside RunInfiniteLoop, parked counts
+	// those of them that are waiting for Resume.
+	active int
+	parked int
+
+	// tids holds the host thread id of each running vCPU, or 0.
+	tids []int
+
+	// spawn runs a vCPU while Start is running and any of its vCPUs
+	// is, running counts them.
+	spawn   func(cpu int)
+	running int
+}
+
+func (m *Machine) initRunState() {
+	m.rs.cond = sync.NewCond(&m.rs.mu)
+	m.rs.tids = make([]int, len(m.vcpuFds))
+}
+
+// startCPU runs cpu if the machine is running. Must be called with mu
+// held.
+func (rs *runState) startCPU(cpu int) {
+	// Once no vCPU runs, Start is about to return.
+	if rs.spawn != nil && rs.running > 0 {
+		rs.spawn(cpu)
+	}
+}
+
+// kick forces every vCPU currently in KVM_RUN back to userspace.
+// ImmediateExit covers the window where the signal arrives before
+// the vCPU thread has entered the guest. Must be called with rs.mu held.
+func (m *Machine) kick() {
+	for cpu := 0; cpu < m.NumCPUs(); cpu++ {
+		m.kickOne(cpu)
+	}
+}
+
+func (m *Machine) kickOne(cpu int) {
+	m.runs[cpu].ImmediateExit = 1
+
+	if tid := m.rs.tids[cpu]; tid != 0 {
+		_ = syscall.Tgkill(syscall.Getpid(), tid, kickSignal)
+	}
+}
+
+// kickCPU makes cpu notice that its context is done, whether it
+// is in the guest or parked by Pause.
+func (m *Machine) kickCPU(cpu int) {
+	m.rs.mu.Lock()
+	defer m.rs.mu.Unlock()
+
+	m.kickOne(cpu)
+	m.rs.cond.Broadcast()
+}
+
+// enterLoop registers the calling thread as the host thread of cpu.
+func (m *Machine) enterLoop(cpu int) {
+	m.rs.mu.Lock()
+	defer m.rs.mu.Unlock()
+
+	m.rs.tids[cpu] = syscall.Gettid()
+	m.rs.active++
+}
+
+func (m *Machine) leaveLoop(cpu int) {
+	m.rs.mu.Lock()
+	defer m.rs.mu.Unlock()
+
+	m.rs.tids[cpu] = 0
+	m.rs.active--
+	m.rs.cond.Broadcast()
+}
+
+// waitRunnable blocks while the machine is paused. It returns
+// ErrStopped if the machine has been stopped, and the error of
+// ctx once it is done.
+func (m *Machine) waitRunnable(ctx context.Context, cpu int) error {
+	m.rs.mu.Lock()
+	defer m.rs.mu.Unlock()
+
+	if m.rs.paused && !m.rs.stopped && ctx.Err() == nil {
+		m.rs.parked++
+		m.rs.cond.Broadcast()
+
+		for m.rs.paused && !m.rs.stopped && ctx.Err() == nil {
+			m.rs.cond.Wait()
+		}
+
+		m.rs.parked--
+	}
+
+	if m.rs.stopped {
+		return ErrStopped
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.runs[cpu].ImmediateExit = 0
+
+	return nil
+}
+
+// Pause stops all vCPUs and waits until each of them has left the guest.
+func (m *Machine) Pause() error {
+	m.rs.mu.Lock()
+	defer m.rs.mu.Unlock()
+
+	if m.rs.stopped {
+		return ErrStopped
+	}
+
+	m.rs.paused = true
+	m.kick()
+
+	for m.rs.parked < m.rs.active {
+		m.rs.cond.Wait()
+	}
+
+	return nil
+}
+
+// Resume lets vCPUs stopped by Pause run again.
+func (m *Machine) Resume() error {
+	m.rs.mu.Lock()
+	defer m.rs.mu.Unlock()
+
+	if m.rs.stopped {
+		return ErrStopped
+	}
+
+	m.rs.paused = false
+	m.rs.cond.Broadcast()
+
+	return nil
+}
+
+// Paused reports whether the vCPUs are held by Pause.
+func (m *Machine) Paused() bool {
+	m.rs.mu.Lock()
+	defer m.rs.mu.Unlock()
+
+	return m.rs.paused
+}
+
+// Stop makes every RunInfiniteLoop return ErrStopped. A stopped
+// machine cannot be resumed.
+func (m *Machine) Stop() {
+	m.Shutdown(ExitStopped)
+}
+
+// Shutdown stops the machine like Stop, and makes Start report reason.
+// Only the reason of the first call is kept.
+func (m *Machine) Shutdown(reason ExitReason) {
+	m.rs.mu.Lock()
+	defer m.rs.mu.Unlock()
+
+	if !m.rs.stopped {
+		m.rs.reason = reason
+	}
+
+	m.rs.stopped = true
+	m.kick()
+	m.rs.cond.Broadcast()
+}
+
+// stopReason returns the reason given to Shutdown.
+func (m *Machine) stopReason() ExitReason {
+	m.rs.mu.Lock()
+	defer m.rs.mu.Unlock()
+
+	return m.rs.reason
+}
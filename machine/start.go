@@ -0,0 +1,185 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"golang.org/x/sync/errgroup"
+)
+
+// ExitReason tells why a machine started with Start stopped running.
+type ExitReason int
+
+const (
+	// ExitStopped means the host stopped the machine, with Stop or by
+	// cancelling the context given to Start.
+	ExitStopped ExitReason = iota
+
+	// ExitPoweroff means the guest entered the ACPI S5 sleep state, or
+	// the host powered the machine off with Shutdown.
+	ExitPoweroff
+
+	// ExitReset means the guest asked for a reboot through port 0xcf9,
+	// or a vCPU triple faulted.
+	ExitReset
+
+	// ExitDebug means the guest wrote to DebugExitPort.
+	ExitDebug
+
+	// ExitCrash means a vCPU failed, e.g. on an unexpected exit reason.
+	ExitCrash
+)
+
+func (r ExitReason) String() string {
+	switch r {
+	case ExitStopped:
+		return "stopped"
+	case ExitPoweroff:
+		return "poweroff"
+	case ExitReset:
+		return "reset"
+	case ExitDebug:
+		return "debug exit"
+	case ExitCrash:
+		return "crash"
+	default:
+		return fmt.Sprintf("ExitReason(%d)", int(r))
+	}
+}
+
+// Exit describes how a machine stopped. Code is meant as the exit code
+// of a process wrapping the machine: the guest supplied value for
+// ExitDebug, 1 for ExitCrash and 0 otherwise. For ExitCrash, CPU is the
+// vCPU which failed and KVMExit the reason of its last exit from KVM_RUN.
+type Exit struct {
+	Reason  ExitReason
+	Code    int
+	CPU     int
+	KVMExit kvm.ExitType
+}
+
+// DebugExitError is returned by a vCPU whose guest wrote to DebugExitPort.
+type DebugExitError struct {
+	Code int
+}
+
+func (e *DebugExitError) Error() string {
+	return fmt.Sprintf("debug exit with code %d", e.Code)
+}
+
+// exitOf maps the error that ended a vCPU to the exit of the machine.
+func exitOf(err error) Exit {
+	var debugExit *DebugExitError
+
+	switch {
+	case errors.Is(err, ErrWriteToCF9), errors.Is(err, ErrTripleFault):
+		return Exit{Reason: ExitReset}
+	case errors.As(err, &debugExit):
+		return Exit{Reason: ExitDebug, Code: debugExit.Code}
+	default:
+		return Exit{Reason: ExitCrash, Code: 1}
+	}
+}
+
+// Start runs all vCPUs of a loaded machine and blocks until the guest
+// exits, Stop or Shutdown is called, or ctx is done. The first vCPU to
+// fail, reset or debug exit brings the others down. The error is the one
+// of the vCPU for ExitCrash, ctx.Err() if ctx ended the machine, and nil
+// otherwise. A machine can be started only once.
+//
+// The input of each serial port set with SetConsole or SetSerial is fed
+// as is to its UART until it returns an error, see serial.Serial.Feed.
+func (m *Machine) Start(ctx context.Context) (Exit, error) {
+	if m.serials[0].uart == nil {
+		return Exit{Reason: ExitCrash, Code: 1}, ErrNotLoaded
+	}
+
+	defer m.Stop()
+
+	for i, p := range m.serials {
+		if p.uart == nil || p.in == nil {
+			continue
+		}
+
+		i, p := i, p
+
+		go func() {
+			err := p.uart.Feed(p.in)
+			log.Printf("Serial COM%d exits: %v", i+1, err)
+		}()
+	}
+
+	var (
+		mu     sync.Mutex
+		first  error
+		failed int
+	)
+
+	g, gctx := errgroup.WithContext(ctx)
+
+	// Each vCPU, including those added by AddCPU while the others run,
+	// is counted in rs.running until its goroutine is about to end, so
+	// that none is added to g once g.Wait may have returned.
+	m.rs.mu.Lock()
+	m.rs.spawn = func(cpu int) {
+		m.rs.running++
+
+		g.Go(func() error {
+			defer func() {
+				m.rs.mu.Lock()
+				m.rs.running--
+				m.rs.mu.Unlock()
+			}()
+
+			err := m.VCPU(gctx, m.traceOut, cpu, m.traceCount)
+
+			if errors.Is(err, ErrStopped) ||
+				errors.Is(err, context.Canceled) ||
+				errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if first == nil {
+				first, failed = err, cpu
+			}
+
+			// Returning the error cancels gctx, which kicks the others.
+			return err
+		})
+	}
+
+	for cpu := 0; cpu < m.NumCPUs(); cpu++ {
+		m.rs.spawn(cpu)
+	}
+	m.rs.mu.Unlock()
+
+	_ = g.Wait()
+
+	m.rs.mu.Lock()
+	m.rs.spawn = nil
+	m.rs.mu.Unlock()
+
+	switch {
+	case first != nil:
+		exit := exitOf(first)
+		if exit.Reason != ExitCrash {
+			return exit, nil
+		}
+
+		exit.CPU = failed
+		exit.KVMExit = kvm.ExitType(m.runs[failed].ExitReason)
+
+		return exit, first
+	case ctx.Err() != nil:
+		return Exit{Reason: ExitStopped}, ctx.Err()
+	default:
+		return Exit{Reason: m.stopReason()}, nil
+	}
+}
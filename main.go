@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/bobuhiro11/gokvm/flag"
+	"github.com/bobuhiro11/gokvm/machine"
 	"github.com/bobuhiro11/gokvm/probe"
 	"github.com/bobuhiro11/gokvm/vmm"
 )
@@ -21,11 +27,62 @@ func main() {
 			Kernel:     bootArgs.Kernel,
 			Initrd:     bootArgs.Initrd,
 			Params:     bootArgs.Params,
-			TapIfName:  bootArgs.TapIfName,
-			Disk:       bootArgs.Disk,
 			NCPUs:      bootArgs.NCPUs,
+			MaxCPUs:    bootArgs.MaxCPUs,
+			Topology:   bootArgs.Topology,
 			MemSize:    bootArgs.MemSize,
 			TraceCount: bootArgs.TraceCount,
+			QMPSocket:  bootArgs.QMPSocket,
+			CPUID:      bootArgs.CPUID,
+			CPUModel:   bootArgs.CPUModel,
+			Serials:    bootArgs.Serials,
+			VsockPath:  bootArgs.VsockPath,
+			VsockCID:   bootArgs.VsockCID,
+			Rng:        bootArgs.Rng,
+			RngSource:  bootArgs.RngSource,
+			Balloon:    bootArgs.Balloon,
+			QueueSize:  uint16(bootArgs.QueueSize),
+
+			MemPath:      bootArgs.MemPath,
+			MemHugepages: bootArgs.MemHugepages,
+			MemPrealloc:  bootArgs.MemPrealloc,
+			MemHotplug:   uint64(bootArgs.MemHotplug),
+
+			VCPUAffinity: bootArgs.VCPUAffinity,
+			VCPUPriority: bootArgs.VCPUPriority,
+			IOAffinity:   bootArgs.IOAffinity,
+		}
+
+		for _, n := range bootArgs.NUMA {
+			c.NUMA = append(c.NUMA, machine.NUMANode{CPUs: n.CPUs, Size: n.Size, HostNodes: n.HostNodes})
+		}
+
+		for _, d := range bootArgs.Disks {
+			c.Disks = append(c.Disks, vmm.Disk{Path: d.Path, ReadOnly: d.ReadOnly, Snapshot: d.Snapshot})
+		}
+
+		for _, d := range bootArgs.SCSI {
+			c.SCSI = append(c.SCSI, vmm.Disk{Path: d.Path, ReadOnly: d.ReadOnly, Snapshot: d.Snapshot})
+		}
+
+		for _, s := range bootArgs.Shares {
+			c.Shares = append(c.Shares, vmm.Share{Tag: s.Tag, Path: s.Path, ReadOnly: s.ReadOnly})
+		}
+
+		for _, p := range bootArgs.VPorts {
+			c.VPorts = append(c.VPorts, vmm.VPort{Name: p.Name, Console: p.Console, Backend: p.Backend})
+		}
+
+		for _, n := range bootArgs.NICs {
+			nic := vmm.NIC{TapIfName: n.Tap}
+
+			if len(n.MAC) > 0 {
+				if nic.MAC, err = net.ParseMAC(n.MAC); err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			c.NICs = append(c.NICs, nic)
 		}
 
 		vmm := vmm.New(*c)
@@ -35,12 +92,32 @@ func main() {
 		}
 
 		if err := vmm.Setup(); err != nil {
+			vmm.Close()
 			log.Fatal(err)
 		}
 
-		if err := vmm.Boot(); err != nil {
-			log.Fatal(err)
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
+		exit, err := vmm.Boot(ctx)
+
+		stop()
+
+		if err := vmm.Close(); err != nil {
+			log.Print(err)
+		}
+
+		switch {
+		case errors.Is(err, context.Canceled):
+			// Interrupted by a signal.
+		case err != nil:
+			log.Print(err)
+
+			if exit.Code == 0 {
+				exit.Code = 1
+			}
 		}
+
+		os.Exit(exit.Code)
 	}
 
 	if probeArgs != nil {
@@ -0,0 +1,184 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrUnaligned indicates a size of RAM backed by huge pages which is not
+// a multiple of their size.
+var ErrUnaligned = errors.New("memory size is not a multiple of the huge page size")
+
+// Backing selects how Alloc backs RAM on the host. The zero value is
+// anonymous memory.
+type Backing struct {
+	// Path is a file backing RAM, or a directory, e.g. a hugetlbfs
+	// mount, in which Alloc creates an unlinked one.
+	Path string
+
+	// Hugepages backs RAM with a hugetlb memfd when Path is empty.
+	Hugepages bool
+
+	// Prealloc allocates all of RAM up front, so that missing huge
+	// pages make Alloc fail rather than the guest crash later.
+	Prealloc bool
+
+	// Binds place ranges of RAM on host NUMA nodes. Alloc binds them
+	// before it allocates anything, so that Prealloc honors them.
+	Binds []Bind
+}
+
+// Alloc maps size bytes of RAM, shared with its backing if any. Memory
+// not backed by huge pages is advised to use transparent ones, which take
+// fewer EPT misses. Anonymous RAM is private, as shared anonymous memory
+// is shmem, which only takes them when shmem_enabled says so.
+func Alloc(size int, b Backing) ([]byte, error) {
+	f, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+
+	fd, flags, huge := -1, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS, false
+
+	// Bound RAM is populated once bound instead.
+	populate := b.Prealloc && len(b.Binds) == 0
+
+	if f != nil {
+		defer f.Close()
+
+		fd, flags = int(f.Fd()), unix.MAP_SHARED
+
+		if huge, err = sizeFile(f, size, populate); err != nil {
+			return nil, err
+		}
+	}
+
+	if populate {
+		flags |= unix.MAP_POPULATE
+	}
+
+	mem, err := unix.Mmap(fd, 0, size, unix.PROT_READ|unix.PROT_WRITE, flags)
+	if err != nil {
+		return nil, fmt.Errorf("mapping %#x bytes of RAM: %w", size, err)
+	}
+
+	if !huge {
+		// Only a hint, which kernels without THP reject.
+		_ = unix.Madvise(mem, unix.MADV_HUGEPAGE)
+	}
+
+	for _, bind := range b.Binds {
+		if err := bind.mbind(mem); err != nil {
+			_ = unix.Munmap(mem)
+
+			return nil, err
+		}
+	}
+
+	if b.Prealloc && !populate {
+		if err := unix.Madvise(mem, unix.MADV_POPULATE_WRITE); err != nil {
+			_ = unix.Munmap(mem)
+
+			return nil, fmt.Errorf("allocating %#x bytes of RAM: %w", size, err)
+		}
+	}
+
+	return mem, nil
+}
+
+// Free unmaps mem, RAM mapped by Alloc.
+func Free(mem []byte) error {
+	if err := unix.Munmap(mem); err != nil {
+		return fmt.Errorf("unmapping %#x bytes of RAM: %w", len(mem), err)
+	}
+
+	return nil
+}
+
+// Discard gives the pages of mem, RAM mapped by Alloc, back to the host,
+// so that they read as zero and take no host memory until written again.
+// RAM shared with its backing has a hole punched in the backing with
+// MADV_REMOVE, where MADV_DONTNEED would only drop the page tables, and
+// anonymous RAM, which MADV_REMOVE rejects, is dropped with MADV_DONTNEED.
+// mem must cover whole pages, huge ones if RAM is backed by them.
+func Discard(mem []byte) error {
+	err := unix.Madvise(mem, unix.MADV_REMOVE)
+	if errors.Is(err, unix.EINVAL) {
+		err = unix.Madvise(mem, unix.MADV_DONTNEED)
+	}
+
+	if err != nil {
+		return fmt.Errorf("discarding %#x bytes of RAM: %w", len(mem), err)
+	}
+
+	return nil
+}
+
+// open returns the file backing RAM, or nil for anonymous memory.
+func (b Backing) open() (*os.File, error) {
+	switch {
+	case b.Path != "":
+		fi, err := os.Stat(b.Path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		if err != nil || !fi.IsDir() {
+			return os.OpenFile(b.Path, os.O_RDWR|os.O_CREATE, 0o600)
+		}
+
+		f, err := os.CreateTemp(b.Path, "gokvm-ram-")
+		if err != nil {
+			return nil, err
+		}
+
+		// The mapping keeps it alive.
+		if err := os.Remove(f.Name()); err != nil {
+			f.Close()
+
+			return nil, err
+		}
+
+		return f, nil
+	case b.Hugepages:
+		fd, err := unix.MemfdCreate("gokvm-ram", unix.MFD_CLOEXEC|unix.MFD_HUGETLB)
+		if err != nil {
+			return nil, fmt.Errorf("memfd with huge pages: %w", err)
+		}
+
+		return os.NewFile(uintptr(fd), "memfd:gokvm-ram"), nil
+	}
+
+	return nil, nil
+}
+
+// sizeFile makes f size bytes, allocated if prealloc is set, and tells
+// whether it is backed by huge pages.
+func sizeFile(f *os.File, size int, prealloc bool) (bool, error) {
+	var st unix.Statfs_t
+
+	if err := unix.Fstatfs(int(f.Fd()), &st); err != nil {
+		return false, err
+	}
+
+	huge := st.Type == unix.HUGETLBFS_MAGIC
+
+	if huge && size%int(st.Bsize) != 0 {
+		return true, fmt.Errorf("%#x bytes in %#x byte pages: %w", size, st.Bsize, ErrUnaligned)
+	}
+
+	if err := f.Truncate(int64(size)); err != nil {
+		return huge, err
+	}
+
+	if prealloc {
+		if err := unix.Fallocate(int(f.Fd()), 0, 0, int64(size)); err != nil {
+			return huge, fmt.Errorf("allocating %#x bytes of RAM in %s: %w", size, f.Name(), err)
+		}
+	}
+
+	return huge, nil
+}
@@ -0,0 +1,180 @@
+package memory_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"golang.org/x/sys/unix"
+)
+
+func TestAllocAnonymous(t *testing.T) {
+	t.Parallel()
+
+	for _, prealloc := range []bool{false, true} {
+		mem, err := memory.Alloc(1<<21, memory.Backing{Prealloc: prealloc})
+		if err != nil {
+			t.Fatalf("prealloc %v: %v", prealloc, err)
+		}
+
+		if len(mem) != 1<<21 {
+			t.Errorf("prealloc %v: got %#x bytes, want 0x200000", prealloc, len(mem))
+		}
+
+		mem[len(mem)-1] = 1
+
+		// Private, so that transparent huge pages back it even if
+		// shmem does not take them.
+		if perms := mapPerms(t, mem); perms != "rw-p" {
+			t.Errorf("prealloc %v: got %s mapping, want rw-p", prealloc, perms)
+		}
+	}
+}
+
+// mapPerms returns the permissions /proc/self/maps tells for the mapping
+// holding mem.
+func mapPerms(t *testing.T, mem []byte) string {
+	t.Helper()
+
+	maps, err := os.ReadFile("/proc/self/maps")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := uint64(uintptr(unsafe.Pointer(&mem[0])))
+
+	for _, line := range strings.Split(string(maps), "\n") {
+		var start, end uint64
+
+		var perms string
+
+		if _, err := fmt.Sscanf(line, "%x-%x %s", &start, &end, &perms); err == nil && start <= addr && addr < end {
+			return perms
+		}
+	}
+
+	t.Fatalf("no mapping of %#x in %s", addr, maps)
+
+	return ""
+}
+
+func TestAllocFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "ram")
+
+	mem, err := memory.Alloc(0x4000, memory.Backing{Path: path, Prealloc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copy(mem[0x1000:], "ram")
+
+	// The file is shared with the mapping.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) != 0x4000 || !bytes.Equal(b[0x1000:0x1003], []byte("ram")) {
+		t.Errorf("the file does not hold the RAM")
+	}
+}
+
+func TestAllocDir(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	if _, err := memory.Alloc(0x4000, memory.Backing{Path: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file in the directory is unlinked.
+	if es, err := os.ReadDir(dir); err != nil || len(es) != 0 {
+		t.Errorf("got (%v, %v) in %s, want nothing", es, err, dir)
+	}
+
+	if _, err := memory.Alloc(0x4000, memory.Backing{Path: filepath.Join(dir, "none", "ram")}); err == nil {
+		t.Errorf("got nil, want an error for a missing directory")
+	}
+}
+
+func TestAllocHugepages(t *testing.T) {
+	t.Parallel()
+
+	mem, err := memory.Alloc(1<<21, memory.Backing{Hugepages: true, Prealloc: true})
+	if err != nil {
+		t.Skipf("no huge pages: %v", err)
+	}
+
+	mem[0] = 1
+
+	if _, err := memory.Alloc(1<<21+0x1000, memory.Backing{Hugepages: true}); err == nil {
+		t.Errorf("got nil, want %v", memory.ErrUnaligned)
+	}
+}
+
+func TestAllocBind(t *testing.T) {
+	t.Parallel()
+
+	b := memory.Backing{Prealloc: true, Binds: []memory.Bind{{Offset: 0x1000, Size: 0x2000, Nodes: []int{0}}}}
+
+	mem, err := memory.Alloc(0x4000, b)
+	if errors.Is(err, unix.ENOSYS) {
+		t.Skipf("no NUMA: %v", err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem[0x2000] = 1
+
+	for _, tt := range []struct {
+		bind memory.Bind
+		want error
+	}{
+		{memory.Bind{Size: 0x1000, Nodes: []int{memory.MaxHostNodes}}, memory.ErrInvalidNode},
+		{memory.Bind{Offset: 0x3000, Size: 0x2000, Nodes: []int{0}}, memory.ErrOutOfRange},
+	} {
+		if _, err := memory.Alloc(0x4000, memory.Backing{Binds: []memory.Bind{tt.bind}}); !errors.Is(err, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.bind, err, tt.want)
+		}
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	t.Parallel()
+
+	for _, b := range []memory.Backing{{}, {Path: filepath.Join(t.TempDir(), "ram")}} {
+		mem, err := memory.Alloc(0x4000, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range mem {
+			mem[i] = 0xff
+		}
+
+		if err := memory.Discard(mem[0x1000:0x3000]); errors.Is(err, unix.EOPNOTSUPP) {
+			t.Logf("%+v: no hole punching: %v", b, err)
+
+			continue
+		} else if err != nil {
+			t.Fatalf("%+v: %v", b, err)
+		}
+
+		for page, want := range []byte{0xff, 0, 0, 0xff} {
+			if got := mem[page*0x1000+0x10]; got != want {
+				t.Errorf("%+v: page %d: got %#x, want %#x", b, page, got, want)
+			}
+		}
+	}
+}
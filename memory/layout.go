@@ -0,0 +1,42 @@
+package memory
+
+const (
+	// PCIHoleStart is where the 32-bit PCI hole starts. RAM below 4 GiB
+	// ends there, leaving the rest up to 4 GiB to the MMIO of devices,
+	// the PCI config space, the IOAPIC and the LAPIC.
+	PCIHoleStart = 0xC000_0000
+
+	// HighStart is where RAM continues above the PCI hole.
+	HighStart = 1 << 32
+)
+
+// Layout places ram in the guest physical address space: from 0 up to
+// PCIHoleStart, then the rest from HighStart. The regions share ram.
+func Layout(ram []byte) []Region {
+	if len(ram) <= PCIHoleStart {
+		return []Region{{GPA: 0, Data: ram}}
+	}
+
+	return []Region{
+		{GPA: 0, Data: ram[:PCIHoleStart:PCIHoleStart]},
+		{GPA: HighStart, Data: ram[PCIHoleStart:]},
+	}
+}
+
+// Split returns how many bytes of RAM the memory holds below 4 GiB and
+// from 4 GiB on.
+func (g *GuestMemory) Split() (below, above uint64) {
+	for _, r := range g.Regions() {
+		switch {
+		case r.End() <= HighStart:
+			below += uint64(len(r.Data))
+		case r.GPA >= HighStart:
+			above += uint64(len(r.Data))
+		default:
+			below += HighStart - r.GPA
+			above += r.End() - HighStart
+		}
+	}
+
+	return below, above
+}
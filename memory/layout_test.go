@@ -0,0 +1,82 @@
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"golang.org/x/sys/unix"
+)
+
+// reserve returns size bytes of address space, which is never touched
+// so that its size costs nothing.
+func reserve(t *testing.T, size int) []byte {
+	t.Helper()
+
+	b, err := unix.Mmap(-1, 0, size, unix.PROT_NONE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_NORESERVE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = unix.Munmap(b) })
+
+	return b
+}
+
+func TestLayout(t *testing.T) {
+	t.Parallel()
+
+	small := reserve(t, 1<<30)
+
+	rs := memory.Layout(small)
+	if len(rs) != 1 || rs[0].GPA != 0 || rs[0].End() != 1<<30 {
+		t.Fatalf("1 GiB: got %d regions, want [0, 1 GiB)", len(rs))
+	}
+
+	large := reserve(t, 5<<30)
+
+	rs = memory.Layout(large)
+	if len(rs) != 2 {
+		t.Fatalf("5 GiB: got %d regions, want 2", len(rs))
+	}
+
+	if rs[0].GPA != 0 || rs[0].End() != memory.PCIHoleStart {
+		t.Errorf("5 GiB: got [%#x, %#x) below 4 GiB, want [0, %#x)", rs[0].GPA, rs[0].End(), memory.PCIHoleStart)
+	}
+
+	if rs[1].GPA != memory.HighStart || rs[1].End() != memory.HighStart+2<<30 {
+		t.Errorf("5 GiB: got [%#x, %#x) above 4 GiB, want [4 GiB, 6 GiB)", rs[1].GPA, rs[1].End())
+	}
+
+	// The regions share the RAM, the first one must not grow into the
+	// second.
+	if cap(rs[0].Data) != memory.PCIHoleStart || &rs[1].Data[0] != &large[memory.PCIHoleStart] {
+		t.Errorf("5 GiB: the regions do not split the RAM")
+	}
+
+	m, err := memory.New(rs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Slice(memory.PCIHoleStart, 1); err == nil {
+		t.Errorf("the PCI hole is backed by RAM")
+	}
+
+	if below, above := m.Split(); below != 3<<30 || above != 2<<30 {
+		t.Errorf("split: got (%#x, %#x), want (3 GiB, 2 GiB)", below, above)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	t.Parallel()
+
+	// A region across 4 GiB counts on both sides.
+	m, err := memory.New(memory.Region{GPA: memory.HighStart - 0x1000, Data: make([]byte, 0x3000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if below, above := m.Split(); below != 0x1000 || above != 0x2000 {
+		t.Errorf("split: got (%#x, %#x), want (0x1000, 0x2000)", below, above)
+	}
+}
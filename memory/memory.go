@@ -0,0 +1,267 @@
+// Package memory gives checked access to the memory of a guest, so that
+// addresses and lengths taken from the guest can not crash the host.
+package memory
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrOutOfRange indicates an access to guest physical addresses
+	// which are not backed by a single region.
+	ErrOutOfRange = errors.New("guest memory access out of range")
+
+	// ErrOverlap indicates regions which share addresses.
+	ErrOverlap = errors.New("guest memory regions overlap")
+)
+
+// Region is a range of guest physical addresses from GPA, backed by
+// Data on the host.
+type Region struct {
+	GPA  uint64
+	Data []byte
+}
+
+// End returns the address past the region.
+func (r Region) End() uint64 {
+	return r.GPA + uint64(len(r.Data))
+}
+
+// GuestMemory is the memory of a guest, made of regions which may leave
+// holes between them.
+type GuestMemory struct {
+	// mu serializes Add and Remove, which replace the regions as a
+	// whole so that accesses need no lock.
+	mu      sync.Mutex
+	regions atomic.Pointer[[]Region]
+}
+
+// New returns the memory made of regions, which must not overlap.
+func New(regions ...Region) (*GuestMemory, error) {
+	rs, err := sorted(regions)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &GuestMemory{}
+	g.regions.Store(&rs)
+
+	return g, nil
+}
+
+// sorted returns a copy of regions by address, which must not overlap.
+func sorted(regions []Region) ([]Region, error) {
+	rs := append([]Region{}, regions...)
+	sort.Slice(rs, func(i, j int) bool { return rs[i].GPA < rs[j].GPA })
+
+	for i := 1; i < len(rs); i++ {
+		if rs[i].GPA < rs[i-1].End() {
+			return nil, fmt.Errorf("%w: %#x and %#x", ErrOverlap, rs[i-1].GPA, rs[i].GPA)
+		}
+	}
+
+	return rs, nil
+}
+
+// Add adds r to the memory, e.g. once it is hotplugged.
+func (g *GuestMemory) Add(r Region) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rs, err := sorted(append(g.Regions(), r))
+	if err != nil {
+		return err
+	}
+
+	g.regions.Store(&rs)
+
+	return nil
+}
+
+// Remove removes the region starting at gpa from the memory. Slices
+// taken from it before stay valid on the host.
+func (g *GuestMemory) Remove(gpa uint64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rs := []Region{}
+
+	for _, r := range g.Regions() {
+		if r.GPA != gpa {
+			rs = append(rs, r)
+		}
+	}
+
+	if len(rs) == len(g.Regions()) {
+		return fmt.Errorf("%w: no region at %#x", ErrOutOfRange, gpa)
+	}
+
+	g.regions.Store(&rs)
+
+	return nil
+}
+
+// Regions returns the regions of the memory, by address.
+func (g *GuestMemory) Regions() []Region {
+	return *g.regions.Load()
+}
+
+// Size returns how many bytes the regions hold.
+func (g *GuestMemory) Size() uint64 {
+	n := uint64(0)
+
+	for _, r := range g.Regions() {
+		n += uint64(len(r.Data))
+	}
+
+	return n
+}
+
+// region returns the region holding gpa.
+func (g *GuestMemory) region(gpa uint64) (Region, bool) {
+	rs := g.Regions()
+
+	i := sort.Search(len(rs), func(i int) bool { return rs[i].End() > gpa })
+	if i == len(rs) || gpa < rs[i].GPA {
+		return Region{}, false
+	}
+
+	return rs[i], true
+}
+
+// Slice returns the l bytes from gpa, which must be in a single region.
+// The slice is the memory itself, not a copy.
+func (g *GuestMemory) Slice(gpa, l uint64) ([]byte, error) {
+	r, ok := g.region(gpa)
+	if !ok || l > r.End()-gpa {
+		return nil, fmt.Errorf("%w: %#x bytes at %#x", ErrOutOfRange, l, gpa)
+	}
+
+	off := gpa - r.GPA
+
+	return r.Data[off : off+l : off+l], nil
+}
+
+// ReadAt implements io.ReaderAt over guest physical addresses. Reads may
+// span adjacent regions, but not holes.
+func (g *GuestMemory) ReadAt(b []byte, off int64) (int, error) {
+	return g.access(b, off, func(mem, b []byte) int { return copy(b, mem) })
+}
+
+// WriteAt implements io.WriterAt over guest physical addresses, like
+// ReadAt.
+func (g *GuestMemory) WriteAt(b []byte, off int64) (int, error) {
+	return g.access(b, off, func(mem, b []byte) int { return copy(mem, b) })
+}
+
+// access calls f with the memory from off and the rest of b, region by
+// region, and returns how much of b was done.
+func (g *GuestMemory) access(b []byte, off int64, f func(mem, b []byte) int) (int, error) {
+	n := 0
+
+	for n < len(b) {
+		gpa := uint64(off) + uint64(n)
+
+		r, ok := g.region(gpa)
+		if off < 0 || !ok {
+			return n, fmt.Errorf("%w: %#x bytes at %#x", ErrOutOfRange, len(b)-n, gpa)
+		}
+
+		n += f(r.Data[gpa-r.GPA:], b[n:])
+	}
+
+	return n, nil
+}
+
+// Uint8 returns the byte at gpa.
+func (g *GuestMemory) Uint8(gpa uint64) (uint8, error) {
+	b, err := g.Slice(gpa, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	return b[0], nil
+}
+
+// Uint16 returns the little-endian uint16 at gpa.
+func (g *GuestMemory) Uint16(gpa uint64) (uint16, error) {
+	b, err := g.Slice(gpa, 2)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+// Uint32 returns the little-endian uint32 at gpa.
+func (g *GuestMemory) Uint32(gpa uint64) (uint32, error) {
+	b, err := g.Slice(gpa, 4)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// Uint64 returns the little-endian uint64 at gpa.
+func (g *GuestMemory) Uint64(gpa uint64) (uint64, error) {
+	b, err := g.Slice(gpa, 8)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// PutUint8 writes x at gpa.
+func (g *GuestMemory) PutUint8(gpa uint64, x uint8) error {
+	b, err := g.Slice(gpa, 1)
+	if err != nil {
+		return err
+	}
+
+	b[0] = x
+
+	return nil
+}
+
+// PutUint16 writes x at gpa in little-endian.
+func (g *GuestMemory) PutUint16(gpa uint64, x uint16) error {
+	b, err := g.Slice(gpa, 2)
+	if err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint16(b, x)
+
+	return nil
+}
+
+// PutUint32 writes x at gpa in little-endian.
+func (g *GuestMemory) PutUint32(gpa uint64, x uint32) error {
+	b, err := g.Slice(gpa, 4)
+	if err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint32(b, x)
+
+	return nil
+}
+
+// PutUint64 writes x at gpa in little-endian.
+func (g *GuestMemory) PutUint64(gpa uint64, x uint64) error {
+	b, err := g.Slice(gpa, 8)
+	if err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint64(b, x)
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package memory_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/memory"
+)
+
+func newMemory(t *testing.T) *memory.GuestMemory {
+	t.Helper()
+
+	// Two adjacent regions, then a hole up to 0x3000.
+	m, err := memory.New(
+		memory.Region{GPA: 0x3000, Data: make([]byte, 0x1000)},
+		memory.Region{GPA: 0, Data: make([]byte, 0x1000)},
+		memory.Region{GPA: 0x1000, Data: make([]byte, 0x1000)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	m := newMemory(t)
+
+	if rs := m.Regions(); len(rs) != 3 || rs[0].GPA != 0 || rs[2].GPA != 0x3000 {
+		t.Errorf("regions: got %v, want them by address", rs)
+	}
+
+	if m.Size() != 0x3000 {
+		t.Errorf("size: got %#x, want 0x3000", m.Size())
+	}
+
+	if _, err := memory.New(
+		memory.Region{GPA: 0, Data: make([]byte, 0x1000)},
+		memory.Region{GPA: 0xfff, Data: make([]byte, 0x1000)},
+	); !errors.Is(err, memory.ErrOverlap) {
+		t.Errorf("got %v, want %v", err, memory.ErrOverlap)
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	t.Parallel()
+
+	m := newMemory(t)
+
+	if err := m.Add(memory.Region{GPA: 0x2000, Data: make([]byte, 0x1000)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hole is filled, so accesses span it.
+	if _, err := m.ReadAt(make([]byte, 0x4000), 0); err != nil {
+		t.Errorf("read across the added region: %v", err)
+	}
+
+	if err := m.Add(memory.Region{GPA: 0x3800, Data: make([]byte, 0x1000)}); !errors.Is(err, memory.ErrOverlap) {
+		t.Errorf("add an overlapping region: got %v, want %v", err, memory.ErrOverlap)
+	}
+
+	if err := m.Remove(0x1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Slice(0x1000, 1); !errors.Is(err, memory.ErrOutOfRange) {
+		t.Errorf("access the removed region: got %v, want %v", err, memory.ErrOutOfRange)
+	}
+
+	if err := m.Remove(0x1800); !errors.Is(err, memory.ErrOutOfRange) {
+		t.Errorf("remove at no region start: got %v, want %v", err, memory.ErrOutOfRange)
+	}
+
+	if m.Size() != 0x3000 {
+		t.Errorf("size: got %#x, want 0x3000", m.Size())
+	}
+}
+
+func TestSlice(t *testing.T) {
+	t.Parallel()
+
+	m := newMemory(t)
+
+	for _, tt := range []struct {
+		gpa, l uint64
+		ok     bool
+	}{
+		{gpa: 0, l: 0x1000, ok: true},
+		{gpa: 0x3ff0, l: 0x10, ok: true},
+		{gpa: 0xff0, l: 0x20},     // across regions
+		{gpa: 0x2000, l: 1},       // in the hole
+		{gpa: 0x3ff0, l: 0x11},    // past the end
+		{gpa: 0x3000, l: 1 << 63}, // overflowing
+		{gpa: ^uint64(0), l: 2},
+	} {
+		b, err := m.Slice(tt.gpa, tt.l)
+		if tt.ok && (err != nil || uint64(len(b)) != tt.l) {
+			t.Errorf("%#x+%#x: got %d bytes and %v", tt.gpa, tt.l, len(b), err)
+		}
+
+		if !tt.ok && !errors.Is(err, memory.ErrOutOfRange) {
+			t.Errorf("%#x+%#x: got %v, want %v", tt.gpa, tt.l, err, memory.ErrOutOfRange)
+		}
+	}
+}
+
+func TestReadWriteAt(t *testing.T) {
+	t.Parallel()
+
+	m := newMemory(t)
+	b := bytes.Repeat([]byte{0xab}, 0x20)
+
+	// Adjacent regions are written in one go.
+	if n, err := m.WriteAt(b, 0xff0); n != len(b) || err != nil {
+		t.Fatalf("got %d and %v", n, err)
+	}
+
+	actual := make([]byte, 0x20)
+	if n, err := m.ReadAt(actual, 0xff0); n != len(b) || err != nil || !bytes.Equal(actual, b) {
+		t.Fatalf("got %d, %v and %v", n, err, actual)
+	}
+
+	// Writes stop at the hole.
+	if n, err := m.WriteAt(b, 0x1ff0); n != 0x10 || !errors.Is(err, memory.ErrOutOfRange) {
+		t.Errorf("got %d and %v, want 16 and %v", n, err, memory.ErrOutOfRange)
+	}
+
+	if _, err := m.ReadAt(actual, -1); !errors.Is(err, memory.ErrOutOfRange) {
+		t.Errorf("got %v, want %v", err, memory.ErrOutOfRange)
+	}
+}
+
+func TestUint(t *testing.T) {
+	t.Parallel()
+
+	m := newMemory(t)
+
+	if err := m.PutUint64(0x3000, 0x0102030405060708); err != nil {
+		t.Fatal(err)
+	}
+
+	if x, err := m.Uint32(0x3000); x != 0x05060708 || err != nil {
+		t.Errorf("uint32: got %#x and %v", x, err)
+	}
+
+	if x, err := m.Uint16(0x3006); x != 0x0102 || err != nil {
+		t.Errorf("uint16: got %#x and %v", x, err)
+	}
+
+	if err := m.PutUint32(0xffe, 1); !errors.Is(err, memory.ErrOutOfRange) {
+		t.Errorf("across regions: got %v, want %v", err, memory.ErrOutOfRange)
+	}
+
+	if _, err := m.Uint8(0x2000); !errors.Is(err, memory.ErrOutOfRange) {
+		t.Errorf("in the hole: got %v, want %v", err, memory.ErrOutOfRange)
+	}
+}
@@ -0,0 +1,53 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// MaxHostNodes is the number of host NUMA nodes RAM can be bound to.
+const MaxHostNodes = 1024
+
+// ErrInvalidNode indicates a host NUMA node out of range.
+var ErrInvalidNode = errors.New("invalid host NUMA node")
+
+const (
+	mpolBind   = 2
+	mpolMFMove = 1 << 1
+)
+
+// Bind restricts the RAM from Offset to Offset+Size to the host NUMA
+// nodes Nodes. Both Offset and Size must be multiples of the page size.
+type Bind struct {
+	Offset, Size int
+	Nodes        []int
+}
+
+// mbind applies b to mem, moving the pages already allocated.
+func (b Bind) mbind(mem []byte) error {
+	var mask [MaxHostNodes / 64]uint64
+
+	for _, n := range b.Nodes {
+		if n < 0 || n >= MaxHostNodes {
+			return fmt.Errorf("node %d:%w", n, ErrInvalidNode)
+		}
+
+		mask[n/64] |= 1 << (n % 64)
+	}
+
+	if b.Offset < 0 || b.Size <= 0 || b.Offset+b.Size > len(mem) {
+		return fmt.Errorf("binding %#x bytes at %#x of %#x:%w", b.Size, b.Offset, len(mem), ErrOutOfRange)
+	}
+
+	// The kernel takes one bit less than maxnode.
+	_, _, errno := unix.Syscall6(unix.SYS_MBIND, uintptr(unsafe.Pointer(&mem[b.Offset])), uintptr(b.Size),
+		mpolBind, uintptr(unsafe.Pointer(&mask[0])), MaxHostNodes+1, mpolMFMove)
+	if errno != 0 {
+		return fmt.Errorf("binding %#x bytes at %#x to nodes %v: %w", b.Size, b.Offset, b.Nodes, errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package p9
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+// Message types of 9P2000.L. Each reply is the type of its request
+// plus one.
+//
+// refs https://github.com/torvalds/linux/blob/v6.1/include/net/9p/9p.h
+const (
+	Rlerror     = 7
+	Tstatfs     = 8
+	Tlopen      = 12
+	Tlcreate    = 14
+	Tsymlink    = 16
+	Tmknod      = 18
+	Trename     = 20
+	Treadlink   = 22
+	Tgetattr    = 24
+	Tsetattr    = 26
+	Txattrwalk  = 30
+	Txattrcreat = 32
+	Treaddir    = 40
+	Tfsync      = 50
+	Tlock       = 52
+	Tgetlock    = 54
+	Tlink       = 70
+	Tmkdir      = 72
+	Trenameat   = 74
+	Tunlinkat   = 76
+	Tversion    = 100
+	Tauth       = 102
+	Tattach     = 104
+	Tflush      = 108
+	Twalk       = 110
+	Tread       = 116
+	Twrite      = 118
+	Tclunk      = 120
+	Tremove     = 122
+)
+
+// Qid types.
+const (
+	qidDir     = 0x80
+	qidSymlink = 0x02
+	qidFile    = 0x00
+)
+
+// headerSize is the size of size[4] type[1] tag[2], which starts
+// every message.
+const headerSize = 7
+
+// qid identifies a file on the server.
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+// decoder reads the fields of a request. Reading past the end sets
+// err and returns zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = syscall.EINVAL
+		d.b = nil
+
+		return make([]byte, n)
+	}
+
+	b := d.b[:n]
+	d.b = d.b[n:]
+
+	return b
+}
+
+func (d *decoder) u8() uint8   { return d.next(1)[0] }
+func (d *decoder) u16() uint16 { return binary.LittleEndian.Uint16(d.next(2)) }
+func (d *decoder) u32() uint32 { return binary.LittleEndian.Uint32(d.next(4)) }
+func (d *decoder) u64() uint64 { return binary.LittleEndian.Uint64(d.next(8)) }
+
+func (d *decoder) str() string {
+	return string(d.next(int(d.u16())))
+}
+
+// encoder builds a reply.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) u8(v uint8)   { e.b = append(e.b, v) }
+func (e *encoder) u16(v uint16) { e.b = binary.LittleEndian.AppendUint16(e.b, v) }
+func (e *encoder) u32(v uint32) { e.b = binary.LittleEndian.AppendUint32(e.b, v) }
+func (e *encoder) u64(v uint64) { e.b = binary.LittleEndian.AppendUint64(e.b, v) }
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) qid(q qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
@@ -0,0 +1,1234 @@
+// Package p9 implements a 9P2000.L file server, which shares a host
+// directory with the guest over the virtio 9p transport, e.g.
+//
+//	mount -t 9p -o trans=virtio,version=9p2000.L TAG /mnt
+//
+// Files are created and accessed as the user running the VMM. Walks
+// never follow symbolic links, so that the guest cannot reach files
+// outside of the shared directory through one, and only directories
+// and regular files are opened on the host.
+//
+// refs https://github.com/chaos/diod/blob/master/protocol.md
+package p9
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Version is the only protocol version served.
+	Version = "9P2000.L"
+
+	// MaxMessageSize bounds the msize negotiated with the guest, so that
+	// a request and its reply, split into pages by the guest, fit in the
+	// virt queue of the device.
+	MaxMessageSize = 32 << 10
+
+	// minMessageSize is the smallest msize accepted.
+	minMessageSize = 4096
+
+	// maxWalk is the most names a walk may have.
+	maxWalk = 16
+
+	// ioHeaderSize is the size of the fields of Rread before its data,
+	// size[4] type[1] tag[2] count[4].
+	ioHeaderSize = headerSize + 4
+)
+
+// Bits of the valid mask of Tsetattr.
+const (
+	setattrMode     = 0x1
+	setattrUID      = 0x2
+	setattrGID      = 0x4
+	setattrSize     = 0x8
+	setattrAtime    = 0x10
+	setattrMtime    = 0x20
+	setattrAtimeSet = 0x80
+	setattrMtimeSet = 0x100
+)
+
+// getattrBasic is the valid mask of Rgetattr, all but btime, gen and
+// data_version.
+const getattrBasic = 0x7ff
+
+// lopenFlags are the open flags passed on to the host.
+const lopenFlags = syscall.O_ACCMODE | syscall.O_APPEND | syscall.O_TRUNC | syscall.O_EXCL | syscall.O_SYNC
+
+var ErrNotDir = errors.New("shared path is not a directory")
+
+// fid is a file of the guest.
+type fid struct {
+	path string
+	file *os.File
+
+	// dirents is the content of a directory read by Treaddir at
+	// offset 0, which later offsets index.
+	dirents []dirent
+}
+
+type dirent struct {
+	qid  qid
+	typ  uint8
+	name string
+}
+
+// Server serves the directory root.
+type Server struct {
+	mu sync.Mutex
+
+	root     string
+	readOnly bool
+	msize    uint32
+	fids     map[uint32]*fid
+
+	handlers map[uint8]func(*decoder, *encoder) error
+}
+
+// NewServer creates a server of the directory root. readOnly makes
+// every request that would change it fail with EROFS.
+func NewServer(root string, readOnly bool) (*Server, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s: %w", root, ErrNotDir)
+	}
+
+	s := &Server{
+		root:     root,
+		readOnly: readOnly,
+		msize:    MaxMessageSize,
+		fids:     map[uint32]*fid{},
+	}
+
+	s.handlers = map[uint8]func(*decoder, *encoder) error{
+		Tversion:    s.version,
+		Tattach:     s.attach,
+		Twalk:       s.walk,
+		Tlopen:      s.lopen,
+		Tlcreate:    s.lcreate,
+		Tread:       s.read,
+		Twrite:      s.write,
+		Tclunk:      s.clunk,
+		Tremove:     s.remove,
+		Tgetattr:    s.getattr,
+		Tsetattr:    s.setattr,
+		Treaddir:    s.readdir,
+		Tstatfs:     s.statfs,
+		Tmkdir:      s.mkdir,
+		Tsymlink:    s.symlink,
+		Treadlink:   s.readlink,
+		Tlink:       s.link,
+		Tmknod:      s.mknod,
+		Trename:     s.rename,
+		Trenameat:   s.renameat,
+		Tunlinkat:   s.unlinkat,
+		Tfsync:      s.fsync,
+		Tflush:      s.flush,
+		Tlock:       s.lock,
+		Tgetlock:    s.getlock,
+		Tauth:       unsupported,
+		Txattrwalk:  unsupported,
+		Txattrcreat: unsupported,
+	}
+
+	return s, nil
+}
+
+// Close clunks every fid, closing the files they opened.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for n := range s.fids {
+		s.clunkFid(n)
+	}
+
+	return nil
+}
+
+// MessageSize returns the msize negotiated with the guest.
+func (s *Server) MessageSize() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.msize
+}
+
+// Handle serves the request req and returns its reply.
+func (s *Server) Handle(req []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := &decoder{b: req}
+	size := d.u32()
+	typ := d.u8()
+	tag := d.u16()
+
+	if d.err == nil && int(size) <= len(req) && size >= headerSize {
+		d.b = req[headerSize:size]
+	} else {
+		d.err = syscall.EINVAL
+	}
+
+	e := &encoder{b: make([]byte, headerSize, 128)}
+
+	err := d.err
+
+	if h, ok := s.handlers[typ]; !ok {
+		err = syscall.EOPNOTSUPP
+	} else if err == nil {
+		err = h(d, e)
+	}
+
+	rtyp := typ + 1
+
+	if err != nil {
+		e.b = e.b[:headerSize]
+		e.u32(uint32(errno(err)))
+		rtyp = Rlerror
+	}
+
+	binary.LittleEndian.PutUint32(e.b, uint32(len(e.b)))
+	e.b[4] = rtyp
+	binary.LittleEndian.PutUint16(e.b[5:], tag)
+
+	return e.b
+}
+
+// errno returns the error number of err for Rlerror.
+func errno(err error) syscall.Errno {
+	var en syscall.Errno
+
+	if errors.As(err, &en) {
+		return en
+	}
+
+	return syscall.EIO
+}
+
+func (s *Server) fid(n uint32) (*fid, error) {
+	f, ok := s.fids[n]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	return f, nil
+}
+
+func (s *Server) writable() error {
+	if s.readOnly {
+		return syscall.EROFS
+	}
+
+	return nil
+}
+
+// child returns the path of name in the directory of f. name must be a
+// single component.
+func (s *Server) child(f *fid, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return "", syscall.EINVAL
+	}
+
+	return filepath.Join(f.path, name), nil
+}
+
+func (s *Server) clunkFid(n uint32) {
+	if f, ok := s.fids[n]; ok && f.file != nil {
+		f.file.Close()
+	}
+
+	delete(s.fids, n)
+}
+
+// moved updates the fids under oldPath once it was renamed to newPath.
+func (s *Server) moved(oldPath, newPath string) {
+	for _, f := range s.fids {
+		if f.path == oldPath {
+			f.path = newPath
+		} else if strings.HasPrefix(f.path, oldPath+"/") {
+			f.path = newPath + strings.TrimPrefix(f.path, oldPath)
+		}
+	}
+}
+
+func statOf(fi os.FileInfo) *syscall.Stat_t {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return &syscall.Stat_t{}
+	}
+
+	return st
+}
+
+func qidOf(fi os.FileInfo) qid {
+	st := statOf(fi)
+	q := qid{
+		typ:     qidFile,
+		version: uint32(st.Mtim.Sec) ^ uint32(st.Mtim.Nsec),
+		path:    st.Ino,
+	}
+
+	switch {
+	case fi.IsDir():
+		q.typ = qidDir
+	case fi.Mode()&os.ModeSymlink != 0:
+		q.typ = qidSymlink
+	}
+
+	return q
+}
+
+func lstatQid(path string) (qid, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return qid{}, err
+	}
+
+	return qidOf(fi), nil
+}
+
+func (s *Server) version(d *decoder, e *encoder) error {
+	msize := d.u32()
+	version := d.str()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	if msize < minMessageSize {
+		return syscall.EINVAL
+	}
+
+	// A new session starts.
+	for n := range s.fids {
+		s.clunkFid(n)
+	}
+
+	s.msize = MaxMessageSize
+	if msize < s.msize {
+		s.msize = msize
+	}
+
+	if version != Version {
+		version = "unknown"
+	}
+
+	e.u32(s.msize)
+	e.str(version)
+
+	return nil
+}
+
+func (s *Server) attach(d *decoder, e *encoder) error {
+	n := d.u32()
+	d.u32() // afid
+	d.str() // uname
+	d.str() // aname
+	d.u32() // n_uname
+
+	if d.err != nil {
+		return d.err
+	}
+
+	if _, ok := s.fids[n]; ok {
+		return syscall.EBADF
+	}
+
+	q, err := lstatQid(s.root)
+	if err != nil {
+		return err
+	}
+
+	s.fids[n] = &fid{path: s.root}
+	e.qid(q)
+
+	return nil
+}
+
+func (s *Server) walk(d *decoder, e *encoder) error {
+	n := d.u32()
+	newN := d.u32()
+	names := make([]string, d.u16())
+
+	for i := range names {
+		names[i] = d.str()
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.fids[newN]; ok && newN != n {
+		return syscall.EBADF
+	}
+
+	if len(names) > maxWalk {
+		return syscall.EINVAL
+	}
+
+	path := f.path
+	qids := []qid{}
+
+	for i, name := range names {
+		// Only a directory is walked through, never a link to one.
+		fi, err := os.Lstat(path)
+		if err == nil && !fi.IsDir() {
+			err = syscall.ENOTDIR
+		}
+
+		next := path
+
+		switch {
+		case err != nil:
+		case name == "..":
+			if path != s.root {
+				next = filepath.Dir(path)
+			}
+		default:
+			next, err = s.child(&fid{path: path}, name)
+		}
+
+		var q qid
+
+		if err == nil {
+			q, err = lstatQid(next)
+		}
+
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+
+			break
+		}
+
+		path = next
+		qids = append(qids, q)
+	}
+
+	if len(qids) == len(names) {
+		if newN == n {
+			s.clunkFid(n)
+		}
+
+		s.fids[newN] = &fid{path: path}
+	}
+
+	e.u16(uint16(len(qids)))
+
+	for _, q := range qids {
+		e.qid(q)
+	}
+
+	return nil
+}
+
+func (s *Server) lopen(d *decoder, e *encoder) error {
+	n := d.u32()
+	flags := int(d.u32())
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	if f.file != nil {
+		return syscall.EBADF
+	}
+
+	fi, err := os.Lstat(f.path)
+	if err != nil {
+		return err
+	}
+
+	flags &= lopenFlags
+
+	switch {
+	case fi.IsDir():
+		flags = syscall.O_RDONLY | syscall.O_DIRECTORY
+	case !fi.Mode().IsRegular():
+		return syscall.EPERM
+	case flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0:
+		if err := s.writable(); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(f.path, flags|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	f.file = file
+	f.dirents = nil
+
+	e.qid(qidOf(fi))
+	e.u32(0) // iounit, up to msize
+
+	return nil
+}
+
+func (s *Server) lcreate(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	flags := int(d.u32())
+	mode := d.u32()
+	d.u32() // gid
+
+	if d.err != nil {
+		return d.err
+	}
+
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	path, err := s.child(f, name)
+	if err != nil {
+		return err
+	}
+
+	flags = flags&lopenFlags | syscall.O_CREAT | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+
+	file, err := os.OpenFile(path, flags, os.FileMode(mode&0o777))
+	if err != nil {
+		return err
+	}
+
+	q, err := lstatQid(path)
+	if err != nil {
+		file.Close()
+
+		return err
+	}
+
+	// The fid now stands for the new file.
+	f.path = path
+	f.file = file
+	f.dirents = nil
+
+	e.qid(q)
+	e.u32(0)
+
+	return nil
+}
+
+func (s *Server) openFid(n uint32) (*fid, error) {
+	f, err := s.fid(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.file == nil {
+		return nil, syscall.EBADF
+	}
+
+	return f, nil
+}
+
+func (s *Server) read(d *decoder, e *encoder) error {
+	n := d.u32()
+	offset := d.u64()
+	count := d.u32()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := s.openFid(n)
+	if err != nil {
+		return err
+	}
+
+	if limit := s.msize - ioHeaderSize; count > limit {
+		count = limit
+	}
+
+	buf := make([]byte, count)
+
+	l, err := syscall.Pread(int(f.file.Fd()), buf, int64(offset))
+	if err != nil {
+		return err
+	}
+
+	e.u32(uint32(l))
+	e.b = append(e.b, buf[:l]...)
+
+	return nil
+}
+
+func (s *Server) write(d *decoder, e *encoder) error {
+	n := d.u32()
+	offset := d.u64()
+	data := d.next(int(d.u32()))
+
+	if d.err != nil {
+		return d.err
+	}
+
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	f, err := s.openFid(n)
+	if err != nil {
+		return err
+	}
+
+	// pwrite appends to a file opened with O_APPEND.
+	l, err := syscall.Pwrite(int(f.file.Fd()), data, int64(offset))
+	if err != nil {
+		return err
+	}
+
+	e.u32(uint32(l))
+
+	return nil
+}
+
+func (s *Server) clunk(d *decoder, _ *encoder) error {
+	n := d.u32()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	if _, err := s.fid(n); err != nil {
+		return err
+	}
+
+	s.clunkFid(n)
+
+	return nil
+}
+
+func (s *Server) remove(d *decoder, _ *encoder) error {
+	n := d.u32()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	// The fid is clunked even if the file is not removed.
+	defer s.clunkFid(n)
+
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	return unlink(f.path)
+}
+
+func unlink(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return syscall.Rmdir(path)
+	}
+
+	return syscall.Unlink(path)
+}
+
+func (s *Server) getattr(d *decoder, e *encoder) error {
+	n := d.u32()
+	d.u64() // request_mask
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(f.path)
+	if err != nil {
+		return err
+	}
+
+	st := statOf(fi)
+
+	e.u64(getattrBasic)
+	e.qid(qidOf(fi))
+	e.u32(st.Mode)
+	e.u32(st.Uid)
+	e.u32(st.Gid)
+	e.u64(st.Nlink)
+	e.u64(st.Rdev)
+	e.u64(uint64(st.Size))
+	e.u64(uint64(st.Blksize))
+	e.u64(uint64(st.Blocks))
+
+	for _, t := range []syscall.Timespec{st.Atim, st.Mtim, st.Ctim, {}} {
+		e.u64(uint64(t.Sec))
+		e.u64(uint64(t.Nsec))
+	}
+
+	e.u64(0) // gen
+	e.u64(0) // data_version
+
+	return nil
+}
+
+func (s *Server) setattr(d *decoder, _ *encoder) error {
+	n := d.u32()
+	valid := d.u32()
+	mode := d.u32()
+	uid := d.u32()
+	gid := d.u32()
+	size := d.u64()
+	atime := unix.Timespec{Sec: int64(d.u64()), Nsec: int64(d.u64())}
+	mtime := unix.Timespec{Sec: int64(d.u64()), Nsec: int64(d.u64())}
+
+	if d.err != nil {
+		return d.err
+	}
+
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(f.path)
+	if err != nil {
+		return err
+	}
+
+	// Links are never followed, and have no mode or size of their own.
+	link := fi.Mode()&os.ModeSymlink != 0
+
+	if valid&setattrMode != 0 && !link {
+		if err := syscall.Chmod(f.path, mode&0o7777); err != nil {
+			return err
+		}
+	}
+
+	if valid&(setattrUID|setattrGID) != 0 {
+		u, g := -1, -1
+
+		if valid&setattrUID != 0 {
+			u = int(uid)
+		}
+
+		if valid&setattrGID != 0 {
+			g = int(gid)
+		}
+
+		if err := os.Lchown(f.path, u, g); err != nil {
+			return err
+		}
+	}
+
+	if valid&setattrSize != 0 {
+		if link {
+			return syscall.EINVAL
+		}
+
+		if err := syscall.Truncate(f.path, int64(size)); err != nil {
+			return err
+		}
+	}
+
+	if valid&(setattrAtime|setattrMtime) == 0 {
+		return nil
+	}
+
+	ts := []unix.Timespec{{Nsec: unix.UTIME_OMIT}, {Nsec: unix.UTIME_OMIT}}
+
+	for i, t := range []struct {
+		set, given uint32
+		time       unix.Timespec
+	}{
+		{setattrAtime, setattrAtimeSet, atime},
+		{setattrMtime, setattrMtimeSet, mtime},
+	} {
+		switch {
+		case valid&t.set == 0:
+		case valid&t.given != 0:
+			ts[i] = t.time
+		default:
+			ts[i] = unix.Timespec{Nsec: unix.UTIME_NOW}
+		}
+	}
+
+	return unix.UtimesNanoAt(unix.AT_FDCWD, f.path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func (s *Server) readdir(d *decoder, e *encoder) error {
+	n := d.u32()
+	offset := d.u64()
+	count := d.u32()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := s.openFid(n)
+	if err != nil {
+		return err
+	}
+
+	if offset == 0 || f.dirents == nil {
+		if f.dirents, err = s.dirents(f.path); err != nil {
+			return err
+		}
+	}
+
+	if limit := s.msize - ioHeaderSize; count > limit {
+		count = limit
+	}
+
+	data := &encoder{}
+
+	for i := offset; i < uint64(len(f.dirents)); i++ {
+		de := f.dirents[i]
+
+		// qid[13] offset[8] type[1] name[s]
+		if len(data.b)+13+8+1+2+len(de.name) > int(count) {
+			break
+		}
+
+		data.qid(de.qid)
+		data.u64(i + 1)
+		data.u8(de.typ)
+		data.str(de.name)
+	}
+
+	e.u32(uint32(len(data.b)))
+	e.b = append(e.b, data.b...)
+
+	return nil
+}
+
+// dirents lists the directory at path, with "." and "..".
+func (s *Server) dirents(path string) ([]dirent, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := path
+	if path != s.root {
+		parent = filepath.Dir(path)
+	}
+
+	res := make([]dirent, 0, len(entries)+2)
+
+	names := []string{".", ".."}
+	for _, de := range entries {
+		names = append(names, de.Name())
+	}
+
+	sort.Strings(names[2:])
+
+	for i, name := range names {
+		p := filepath.Join(path, name)
+
+		switch i {
+		case 0:
+			p = path
+		case 1:
+			p = parent
+		}
+
+		fi, err := os.Lstat(p)
+		if err != nil {
+			// Removed meanwhile.
+			continue
+		}
+
+		// The type of a dirent is the file type of its mode.
+		res = append(res, dirent{
+			qid:  qidOf(fi),
+			typ:  uint8(statOf(fi).Mode >> 12 & 0xf),
+			name: name,
+		})
+	}
+
+	return res, nil
+}
+
+func (s *Server) statfs(d *decoder, e *encoder) error {
+	n := d.u32()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	var st syscall.Statfs_t
+
+	if err := syscall.Statfs(f.path, &st); err != nil {
+		return err
+	}
+
+	e.u32(uint32(st.Type))
+	e.u32(uint32(st.Bsize))
+	e.u64(st.Blocks)
+	e.u64(st.Bfree)
+	e.u64(st.Bavail)
+	e.u64(st.Files)
+	e.u64(st.Ffree)
+	e.u64(uint64(uint32(st.Fsid.X__val[0])) | uint64(uint32(st.Fsid.X__val[1]))<<32)
+	e.u32(uint32(st.Namelen))
+
+	return nil
+}
+
+// newChild returns the path of name in the directory of the fid n, for
+// a request that changes the directory.
+func (s *Server) newChild(n uint32, name string) (string, error) {
+	if err := s.writable(); err != nil {
+		return "", err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return "", err
+	}
+
+	return s.child(f, name)
+}
+
+func (s *Server) mkdir(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	mode := d.u32()
+	d.u32() // gid
+
+	if d.err != nil {
+		return d.err
+	}
+
+	path, err := s.newChild(n, name)
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mkdir(path, mode&0o7777); err != nil {
+		return err
+	}
+
+	q, err := lstatQid(path)
+	if err != nil {
+		return err
+	}
+
+	e.qid(q)
+
+	return nil
+}
+
+func (s *Server) symlink(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	target := d.str()
+	d.u32() // gid
+
+	if d.err != nil {
+		return d.err
+	}
+
+	path, err := s.newChild(n, name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Symlink(target, path); err != nil {
+		return err
+	}
+
+	q, err := lstatQid(path)
+	if err != nil {
+		return err
+	}
+
+	e.qid(q)
+
+	return nil
+}
+
+func (s *Server) readlink(d *decoder, e *encoder) error {
+	n := d.u32()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	target, err := os.Readlink(f.path)
+	if err != nil {
+		return err
+	}
+
+	e.str(target)
+
+	return nil
+}
+
+func (s *Server) link(d *decoder, _ *encoder) error {
+	dn := d.u32()
+	n := d.u32()
+	name := d.str()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	path, err := s.newChild(dn, name)
+	if err != nil {
+		return err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	return os.Link(f.path, path)
+}
+
+func (s *Server) mknod(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	mode := d.u32()
+	major := d.u32()
+	minor := d.u32()
+	d.u32() // gid
+
+	if d.err != nil {
+		return d.err
+	}
+
+	path, err := s.newChild(n, name)
+	if err != nil {
+		return err
+	}
+
+	// Device nodes of the guest would give access to the devices of
+	// the host.
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG, syscall.S_IFIFO, syscall.S_IFSOCK:
+	default:
+		return syscall.EPERM
+	}
+
+	if err := syscall.Mknod(path, mode, int(unix.Mkdev(major, minor))); err != nil {
+		return err
+	}
+
+	q, err := lstatQid(path)
+	if err != nil {
+		return err
+	}
+
+	e.qid(q)
+
+	return nil
+}
+
+func (s *Server) rename(d *decoder, _ *encoder) error {
+	n := d.u32()
+	dn := d.u32()
+	name := d.str()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := s.fid(n)
+	if err != nil {
+		return err
+	}
+
+	if f.path == s.root {
+		return syscall.EBUSY
+	}
+
+	path, err := s.newChild(dn, name)
+	if err != nil {
+		return err
+	}
+
+	oldPath := f.path
+
+	if err := os.Rename(oldPath, path); err != nil {
+		return err
+	}
+
+	s.moved(oldPath, path)
+
+	return nil
+}
+
+func (s *Server) renameat(d *decoder, _ *encoder) error {
+	on := d.u32()
+	oldName := d.str()
+	nn := d.u32()
+	newName := d.str()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	oldPath, err := s.newChild(on, oldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := s.newChild(nn, newName)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+
+	s.moved(oldPath, newPath)
+
+	return nil
+}
+
+func (s *Server) unlinkat(d *decoder, _ *encoder) error {
+	n := d.u32()
+	name := d.str()
+	flags := d.u32()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	path, err := s.newChild(n, name)
+	if err != nil {
+		return err
+	}
+
+	if flags&unix.AT_REMOVEDIR != 0 {
+		return syscall.Rmdir(path)
+	}
+
+	return syscall.Unlink(path)
+}
+
+func (s *Server) fsync(d *decoder, _ *encoder) error {
+	n := d.u32()
+	d.u32() // datasync
+
+	if d.err != nil {
+		return d.err
+	}
+
+	f, err := s.openFid(n)
+	if err != nil {
+		return err
+	}
+
+	return f.file.Sync()
+}
+
+func unsupported(*decoder, *encoder) error {
+	return syscall.EOPNOTSUPP
+}
+
+func (s *Server) flush(d *decoder, _ *encoder) error {
+	d.u16() // oldtag
+
+	// Requests are served in order, so the old one is done.
+	return d.err
+}
+
+// lock grants every lock, which is enough for a single guest.
+func (s *Server) lock(d *decoder, e *encoder) error {
+	d.u32() // fid
+	d.u8()  // type
+	d.u32() // flags
+	d.u64() // start
+	d.u64() // length
+	d.u32() // proc_id
+	d.str() // client_id
+
+	if d.err != nil {
+		return d.err
+	}
+
+	e.u8(0) // P9_LOCK_SUCCESS
+
+	return nil
+}
+
+// getlock reports that no lock conflicts.
+func (s *Server) getlock(d *decoder, e *encoder) error {
+	d.u32() // fid
+	d.u8()  // type
+	start := d.u64()
+	length := d.u64()
+	procID := d.u32()
+	clientID := d.str()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	e.u8(unix.F_UNLCK)
+	e.u64(start)
+	e.u64(length)
+	e.u32(procID)
+	e.str(clientID)
+
+	return nil
+}
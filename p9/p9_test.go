@@ -0,0 +1,278 @@
+package p9_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/p9"
+)
+
+// client plays the guest side of the protocol.
+type client struct {
+	t *testing.T
+	s *p9.Server
+}
+
+// msg builds a message of the fields, which are uint8, uint16, uint32,
+// uint64, string or []byte.
+func msg(typ uint8, fields ...interface{}) []byte {
+	b := []byte{0, 0, 0, 0, typ, 1, 0}
+
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint8:
+			b = append(b, v)
+		case uint16:
+			b = binary.LittleEndian.AppendUint16(b, v)
+		case uint32:
+			b = binary.LittleEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.LittleEndian.AppendUint64(b, v)
+		case string:
+			b = binary.LittleEndian.AppendUint16(b, uint16(len(v)))
+			b = append(b, v...)
+		case []byte:
+			b = append(b, v...)
+		}
+	}
+
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+
+	return b
+}
+
+// call sends a request and returns the body of the reply, or the error
+// number of Rlerror.
+func (c *client) call(typ uint8, fields ...interface{}) ([]byte, syscall.Errno) {
+	c.t.Helper()
+
+	r := c.s.Handle(msg(typ, fields...))
+
+	if size := binary.LittleEndian.Uint32(r); int(size) != len(r) {
+		c.t.Fatalf("reply size %d, actual %d", size, len(r))
+	}
+
+	if r[4] == p9.Rlerror {
+		return nil, syscall.Errno(binary.LittleEndian.Uint32(r[7:]))
+	}
+
+	if r[4] != typ+1 {
+		c.t.Fatalf("reply type %d to %d", r[4], typ)
+	}
+
+	return r[7:], 0
+}
+
+func (c *client) ok(typ uint8, fields ...interface{}) []byte {
+	c.t.Helper()
+
+	b, en := c.call(typ, fields...)
+	if en != 0 {
+		c.t.Fatalf("request %d: %v", typ, en)
+	}
+
+	return b
+}
+
+func newClient(t *testing.T, root string, readOnly bool) *client {
+	t.Helper()
+
+	s, err := p9.NewServer(root, readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &client{t: t, s: s}
+
+	r := c.ok(p9.Tversion, uint32(1<<20), p9.Version)
+	if msize := binary.LittleEndian.Uint32(r); msize != p9.MaxMessageSize {
+		t.Fatalf("msize: expected %d, actual %d", p9.MaxMessageSize, msize)
+	}
+
+	c.ok(p9.Tattach, uint32(0), ^uint32(0), "root", "", uint32(0))
+
+	return c
+}
+
+func TestNewServer(t *testing.T) {
+	t.Parallel()
+
+	f := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(f, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p9.NewServer(f, false); !errors.Is(err, p9.ErrNotDir) {
+		t.Errorf("expected %v, actual %v", p9.ErrNotDir, err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	c := newClient(t, root, false)
+
+	// Create and write dir/a.
+	c.ok(p9.Tmkdir, uint32(0), "dir", uint32(0o755), uint32(0))
+	c.ok(p9.Twalk, uint32(0), uint32(1), uint16(1), "dir")
+	c.ok(p9.Tlcreate, uint32(1), "a", uint32(syscall.O_RDWR), uint32(0o644), uint32(0))
+
+	if r := c.ok(p9.Twrite, uint32(1), uint64(0), uint32(5), []byte("hello")); binary.LittleEndian.Uint32(r) != 5 {
+		t.Errorf("Rwrite: %v", r)
+	}
+
+	c.ok(p9.Tclunk, uint32(1))
+
+	if b, err := os.ReadFile(filepath.Join(root, "dir", "a")); err != nil || string(b) != "hello" {
+		t.Errorf("host: got %q, %v", b, err)
+	}
+
+	// Read it back from offset 1.
+	c.ok(p9.Twalk, uint32(0), uint32(2), uint16(2), "dir", "a")
+	c.ok(p9.Tlopen, uint32(2), uint32(syscall.O_RDONLY))
+
+	r := c.ok(p9.Tread, uint32(2), uint64(1), uint32(100))
+	if n := binary.LittleEndian.Uint32(r); string(r[4:4+n]) != "ello" {
+		t.Errorf("Rread: got %q", r[4:])
+	}
+
+	// Size from getattr, at qid[13] mode[4] uid[4] gid[4] nlink[8] rdev[8].
+	r = c.ok(p9.Tgetattr, uint32(2), uint64(0x7ff))
+	if size := binary.LittleEndian.Uint64(r[8+13+4+4+4+8+8:]); size != 5 {
+		t.Errorf("Rgetattr: size %d, expected 5", size)
+	}
+
+	c.ok(p9.Tsetattr, uint32(2), uint32(0x8), uint32(0), uint32(0), uint32(0), uint64(2),
+		uint64(0), uint64(0), uint64(0), uint64(0))
+
+	if fi, err := os.Stat(filepath.Join(root, "dir", "a")); err != nil || fi.Size() != 2 {
+		t.Errorf("host after truncate: %v, %v", fi, err)
+	}
+
+	// Rename it, and the open fid follows.
+	c.ok(p9.Twalk, uint32(0), uint32(3), uint16(1), "dir")
+	c.ok(p9.Trenameat, uint32(3), "a", uint32(0), "b")
+
+	r = c.ok(p9.Tgetattr, uint32(2), uint64(0x7ff))
+	if size := binary.LittleEndian.Uint64(r[8+13+4+4+4+8+8:]); size != 2 {
+		t.Errorf("Rgetattr after rename: size %d, expected 2", size)
+	}
+
+	// List dir, which is empty now.
+	c.ok(p9.Tlopen, uint32(3), uint32(syscall.O_RDONLY))
+
+	r = c.ok(p9.Treaddir, uint32(3), uint64(0), uint32(4096))
+	if names := direntNames(r); len(names) != 2 || names[0] != "." || names[1] != ".." {
+		t.Errorf("Rreaddir: got %v", names)
+	}
+
+	c.ok(p9.Tunlinkat, uint32(0), "b", uint32(0))
+	c.ok(p9.Tunlinkat, uint32(0), "dir", uint32(0x200))
+
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("host: got %v, expected an empty directory", entries)
+	}
+}
+
+func direntNames(r []byte) []string {
+	n := binary.LittleEndian.Uint32(r)
+	b := r[4 : 4+n]
+	names := []string{}
+
+	for len(b) > 0 {
+		// qid[13] offset[8] type[1] name[s]
+		l := int(binary.LittleEndian.Uint16(b[22:]))
+		names = append(names, string(b[24:24+l]))
+		b = b[24+l:]
+	}
+
+	return names
+}
+
+func TestConfinement(t *testing.T) {
+	t.Parallel()
+
+	outside := t.TempDir()
+	root := t.TempDir()
+
+	if err := os.Symlink(outside, filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClient(t, root, false)
+
+	// ".." of the root is the root.
+	r := c.ok(p9.Twalk, uint32(0), uint32(1), uint16(2), "..", "..")
+	if n := binary.LittleEndian.Uint16(r); n != 2 {
+		t.Errorf("walk to ..: %d qids", n)
+	}
+
+	if _, en := c.call(p9.Tlcreate, uint32(1), "x", uint32(syscall.O_RDWR), uint32(0o644), uint32(0)); en != 0 {
+		t.Errorf("create at ..: %v", en)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "x")); err != nil {
+		t.Errorf("the file is not in the root: %v", err)
+	}
+
+	// A link is never walked through, so the walk stops at it.
+	r = c.ok(p9.Twalk, uint32(0), uint32(2), uint16(2), "out", "x")
+	if n := binary.LittleEndian.Uint16(r); n != 1 {
+		t.Errorf("walk through a link: %d qids, expected 1", n)
+	}
+
+	if _, en := c.call(p9.Tgetattr, uint32(2), uint64(0x7ff)); en != syscall.EBADF {
+		t.Errorf("fid of a partial walk: got %v, expected %v", en, syscall.EBADF)
+	}
+
+	if _, en := c.call(p9.Tmkdir, uint32(0), "a/b", uint32(0o755), uint32(0)); en != syscall.EINVAL {
+		t.Errorf("mkdir a/b: got %v, expected %v", en, syscall.EINVAL)
+	}
+
+	if _, en := c.call(p9.Tmknod, uint32(0), "sda", uint32(syscall.S_IFBLK|0o600), uint32(8), uint32(0),
+		uint32(0)); en != syscall.EPERM {
+		t.Errorf("mknod of a block device: got %v, expected %v", en, syscall.EPERM)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClient(t, root, true)
+
+	c.ok(p9.Twalk, uint32(0), uint32(1), uint16(1), "a")
+
+	if _, en := c.call(p9.Tlopen, uint32(1), uint32(syscall.O_RDWR)); en != syscall.EROFS {
+		t.Errorf("open for writing: got %v, expected %v", en, syscall.EROFS)
+	}
+
+	c.ok(p9.Tlopen, uint32(1), uint32(syscall.O_RDONLY))
+
+	for _, req := range []struct {
+		typ    uint8
+		fields []interface{}
+	}{
+		{p9.Tlcreate, []interface{}{uint32(0), "b", uint32(syscall.O_RDWR), uint32(0o644), uint32(0)}},
+		{p9.Tmkdir, []interface{}{uint32(0), "d", uint32(0o755), uint32(0)}},
+		{p9.Tunlinkat, []interface{}{uint32(0), "a", uint32(0)}},
+		{p9.Twrite, []interface{}{uint32(1), uint64(0), uint32(1), []byte("x")}},
+	} {
+		if _, en := c.call(req.typ, req.fields...); en != syscall.EROFS {
+			t.Errorf("request %d: got %v, expected %v", req.typ, en, syscall.EROFS)
+		}
+	}
+
+	if b, err := os.ReadFile(filepath.Join(root, "a")); err != nil || string(b) != "data" {
+		t.Errorf("host: got %q, %v", b, err)
+	}
+}
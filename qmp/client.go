@@ -0,0 +1,81 @@
+package qmp
+
+import (
+	"encoding/json"
+	"net"
+)
+
+// Client is a minimal client for the control socket, used by
+// orchestration code and tests.
+type Client struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+// Dial connects to the control socket at path and negotiates capabilities.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(conn),
+	}
+
+	var g greeting
+
+	if err := c.dec.Decode(&g); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	if err := c.Execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Execute runs cmd with args and decodes the "return" member into ret.
+// args and ret may be nil. A QMP error reply is returned as *Error.
+func (c *Client) Execute(cmd string, args, ret interface{}) error {
+	req := struct {
+		Execute   string      `json:"execute"`
+		Arguments interface{} `json:"arguments,omitempty"`
+	}{cmd, args}
+
+	if err := c.enc.Encode(req); err != nil {
+		return err
+	}
+
+	var resp struct {
+		Return json.RawMessage `json:"return"`
+		Error  *Error          `json:"error"`
+	}
+
+	if err := c.dec.Decode(&resp); err != nil {
+		return err
+	}
+
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	if ret == nil {
+		return nil
+	}
+
+	return json.Unmarshal(resp.Return, ret)
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
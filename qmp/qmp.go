@@ -0,0 +1,727 @@
+// Package qmp implements a QMP-style JSON control socket for a running VM.
+//
+// The wire protocol follows QEMU's QMP: the server greets each client, the
+// client negotiates with qmp_capabilities and then sends one JSON object per
+// command, e.g. {"execute": "query-status"}. Replies are either
+// {"return": ...} or {"error": {"class": ..., "desc": ...}}, and carry the
+// "id" of the command if one was given.
+//
+// refs https://www.qemu.org/docs/master/interop/qmp-spec.html
+package qmp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+)
+
+// Error classes as defined by QMP.
+const (
+	ClassGenericError    = "GenericError"
+	ClassCommandNotFound = "CommandNotFound"
+)
+
+// MaxReadMemory is the largest size accepted by read-memory.
+const MaxReadMemory = 1 << 20
+
+var (
+	ErrHotplugUnsupported = errors.New("device hotplug is not supported")
+	ErrNoBalloon          = errors.New("no balloon device has been activated")
+	ErrNoMemHotplug       = errors.New("no virtio-mem device has been activated")
+	ErrNoCPUHotplug       = errors.New("cpu hotplug is not enabled")
+	ErrMissingArgument    = errors.New("missing argument")
+	ErrReadTooLarge       = fmt.Errorf("read-memory size must be at most %d bytes", MaxReadMemory)
+)
+
+// Status is the run state reported by query-status.
+type Status string
+
+const (
+	StatusRunning  Status = "running"
+	StatusPaused   Status = "paused"
+	StatusShutdown Status = "shutdown"
+)
+
+// VM is the set of operations on a virtual machine that the control
+// socket exposes. It is implemented by vmm.VMM.
+type VM interface {
+	Status() Status
+	NumCPUs() int
+	GetRegs(cpu int) (*kvm.Regs, error)
+	GetSRegs(cpu int) (*kvm.Sregs, error)
+	Pause() error
+	Resume() error
+	Powerdown() error
+	Reset() error
+	Quit() error
+	ReadAt(b []byte, off int64) (int, error)
+}
+
+// HotplugHandler is called for device_add and device_del. Every
+// argument of device_add except driver and id is passed in props.
+type HotplugHandler interface {
+	DeviceAdd(driver, id string, props map[string]interface{}) error
+	DeviceDel(id string) error
+}
+
+// BalloonHandler is called for balloon, query-balloon and
+// query-balloon-stats. Sizes are in bytes.
+type BalloonHandler interface {
+	SetBalloonTarget(size uint64) error
+	QueryBalloon() (uint64, error)
+	BalloonStats() (map[string]uint64, time.Time, error)
+}
+
+// MemoryHandler is called for resize-memory and
+// query-memory-size-summary. Sizes are in bytes.
+type MemoryHandler interface {
+	ResizeMemory(size uint64) error
+	QueryMemory() (base, plugged uint64, err error)
+}
+
+// CPUHotplugHandler is called for query-hotpluggable-cpus.
+type CPUHotplugHandler interface {
+	HotpluggableCPUs() ([]HotpluggableCPU, error)
+}
+
+// CommandFunc runs a command with its raw "arguments" object and
+// returns the value sent back as "return".
+type CommandFunc func(args json.RawMessage) (interface{}, error)
+
+// CPUInfo is one element of the query-cpus reply.
+type CPUInfo struct {
+	CPU   int        `json:"cpu-index"`
+	Regs  *kvm.Regs  `json:"regs"`
+	Sregs *kvm.Sregs `json:"sregs"`
+}
+
+// StatusInfo is the query-status reply.
+type StatusInfo struct {
+	Running bool   `json:"running"`
+	Status  Status `json:"status"`
+}
+
+// ReadMemoryArgs are the arguments of read-memory.
+type ReadMemoryArgs struct {
+	Addr uint64 `json:"addr"`
+	Size uint64 `json:"size"`
+}
+
+// ReadMemoryInfo is the read-memory reply. Data is base64 encoded on the wire.
+type ReadMemoryInfo struct {
+	Data []byte `json:"data"`
+}
+
+// BalloonArgs are the arguments of balloon. Value is the memory size
+// the guest is asked to shrink or grow to.
+type BalloonArgs struct {
+	Value uint64 `json:"value"`
+}
+
+// BalloonInfo is the query-balloon reply. Actual is the memory size of
+// the guest, less what is in the balloon.
+type BalloonInfo struct {
+	Actual uint64 `json:"actual"`
+}
+
+// BalloonStats is the query-balloon-stats reply. LastUpdate is the
+// time the guest sent Stats, in seconds since the epoch, or 0 if it
+// never did.
+type BalloonStats struct {
+	Stats      map[string]uint64 `json:"stats"`
+	LastUpdate int64             `json:"last-update"`
+}
+
+// ResizeMemoryArgs are the arguments of resize-memory. Size is the
+// memory size the guest is asked to grow or shrink to by hotplug.
+type ResizeMemoryArgs struct {
+	Size uint64 `json:"size"`
+}
+
+// MemorySizeSummary is the query-memory-size-summary reply, the memory
+// size of the guest at boot and how much it has plugged since then.
+type MemorySizeSummary struct {
+	BaseMemory    uint64 `json:"base-memory"`
+	PluggedMemory uint64 `json:"plugged-memory"`
+}
+
+// HotpluggableCPU is one element of the query-hotpluggable-cpus reply.
+// QOMPath is set once the CPU is present. Props are the properties
+// device_add takes to add it.
+type HotpluggableCPU struct {
+	Type       string   `json:"type"`
+	VCPUsCount int      `json:"vcpus-count"`
+	Props      CPUProps `json:"props"`
+	QOMPath    string   `json:"qom-path,omitempty"`
+}
+
+// CPUProps locates a CPU in the topology of the VM.
+type CPUProps struct {
+	SocketID int `json:"socket-id"`
+	CoreID   int `json:"core-id"`
+	ThreadID int `json:"thread-id"`
+}
+
+// Error is the "error" member of a failed reply.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+type request struct {
+	Execute   string          `json:"execute"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	ID        json.RawMessage `json:"id,omitempty"`
+}
+
+type response struct {
+	Return interface{}     `json:"return,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+	ID     json.RawMessage `json:"id,omitempty"`
+}
+
+type greeting struct {
+	QMP struct {
+		Version struct {
+			Package string `json:"package"`
+		} `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	} `json:"QMP"`
+}
+
+// Server serves the control protocol on a unix socket.
+type Server struct {
+	vm VM
+
+	// runMu serializes the commands changing the run state, so that
+	// query-cpus does not resume a VM stopped meanwhile.
+	runMu sync.Mutex
+
+	mu       sync.Mutex
+	commands map[string]CommandFunc
+	hotplug  HotplugHandler
+	balloon  BalloonHandler
+	memory   MemoryHandler
+	cpus     CPUHotplugHandler
+
+	ln   net.Listener
+	path string
+}
+
+// New creates a control server for vm with the builtin commands registered.
+func New(vm VM) *Server {
+	s := &Server{
+		vm:       vm,
+		commands: map[string]CommandFunc{},
+	}
+
+	s.Register("query-status", s.queryStatus)
+	s.Register("query-cpus", s.queryCPUs)
+	s.Register("query-commands", s.queryCommands)
+	s.Register("stop", s.stop)
+	s.Register("cont", s.cont)
+	s.Register("system_powerdown", func(json.RawMessage) (interface{}, error) { return struct{}{}, vm.Powerdown() })
+	s.Register("system_reset", func(json.RawMessage) (interface{}, error) { return struct{}{}, vm.Reset() })
+	s.Register("device_add", s.deviceAdd)
+	s.Register("device_del", s.deviceDel)
+	s.Register("read-memory", s.readMemory)
+	s.Register("balloon", s.setBalloon)
+	s.Register("query-balloon", s.queryBalloon)
+	s.Register("query-balloon-stats", s.queryBalloonStats)
+	s.Register("resize-memory", s.resizeMemory)
+	s.Register("query-memory-size-summary", s.queryMemory)
+	s.Register("query-hotpluggable-cpus", s.queryHotpluggableCPUs)
+
+	return s
+}
+
+// Register adds or replaces a command.
+func (s *Server) Register(name string, f CommandFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands[name] = f
+}
+
+// SetHotplugHandler installs the handler for device_add and device_del.
+func (s *Server) SetHotplugHandler(h HotplugHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hotplug = h
+}
+
+// SetBalloonHandler installs the handler for the balloon commands.
+func (s *Server) SetBalloonHandler(h BalloonHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.balloon = h
+}
+
+// SetMemoryHandler installs the handler for the memory hotplug commands.
+func (s *Server) SetMemoryHandler(h MemoryHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.memory = h
+}
+
+// SetCPUHotplugHandler installs the handler for query-hotpluggable-cpus.
+func (s *Server) SetCPUHotplugHandler(h CPUHotplugHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cpus = h
+}
+
+// Listen creates the unix socket at path, replacing a stale one.
+func (s *Server) Listen(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	s.ln = ln
+	s.path = path
+
+	return nil
+}
+
+// Serve accepts clients until Close is called.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		go func() {
+			if err := s.handle(conn); err != nil {
+				log.Printf("qmp: %v", err)
+			}
+		}()
+	}
+}
+
+// Close stops accepting clients and removes the socket.
+func (s *Server) Close() error {
+	if s.ln == nil {
+		return nil
+	}
+
+	err := s.ln.Close()
+
+	_ = os.Remove(s.path)
+
+	return err
+}
+
+func (s *Server) handle(conn net.Conn) error {
+	defer conn.Close()
+
+	var in io.Reader = conn
+
+	dec := json.NewDecoder(in)
+	enc := json.NewEncoder(conn)
+
+	var g greeting
+
+	g.QMP.Version.Package = "gokvm"
+	g.QMP.Capabilities = []string{}
+
+	if err := enc.Encode(g); err != nil {
+		return err
+	}
+
+	negotiated := false
+
+	for {
+		var req request
+
+		err := dec.Decode(&req)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		var (
+			syntaxErr *json.SyntaxError
+			typeErr   *json.UnmarshalTypeError
+		)
+
+		if err != nil && !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
+			return err
+		}
+
+		resp := response{ID: req.ID}
+
+		switch {
+		case err != nil:
+			resp.Error = &Error{Class: ClassGenericError, Desc: "JSON parse error, " + err.Error()}
+		case req.Execute == "qmp_capabilities":
+			negotiated = true
+			resp.Return = struct{}{}
+		case !negotiated:
+			resp.Error = &Error{
+				Class: ClassCommandNotFound,
+				Desc:  "Expecting capabilities negotiation with 'qmp_capabilities'",
+			}
+		case req.Execute == "quit":
+			// Reply before acting, the VMM may exit right away.
+			resp.Return = struct{}{}
+			if err := enc.Encode(resp); err != nil {
+				return err
+			}
+
+			return s.vm.Quit()
+		default:
+			resp.Return, resp.Error = s.execute(req)
+		}
+
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+
+		// The decoder is stuck on bad JSON, whose line is skipped.
+		if syntaxErr != nil {
+			in = io.MultiReader(dec.Buffered(), in)
+
+			if err := skipLine(in); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+
+				return err
+			}
+
+			dec = json.NewDecoder(in)
+		}
+	}
+}
+
+// skipLine reads r up to the end of the next line which is not blank,
+// as the input left by a decoder starts with the end of the line before.
+func skipLine(r io.Reader) error {
+	b := make([]byte, 1)
+	blank := true
+
+	for blank || b[0] != '\n' {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+
+		blank = blank && (b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n')
+	}
+
+	return nil
+}
+
+func (s *Server) execute(req request) (interface{}, *Error) {
+	s.mu.Lock()
+	f, ok := s.commands[req.Execute]
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, &Error{
+			Class: ClassCommandNotFound,
+			Desc:  fmt.Sprintf("The command %s has not been found", req.Execute),
+		}
+	}
+
+	ret, err := f(req.Arguments)
+	if err != nil {
+		return nil, &Error{Class: ClassGenericError, Desc: err.Error()}
+	}
+
+	// A successful reply always carries a "return" member.
+	if ret == nil {
+		ret = struct{}{}
+	}
+
+	return ret, nil
+}
+
+func (s *Server) queryStatus(json.RawMessage) (interface{}, error) {
+	st := s.vm.Status()
+
+	return StatusInfo{Running: st == StatusRunning, Status: st}, nil
+}
+
+func (s *Server) queryCommands(json.RawMessage) (interface{}, error) {
+	type command struct {
+		Name string `json:"name"`
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cmds := []command{{Name: "qmp_capabilities"}, {Name: "quit"}}
+	for name := range s.commands {
+		cmds = append(cmds, command{Name: name})
+	}
+
+	return cmds, nil
+}
+
+func (s *Server) stop(json.RawMessage) (interface{}, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	return struct{}{}, s.vm.Pause()
+}
+
+func (s *Server) cont(json.RawMessage) (interface{}, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	return struct{}{}, s.vm.Resume()
+}
+
+// queryCPUs dumps the registers of every vCPU. Registers can only be read
+// while a vCPU is out of the guest, so a running VM is paused meanwhile,
+// with stop and cont held off until it is resumed.
+func (s *Server) queryCPUs(json.RawMessage) (interface{}, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	if s.vm.Status() == StatusRunning {
+		if err := s.vm.Pause(); err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			if err := s.vm.Resume(); err != nil {
+				log.Printf("qmp: resume after query-cpus: %v", err)
+			}
+		}()
+	}
+
+	cpus := make([]CPUInfo, 0, s.vm.NumCPUs())
+
+	for cpu := 0; cpu < s.vm.NumCPUs(); cpu++ {
+		r, err := s.vm.GetRegs(cpu)
+		if err != nil {
+			return nil, err
+		}
+
+		sr, err := s.vm.GetSRegs(cpu)
+		if err != nil {
+			return nil, err
+		}
+
+		cpus = append(cpus, CPUInfo{CPU: cpu, Regs: r, Sregs: sr})
+	}
+
+	return cpus, nil
+}
+
+func (s *Server) readMemory(args json.RawMessage) (interface{}, error) {
+	var a ReadMemoryArgs
+
+	if err := unmarshalArgs(args, &a); err != nil {
+		return nil, err
+	}
+
+	if a.Size > MaxReadMemory {
+		return nil, ErrReadTooLarge
+	}
+
+	b := make([]byte, a.Size)
+
+	n, err := s.vm.ReadAt(b, int64(a.Addr))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return ReadMemoryInfo{Data: b[:n]}, nil
+}
+
+func (s *Server) deviceAdd(args json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	h := s.hotplug
+	s.mu.Unlock()
+
+	if h == nil {
+		return nil, ErrHotplugUnsupported
+	}
+
+	props := map[string]interface{}{}
+	if err := unmarshalArgs(args, &props); err != nil {
+		return nil, err
+	}
+
+	driver, _ := props["driver"].(string)
+	id, _ := props["id"].(string)
+
+	if driver == "" {
+		return nil, fmt.Errorf("driver: %w", ErrMissingArgument)
+	}
+
+	delete(props, "driver")
+	delete(props, "id")
+
+	return struct{}{}, h.DeviceAdd(driver, id, props)
+}
+
+func (s *Server) deviceDel(args json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	h := s.hotplug
+	s.mu.Unlock()
+
+	if h == nil {
+		return nil, ErrHotplugUnsupported
+	}
+
+	var a struct {
+		ID string `json:"id"`
+	}
+
+	if err := unmarshalArgs(args, &a); err != nil {
+		return nil, err
+	}
+
+	if a.ID == "" {
+		return nil, fmt.Errorf("id: %w", ErrMissingArgument)
+	}
+
+	return struct{}{}, h.DeviceDel(a.ID)
+}
+
+func (s *Server) balloonHandler() (BalloonHandler, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.balloon == nil {
+		return nil, ErrNoBalloon
+	}
+
+	return s.balloon, nil
+}
+
+func (s *Server) setBalloon(args json.RawMessage) (interface{}, error) {
+	h, err := s.balloonHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	var a BalloonArgs
+
+	if err := unmarshalArgs(args, &a); err != nil {
+		return nil, err
+	}
+
+	return struct{}{}, h.SetBalloonTarget(a.Value)
+}
+
+func (s *Server) queryBalloon(json.RawMessage) (interface{}, error) {
+	h, err := s.balloonHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	actual, err := h.QueryBalloon()
+	if err != nil {
+		return nil, err
+	}
+
+	return BalloonInfo{Actual: actual}, nil
+}
+
+func (s *Server) queryBalloonStats(json.RawMessage) (interface{}, error) {
+	h, err := s.balloonHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	stats, at, err := h.BalloonStats()
+	if err != nil {
+		return nil, err
+	}
+
+	info := BalloonStats{Stats: stats}
+	if !at.IsZero() {
+		info.LastUpdate = at.Unix()
+	}
+
+	return info, nil
+}
+
+func (s *Server) memoryHandler() (MemoryHandler, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.memory == nil {
+		return nil, ErrNoMemHotplug
+	}
+
+	return s.memory, nil
+}
+
+func (s *Server) resizeMemory(args json.RawMessage) (interface{}, error) {
+	h, err := s.memoryHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	var a ResizeMemoryArgs
+
+	if err := unmarshalArgs(args, &a); err != nil {
+		return nil, err
+	}
+
+	return struct{}{}, h.ResizeMemory(a.Size)
+}
+
+func (s *Server) queryMemory(json.RawMessage) (interface{}, error) {
+	h, err := s.memoryHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	base, plugged, err := h.QueryMemory()
+	if err != nil {
+		return nil, err
+	}
+
+	return MemorySizeSummary{BaseMemory: base, PluggedMemory: plugged}, nil
+}
+
+func (s *Server) queryHotpluggableCPUs(json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	h := s.cpus
+	s.mu.Unlock()
+
+	if h == nil {
+		return nil, ErrNoCPUHotplug
+	}
+
+	return h.HotpluggableCPUs()
+}
+
+func unmarshalArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return fmt.Errorf("arguments: %w", ErrMissingArgument)
+	}
+
+	return json.Unmarshal(args, v)
+}
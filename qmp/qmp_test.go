@@ -0,0 +1,498 @@
+package qmp_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/kvm"
+	"github.com/bobuhiro11/gokvm/qmp"
+)
+
+type mockVM struct {
+	mu     sync.Mutex
+	status qmp.Status
+	mem    []byte
+	resets int
+	quit   chan struct{}
+
+	// onRegs, if set, is called as the registers of vCPU 0 are read.
+	onRegs func()
+}
+
+func newMockVM() *mockVM {
+	mem := make([]byte, 0x1000)
+	copy(mem[0x100:], "gokvm")
+
+	return &mockVM{status: qmp.StatusRunning, mem: mem, quit: make(chan struct{})}
+}
+
+func (m *mockVM) Status() qmp.Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.status
+}
+
+func (m *mockVM) set(s qmp.Status) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status = s
+
+	return nil
+}
+
+func (m *mockVM) NumCPUs() int { return 2 }
+
+func (m *mockVM) GetRegs(cpu int) (*kvm.Regs, error) {
+	if m.Status() == qmp.StatusRunning {
+		return nil, errors.New("regs read while running")
+	}
+
+	if m.onRegs != nil && cpu == 0 {
+		m.onRegs()
+	}
+
+	return &kvm.Regs{RIP: uint64(0x1000 + cpu)}, nil
+}
+
+func (m *mockVM) GetSRegs(cpu int) (*kvm.Sregs, error) { return &kvm.Sregs{CR3: 0x30000}, nil }
+func (m *mockVM) Pause() error                         { return m.set(qmp.StatusPaused) }
+func (m *mockVM) Resume() error                        { return m.set(qmp.StatusRunning) }
+func (m *mockVM) Powerdown() error                     { return m.set(qmp.StatusShutdown) }
+
+func (m *mockVM) Reset() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.resets++
+
+	return nil
+}
+
+func (m *mockVM) Quit() error {
+	close(m.quit)
+
+	return nil
+}
+
+func (m *mockVM) ReadAt(b []byte, off int64) (int, error) {
+	return bytes.NewReader(m.mem).ReadAt(b, off)
+}
+
+type mockHotplug struct {
+	added map[string]string
+}
+
+func (h *mockHotplug) DeviceAdd(driver, id string, props map[string]interface{}) error {
+	h.added[id] = driver
+
+	return nil
+}
+
+func (h *mockHotplug) DeviceDel(id string) error {
+	delete(h.added, id)
+
+	return nil
+}
+
+type mockBalloon struct {
+	target uint64
+}
+
+func (b *mockBalloon) SetBalloonTarget(size uint64) error {
+	b.target = size
+
+	return nil
+}
+
+func (b *mockBalloon) QueryBalloon() (uint64, error) { return b.target, nil }
+
+func (b *mockBalloon) BalloonStats() (map[string]uint64, time.Time, error) {
+	return map[string]uint64{"stat-free-memory": 1 << 20}, time.Unix(1700000000, 0), nil
+}
+
+type mockMemory struct {
+	size uint64
+}
+
+func (m *mockMemory) ResizeMemory(size uint64) error {
+	m.size = size
+
+	return nil
+}
+
+func (m *mockMemory) QueryMemory() (uint64, uint64, error) { return 1 << 30, m.size - 1<<30, nil }
+
+// mockCPUs has 2 CPUs present of 4.
+type mockCPUs struct{}
+
+func (mockCPUs) HotpluggableCPUs() ([]qmp.HotpluggableCPU, error) {
+	cpus := make([]qmp.HotpluggableCPU, 4)
+
+	for i := range cpus {
+		cpus[i] = qmp.HotpluggableCPU{Type: "host-x86_64-cpu", VCPUsCount: 1, Props: qmp.CPUProps{SocketID: i}}
+		if i < 2 {
+			cpus[i].QOMPath = fmt.Sprintf("/machine/unattached/device[%d]", i)
+		}
+	}
+
+	return cpus, nil
+}
+
+func startServer(t *testing.T, vm qmp.VM) (*qmp.Server, *qmp.Client) {
+	t.Helper()
+
+	s, path := listen(t, vm)
+
+	return s, dial(t, path)
+}
+
+// listen serves vm on a socket, whose path it returns.
+func listen(t *testing.T, vm qmp.VM) (*qmp.Server, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "qmp.sock")
+	s := qmp.New(vm)
+
+	if err := s.Listen(path); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if err := s.Serve(); err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	}()
+
+	t.Cleanup(func() { s.Close() })
+
+	return s, path
+}
+
+func dial(t *testing.T, path string) *qmp.Client {
+	t.Helper()
+
+	c, err := qmp.Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func TestStatusPauseResume(t *testing.T) {
+	t.Parallel()
+
+	_, c := startServer(t, newMockVM())
+
+	for _, tt := range []struct {
+		cmd  string
+		want qmp.Status
+	}{
+		{cmd: "", want: qmp.StatusRunning},
+		{cmd: "stop", want: qmp.StatusPaused},
+		{cmd: "cont", want: qmp.StatusRunning},
+		{cmd: "system_powerdown", want: qmp.StatusShutdown},
+	} {
+		if tt.cmd != "" {
+			if err := c.Execute(tt.cmd, nil, nil); err != nil {
+				t.Fatalf("%s: %v", tt.cmd, err)
+			}
+		}
+
+		var st qmp.StatusInfo
+		if err := c.Execute("query-status", nil, &st); err != nil {
+			t.Fatal(err)
+		}
+
+		if st.Status != tt.want || st.Running != (tt.want == qmp.StatusRunning) {
+			t.Errorf("after %q: got %+v, want %v", tt.cmd, st, tt.want)
+		}
+	}
+}
+
+func TestQueryCPUs(t *testing.T) {
+	t.Parallel()
+
+	vm := newMockVM()
+	_, c := startServer(t, vm)
+
+	var cpus []qmp.CPUInfo
+	if err := c.Execute("query-cpus", nil, &cpus); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cpus) != 2 {
+		t.Fatalf("got %d cpus, want 2", len(cpus))
+	}
+
+	for i, cpu := range cpus {
+		if cpu.CPU != i || cpu.Regs.RIP != uint64(0x1000+i) || cpu.Sregs.CR3 != 0x30000 {
+			t.Errorf("cpu %d: got %+v", i, cpu)
+		}
+	}
+
+	if vm.Status() != qmp.StatusRunning {
+		t.Errorf("query-cpus left the VM %v", vm.Status())
+	}
+}
+
+func TestQueryCPUsStop(t *testing.T) {
+	t.Parallel()
+
+	vm := newMockVM()
+	_, path := listen(t, vm)
+	c, other := dial(t, path), dial(t, path)
+
+	// Another client stops the VM while query-cpus reads the registers.
+	stopped := make(chan error, 1)
+	vm.onRegs = func() {
+		vm.onRegs = nil
+
+		go func() { stopped <- other.Execute("stop", nil, nil) }()
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := c.Execute("query-cpus", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+
+	if vm.Status() != qmp.StatusPaused {
+		t.Errorf("stop during query-cpus left the VM %v", vm.Status())
+	}
+}
+
+func TestBadJSON(t *testing.T) {
+	t.Parallel()
+
+	_, path := listen(t, newMockVM())
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+
+	var greeting json.RawMessage
+	if err := dec.Decode(&greeting); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each bad command gets an error, and the next one is served.
+	in := `{"execute": "qmp_capabilities"}
+{"execute" "stop"}
+{"execute": 1}
+{"execute": "query-status", "id": 7}
+`
+	if _, err := conn.Write([]byte(in)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []string{"", qmp.ClassGenericError, qmp.ClassGenericError, ""} {
+		var resp struct {
+			Return json.RawMessage `json:"return"`
+			Error  *qmp.Error      `json:"error"`
+			ID     int             `json:"id"`
+		}
+
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+
+		got := ""
+		if resp.Error != nil {
+			got = resp.Error.Class
+		}
+
+		if got != want {
+			t.Errorf("reply %d: got %+v, want %q", i, resp, want)
+		}
+
+		if i == 3 && resp.ID != 7 {
+			t.Errorf("reply %d: got id %d, want 7", i, resp.ID)
+		}
+	}
+}
+
+func TestReadMemory(t *testing.T) {
+	t.Parallel()
+
+	_, c := startServer(t, newMockVM())
+
+	var ret qmp.ReadMemoryInfo
+	if err := c.Execute("read-memory", qmp.ReadMemoryArgs{Addr: 0x100, Size: 5}, &ret); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(ret.Data) != "gokvm" {
+		t.Errorf("got %q, want %q", ret.Data, "gokvm")
+	}
+
+	err := c.Execute("read-memory", qmp.ReadMemoryArgs{Size: qmp.MaxReadMemory + 1}, nil)
+
+	var qerr *qmp.Error
+	if !errors.As(err, &qerr) || qerr.Class != qmp.ClassGenericError {
+		t.Errorf("oversized read: got %v, want %s", err, qmp.ClassGenericError)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	t.Parallel()
+
+	_, c := startServer(t, newMockVM())
+
+	err := c.Execute("no-such-command", nil, nil)
+
+	var qerr *qmp.Error
+	if !errors.As(err, &qerr) || qerr.Class != qmp.ClassCommandNotFound {
+		t.Errorf("got %v, want %s", err, qmp.ClassCommandNotFound)
+	}
+}
+
+func TestDeviceHotplug(t *testing.T) {
+	t.Parallel()
+
+	s, c := startServer(t, newMockVM())
+
+	args := map[string]string{"driver": "virtio-blk", "id": "disk1", "path": "/tmp/x.img"}
+
+	if err := c.Execute("device_add", args, nil); err == nil {
+		t.Errorf("device_add without handler: got nil, want err")
+	}
+
+	h := &mockHotplug{added: map[string]string{}}
+	s.SetHotplugHandler(h)
+
+	if err := c.Execute("device_add", args, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.added["disk1"] != "virtio-blk" {
+		t.Errorf("device_add: got %v", h.added)
+	}
+
+	if err := c.Execute("device_del", map[string]string{"id": "disk1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.added) != 0 {
+		t.Errorf("device_del: got %v", h.added)
+	}
+}
+
+func TestBalloon(t *testing.T) {
+	t.Parallel()
+
+	s, c := startServer(t, newMockVM())
+
+	var qerr *qmp.Error
+
+	err := c.Execute("query-balloon", nil, nil)
+	if !errors.As(err, &qerr) || !strings.Contains(qerr.Desc, "no balloon") {
+		t.Errorf("query-balloon without handler: got %v, want %v", err, qmp.ErrNoBalloon)
+	}
+
+	s.SetBalloonHandler(&mockBalloon{})
+
+	if err := c.Execute("balloon", qmp.BalloonArgs{Value: 512 << 20}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var info qmp.BalloonInfo
+
+	if err := c.Execute("query-balloon", nil, &info); err != nil || info.Actual != 512<<20 {
+		t.Errorf("query-balloon: got %+v, %v, want %d", info, err, 512<<20)
+	}
+
+	var stats qmp.BalloonStats
+
+	if err := c.Execute("query-balloon-stats", nil, &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Stats["stat-free-memory"] != 1<<20 || stats.LastUpdate != 1700000000 {
+		t.Errorf("query-balloon-stats: got %+v", stats)
+	}
+}
+
+func TestResizeMemory(t *testing.T) {
+	t.Parallel()
+
+	s, c := startServer(t, newMockVM())
+
+	var qerr *qmp.Error
+
+	err := c.Execute("resize-memory", qmp.ResizeMemoryArgs{Size: 2 << 30}, nil)
+	if !errors.As(err, &qerr) || !strings.Contains(qerr.Desc, "no virtio-mem") {
+		t.Errorf("resize-memory without handler: got %v, want %v", err, qmp.ErrNoMemHotplug)
+	}
+
+	s.SetMemoryHandler(&mockMemory{})
+
+	if err := c.Execute("resize-memory", qmp.ResizeMemoryArgs{Size: 2 << 30}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var info qmp.MemorySizeSummary
+
+	if err := c.Execute("query-memory-size-summary", nil, &info); err != nil ||
+		info.BaseMemory != 1<<30 || info.PluggedMemory != 1<<30 {
+		t.Errorf("query-memory-size-summary: got %+v, %v, want 1 GiB each", info, err)
+	}
+}
+
+func TestQueryHotpluggableCPUs(t *testing.T) {
+	t.Parallel()
+
+	s, c := startServer(t, newMockVM())
+
+	var qerr *qmp.Error
+
+	err := c.Execute("query-hotpluggable-cpus", nil, nil)
+	if !errors.As(err, &qerr) || !strings.Contains(qerr.Desc, "cpu hotplug") {
+		t.Errorf("query-hotpluggable-cpus without handler: got %v, want %v", err, qmp.ErrNoCPUHotplug)
+	}
+
+	s.SetCPUHotplugHandler(mockCPUs{})
+
+	var cpus []qmp.HotpluggableCPU
+
+	if err := c.Execute("query-hotpluggable-cpus", nil, &cpus); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cpus) != 4 || cpus[3].Props.SocketID != 3 || cpus[3].QOMPath != "" || cpus[1].QOMPath == "" {
+		t.Errorf("query-hotpluggable-cpus: got %+v", cpus)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	t.Parallel()
+
+	vm := newMockVM()
+	_, c := startServer(t, vm)
+
+	if err := c.Execute("quit", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	<-vm.quit
+}
@@ -0,0 +1,117 @@
+// Package sched sets which host CPUs a host thread runs on and its
+// scheduling policy, for the threads running vCPUs or device IO.
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// MaxCPUs is the number of host CPUs a thread can be pinned to.
+	MaxCPUs = 1024
+
+	// MaxPriority is the highest SCHED_FIFO priority.
+	MaxPriority = 99
+
+	schedFIFO = 1
+)
+
+var (
+	// ErrInvalidCPU indicates a host CPU out of range.
+	ErrInvalidCPU = errors.New("invalid host CPU")
+
+	// ErrInvalidPriority indicates a SCHED_FIFO priority out of range.
+	ErrInvalidPriority = errors.New("invalid SCHED_FIFO priority")
+)
+
+// Policy tells how the host schedules a thread: on the host CPUs CPUs,
+// or on any if empty, and with the real-time SCHED_FIFO policy at
+// Priority, from 1 to MaxPriority, or with the default policy if 0.
+type Policy struct {
+	CPUs     []int
+	Priority int
+}
+
+// IsZero tells whether p leaves a thread as it is.
+func (p Policy) IsZero() bool {
+	return len(p.CPUs) == 0 && p.Priority == 0
+}
+
+// Check returns an error if p has a host CPU or a priority out of range.
+func (p Policy) Check() error {
+	for _, c := range p.CPUs {
+		if c < 0 || c >= MaxCPUs {
+			return fmt.Errorf("CPU %d:%w", c, ErrInvalidCPU)
+		}
+	}
+
+	if p.Priority < 0 || p.Priority > MaxPriority {
+		return fmt.Errorf("priority %d:%w", p.Priority, ErrInvalidPriority)
+	}
+
+	return nil
+}
+
+// Apply applies p to the calling thread. The goroutine must be locked to
+// the thread with runtime.LockOSThread and stay locked until it ends, so
+// that the thread exits with it instead of running other goroutines.
+func (p Policy) Apply() error {
+	if err := p.Check(); err != nil {
+		return err
+	}
+
+	if len(p.CPUs) > 0 {
+		var set unix.CPUSet
+
+		for _, c := range p.CPUs {
+			set.Set(c)
+		}
+
+		if err := unix.SchedSetaffinity(0, &set); err != nil {
+			return fmt.Errorf("pinning to CPUs %v: %w", p.CPUs, err)
+		}
+	}
+
+	if p.Priority != 0 {
+		param := struct{ priority int32 }{int32(p.Priority)}
+
+		_, _, errno := unix.RawSyscall(unix.SYS_SCHED_SETSCHEDULER, 0, schedFIFO, uintptr(unsafe.Pointer(&param)))
+		if errno != 0 {
+			return fmt.Errorf("setting SCHED_FIFO priority %d: %w", p.Priority, errno)
+		}
+	}
+
+	return nil
+}
+
+// Go runs f in a new goroutine. Unless p is zero, the goroutine runs on
+// a thread of its own to which p is applied, and which exits with it.
+// The error is the one of applying p, in which case f does not run.
+func Go(p Policy, f func()) error {
+	if p.IsZero() {
+		go f()
+
+		return nil
+	}
+
+	errc := make(chan error)
+
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine.
+		runtime.LockOSThread()
+
+		err := p.Apply()
+		errc <- err
+
+		if err == nil {
+			f()
+		}
+	}()
+
+	return <-errc
+}
@@ -0,0 +1,89 @@
+package sched_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/sched"
+	"golang.org/x/sys/unix"
+)
+
+func TestGo(t *testing.T) {
+	t.Parallel()
+
+	type result struct {
+		set    unix.CPUSet
+		policy int
+	}
+
+	run := func(p sched.Policy) (result, error) {
+		done := make(chan result, 1)
+
+		err := sched.Go(p, func() {
+			var r result
+
+			_ = unix.SchedGetaffinity(0, &r.set)
+			policy, _, _ := unix.RawSyscall(unix.SYS_SCHED_GETSCHEDULER, 0, 0, 0)
+			r.policy = int(policy)
+			done <- r
+		})
+		if err != nil {
+			return result{}, err
+		}
+
+		return <-done, nil
+	}
+
+	r, err := run(sched.Policy{CPUs: []int{0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.set.Count() != 1 || !r.set.IsSet(0) {
+		t.Errorf("pinned to %d CPUs, want CPU 0 only", r.set.Count())
+	}
+
+	r, err = run(sched.Policy{CPUs: []int{0}, Priority: 1})
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("no real-time scheduling: %v", err)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.policy != 1 {
+		t.Errorf("got policy %d, want SCHED_FIFO", r.policy)
+	}
+
+	// The policy must not leak to other goroutines.
+	if r, _ = run(sched.Policy{}); r.policy != 0 {
+		t.Errorf("got policy %d for a zero policy, want SCHED_OTHER", r.policy)
+	}
+}
+
+func TestGoErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		p   sched.Policy
+		err error
+	}{
+		{sched.Policy{CPUs: []int{-1}}, sched.ErrInvalidCPU},
+		{sched.Policy{CPUs: []int{sched.MaxCPUs}}, sched.ErrInvalidCPU},
+		{sched.Policy{Priority: sched.MaxPriority + 1}, sched.ErrInvalidPriority},
+		{sched.Policy{Priority: -1}, sched.ErrInvalidPriority},
+		// No host has that many CPUs online.
+		{sched.Policy{CPUs: []int{sched.MaxCPUs - 1}}, unix.EINVAL},
+	} {
+		ran := false
+
+		if err := sched.Go(tt.p, func() { ran = true }); !errors.Is(err, tt.err) {
+			t.Errorf("%+v: got %v, want %v", tt.p, err, tt.err)
+		}
+
+		if ran {
+			t.Errorf("%+v: ran despite the error", tt.p)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrInvalidSpec = errors.New("invalid serial backend")
+	ErrClosed      = errors.New("serial backend closed")
+)
+
+// Kinds of backends, as given before the first colon of a spec.
+const (
+	KindStdio = "stdio"
+	KindNull  = "null"
+	KindPTY   = "pty"
+	KindFile  = "file"
+	KindUnix  = "unix"
+	KindTCP   = "tcp"
+)
+
+// Spec describes the host side of a serial port, written as
+//
+//	stdio | null | pty | file:PATH | unix:PATH | tcp:HOST:PORT
+//
+// optionally followed by ",timestamps" to prefix each output line with
+// the time it was written.
+type Spec struct {
+	Kind       string
+	Path       string
+	Timestamps bool
+}
+
+// ParseSpec parses a backend spec. It does not open anything.
+func ParseSpec(s string) (Spec, error) {
+	var spec Spec
+
+	main, opts, _ := strings.Cut(s, ",")
+
+	for _, opt := range strings.Split(opts, ",") {
+		switch opt {
+		case "":
+		case "timestamps":
+			spec.Timestamps = true
+		default:
+			return spec, fmt.Errorf("%w %q: unknown option %q", ErrInvalidSpec, s, opt)
+		}
+	}
+
+	spec.Kind, spec.Path, _ = strings.Cut(main, ":")
+
+	switch spec.Kind {
+	case KindStdio, KindNull, KindPTY:
+		if spec.Path != "" {
+			return spec, fmt.Errorf("%w %q: %s takes no argument", ErrInvalidSpec, s, spec.Kind)
+		}
+	case KindFile, KindUnix:
+		if spec.Path == "" {
+			return spec, fmt.Errorf("%w %q: %s needs a path", ErrInvalidSpec, s, spec.Kind)
+		}
+	case KindTCP:
+		if _, _, err := net.SplitHostPort(spec.Path); err != nil {
+			return spec, fmt.Errorf("%w %q: %v", ErrInvalidSpec, s, err)
+		}
+	default:
+		return spec, fmt.Errorf("%w %q: want stdio, null, pty, file:PATH, unix:PATH or tcp:HOST:PORT",
+			ErrInvalidSpec, s)
+	}
+
+	return spec, nil
+}
+
+// Backend connects a serial port to the host. The guest output is
+// written to it and the guest input is read from it. Read blocks
+// until there is input and returns io.EOF once the backend is closed.
+type Backend interface {
+	io.ReadWriteCloser
+
+	// Addr tells where to connect to the port, e.g. the path of the
+	// pty. It is empty for backends nobody connects to.
+	Addr() string
+}
+
+// Open creates the backend described by s.
+func (s Spec) Open() (Backend, error) {
+	switch s.Kind {
+	case KindStdio:
+		return &stdio{closed: make(chan struct{})}, nil
+	case KindNull:
+		return &null{closed: make(chan struct{})}, nil
+	case KindPTY:
+		return openPTY()
+	case KindFile:
+		f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		return &file{File: f, closed: make(chan struct{})}, nil
+	case KindUnix, KindTCP:
+		if s.Kind == KindUnix {
+			if err := os.Remove(s.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+
+		ln, err := net.Listen(s.Kind, s.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		return newListener(ln), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidSpec, s.Kind)
+	}
+}
+
+// stdio reads stdin and writes stdout. Close does not close either.
+type stdio struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (s *stdio) Read(b []byte) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, io.EOF
+	default:
+		return os.Stdin.Read(b)
+	}
+}
+
+func (s *stdio) Write(b []byte) (int, error) { return os.Stdout.Write(b) }
+func (s *stdio) Addr() string                { return "" }
+
+func (s *stdio) Close() error {
+	s.once.Do(func() { close(s.closed) })
+
+	return nil
+}
+
+// null discards the output and never has input.
+type null struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (n *null) Read([]byte) (int, error) {
+	<-n.closed
+
+	return 0, io.EOF
+}
+
+func (n *null) Write(b []byte) (int, error) { return len(b), nil }
+func (n *null) Addr() string                { return "" }
+
+func (n *null) Close() error {
+	n.once.Do(func() { close(n.closed) })
+
+	return nil
+}
+
+// file appends the output to a log file and never has input.
+type file struct {
+	*os.File
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (f *file) Read([]byte) (int, error) {
+	<-f.closed
+
+	return 0, io.EOF
+}
+
+func (f *file) Addr() string { return "" }
+
+func (f *file) Close() error {
+	f.once.Do(func() { close(f.closed) })
+
+	return f.File.Close()
+}
+
+// pty is the master side of a pseudo terminal. Its slave, given by
+// Addr, can be opened with screen or minicom.
+type pty struct {
+	*os.File
+
+	path string
+}
+
+func openPTY() (*pty, error) {
+	f, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := int(f.Fd())
+
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	// Like cfmakeraw(3), so that the guest sees every byte as typed.
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, t); err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	return &pty{File: f, path: fmt.Sprintf("/dev/pts/%d", n)}, nil
+}
+
+func (p *pty) Addr() string { return p.path }
+
+// Read waits for a slave to be opened, since the master reads EIO
+// while there is none.
+func (p *pty) Read(b []byte) (int, error) {
+	for {
+		n, err := p.File.Read(b)
+		if !errors.Is(err, syscall.EIO) {
+			if errors.Is(err, os.ErrClosed) {
+				return n, io.EOF
+			}
+
+			return n, err
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// listener serves the port to one client of a unix or tcp socket at a
+// time. A new client replaces the previous one, and the output is
+// discarded while no client is connected.
+type listener struct {
+	ln net.Listener
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	conn   net.Conn
+	closed bool
+}
+
+func newListener(ln net.Listener) *listener {
+	l := &listener{ln: ln}
+	l.cond = sync.NewCond(&l.mu)
+
+	go l.accept()
+
+	return l
+}
+
+func (l *listener) accept() {
+	for {
+		c, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		l.mu.Lock()
+
+		if l.conn != nil {
+			l.conn.Close()
+		}
+
+		l.conn = c
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	}
+}
+
+// client waits for a client to connect.
+func (l *listener) client() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.conn == nil && !l.closed {
+		l.cond.Wait()
+	}
+
+	if l.closed {
+		return nil, ErrClosed
+	}
+
+	return l.conn, nil
+}
+
+func (l *listener) drop(c net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c.Close()
+
+	if l.conn == c {
+		l.conn = nil
+	}
+}
+
+func (l *listener) Read(b []byte) (int, error) {
+	for {
+		c, err := l.client()
+		if err != nil {
+			return 0, io.EOF
+		}
+
+		n, err := c.Read(b)
+		if n > 0 || err == nil {
+			return n, nil
+		}
+
+		l.drop(c)
+	}
+}
+
+func (l *listener) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	c := l.conn
+	l.mu.Unlock()
+
+	if c == nil {
+		return len(b), nil
+	}
+
+	if _, err := c.Write(b); err != nil {
+		l.drop(c)
+	}
+
+	return len(b), nil
+}
+
+func (l *listener) Addr() string {
+	return l.ln.Addr().String()
+}
+
+func (l *listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	l.cond.Broadcast()
+
+	if l.conn != nil {
+		l.conn.Close()
+	}
+
+	// Closing a unix listener removes its socket file.
+	return l.ln.Close()
+}
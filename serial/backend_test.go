@@ -0,0 +1,177 @@
+package serial_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/serial"
+)
+
+func TestParseSpec(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		in   string
+		want serial.Spec
+	}{
+		{in: "stdio", want: serial.Spec{Kind: serial.KindStdio}},
+		{in: "null", want: serial.Spec{Kind: serial.KindNull}},
+		{in: "pty,timestamps", want: serial.Spec{Kind: serial.KindPTY, Timestamps: true}},
+		{in: "file:/var/log/vm.log", want: serial.Spec{Kind: serial.KindFile, Path: "/var/log/vm.log"}},
+		{in: "unix:/run/vm.sock", want: serial.Spec{Kind: serial.KindUnix, Path: "/run/vm.sock"}},
+		{in: "tcp:127.0.0.1:4444", want: serial.Spec{Kind: serial.KindTCP, Path: "127.0.0.1:4444"}},
+	} {
+		got, err := serial.ParseSpec(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSpec(%q): got %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "telnet", "pty:/dev/pts/1", "file", "unix:", "tcp:4444", "null,color"} {
+		if _, err := serial.ParseSpec(in); !errors.Is(err, serial.ErrInvalidSpec) {
+			t.Errorf("ParseSpec(%q): got %v, want %v", in, err, serial.ErrInvalidSpec)
+		}
+	}
+}
+
+func open(t *testing.T, spec string) serial.Backend {
+	t.Helper()
+
+	s, err := serial.ParseSpec(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// readEOF checks that Read on b returns io.EOF once b is closed.
+func readEOF(t *testing.T, b serial.Backend) {
+	t.Helper()
+
+	done := make(chan error)
+
+	go func() {
+		_, err := b.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; !errors.Is(err, io.EOF) {
+		t.Errorf("Read after Close: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestNullAndFile(t *testing.T) {
+	t.Parallel()
+
+	readEOF(t, open(t, "null"))
+
+	path := filepath.Join(t.TempDir(), "console.log")
+	b := open(t, "file:"+path)
+
+	if _, err := b.Write([]byte("boot\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	readEOF(t, b)
+
+	if got, err := os.ReadFile(path); err != nil || string(got) != "boot\n" {
+		t.Errorf("file: got %q, %v, want %q", got, err, "boot\n")
+	}
+}
+
+// roundTrip checks that c receives the output of b and b the input of c.
+func roundTrip(t *testing.T, b serial.Backend, c io.ReadWriter) {
+	t.Helper()
+
+	// Writes before the client is seen by the backend may be dropped.
+	deadline := time.Now().Add(5 * time.Second)
+	got := make([]byte, 2)
+
+	for {
+		if _, err := b.Write([]byte("ok")); err != nil {
+			t.Fatal(err)
+		}
+
+		if conn, isConn := c.(net.Conn); isConn {
+			_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		}
+
+		if n, _ := io.ReadFull(c, got); n == 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("no output from the backend")
+		}
+	}
+
+	if string(got) != "ok" {
+		t.Errorf("output: got %q, want %q", got, "ok")
+	}
+
+	if _, err := c.Write([]byte("in")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(b, got); err != nil || string(got) != "in" {
+		t.Errorf("input: got %q, %v, want %q", got, err, "in")
+	}
+}
+
+func TestSocket(t *testing.T) {
+	t.Parallel()
+
+	for _, spec := range []string{"unix:" + filepath.Join(t.TempDir(), "console.sock"), "tcp:127.0.0.1:0"} {
+		b := open(t, spec)
+		s, _ := serial.ParseSpec(spec)
+
+		c, err := net.Dial(s.Kind, b.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roundTrip(t, b, c)
+
+		// The next client takes over.
+		c2, err := net.Dial(s.Kind, b.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		roundTrip(t, b, c2)
+
+		c.Close()
+		c2.Close()
+		readEOF(t, b)
+	}
+}
+
+func TestPTY(t *testing.T) {
+	t.Parallel()
+
+	b := open(t, "pty")
+
+	slave, err := os.OpenFile(b.Addr(), os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("opening %s: %v", b.Addr(), err)
+	}
+	defer slave.Close()
+
+	roundTrip(t, b, slave)
+	readEOF(t, b)
+}
@@ -0,0 +1,123 @@
+package serial
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// MaxOutputBuffer is the number of bytes Output holds while its writer
+// is busy with the previous batch. Further bytes are dropped.
+const MaxOutputBuffer = 1 << 16
+
+// TimestampFormat is the prefix of each line written by an Output
+// with timestamps.
+const TimestampFormat = "[2006-01-02 15:04:05.000] "
+
+// Output decouples the guest from a slow or blocked writer. The guest
+// writes one byte per port access, which Output collects and hands to
+// the writer in batches from its own goroutine.
+type Output struct {
+	w          io.Writer
+	timestamps bool
+
+	mu          sync.Mutex
+	buf         []byte
+	lineStarted bool
+	closed      bool
+
+	kick chan struct{}
+	done chan struct{}
+}
+
+// NewOutput starts an Output in front of w. If timestamps is set, each
+// line is prefixed with the time formatted as TimestampFormat.
+func NewOutput(w io.Writer, timestamps bool) *Output {
+	o := &Output{
+		w:          w,
+		timestamps: timestamps,
+		kick:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	go o.flusher()
+
+	return o
+}
+
+// Write never blocks on the underlying writer.
+func (o *Output) Write(b []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return 0, ErrClosed
+	}
+
+	for _, c := range b {
+		if o.timestamps && !o.lineStarted {
+			o.append([]byte(time.Now().Format(TimestampFormat))...)
+		}
+
+		o.append(c)
+		o.lineStarted = c != '\n'
+	}
+
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+
+	return len(b), nil
+}
+
+func (o *Output) append(b ...byte) {
+	if len(o.buf)+len(b) <= MaxOutputBuffer {
+		o.buf = append(o.buf, b...)
+	}
+}
+
+func (o *Output) flusher() {
+	defer close(o.done)
+
+	for range o.kick {
+		o.mu.Lock()
+		b := o.buf
+		o.buf = nil
+		closed := o.closed
+		o.mu.Unlock()
+
+		if len(b) > 0 {
+			_, _ = o.w.Write(b)
+		}
+
+		if closed {
+			return
+		}
+	}
+}
+
+// Close writes what is left in the buffer. It does not close the
+// underlying writer.
+func (o *Output) Close() error {
+	o.mu.Lock()
+
+	if o.closed {
+		o.mu.Unlock()
+
+		return nil
+	}
+
+	o.closed = true
+
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+
+	o.mu.Unlock()
+
+	<-o.done
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package serial_test
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/serial"
+)
+
+// blockedWriter blocks every Write until unblock is closed.
+type blockedWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	writes  int
+	unblock chan struct{}
+}
+
+func (w *blockedWriter) Write(b []byte) (int, error) {
+	<-w.unblock
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.writes++
+
+	return w.buf.Write(b)
+}
+
+func TestOutputDoesNotBlock(t *testing.T) {
+	t.Parallel()
+
+	w := &blockedWriter{unblock: make(chan struct{})}
+	o := serial.NewOutput(w, false)
+
+	in := bytes.Repeat([]byte("0123456789abcdef"), serial.MaxOutputBuffer/4)
+
+	// One byte at a time, like the guest does.
+	for _, b := range in {
+		if _, err := o.Write([]byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(w.unblock)
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.Write([]byte{0}); !errors.Is(err, serial.ErrClosed) {
+		t.Errorf("Write after Close: got %v, want %v", err, serial.ErrClosed)
+	}
+
+	got := w.buf.Bytes()
+
+	// At most one batch is held by the blocked write, and one
+	// more is buffered meanwhile.
+	if len(got) > 2*serial.MaxOutputBuffer || len(got) == len(in) || got[0] != in[0] {
+		t.Errorf("got %d of %d bytes, want at most %d", len(got), len(in), 2*serial.MaxOutputBuffer)
+	}
+
+	if w.writes > 3 {
+		t.Errorf("got %d writes, want the output batched", w.writes)
+	}
+}
+
+func TestOutputTimestamps(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	o := serial.NewOutput(&buf, true)
+
+	for _, s := range []string{"Linux ", "version\r\n", "init\r", "\n"} {
+		if _, err := o.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := `\[\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\.\d{3}\] `
+	want := regexp.MustCompile("^" + ts + "Linux version\r\n" + ts + "init\r\n$")
+
+	if !want.Match(buf.Bytes()) {
+		t.Errorf("got %q, want it to match %v", buf.String(), want)
+	}
+}
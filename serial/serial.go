@@ -1,126 +1,461 @@
+// Package serial emulates a 16550A UART.
+//
+// Transmission is instantaneous: a byte written to THR goes straight to
+// the output, so the transmitter FIFO is always empty. Received bytes
+// wait in a host side queue until the receiver FIFO has room for them.
+//
+// refs https://www.ti.com/lit/ds/symlink/pc16550d.pdf
 package serial
 
 import (
 	"bufio"
 	"errors"
-	"fmt"
 	"io"
 	"log"
+	"os"
+	"sync"
 )
 
+// Base ports of the standard PC serial ports.
 const (
 	COM1Addr = 0x03f8
+	COM2Addr = 0x02f8
+	COM3Addr = 0x03e8
+	COM4Addr = 0x02e8
 )
 
-// Note that this identical interface is defined across
-// multiple packages. It should be defined by the machine.
+// Ports lists the base port and the IRQ of COM1 to COM4 in order. COM1
+// and COM3 share IRQ 4, COM2 and COM4 share IRQ 3.
+var Ports = [...]struct {
+	Addr uint64
+	IRQ  uint8
+}{
+	{COM1Addr, 4},
+	{COM2Addr, 3},
+	{COM3Addr, 4},
+	{COM4Addr, 3},
+}
+
+const (
+	// fifoSize is the depth of the 16550A FIFOs.
+	fifoSize = 16
+)
+
+// Register offsets from the base port.
+const (
+	regData = 0 // RBR, THR, or DLL when DLAB is set
+	regIER  = 1 // or DLM when DLAB is set
+	regIIR  = 2 // FCR on write
+	regLCR  = 3
+	regMCR  = 4
+	regLSR  = 5
+	regMSR  = 6
+	regSCR  = 7
+)
+
+// Register bits.
+const (
+	ierRDI  = 0x01 // received data available
+	ierTHRI = 0x02 // transmitter holding register empty
+	ierRLSI = 0x04 // receiver line status
+	ierMSI  = 0x08 // modem status
+
+	iirNoInt = 0x01
+	iirMSI   = 0x00
+	iirTHRI  = 0x02
+	iirRDI   = 0x04
+	iirRLSI  = 0x06
+	iirCTI   = 0x0c // character timeout
+	iirFIFO  = 0xc0
+
+	fcrEnable   = 0x01
+	fcrClearRX  = 0x02
+	fcrClearTX  = 0x04
+	fcrTrigMask = 0xc0
+
+	lcrDLAB = 0x80
+
+	mcrDTR  = 0x01
+	mcrRTS  = 0x02
+	mcrOUT1 = 0x04
+	mcrOUT2 = 0x08
+	mcrLoop = 0x10
+
+	lsrDR     = 0x01
+	lsrOE     = 0x02
+	lsrPE     = 0x04
+	lsrFE     = 0x08
+	lsrBI     = 0x10
+	lsrTHRE   = 0x20
+	lsrTEMT   = 0x40
+	lsrErrors = lsrOE | lsrPE | lsrFE | lsrBI
+
+	msrDCTS  = 0x01
+	msrDDSR  = 0x02
+	msrTERI  = 0x04
+	msrDDCD  = 0x08
+	msrCTS   = 0x10
+	msrDSR   = 0x20
+	msrRI    = 0x40
+	msrDCD   = 0x80
+	msrDelta = msrDCTS | msrDDSR | msrTERI | msrDDCD
+)
 
+// IRQInjector drives the interrupt line of the UART.
+//
+// Note that a similar interface is defined across
+// multiple packages. It should be defined by the machine.
 type IRQInjector interface {
-	InjectSerialIRQ() error
+	SetSerialIRQ(level bool) error
 }
 
 type Serial struct {
-	IER byte
-	LCR byte
+	mu sync.Mutex
+
+	// base is the first of the 8 ports of the UART.
+	base uint64
+
+	ier, lcr, mcr, scr, fcr byte
+	lsr, msr                byte
+	divisor                 uint16
+
+	rx []byte
 
+	// thrIPending is set when THR becomes empty and cleared when the
+	// guest reads the THRE interrupt from IIR or writes THR.
+	thrIPending bool
+
+	irqLevel bool
+
+	// inputChan queues the host input until rx has room.
 	inputChan chan byte
 
+	// out receives every byte written by the guest to THR.
+	out io.Writer
+
 	irqInjector IRQInjector
 }
 
-func New(irqInjector IRQInjector) (*Serial, error) {
+// New creates a UART at the ports from base to base+7, e.g. COM1Addr.
+func New(base uint64, irqInjector IRQInjector) (*Serial, error) {
 	s := &Serial{
-		IER: 0, LCR: 0,
+		base:        base,
+		lsr:         lsrTHRE | lsrTEMT,
+		msr:         msrCTS | msrDSR | msrDCD,
+		divisor:     0xc, // baud rate 9600
 		inputChan:   make(chan byte, 10000),
+		out:         os.Stdout,
 		irqInjector: irqInjector,
 	}
 
 	return s, nil
 }
 
+// SetOutput redirects the guest output, which goes to stdout by default.
+func (s *Serial) SetOutput(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.out = w
+}
+
+// GetInputChan returns the queue of the host input. Bytes sent to it
+// are seen by the guest when it next accesses the UART; use Receive to
+// notify it right away.
 func (s *Serial) GetInputChan() chan<- byte {
 	return s.inputChan
 }
 
 func (s *Serial) dlab() bool {
-	return s.LCR&0x80 != 0
+	return s.lcr&lcrDLAB != 0
 }
 
-func (s *Serial) In(port uint64, values []byte) error {
-	port -= COM1Addr
+func (s *Serial) fifoEnabled() bool {
+	return s.fcr&fcrEnable != 0
+}
+
+func (s *Serial) rxCapacity() int {
+	if s.fifoEnabled() {
+		return fifoSize
+	}
+
+	return 1
+}
+
+// rxTrigger returns the RX FIFO level which raises RDI.
+func (s *Serial) rxTrigger() int {
+	if !s.fifoEnabled() {
+		return 1
+	}
+
+	return [4]int{1, 4, 8, 14}[s.fcr>>6]
+}
+
+// fill moves queued host input into the receiver.
+func (s *Serial) fill() {
+	for len(s.rx) < s.rxCapacity() && s.mcr&mcrLoop == 0 {
+		select {
+		case b := <-s.inputChan:
+			s.rx = append(s.rx, b)
+		default:
+			return
+		}
+	}
+}
+
+// push receives b from the transmitter in loopback mode.
+func (s *Serial) push(b byte) {
+	if len(s.rx) >= s.rxCapacity() {
+		s.lsr |= lsrOE
+
+		return
+	}
+
+	s.rx = append(s.rx, b)
+}
+
+func (s *Serial) iir() byte {
+	var id byte = iirNoInt
 
 	switch {
-	case port == 0 && !s.dlab():
-		// RBR
-		if len(s.inputChan) > 0 {
-			values[0] = <-s.inputChan
-		}
-	case port == 0 && s.dlab():
-		// DLL
-		values[0] = 0xc // baud rate 9600
-	case port == 1 && !s.dlab():
-		// IER
-		values[0] = s.IER
-	case port == 1 && s.dlab():
-		// DLM
-		values[0] = 0x0 // baud rate 9600
-	case port == 2:
-		// IIR
-	case port == 3:
-		// LCR
-	case port == 4:
-		// MCR
-	case port == 5:
-		// LSR
-		values[0] |= 0x20 // Empty Transmitter Holding Register
-		values[0] |= 0x40 // Empty Data Holding Registers
-
-		if len(s.inputChan) > 0 {
-			values[0] |= 0x1 // Data Ready
-		}
-	case port == 6:
-		// MSR
-		break
-	}
-
-	return nil
+	case s.ier&ierRLSI != 0 && s.lsr&lsrErrors != 0:
+		id = iirRLSI
+	case s.ier&ierRDI != 0 && len(s.rx) >= s.rxTrigger():
+		id = iirRDI
+	case s.ier&ierRDI != 0 && len(s.rx) > 0:
+		// Data below the trigger level with no more input to come.
+		id = iirCTI
+	case s.ier&ierTHRI != 0 && s.thrIPending:
+		id = iirTHRI
+	case s.ier&ierMSI != 0 && s.msr&msrDelta != 0:
+		id = iirMSI
+	}
+
+	if s.fifoEnabled() {
+		id |= iirFIFO
+	}
+
+	return id
+}
+
+// updateIRQ raises or lowers the interrupt line after a state change.
+// The line is edge triggered, so it is only driven on a change.
+func (s *Serial) updateIRQ() error {
+	level := s.iir()&iirNoInt == 0
+	if level == s.irqLevel {
+		return nil
+	}
+
+	s.irqLevel = level
+
+	return s.irqInjector.SetSerialIRQ(level)
+}
+
+// setMCR updates the modem lines. In loopback mode the outputs of MCR
+// drive the inputs of MSR, otherwise the other end is always ready.
+func (s *Serial) setMCR(mcr byte) {
+	s.mcr = mcr & 0x1f
+
+	msr := byte(msrCTS | msrDSR | msrDCD)
+
+	if s.mcr&mcrLoop != 0 {
+		msr = 0
+
+		for _, m := range []struct{ out, in byte }{
+			{mcrRTS, msrCTS}, {mcrDTR, msrDSR}, {mcrOUT1, msrRI}, {mcrOUT2, msrDCD},
+		} {
+			if s.mcr&m.out != 0 {
+				msr |= m.in
+			}
+		}
+	}
+
+	changed := (s.msr ^ msr) & 0xf0
+	delta := s.msr & msrDelta
+
+	if changed&msrCTS != 0 {
+		delta |= msrDCTS
+	}
+
+	if changed&msrDSR != 0 {
+		delta |= msrDDSR
+	}
+
+	if changed&msrDCD != 0 {
+		delta |= msrDDCD
+	}
+
+	if changed&msrRI != 0 && msr&msrRI == 0 {
+		delta |= msrTERI
+	}
+
+	s.msr = msr | delta
+}
+
+func (s *Serial) setFCR(fcr byte) {
+	if (s.fcr^fcr)&fcrEnable != 0 {
+		// Enabling or disabling the FIFOs clears them.
+		fcr |= fcrClearRX | fcrClearTX
+	}
+
+	if fcr&fcrClearRX != 0 {
+		s.rx = nil
+	}
+
+	s.fcr = fcr & (fcrEnable | fcrTrigMask)
+	if !s.fifoEnabled() {
+		s.fcr = 0
+	}
+}
+
+func (s *Serial) In(port uint64, values []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fill()
+
+	switch port - s.base {
+	case regData:
+		if s.dlab() {
+			values[0] = byte(s.divisor)
+
+			break
+		}
+
+		values[0] = 0
+
+		if len(s.rx) > 0 {
+			values[0] = s.rx[0]
+			s.rx = s.rx[1:]
+			s.fill()
+		}
+	case regIER:
+		if s.dlab() {
+			values[0] = byte(s.divisor >> 8)
+		} else {
+			values[0] = s.ier
+		}
+	case regIIR:
+		values[0] = s.iir()
+		if values[0]&0x0f == iirTHRI {
+			s.thrIPending = false
+		}
+	case regLCR:
+		values[0] = s.lcr
+	case regMCR:
+		values[0] = s.mcr
+	case regLSR:
+		values[0] = s.lsr | lsrTHRE | lsrTEMT
+		if len(s.rx) > 0 {
+			values[0] |= lsrDR
+		}
+
+		s.lsr &^= lsrErrors
+	case regMSR:
+		values[0] = s.msr
+		s.msr &^= msrDelta
+	case regSCR:
+		values[0] = s.scr
+	}
+
+	return s.updateIRQ()
 }
 
 func (s *Serial) Out(port uint64, values []byte) error {
-	port -= COM1Addr
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	var err error
 
-	switch {
-	case port == 0 && !s.dlab():
-		// THR
-		fmt.Printf("%c", values[0])
-	case port == 0 && s.dlab():
-		// DLL
-	case port == 1 && !s.dlab():
-		// IER
-		s.IER = values[0]
-		if s.IER != 0 {
-			err = s.irqInjector.InjectSerialIRQ()
-		}
-	case port == 1 && s.dlab():
-		// DLM
-	case port == 2:
-		// FCR
-	case port == 3:
-		// LCR
-		s.LCR = values[0]
-	case port == 4:
-		// MCR
-	default:
-		// factory test or not used
-		break
+	switch port - s.base {
+	case regData:
+		if s.dlab() {
+			s.divisor = s.divisor&0xff00 | uint16(values[0])
+
+			break
+		}
+
+		if s.mcr&mcrLoop != 0 {
+			s.push(values[0])
+		} else {
+			_, err = s.out.Write(values[:1])
+		}
+
+		// The byte is sent at once, so THR is empty again.
+		s.thrIPending = true
+	case regIER:
+		if s.dlab() {
+			s.divisor = s.divisor&0x00ff | uint16(values[0])<<8
+
+			break
+		}
+
+		if values[0]&ierTHRI != 0 && s.ier&ierTHRI == 0 {
+			s.thrIPending = true
+		}
+
+		s.ier = values[0] & 0x0f
+	case regIIR:
+		s.setFCR(values[0])
+	case regLCR:
+		s.lcr = values[0]
+	case regMCR:
+		s.setMCR(values[0])
+	case regLSR:
+		// factory test
+	case regMSR:
+		// read only
+	case regSCR:
+		s.scr = values[0]
+	}
+
+	s.fill()
+
+	if irqErr := s.updateIRQ(); err == nil {
+		err = irqErr
 	}
 
 	return err
 }
 
-func (s *Serial) Start(in bufio.Reader, restoreMode func(), irqInject func() error) error {
+// Receive queues b as input from the host and interrupts the guest if
+// it asked for it. It blocks while the queue is full.
+func (s *Serial) Receive(b byte) error {
+	s.inputChan <- b
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fill()
+
+	return s.updateIRQ()
+}
+
+// Feed feeds the bytes read from in to the guest until in fails, which
+// is io.EOF once it is exhausted. Unlike Start, it gives no byte a
+// meaning of its own, so that binary data passes through.
+func (s *Serial) Feed(in io.Reader) error {
+	buf := make([]byte, 4096)
+
+	for {
+		n, err := in.Read(buf)
+
+		for _, b := range buf[:n] {
+			if err := s.Receive(b); err != nil {
+				log.Printf("SetSerialIRQ: %v", err)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Start feeds the bytes read from in, typed on the terminal, to the
+// guest until in is exhausted or Ctrl-a x is typed, in which case
+// restoreMode is called.
+func (s *Serial) Start(in bufio.Reader, restoreMode func()) error {
 	var before byte = 0
 
 	for {
@@ -132,12 +467,9 @@ func (s *Serial) Start(in bufio.Reader, restoreMode func(), irqInject func() err
 
 			break
 		}
-		s.GetInputChan() <- b
 
-		if len(s.GetInputChan()) > 0 {
-			if err := irqInject(); err != nil {
-				log.Printf("InjectSerialIRQ: %v", err)
-			}
+		if err := s.Receive(b); err != nil {
+			log.Printf("SetSerialIRQ: %v", err)
 		}
 
 		if before == 0x1 && b == 'x' {
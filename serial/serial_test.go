@@ -10,16 +10,25 @@ import (
 	"github.com/bobuhiro11/gokvm/serial"
 )
 
-type mockInjector struct{}
+type mockInjector struct {
+	level bool
+	edges int
+}
+
+func (m *mockInjector) SetSerialIRQ(level bool) error {
+	if level && !m.level {
+		m.edges++
+	}
+
+	m.level = level
 
-func (m *mockInjector) InjectSerialIRQ() error {
 	return nil
 }
 
 func TestNew(t *testing.T) {
 	t.Parallel()
 
-	s, err := serial.New(&mockInjector{})
+	s, err := serial.New(serial.COM1Addr, &mockInjector{})
 	s.GetInputChan()
 
 	if err != nil {
@@ -30,7 +39,7 @@ func TestNew(t *testing.T) {
 func TestIn(t *testing.T) {
 	t.Parallel()
 
-	s, err := serial.New(&mockInjector{})
+	s, err := serial.New(serial.COM1Addr, &mockInjector{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -47,7 +56,7 @@ func TestIn(t *testing.T) {
 func TestOut(t *testing.T) {
 	t.Parallel()
 
-	s, err := serial.New(&mockInjector{})
+	s, err := serial.New(serial.COM1Addr, &mockInjector{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -64,15 +73,11 @@ func TestOut(t *testing.T) {
 func TestStartSerial(t *testing.T) {
 	t.Parallel()
 
-	s, err := serial.New(&mockInjector{})
+	s, err := serial.New(serial.COM1Addr, &mockInjector{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	injectFunc := func() error {
-		return nil
-	}
-
 	var bufIn bytes.Buffer
 
 	if _, err := bufIn.Write([]byte{'T', 'E', 'S', 'T'}); err != nil {
@@ -82,7 +87,7 @@ func TestStartSerial(t *testing.T) {
 	in := bufio.NewReader(&bufIn)
 
 	go func() {
-		if err := s.Start(*in, func() {}, injectFunc); !errors.Is(err, io.EOF) {
+		if err := s.Start(*in, func() {}); !errors.Is(err, io.EOF) {
 			t.Errorf("s.Start(): got %v, want %v", err, io.EOF)
 		}
 	}()
@@ -91,3 +96,253 @@ func TestStartSerial(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestFeed(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(serial.COM1Addr, &mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ctrl-a x is data like any other.
+	if err := s.Feed(bytes.NewReader([]byte("a\x01xb"))); !errors.Is(err, io.EOF) {
+		t.Errorf("Feed: got %v, want %v", err, io.EOF)
+	}
+
+	var got []byte
+
+	for in(t, s, 5)&0x01 != 0 {
+		got = append(got, in(t, s, 0))
+	}
+
+	if string(got) != "a\x01xb" {
+		t.Errorf("RBR: got %q, want %q", got, "a\x01xb")
+	}
+}
+
+func TestSetOutput(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(serial.COM1Addr, &mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+
+	s.SetOutput(&out)
+
+	for _, b := range []byte("ok\xff") {
+		if err := s.Out(serial.COM1Addr, []byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out.String() != "ok\xff" {
+		t.Errorf("got %q, want %q", out.String(), "ok\xff")
+	}
+}
+
+func in(t *testing.T, s *serial.Serial, reg uint64) byte {
+	t.Helper()
+
+	b := []byte{0}
+	if err := s.In(serial.COM1Addr+reg, b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b[0]
+}
+
+func out(t *testing.T, s *serial.Serial, reg uint64, v byte) {
+	t.Helper()
+
+	if err := s.Out(serial.COM1Addr+reg, []byte{v}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProbe16550A(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(serial.COM1Addr, &mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out(t, s, 7, 0xa5) // SCR
+	if got := in(t, s, 7); got != 0xa5 {
+		t.Errorf("SCR: got %#x, want %#x", got, 0xa5)
+	}
+
+	out(t, s, 2, 0xc7) // FCR: enable and clear FIFOs, trigger at 14
+	if got := in(t, s, 2); got != 0xc1 {
+		t.Errorf("IIR: got %#x, want FIFOs enabled and no interrupt", got)
+	}
+
+	out(t, s, 3, 0x80) // DLAB
+	out(t, s, 0, 0x01) // DLL
+	out(t, s, 1, 0x00) // DLM
+
+	if dll, dlm := in(t, s, 0), in(t, s, 1); dll != 0x01 || dlm != 0x00 {
+		t.Errorf("divisor: got %#x %#x, want 0x01 0x00", dlm, dll)
+	}
+
+	out(t, s, 3, 0x03) // 8N1
+
+	if got := in(t, s, 5); got != 0x60 {
+		t.Errorf("LSR: got %#x, want THRE|TEMT", got)
+	}
+}
+
+func TestReceiveFIFO(t *testing.T) {
+	t.Parallel()
+
+	irq := &mockInjector{}
+
+	s, err := serial.New(serial.COM1Addr, irq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out(t, s, 2, 0x41) // FCR: enable, trigger at 4
+	out(t, s, 1, 0x01) // IER: RDI
+
+	for i, b := range []byte("abc") {
+		if err := s.Receive(b); err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 0 && !irq.level {
+			t.Errorf("IRQ not raised on input")
+		}
+	}
+
+	if got := in(t, s, 2); got != 0xcc {
+		t.Errorf("IIR below the trigger level: got %#x, want the character timeout", got)
+	}
+
+	if err := s.Receive('d'); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := in(t, s, 2); got != 0xc4 {
+		t.Errorf("IIR at the trigger level: got %#x, want data available", got)
+	}
+
+	var got []byte
+
+	for in(t, s, 5)&0x01 != 0 {
+		got = append(got, in(t, s, 0))
+	}
+
+	if string(got) != "abcd" {
+		t.Errorf("RBR: got %q, want %q", got, "abcd")
+	}
+
+	if irq.level || irq.edges != 1 {
+		t.Errorf("IRQ: got level %v after %d edges, want low after 1", irq.level, irq.edges)
+	}
+}
+
+func TestTHREInterrupt(t *testing.T) {
+	t.Parallel()
+
+	irq := &mockInjector{}
+
+	s, err := serial.New(serial.COM1Addr, irq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetOutput(io.Discard)
+
+	out(t, s, 1, 0x02) // IER: THRI
+
+	if !irq.level {
+		t.Errorf("IRQ not raised when enabling THRI")
+	}
+
+	// Reading THRE from IIR clears it.
+	if got := in(t, s, 2); got != 0x02 || irq.level {
+		t.Errorf("IIR: got %#x, IRQ %v, want THRE and the IRQ cleared", got, irq.level)
+	}
+
+	if got := in(t, s, 2); got != 0x01 {
+		t.Errorf("IIR after read: got %#x, want no interrupt", got)
+	}
+
+	out(t, s, 0, 'x')
+
+	if got := in(t, s, 2); got != 0x02 || irq.edges != 2 {
+		t.Errorf("IIR after THR write: got %#x after %d edges, want THRE again", got, irq.edges)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	t.Parallel()
+
+	s, err := serial.New(serial.COM1Addr, &mockInjector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	s.SetOutput(&buf)
+
+	out(t, s, 4, 0x1a) // MCR: LOOP|OUT2|RTS
+
+	if got := in(t, s, 6); got != 0x92 {
+		t.Errorf("MSR: got %#x, want DCD|CTS with DDSR set", got)
+	}
+
+	if got := in(t, s, 6); got != 0x90 {
+		t.Errorf("MSR after read: got %#x, want deltas cleared", got)
+	}
+
+	out(t, s, 1, 0x04) // IER: RLSI
+	out(t, s, 0, 'a')
+	out(t, s, 0, 'b') // overruns the holding register
+
+	if got := in(t, s, 2); got != 0x06 {
+		t.Errorf("IIR: got %#x, want line status", got)
+	}
+
+	if got := in(t, s, 5); got != 0x63 {
+		t.Errorf("LSR: got %#x, want DR|OE|THRE|TEMT", got)
+	}
+
+	if got := in(t, s, 0); got != 'a' {
+		t.Errorf("RBR: got %q, want %q", got, 'a')
+	}
+
+	if got := in(t, s, 5); got != 0x60 {
+		t.Errorf("LSR after read: got %#x, want OE cleared", got)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("output: got %q, want nothing in loopback", buf.String())
+	}
+}
+
+func TestPorts(t *testing.T) {
+	t.Parallel()
+
+	for _, p := range serial.Ports {
+		s, err := serial.New(p.Addr, &mockInjector{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Out(p.Addr+7, []byte{0x5a}); err != nil {
+			t.Fatal(err)
+		}
+
+		b := []byte{0}
+		if err := s.In(p.Addr+7, b); err != nil || b[0] != 0x5a {
+			t.Errorf("SCR at %#x: got %#x, %v, want 0x5a", p.Addr+7, b[0], err)
+		}
+	}
+}
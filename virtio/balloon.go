@@ -0,0 +1,489 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+const (
+	BalloonIOPortStart = 0x6700
+	BalloonIOPortSize  = 0x100
+
+	// BalloonPageSize is the unit of the balloon, whatever the page
+	// size of the guest.
+	BalloonPageSize = 4096
+)
+
+// Features offered by the device.
+//
+// refs https://github.com/torvalds/linux/blob/v6.1/include/uapi/linux/virtio_balloon.h
+const (
+	balloonFStatsVQ      = 1 << 1
+	balloonFDeflateOnOOM = 1 << 2
+	balloonFReporting    = 1 << 5
+)
+
+// Queues of the device. The stats queue exists only if the guest
+// accepted balloonFStatsVQ, and the later queues are numbered one
+// lower without it.
+const (
+	balloonInflate = iota
+	balloonDeflate
+	balloonStats
+	balloonReporting
+)
+
+// balloonStatNames are the names of the memory statistics of the guest
+// by their tag, like the ones of QEMU.
+var balloonStatNames = []string{
+	"stat-swap-in",
+	"stat-swap-out",
+	"stat-major-faults",
+	"stat-minor-faults",
+	"stat-free-memory",
+	"stat-total-memory",
+	"stat-available-memory",
+	"stat-disk-caches",
+	"stat-htlb-pgalloc",
+	"stat-htlb-pgfail",
+	"stat-oom-kills",
+	"stat-alloc-stalls",
+	"stat-async-scans",
+	"stat-direct-scans",
+	"stat-async-reclaims",
+	"stat-direct-reclaims",
+}
+
+// balloonStatSize is the size of struct virtio_balloon_stat, a 16 bit
+// tag followed by a 64 bit value.
+const balloonStatSize = 10
+
+type balloonHdr struct {
+	commonHeader  commonHeader
+	balloonHeader balloonHeader
+}
+
+func (h balloonHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type balloonHeader struct {
+	// numPages is the size the host asks the balloon to be, and
+	// actual is the size the guest has inflated it to.
+	numPages uint32
+	actual   uint32
+}
+
+// Balloon is a virtio memory balloon device. The pages the guest puts
+// into the balloon, and the free pages it reports, are given back to
+// the host with memory.Discard, so that the regions of Mem must be mapped
+// by memory.Alloc.
+type Balloon struct {
+	mu sync.Mutex
+
+	Hdr           balloonHdr
+	guestFeatures uint32
+
+	VirtQueue    [4]*VirtQueue
+	Mem          *memory.GuestMemory
+	LastAvailIdx [4]uint16
+
+	// The guest passes its stats in a buffer which is held until the
+	// host asks for the next ones.
+	statsHead    uint16
+	statsHeld    bool
+	stats        map[string]uint64
+	statsTime    time.Time
+	statsUpdated chan struct{}
+
+	kick chan uint16
+
+	ioport      uint64
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *Balloon) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1002,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 5, // Memory Balloon
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			uint32(v.ioport) | 0x1,
+		},
+		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
+		InterruptPin: 1,
+		// https://www.webopedia.com/reference/irqnumbers/
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Balloon) Read(port uint64, bytes []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	offset := int(port - v.ioport)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	// Past the end of the config reads as zero.
+	if offset > len(b) {
+		offset = len(b)
+	}
+
+	l := len(bytes)
+	for i := copy(bytes[:l], b[offset:]); i < l; i++ {
+		bytes[i] = 0
+	}
+
+	// Reading the ISR acknowledges the interrupt.
+	if offset <= 19 && 19 < offset+l {
+		v.Hdr.commonHeader.isr = 0x0
+	}
+
+	return nil
+}
+
+func (v *Balloon) Write(port uint64, bytes []byte) error {
+	v.mu.Lock()
+
+	offset := int(port - v.ioport)
+
+	switch {
+	case offset == 4:
+		v.guestFeatures = uint32(pci.BytesToNum(bytes))
+	case offset == 8:
+		q, ok := v.queue(v.Hdr.commonHeader.queueSEL)
+		if !ok {
+			v.mu.Unlock()
+
+			return ErrInvalidSel
+		}
+
+		// Queue PFN is aligned to page (4096 bytes)
+		vq, err := newVirtQueue(v.Mem, pci.BytesToNum(bytes), v.Hdr.commonHeader.queueNUM)
+		if err != nil {
+			v.mu.Unlock()
+
+			return err
+		}
+
+		v.VirtQueue[q] = vq
+
+		v.LastAvailIdx[q] = 0
+
+		if q == balloonStats {
+			v.statsHeld = false
+		}
+	case offset == 14:
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	case offset == 16:
+		v.mu.Unlock()
+
+		v.kick <- uint16(pci.BytesToNum(bytes))
+
+		return nil
+	case offset >= 24 && offset+len(bytes) <= 28:
+		// The legacy driver writes actual a byte at a time.
+		b := binary.LittleEndian.AppendUint32(nil, v.Hdr.balloonHeader.actual)
+		copy(b[offset-24:], bytes)
+		v.Hdr.balloonHeader.actual = binary.LittleEndian.Uint32(b)
+	default:
+	}
+
+	v.mu.Unlock()
+
+	return nil
+}
+
+// SetQueueSize sets the size of the queues, which the guest reads before
+// setting them up.
+func (v *Balloon) SetQueueSize(size uint16) error {
+	if err := CheckQueueSize(size); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.Hdr.commonHeader.queueNUM = size
+
+	return nil
+}
+
+func (v *Balloon) IOPort() uint64 {
+	return v.ioport
+}
+
+func (v *Balloon) Size() uint64 {
+	return BalloonIOPortSize
+}
+
+// queue returns the queue whose index is sel for the guest.
+func (v *Balloon) queue(sel uint16) (int, bool) {
+	q := int(sel)
+
+	if q >= balloonStats && v.guestFeatures&balloonFStatsVQ == 0 {
+		q++
+	}
+
+	return q, q < len(v.VirtQueue)
+}
+
+func (v *Balloon) IOThreadEntry() {
+	for sel := range v.kick {
+		_ = v.IO(sel)
+	}
+}
+
+// Close makes IOThreadEntry return. The guest must not notify the device
+// anymore.
+func (v *Balloon) Close() error {
+	close(v.kick)
+
+	return nil
+}
+
+// IO handles a notification of the queue whose index is sel for the
+// guest.
+func (v *Balloon) IO(sel uint16) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	q, ok := v.queue(sel)
+	if !ok {
+		return ErrInvalidSel
+	}
+
+	vq := v.VirtQueue[q]
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	var err error
+
+	used := false
+
+	for v.LastAvailIdx[q] != vq.availIdx() {
+		head := vq.availHead(v.LastAvailIdx[q])
+
+		switch q {
+		case balloonInflate:
+			var b []byte
+
+			if b, err = readChain(vq, head); err == nil {
+				err = v.inflate(b)
+			}
+		case balloonDeflate:
+			// The pages fault in again once the guest uses them.
+		case balloonStats:
+			b, e := readChain(vq, head)
+			if e != nil {
+				err = e
+
+				break
+			}
+
+			v.updateStats(b)
+
+			v.statsHead = head
+			v.statsHeld = true
+			v.LastAvailIdx[q]++
+
+			continue
+		case balloonReporting:
+			if e := walk(vq, head, func(addr uint64, b []byte, _ bool) {
+				if e := v.discard(addr, uint64(len(b))); e != nil {
+					err = e
+				}
+			}); e != nil {
+				err = e
+			}
+		}
+
+		complete(vq, &v.LastAvailIdx[q], head, 0)
+
+		used = true
+	}
+
+	if used {
+		v.Hdr.commonHeader.isr |= 0x1
+
+		if e := v.IRQInjector.InjectVirtioIRQ(v.irq); e != nil {
+			return e
+		}
+	}
+
+	return err
+}
+
+// inflate gives back to the host the pages whose 32 bit page frame
+// numbers are in b, merging adjacent ones into a single call.
+func (v *Balloon) inflate(b []byte) error {
+	var start, end uint64
+
+	for i := 0; i+4 <= len(b); i += 4 {
+		addr := uint64(binary.LittleEndian.Uint32(b[i:])) * BalloonPageSize
+
+		if addr == end && end != 0 {
+			end += BalloonPageSize
+
+			continue
+		}
+
+		if err := v.discard(start, end-start); err != nil {
+			return err
+		}
+
+		start, end = addr, addr+BalloonPageSize
+	}
+
+	return v.discard(start, end-start)
+}
+
+// discard gives the whole pages from addr to addr+l of the memory back
+// to the host, see memory.Discard. Memory backed by huge pages can not
+// give back a page of theirs, which is left as it is.
+func (v *Balloon) discard(addr, l uint64) error {
+	start := (addr + BalloonPageSize - 1) &^ (BalloonPageSize - 1)
+	end := (addr + l) &^ (BalloonPageSize - 1)
+
+	if start >= end {
+		return nil
+	}
+
+	b, err := v.Mem.Slice(start, end-start)
+	if err != nil {
+		return err
+	}
+
+	if err := memory.Discard(b); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+
+	return nil
+}
+
+func (v *Balloon) updateStats(b []byte) {
+	stats := map[string]uint64{}
+
+	for i := 0; i+balloonStatSize <= len(b); i += balloonStatSize {
+		tag := int(binary.LittleEndian.Uint16(b[i:]))
+
+		// Tags of newer guests are left out.
+		if tag < len(balloonStatNames) {
+			stats[balloonStatNames[tag]] = binary.LittleEndian.Uint64(b[i+2:])
+		}
+	}
+
+	v.stats = stats
+	v.statsTime = time.Now()
+
+	select {
+	case v.statsUpdated <- struct{}{}:
+	default:
+	}
+}
+
+// Resize asks the guest to inflate or deflate the balloon to pages of
+// BalloonPageSize.
+func (v *Balloon) Resize(pages uint32) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.Hdr.balloonHeader.numPages = pages
+	v.Hdr.commonHeader.isr |= 0x2
+
+	return v.IRQInjector.InjectVirtioIRQ(v.irq)
+}
+
+// Actual returns the number of pages in the balloon.
+func (v *Balloon) Actual() uint32 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.Hdr.balloonHeader.actual
+}
+
+// Stats asks the guest for its memory statistics and waits up to
+// timeout for them. If the guest does not answer in time, the last
+// ones are returned with the time they were received, which is zero
+// if the guest never sent any.
+func (v *Balloon) Stats(timeout time.Duration) (map[string]uint64, time.Time, error) {
+	v.mu.Lock()
+
+	if v.statsHeld {
+		select {
+		case <-v.statsUpdated:
+		default:
+		}
+
+		release(v.VirtQueue[balloonStats], v.statsHead, 0)
+		v.statsHeld = false
+		v.Hdr.commonHeader.isr |= 0x1
+
+		if err := v.IRQInjector.InjectVirtioIRQ(v.irq); err != nil {
+			v.mu.Unlock()
+
+			return nil, time.Time{}, err
+		}
+
+		v.mu.Unlock()
+
+		select {
+		case <-v.statsUpdated:
+		case <-time.After(timeout):
+		}
+
+		v.mu.Lock()
+	}
+
+	defer v.mu.Unlock()
+
+	stats := make(map[string]uint64, len(v.stats))
+	for k, s := range v.stats {
+		stats[k] = s
+	}
+
+	return stats, v.statsTime, nil
+}
+
+// NewBalloon creates a virtio memory balloon device whose registers
+// are mapped at the IO port ioport.
+func NewBalloon(ioport uint64, irq uint8, irqInjector IRQInjector, mem *memory.GuestMemory) *Balloon {
+	return &Balloon{
+		Hdr: balloonHdr{
+			commonHeader: commonHeader{
+				hostFeatures: ringFIndirectDesc | balloonFStatsVQ | balloonFDeflateOnOOM | balloonFReporting,
+				queueNUM:     QueueSize,
+				isr:          0x0,
+			},
+		},
+		statsUpdated: make(chan struct{}, 1),
+		ioport:       ioport,
+		irq:          irq,
+		IRQInjector:  irqInjector,
+		kick:         make(chan uint16),
+		Mem:          mem,
+		VirtQueue:    [4]*VirtQueue{},
+		LastAvailIdx: [4]uint16{},
+	}
+}
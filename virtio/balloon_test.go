@@ -0,0 +1,206 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// balloonMem returns memory for the guest mapped as the machine does,
+// since the balloon punches pages out of it.
+func balloonMem(t *testing.T) []byte {
+	t.Helper()
+
+	mem, err := memory.Alloc(0x100000, memory.Backing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = syscall.Munmap(mem) })
+
+	return mem
+}
+
+func TestBalloonGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewBalloon(virtio.BalloonIOPortStart, 9, &mockInjector{}, guestMem(t, nil))
+
+	if h := v.GetDeviceHeader(); h.DeviceID != 0x1002 || h.SubsystemID != 5 {
+		t.Fatalf("expected: 0x1002 and 5, actual: %#x and %d", h.DeviceID, h.SubsystemID)
+	}
+
+	if err := v.Resize(256); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	// num_pages, and ISR with the config change bit.
+	actual := make([]byte, 4)
+	_ = v.Read(virtio.BalloonIOPortStart+20, actual)
+
+	if !bytes.Equal(actual, []byte{0, 1, 0, 0}) {
+		t.Fatalf("num_pages: expected 256, actual: %v", actual)
+	}
+
+	isr := make([]byte, 1)
+	_ = v.Read(virtio.BalloonIOPortStart+19, isr)
+
+	if isr[0] != 0x2 {
+		t.Fatalf("isr: expected 0x2, actual: %#x", isr[0])
+	}
+
+	// The BAR ends far past the config, which reads as zero there.
+	past := []byte{1, 2, 3, 4}
+	if err := v.Read(virtio.BalloonIOPortStart+virtio.BalloonIOPortSize-4, past); err != nil {
+		t.Fatalf("past the config: err: %v", err)
+	}
+
+	if !bytes.Equal(past, make([]byte, 4)) {
+		t.Fatalf("past the config: expected zeros, actual: %v", past)
+	}
+
+	// The guest writes actual a byte at a time.
+	for i, b := range []byte{0x80, 0, 0, 0} {
+		_ = v.Write(virtio.BalloonIOPortStart+24+uint64(i), []byte{b})
+	}
+
+	if n := v.Actual(); n != 0x80 {
+		t.Fatalf("actual: expected 128, actual: %d", n)
+	}
+}
+
+func TestBalloonInflate(t *testing.T) {
+	t.Parallel()
+
+	mem := balloonMem(t)
+	v := virtio.NewBalloon(virtio.BalloonIOPortStart, 9, &mockInjector{}, guestMem(t, mem))
+
+	inflate := newGuestQueue(t, v, virtio.BalloonIOPortStart, mem, 0)
+
+	for i := 0xc0000; i < 0xc4000; i++ {
+		mem[i] = 0xff
+	}
+
+	// The pages 0xc0, 0xc1 and 0xc3, but not 0xc2.
+	pfns := []byte{}
+	for _, pfn := range []uint32{0xc0, 0xc1, 0xc3} {
+		pfns = binary.LittleEndian.AppendUint32(pfns, pfn)
+	}
+
+	inflate.add(pfns, false)
+
+	if err := v.IO(0); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if n := len(inflate.take()); n != 1 {
+		t.Fatalf("used: expected 1, actual: %d", n)
+	}
+
+	for page, want := range map[int]byte{0xc0: 0, 0xc1: 0, 0xc2: 0xff, 0xc3: 0} {
+		if got := mem[page*virtio.BalloonPageSize+0x10]; got != want {
+			t.Errorf("page %#x: expected %#x, actual: %#x", page, want, got)
+		}
+	}
+}
+
+func TestBalloonReporting(t *testing.T) {
+	t.Parallel()
+
+	mem := balloonMem(t)
+	v := virtio.NewBalloon(virtio.BalloonIOPortStart, 9, &mockInjector{}, guestMem(t, mem))
+
+	// Without the stats queue, the reporting queue is the third one.
+	if err := v.Write(virtio.BalloonIOPortStart+4, []byte{0x20, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	reporting := newGuestQueue(t, v, virtio.BalloonIOPortStart, mem, 2)
+
+	// The buffer of the free page is the page itself.
+	reporting.add(bytes.Repeat([]byte{0xff}, 2*virtio.BalloonPageSize), true)
+
+	if err := v.IO(2); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if got := reporting.take(); len(got) != 1 || len(got[0]) != 0 {
+		t.Fatalf("used: expected 1 empty buffer, actual: %v", got)
+	}
+
+	if got := mem[0x88000:0x8a000]; !bytes.Equal(got, make([]byte, len(got))) {
+		t.Errorf("reported pages are not dropped")
+	}
+}
+
+func balloonStat(tag uint16, val uint64) []byte {
+	return binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint16(nil, tag), val)
+}
+
+func TestBalloonStats(t *testing.T) {
+	t.Parallel()
+
+	mem := balloonMem(t)
+	v := virtio.NewBalloon(virtio.BalloonIOPortStart, 9, &mockInjector{}, guestMem(t, mem))
+
+	if err := v.Write(virtio.BalloonIOPortStart+4, []byte{0x22, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := newGuestQueue(t, v, virtio.BalloonIOPortStart, mem, 2)
+
+	// The guest sends its first stats while probing.
+	stats.add(balloonStat(4, 100), false)
+
+	if err := v.IO(2); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if got := stats.take(); len(got) != 0 {
+		t.Fatalf("the stats buffer is returned before the host asks: %v", got)
+	}
+
+	type result struct {
+		stats map[string]uint64
+		at    time.Time
+		err   error
+	}
+
+	done := make(chan result)
+
+	go func() {
+		s, at, err := v.Stats(5 * time.Second)
+		done <- result{s, at, err}
+	}()
+
+	// The guest answers once it gets the buffer back.
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(stats.take()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the stats buffer is not returned")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	stats.add(append(balloonStat(4, 200), balloonStat(5, 1000)...), false)
+
+	if err := v.IO(2); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	r := <-done
+	if r.err != nil || r.at.IsZero() {
+		t.Fatalf("err: %v, at %v", r.err, r.at)
+	}
+
+	if r.stats["stat-free-memory"] != 200 || r.stats["stat-total-memory"] != 1000 {
+		t.Errorf("stats: got %v", r.stats)
+	}
+}
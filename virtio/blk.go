@@ -3,9 +3,10 @@ package virtio
 import (
 	"bytes"
 	"encoding/binary"
-	"os"
-	"unsafe"
+	"errors"
+	"sync"
 
+	"github.com/bobuhiro11/gokvm/memory"
 	"github.com/bobuhiro11/gokvm/pci"
 )
 
@@ -16,16 +17,82 @@ const (
 	SectorSize = 512
 )
 
+// Features offered by the device.
+//
+// refs https://github.com/torvalds/linux/blob/v6.1/include/uapi/linux/virtio_blk.h
+const (
+	blkFSegMax      = 1 << 2
+	blkFRO          = 1 << 5
+	blkFDiscard     = 1 << 13
+	blkFWriteZeroes = 1 << 14
+)
+
+// Request types and status values.
+const (
+	blkTIn          = 0
+	blkTOut         = 1
+	blkTDiscard     = 11
+	blkTWriteZeroes = 13
+
+	blkSOK     = 0
+	blkSIOErr  = 1
+	blkSUnsupp = 2
+)
+
+// Limits of DISCARD and WRITE_ZEROES. Ranges are aligned to pages, the
+// unit in which the file system of the host frees blocks.
+const (
+	blkMaxDiscardSectors  = 1 << 22
+	blkMaxDiscardSeg      = 32
+	blkDiscardAlignment   = 4096 / SectorSize
+	blkDiscardSegmentSize = 16
+
+	// blkWriteZeroesUnmap lets WRITE_ZEROES deallocate the range.
+	blkWriteZeroesUnmap = 1 << 0
+)
+
+const (
+	// blkWorkers bounds the requests served at once.
+	blkWorkers = 8
+
+	// blkIRQBatch is how many requests may complete, while others are
+	// still in flight, before the guest is interrupted.
+	blkIRQBatch = 4
+)
+
+// Blk is a virtio block device. Requests are served by blkWorkers
+// threads, started on the first request following the policy set by
+// SetIOSched, and returned to the guest as they complete.
 type Blk struct {
-	file *os.File
-	Hdr  blkHdr
+	mu sync.Mutex
+	ioSched
+
+	disk          *disk
+	Hdr           blkHdr
+	guestFeatures uint32
 
 	VirtQueue    [1]*VirtQueue
-	Mem          []byte
+	Mem          *memory.GuestMemory
 	LastAvailIdx [1]uint16
 
+	// work hands the requests over to the workers. pending counts the
+	// requests taken off the ring and not returned yet, which inflight
+	// also counts for Wait. Of those returned, unsignalled ones were not
+	// interrupted for yet, and signalledIdx is the index of the used
+	// ring at the last interrupt.
+	work         chan *blkRequest
+	startWorkers sync.Once
+	inflight     sync.WaitGroup
+	pending      int
+	unsignalled  int
+	signalledIdx uint16
+
 	kick chan interface{}
 
+	// closed stops IO from handing over requests, see Close.
+	closed bool
+
+	ioport      uint64
 	irq         uint8
 	IRQInjector IRQInjector
 }
@@ -45,11 +112,29 @@ func (h blkHdr) Bytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// blkHeader is struct virtio_blk_config up to the limits of
+// WRITE_ZEROES.
 type blkHeader struct {
 	capacity uint64
+	_        uint32 // size_max
+	segMax   uint32
+	_        uint32 // geometry
+	_        uint32 // blk_size
+	_        uint64 // topology
+	_        uint8  // writeback
+	_        uint8
+	_        uint16 // num_queues
+
+	maxDiscardSectors      uint32
+	maxDiscardSeg          uint32
+	discardSectorAlignment uint32
+	maxWriteZeroesSectors  uint32
+	maxWriteZeroesSeg      uint32
+	writeZeroesMayUnmap    uint8
+	_                      [3]uint8
 }
 
-func (v Blk) GetDeviceHeader() pci.DeviceHeader {
+func (v *Blk) GetDeviceHeader() pci.DeviceHeader {
 	return pci.DeviceHeader{
 		DeviceID:    0x1001,
 		VendorID:    0x1AF4,
@@ -57,7 +142,7 @@ func (v Blk) GetDeviceHeader() pci.DeviceHeader {
 		SubsystemID: 2, // Block Device
 		Command:     1, // Enable IO port
 		BAR: [6]uint32{
-			BlkIOPortStart | 0x1,
+			uint32(v.ioport) | 0x1,
 		},
 		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
 		InterruptPin: 1,
@@ -66,150 +151,421 @@ func (v Blk) GetDeviceHeader() pci.DeviceHeader {
 	}
 }
 
-func (v Blk) Read(port uint64, bytes []byte) error {
-	offset := int(port - BlkIOPortStart)
+func (v *Blk) Read(port uint64, bytes []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	offset := int(port - v.ioport)
 
 	b, err := v.Hdr.Bytes()
 	if err != nil {
 		return err
 	}
 
+	// Past the end of the config reads as zero.
+	if offset > len(b) {
+		offset = len(b)
+	}
+
 	l := len(bytes)
-	copy(bytes[:l], b[offset:offset+l])
+	for i := copy(bytes[:l], b[offset:]); i < l; i++ {
+		bytes[i] = 0
+	}
 
 	return nil
 }
 
 func (v *Blk) IOThreadEntry() {
 	for range v.kick {
-		for v.IO() == nil {
-		}
+		_ = v.IO()
 	}
 }
 
+// Close makes IOThreadEntry return, waits for the requests being served
+// and closes the disk. The guest must not notify the device anymore.
+func (v *Blk) Close() error {
+	close(v.kick)
+
+	v.mu.Lock()
+	v.closed = true
+	v.mu.Unlock()
+
+	v.Wait()
+	close(v.work)
+
+	return v.disk.Close()
+}
+
 type BlkReq struct {
 	Type   uint32
 	_      uint32
 	Sector uint64
 }
 
+// blkReqSize is the size of BlkReq in guest memory.
+const blkReqSize = 16
+
+// blkRequest is a request taken off the available ring.
+type blkRequest struct {
+	vq   *VirtQueue
+	head uint16
+
+	// hdr is nil if the header is cut short.
+	hdr    *BlkReq
+	data   [][]byte
+	status []byte
+}
+
+// IO takes the requests the guest made available and hands them over to
+// the workers, waiting for one to be free if need be. It returns
+// ErrNoTxPacket if there was none.
 func (v *Blk) IO() error {
-	sel := uint16(0)
-	// v.dumpDesc(sel)
-	availRing := &v.VirtQueue[sel].AvailRing
-	usedRing := &v.VirtQueue[sel].UsedRing
+	v.mu.Lock()
+
+	vq := v.VirtQueue[0]
+	if vq == nil || v.closed {
+		v.mu.Unlock()
+
+		return ErrVQNotInit
+	}
 
-	if v.LastAvailIdx[sel] == availRing.Idx {
+	reqs := []*blkRequest{}
+
+	var err error
+
+	for {
+		for v.LastAvailIdx[0] != vq.availIdx() {
+			head := vq.availHead(v.LastAvailIdx[0])
+
+			r, e := v.parse(vq, head)
+			if e != nil {
+				err = e
+			}
+
+			reqs = append(reqs, r)
+			v.LastAvailIdx[0]++
+		}
+
+		if v.guestFeatures&ringFEventIdx == 0 {
+			break
+		}
+
+		// Ask to be notified of the next request, then look again for
+		// one made available before the guest could see it.
+		vq.setAvailEvent(v.LastAvailIdx[0])
+
+		if v.LastAvailIdx[0] == vq.availIdx() {
+			break
+		}
+	}
+
+	v.pending += len(reqs)
+	v.inflight.Add(len(reqs))
+	v.mu.Unlock()
+
+	if len(reqs) == 0 {
 		return ErrNoTxPacket
 	}
 
-	for v.LastAvailIdx[sel] != availRing.Idx {
-		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
+	v.startWorkers.Do(func() {
+		for i := 0; i < blkWorkers; i++ {
+			err = errors.Join(err, v.goIO(v.worker))
+		}
+	})
+
+	for _, r := range reqs {
+		v.work <- r
+	}
+
+	return err
+}
+
+// worker serves the requests handed over by IO until Close.
+func (v *Blk) worker() {
+	for r := range v.work {
+		v.serve(r)
+	}
+}
+
+// Wait waits for the requests taken off the ring to complete.
+func (v *Blk) Wait() {
+	v.inflight.Wait()
+}
+
+// parse splits the chain at head into the header, the data buffers and
+// the status byte, which is the last byte of the chain. The header is
+// copied, so that the guest can not change it once checked. A chain out
+// of guest memory is parsed as an empty one, which fails.
+func (v *Blk) parse(vq *VirtQueue, head uint16) (*blkRequest, error) {
+	r := &blkRequest{vq: vq, head: head}
+	bufs := [][]byte{}
+
+	err := walk(vq, head, func(_ uint64, b []byte, _ bool) {
+		bufs = append(bufs, b)
+	})
+
+	if len(bufs) > 0 && len(bufs[0]) >= blkReqSize {
+		r.hdr = &BlkReq{
+			Type:   binary.LittleEndian.Uint32(bufs[0]),
+			Sector: binary.LittleEndian.Uint64(bufs[0][8:]),
+		}
+	}
+
+	if len(bufs) < 2 {
+		return r, err
+	}
+
+	last := bufs[len(bufs)-1]
+	r.data = bufs[1 : len(bufs)-1]
+
+	if len(last) > 0 {
+		r.data = append(r.data, last[:len(last)-1])
+		r.status = last[len(last)-1:]
+	}
+
+	return r, err
+}
+
+// serve serves r on a worker and returns it to the guest.
+func (v *Blk) serve(r *blkRequest) {
+	defer v.inflight.Done()
+
+	status, n := v.do(r)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(r.status) > 0 {
+		r.status[0] = status
+		n++
+	}
+
+	release(r.vq, r.head, n)
 
-		// This structure is holding both the index of the descriptor chain and the
-		// number of bytes that were written to the memory as part of serving the request.
-		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
-		usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
+	v.pending--
+	v.unsignalled++
 
-		var buf [3][]byte
+	if v.pending == 0 || v.unsignalled >= blkIRQBatch {
+		_ = v.signal(r.vq)
+	}
+}
 
-		for i := 0; i < 3; i++ {
-			desc := v.VirtQueue[sel].DescTable[descID]
-			buf[i] = v.Mem[desc.Addr : desc.Addr+uint64(desc.Len)]
+// do serves r, and returns its status and how many bytes of data it
+// wrote for the guest.
+func (v *Blk) do(r *blkRequest) (uint8, uint32) {
+	if r.hdr == nil {
+		return blkSIOErr, 0
+	}
 
-			usedRing.Ring[usedRing.Idx%QueueSize].Len += desc.Len
-			descID = desc.Next
+	l := 0
+	for _, b := range r.data {
+		l += len(b)
+	}
+
+	capacity := v.Hdr.blkHeader.capacity
+	off := int64(r.hdr.Sector * SectorSize)
+
+	switch r.hdr.Type {
+	case blkTIn, blkTOut:
+		if r.hdr.Sector > capacity || uint64(l) > (capacity-r.hdr.Sector)*SectorSize {
+			return blkSIOErr, 0
+		}
+	case blkTDiscard, blkTWriteZeroes:
+		data := make([]byte, 0, l)
+		for _, b := range r.data {
+			data = append(data, b...)
 		}
 
-		// buf[0] contains type, reserved, and sector fields.
-		// buf[1] contains raw io data.
-		// buf[2] contains a status field.
-		//
-		// refs https://wiki.osdev.org/Virtio#Block_Device_Packets
-		blkReq := *((*BlkReq)(unsafe.Pointer(&buf[0][0])))
-		data := buf[1]
+		return v.discard(r.hdr.Type, data), 0
+	default:
+		return blkSUnsupp, 0
+	}
 
+	for _, b := range r.data {
 		var err error
-		if blkReq.Type&0x1 == 0x1 {
-			// write to file
-			_, err = v.file.WriteAt(data, int64(blkReq.Sector*SectorSize))
+
+		if r.hdr.Type == blkTIn {
+			_, err = v.disk.ReadAt(b, off)
 		} else {
-			// read from file
-			_, err = v.file.ReadAt(data, int64(blkReq.Sector*SectorSize))
+			_, err = v.disk.WriteAt(b, off)
 		}
 
 		if err != nil {
-			return err
+			return blkSIOErr, 0
 		}
 
-		if err = v.file.Sync(); err != nil {
-			return err
-		}
+		off += int64(len(b))
+	}
 
-		usedRing.Idx++
-		v.LastAvailIdx[sel]++
+	if r.hdr.Type == blkTIn {
+		return blkSOK, uint32(l)
+	}
+
+	if err := v.disk.Sync(); err != nil {
+		return blkSIOErr, 0
+	}
+
+	return blkSOK, 0
+}
+
+// signal interrupts the guest for the requests completed since the last
+// time, unless it asked not to be.
+func (v *Blk) signal(vq *VirtQueue) error {
+	prev := v.signalledIdx
+	v.signalledIdx = vq.usedIdx()
+	v.unsignalled = 0
+
+	if v.guestFeatures&ringFEventIdx != 0 {
+		if !needEvent(vq.usedEvent(), v.signalledIdx, prev) {
+			return nil
+		}
+	} else if vq.availFlags()&availFlagNoInterrupt != 0 {
+		return nil
 	}
 
 	v.Hdr.commonHeader.isr = 0x1
-	if err := v.IRQInjector.InjectVirtioBlkIRQ(); err != nil {
-		return err
+
+	return v.IRQInjector.InjectVirtioIRQ(v.irq)
+}
+
+// discard serves a DISCARD or WRITE_ZEROES request, whose data is a
+// list of struct virtio_blk_discard_write_zeroes.
+func (v *Blk) discard(typ uint32, data []byte) uint8 {
+	capacity := v.Hdr.blkHeader.capacity
+
+	for ; len(data) >= blkDiscardSegmentSize; data = data[blkDiscardSegmentSize:] {
+		sector := binary.LittleEndian.Uint64(data)
+		n := uint64(binary.LittleEndian.Uint32(data[8:]))
+		flags := binary.LittleEndian.Uint32(data[12:])
+
+		if sector > capacity || n > capacity-sector || n > blkMaxDiscardSectors {
+			return blkSIOErr
+		}
+
+		off, l := int64(sector*SectorSize), int64(n*SectorSize)
+
+		var err error
+
+		if typ == blkTDiscard || flags&blkWriteZeroesUnmap != 0 {
+			err = v.disk.punchHole(off, l)
+		} else {
+			err = v.disk.zeroRange(off, l)
+		}
+
+		if err != nil {
+			return blkSIOErr
+		}
 	}
 
-	return nil
+	return blkSOK
 }
 
 func (v *Blk) Write(port uint64, bytes []byte) error {
-	offset := int(port - BlkIOPortStart)
+	v.mu.Lock()
+
+	offset := int(port - v.ioport)
 
 	switch offset {
+	case 4:
+		v.guestFeatures = uint32(pci.BytesToNum(bytes))
 	case 8:
+		if v.Hdr.commonHeader.queueSEL != 0 {
+			v.mu.Unlock()
+
+			return ErrInvalidSel
+		}
+
 		// Queue PFN is aligned to page (4096 bytes)
-		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
-		v.VirtQueue[v.Hdr.commonHeader.queueSEL] = (*VirtQueue)(unsafe.Pointer(&v.Mem[physAddr]))
+		vq, err := newVirtQueue(v.Mem, pci.BytesToNum(bytes), v.Hdr.commonHeader.queueNUM)
+		if err != nil {
+			v.mu.Unlock()
+
+			return err
+		}
+
+		v.VirtQueue[0] = vq
+
+		v.LastAvailIdx[0] = 0
+		v.signalledIdx = 0
 	case 14:
 		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
 	case 16:
 		v.Hdr.commonHeader.isr = 0x0
+		v.mu.Unlock()
+
 		v.kick <- true
+
+		return nil
 	case 19:
 	default:
 	}
 
+	v.mu.Unlock()
+
 	return nil
 }
 
-func (v Blk) IOPort() uint64 {
-	return BlkIOPortStart
+// SetQueueSize sets the size of the queue, which the guest reads before
+// setting it up.
+func (v *Blk) SetQueueSize(size uint16) error {
+	if err := CheckQueueSize(size); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// The header and the status take a descriptor each.
+	v.Hdr.commonHeader.queueNUM = size
+	v.Hdr.blkHeader.segMax = uint32(size) - 2
+
+	return nil
+}
+
+func (v *Blk) IOPort() uint64 {
+	return v.ioport
 }
 
-func (v Blk) Size() uint64 {
+func (v *Blk) Size() uint64 {
 	return BlkIOPortSize
 }
 
-func NewBlk(path string, irq uint8, irqInjector IRQInjector, mem []byte) (*Blk, error) {
-	file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+// NewBlk creates a virtio block device backed by the file at path,
+// used in mode, whose registers are mapped at the IO port ioport.
+func NewBlk(path string, mode DiskMode, ioport uint64, irq uint8, irqInjector IRQInjector,
+	mem *memory.GuestMemory,
+) (*Blk, error) {
+	d, err := openDisk(path, mode)
 	if err != nil {
 		return nil, err
 	}
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return nil, err
+	features := uint32(ringFEventIdx | ringFIndirectDesc | blkFSegMax | blkFDiscard | blkFWriteZeroes)
+	if mode == DiskReadOnly {
+		features = ringFEventIdx | ringFIndirectDesc | blkFSegMax | blkFRO
 	}
 
-	fileSize := uint64(fileInfo.Size())
-
 	res := &Blk{
 		Hdr: blkHdr{
 			commonHeader: commonHeader{
-				queueNUM: QueueSize,
-				isr:      0x0,
+				hostFeatures: features,
+				queueNUM:     QueueSize,
+				isr:          0x0,
 			},
 			blkHeader: blkHeader{
-				capacity: fileSize / SectorSize,
+				capacity:               d.size / SectorSize,
+				segMax:                 QueueSize - 2,
+				maxDiscardSectors:      blkMaxDiscardSectors,
+				maxDiscardSeg:          blkMaxDiscardSeg,
+				discardSectorAlignment: blkDiscardAlignment,
+				maxWriteZeroesSectors:  blkMaxDiscardSectors,
+				maxWriteZeroesSeg:      blkMaxDiscardSeg,
+				writeZeroesMayUnmap:    1,
 			},
 		},
-		file:         file,
+		disk:         d,
+		work:         make(chan *blkRequest),
+		ioport:       ioport,
 		irq:          irq,
 		IRQInjector:  irqInjector,
 		kick:         make(chan interface{}),
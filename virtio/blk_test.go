@@ -2,17 +2,22 @@ package virtio_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/memory"
 	"github.com/bobuhiro11/gokvm/virtio"
+	"golang.org/x/sys/unix"
 )
 
 func TestBlkGetDeviceHeader(t *testing.T) {
 	t.Parallel()
 
-	v, err := virtio.NewBlk("/dev/zero", 9, &mockInjector{}, []byte{})
+	v, err := virtio.NewBlk("/dev/zero", virtio.DiskReadWrite, virtio.BlkIOPortStart, 9, &mockInjector{}, guestMem(t, nil))
 	if err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
@@ -23,12 +28,22 @@ func TestBlkGetDeviceHeader(t *testing.T) {
 	if actual != expected {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
 	}
+
+	// The BAR ends far past the config, which reads as zero there.
+	past := []byte{1, 2, 3, 4}
+	if err := v.Read(virtio.BlkIOPortStart+virtio.BlkIOPortSize-4, past); err != nil {
+		t.Fatalf("past the config: err: %v", err)
+	}
+
+	if !bytes.Equal(past, make([]byte, 4)) {
+		t.Fatalf("past the config: expected zeros, actual: %v", past)
+	}
 }
 
 func TestBlkGetIORange(t *testing.T) {
 	t.Parallel()
 
-	v, err := virtio.NewBlk("/dev/zero", 9, &mockInjector{}, []byte{})
+	v, err := virtio.NewBlk("/dev/zero", virtio.DiskReadWrite, virtio.BlkIOPortStart, 9, &mockInjector{}, guestMem(t, nil))
 	if err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
@@ -44,7 +59,7 @@ func TestBlkGetIORange(t *testing.T) {
 func TestBlkIOInHandler(t *testing.T) {
 	t.Parallel()
 
-	v, err := virtio.NewBlk("/dev/zero", 9, &mockInjector{}, []byte{})
+	v, err := virtio.NewBlk("/dev/zero", virtio.DiskReadWrite, virtio.BlkIOPortStart, 9, &mockInjector{}, guestMem(t, nil))
 	if err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
@@ -63,7 +78,8 @@ func TestIO(t *testing.T) {
 
 	mem := make([]byte, 0x1000000)
 
-	v, err := virtio.NewBlk("../vda.img", 10, &mockInjector{}, mem)
+	v, err := virtio.NewBlk("../vda.img", virtio.DiskReadWrite, virtio.BlkIOPortStart, 10, &mockInjector{},
+		guestMem(t, mem))
 
 	if os.IsNotExist(err) {
 		t.Skipf("../vda.img does not exist, skipping this test")
@@ -74,29 +90,28 @@ func TestIO(t *testing.T) {
 	}
 
 	// Init virt queue
-	vq := virtio.VirtQueue{}
-	vq.AvailRing.Idx = 1
+	g := newGuestQueue(t, v, virtio.BlkIOPortStart, mem, 0)
 
 	// for blk request
-	vq.DescTable[0].Addr = 0
-	vq.DescTable[0].Len = 1
-	vq.DescTable[0].Next = 1
+	g.setDesc(0, 0, 16, 0x1, 1)
 
 	blkReq := (*virtio.BlkReq)(unsafe.Pointer(&mem[0]))
 	blkReq.Type = 0
 	blkReq.Sector = 2
 
 	// for data
-	vq.DescTable[1].Addr = 0x400
-	vq.DescTable[1].Len = 0x200
-	vq.DescTable[1].Next = 2
+	g.setDesc(1, 0x400, 0x200, 0x1|0x2, 2)
 
-	v.VirtQueue[0] = &vq
+	// for status
+	g.setDesc(2, 0x800, 1, 0x2, 0)
+	g.publish(0)
 
 	if err := v.IO(); err != nil {
 		t.Fatalf("err: %v\n", err)
 	}
 
+	v.Wait()
+
 	if !v.IRQInjector.(*mockInjector).called {
 		t.Fatalf("irqInjected = false\n")
 	}
@@ -108,3 +123,372 @@ func TestIO(t *testing.T) {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
 	}
 }
+
+func TestBlkDiscard(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, bytes.Repeat([]byte{0xff}, 16*virtio.SectorSize), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x1000000)
+
+	v, err := virtio.NewBlk(path, virtio.DiskReadWrite, virtio.BlkIOPortStart, 10, &mockInjector{}, guestMem(t, mem))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	// max_discard_sectors is at 36 in the device config.
+	actual := make([]byte, 4)
+	_ = v.Read(virtio.BlkIOPortStart+20+36, actual)
+
+	if binary.LittleEndian.Uint32(actual) == 0 {
+		t.Fatalf("max_discard_sectors: expected a limit, actual: %v", actual)
+	}
+
+	g := newGuestQueue(t, v, virtio.BlkIOPortStart, mem, 0)
+
+	for i, tt := range []struct {
+		typ            uint32
+		sector, n      uint64
+		flags          uint32
+		expectedStatus byte
+	}{
+		{typ: 11, sector: 8, n: 8},                     // DISCARD
+		{typ: 13, sector: 0, n: 2},                     // WRITE_ZEROES
+		{typ: 13, sector: 4, n: 1, flags: 1},           // WRITE_ZEROES with UNMAP
+		{typ: 11, sector: 12, n: 8, expectedStatus: 1}, // past the end
+		{typ: 8, expectedStatus: 2},                    // GET_ID
+	} {
+		g.setDesc(0, 0, 16, 0x1, 1)
+
+		binary.LittleEndian.PutUint32(mem[0:], tt.typ)
+
+		g.setDesc(1, 0x400, 16, 0x1, 2)
+
+		binary.LittleEndian.PutUint64(mem[0x400:], tt.sector)
+		binary.LittleEndian.PutUint32(mem[0x408:], uint32(tt.n))
+		binary.LittleEndian.PutUint32(mem[0x40c:], tt.flags)
+
+		g.setDesc(2, 0x800, 1, 0x2, 0)
+		mem[0x800] = 0xff
+
+		g.publish(0)
+
+		if err := v.IO(); err != nil {
+			t.Fatalf("err: %v\n", err)
+		}
+
+		v.Wait()
+
+		if mem[0x800] != tt.expectedStatus {
+			t.Errorf("%d: expected status %d, actual: %d", i, tt.expectedStatus, mem[0x800])
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := bytes.Repeat([]byte{0xff}, 16*virtio.SectorSize)
+	copy(expected[0:], make([]byte, 2*virtio.SectorSize))
+	copy(expected[4*virtio.SectorSize:], make([]byte, virtio.SectorSize))
+	copy(expected[8*virtio.SectorSize:], make([]byte, 8*virtio.SectorSize))
+
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected the discarded sectors to read as zero")
+	}
+}
+
+func TestBlkModes(t *testing.T) {
+	t.Parallel()
+
+	base := bytes.Repeat([]byte{0xff}, 16*virtio.SectorSize)
+
+	for _, tt := range []struct {
+		mode           virtio.DiskMode
+		expectedStatus byte
+	}{
+		{mode: virtio.DiskReadOnly, expectedStatus: 1},
+		{mode: virtio.DiskSnapshot},
+	} {
+		path := filepath.Join(t.TempDir(), "disk.img")
+		if err := os.WriteFile(path, base, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		mem := make([]byte, 0x1000000)
+
+		v, err := virtio.NewBlk(path, tt.mode, virtio.BlkIOPortStart, 10, &mockInjector{}, guestMem(t, mem))
+		if err != nil {
+			t.Fatalf("err: %v\n", err)
+		}
+
+		// VIRTIO_BLK_F_RO is offered only for read-only disks.
+		features := make([]byte, 4)
+		_ = v.Read(virtio.BlkIOPortStart, features)
+
+		if ro := features[0]&(1<<5) != 0; ro != (tt.mode == virtio.DiskReadOnly) {
+			t.Errorf("mode %d: expected VIRTIO_BLK_F_RO to be %v", tt.mode, !ro)
+		}
+
+		g := newGuestQueue(t, v, virtio.BlkIOPortStart, mem, 0)
+
+		// Write the sector 1, then read the sectors 0 and 1.
+		for i, typ := range []uint32{1, 0} {
+			g.setDesc(0, 0, 16, 0x1, 1)
+
+			binary.LittleEndian.PutUint32(mem[0:], typ)
+			binary.LittleEndian.PutUint64(mem[8:], uint64(1-i))
+
+			g.setDesc(1, 0x400, uint32((i+1)*virtio.SectorSize), 0x1|uint16(2*i), 2)
+
+			if typ == 1 {
+				copy(mem[0x400:], bytes.Repeat([]byte{0xab}, virtio.SectorSize))
+			}
+
+			g.setDesc(2, 0x1000, 1, 0x2, 0)
+			mem[0x1000] = 0xff
+
+			g.publish(0)
+
+			if err := v.IO(); err != nil {
+				t.Fatalf("err: %v\n", err)
+			}
+
+			v.Wait()
+
+			if typ == 1 && mem[0x1000] != tt.expectedStatus {
+				t.Errorf("mode %d: expected status %d, actual: %d", tt.mode, tt.expectedStatus, mem[0x1000])
+			}
+		}
+
+		expected := append([]byte{}, base[:2*virtio.SectorSize]...)
+		if tt.mode == virtio.DiskSnapshot {
+			copy(expected[virtio.SectorSize:], bytes.Repeat([]byte{0xab}, virtio.SectorSize))
+		}
+
+		if !bytes.Equal(mem[0x400:0x400+2*virtio.SectorSize], expected) {
+			t.Errorf("mode %d: expected the guest to read its writes", tt.mode)
+		}
+
+		if b, _ := os.ReadFile(path); !bytes.Equal(b, base) {
+			t.Errorf("mode %d: expected the file to be left alone", tt.mode)
+		}
+	}
+}
+
+func TestBlkParallel(t *testing.T) {
+	t.Parallel()
+
+	const n = 10
+
+	disk := make([]byte, n*virtio.SectorSize)
+	for i := range disk {
+		disk[i] = byte(i / virtio.SectorSize)
+	}
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, disk, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x100000)
+	injector := &mockInjector{}
+
+	v, err := virtio.NewBlk(path, virtio.DiskReadWrite, virtio.BlkIOPortStart, 10, injector, guestMem(t, mem))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	// VIRTIO_RING_F_EVENT_IDX
+	if err := v.Write(virtio.BlkIOPortStart+4, binary.LittleEndian.AppendUint32(nil, 1<<29)); err != nil {
+		t.Fatal(err)
+	}
+
+	g := newGuestQueue(t, v, virtio.BlkIOPortStart, mem, 0)
+	heads := []uint16{}
+
+	// Read each sector with its own request, of a header, data and
+	// status buffer.
+	for i := 0; i < n; i++ {
+		d := uint16(3 * i)
+		addr := uint64(0x80000 + i*0x1000)
+
+		g.setDesc(d, addr, 16, 0x1, d+1)
+
+		g.setDesc(d+1, addr+0x200, virtio.SectorSize, 0x1|0x2, d+2)
+
+		g.setDesc(d+2, addr+0x400, 1, 0x2, 0)
+
+		binary.LittleEndian.PutUint64(mem[addr+8:], uint64(i))
+		mem[addr+0x400] = 0xff
+
+		heads = append(heads, d)
+	}
+
+	// Ask for an interrupt only once the last request is used.
+	g.setUsedEvent(n - 1)
+	g.publish(heads...)
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	v.Wait()
+
+	if g.usedIdx() != n {
+		t.Fatalf("expected %d used requests, actual: %d", n, g.usedIdx())
+	}
+
+	for i := 0; i < n; i++ {
+		addr := uint64(0x80000 + i*0x1000)
+
+		if !bytes.Equal(mem[addr+0x200:addr+0x400], disk[i*virtio.SectorSize:(i+1)*virtio.SectorSize]) ||
+			mem[addr+0x400] != 0 {
+			t.Errorf("request %d: expected the sector %d and status 0", i, i)
+		}
+	}
+
+	if !injector.called {
+		t.Fatalf("expected an interrupt once every request is used")
+	}
+
+	// No interrupt is wanted for the next request.
+	injector.called = false
+	g.setUsedEvent(n + 5)
+	g.publish(0)
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	v.Wait()
+
+	if g.usedIdx() != n+1 || injector.called {
+		t.Fatalf("expected the request to be used without an interrupt")
+	}
+}
+
+func TestBlkIndirect(t *testing.T) {
+	t.Parallel()
+
+	disk := make([]byte, 4*virtio.SectorSize)
+	for i := range disk {
+		disk[i] = byte(i / virtio.SectorSize)
+	}
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, disk, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x100000)
+
+	v, err := virtio.NewBlk(path, virtio.DiskReadWrite, virtio.BlkIOPortStart, 10, &mockInjector{}, guestMem(t, mem))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	for _, size := range []uint16{0, 2, 100, 2048} {
+		if err := v.SetQueueSize(size); !errors.Is(err, virtio.ErrInvalidQueueSize) {
+			t.Errorf("size %d: expected %v, actual: %v", size, virtio.ErrInvalidQueueSize, err)
+		}
+	}
+
+	if err := v.SetQueueSize(virtio.MaxQueueSize); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	// seg_max is at 12 in the device config.
+	segMax := make([]byte, 4)
+	_ = v.Read(virtio.BlkIOPortStart+20+12, segMax)
+
+	if binary.LittleEndian.Uint32(segMax) != virtio.MaxQueueSize-2 {
+		t.Fatalf("seg_max: expected %d, actual: %v", virtio.MaxQueueSize-2, segMax)
+	}
+
+	g := newGuestQueue(t, v, virtio.BlkIOPortStart, mem, 0)
+	if g.size != virtio.MaxQueueSize {
+		t.Fatalf("queue size: expected %d, actual: %d", virtio.MaxQueueSize, g.size)
+	}
+
+	// Read the sectors 1 to 3, a buffer each, with a single descriptor
+	// of the ring.
+	hdr := binary.LittleEndian.AppendUint64(make([]byte, 8), 1)
+	sector := make([]byte, virtio.SectorSize)
+	addrs := g.addIndirect(1, hdr, sector, sector, sector, []byte{0xff})
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	v.Wait()
+
+	if mem[addrs[4]] != 0 {
+		t.Fatalf("expected status 0, actual: %d", mem[addrs[4]])
+	}
+
+	if !bytes.Equal(mem[addrs[1]:addrs[1]+3*virtio.SectorSize], disk[virtio.SectorSize:]) {
+		t.Fatalf("expected the sectors 1 to 3")
+	}
+
+	// A table out of the memory is not followed, but reported.
+	g.setDesc(1, uint64(len(mem))-8, 16, 0x4, 0)
+	g.publish(1)
+
+	if err := v.IO(); !errors.Is(err, memory.ErrOutOfRange) {
+		t.Fatalf("expected %v, actual: %v", memory.ErrOutOfRange, err)
+	}
+
+	v.Wait()
+
+	if g.usedIdx() != 2 {
+		t.Fatalf("expected the bad request to be used, actual: %d used", g.usedIdx())
+	}
+}
+
+func TestBlkIOSched(t *testing.T) { // nolint:paralleltest
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, make([]byte, 4*virtio.SectorSize), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make([]byte, 0x100000)
+
+	v, err := virtio.NewBlk(path, virtio.DiskReadWrite, virtio.BlkIOPortStart, 10, &mockInjector{}, guestMem(t, mem))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+	defer v.Close()
+
+	policy := ioPolicy(1)
+	v.SetIOSched(policy)
+
+	g := newGuestQueue(t, v, virtio.BlkIOPortStart, mem, 0)
+	before := ioThreads(t, policy)
+
+	addrs := g.addIndirect(1, make([]byte, 16), make([]byte, virtio.SectorSize), []byte{0xff})
+
+	err = v.IO()
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("no real-time scheduling: %v", err)
+	}
+
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	v.Wait()
+
+	if mem[addrs[2]] != 0 {
+		t.Fatalf("expected status 0, actual: %d", mem[addrs[2]])
+	}
+
+	// The workers serving the requests follow the policy.
+	if n := ioThreads(t, policy) - before; n < 8 {
+		t.Errorf("expected 8 workers following the policy, actual: %d", n)
+	}
+}
@@ -1,5 +1,37 @@
 package virtio
 
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/sched"
+)
+
+// Virtqueue descriptor flags.
+const (
+	descFlagNext     = 0x1
+	descFlagWrite    = 0x2
+	descFlagIndirect = 0x4
+)
+
+const (
+	// availFlagNoInterrupt asks the device not to interrupt the driver
+	// when it uses buffers.
+	availFlagNoInterrupt = 0x1
+
+	// ringFEventIdx is the feature with which the driver and the device
+	// tell each other at which ring index they want to be notified, in
+	// the used_event and avail_event fields.
+	ringFEventIdx = 1 << 29
+
+	// ringFIndirectDesc is the feature with which the driver may put a
+	// chain in a table of its own, taking a single descriptor of the
+	// ring, so that large requests do not exhaust it.
+	ringFIndirectDesc = 1 << 28
+)
+
 const (
 	// The number of free descriptors in virt queue must exceed
 	// MAX_SKB_FRAGS (16). Otherwise, packet transmission from
@@ -7,50 +39,315 @@ const (
 	//
 	// refs https://github.com/torvalds/linux/blob/5859a2b/drivers/net/virtio_net.c#L1754
 	QueueSize = 32
+
+	// MinQueueSize and MaxQueueSize bound the size a queue can be
+	// given.
+	MinQueueSize = 4
+	MaxQueueSize = 1024
+)
+
+var (
+	ErrInvalidQueueSize = errors.New("queue size must be a power of 2 from 4 to 1024")
+	ErrQueueOutOfMemory = errors.New("virt queue is out of guest memory")
 )
 
+// ioSched is the policy of the threads a device starts on its own, e.g.
+// to serve requests or connections, on top of the IO threads started
+// for it.
+type ioSched struct {
+	policy sched.Policy
+}
+
+// SetIOSched makes the threads the device starts from now on follow p,
+// as its IO threads do. It must be called before the device is used.
+func (s *ioSched) SetIOSched(p sched.Policy) {
+	s.policy = p
+}
+
+// goIO runs f on a host thread following the policy. If the policy can
+// not be applied, f still runs, on any host CPU, and the error is
+// returned.
+func (s *ioSched) goIO(f func()) error {
+	err := sched.Go(s.policy, f)
+	if err != nil {
+		go f()
+	}
+
+	return err
+}
+
+// IRQInjector raises the legacy interrupt line assigned to a device.
 type IRQInjector interface {
-	InjectVirtioNetIRQ() error
-	InjectVirtioBlkIRQ() error
+	InjectVirtioIRQ(irq uint8) error
 }
 
 type commonHeader struct {
-	_        uint32 // hostFeatures
-	_        uint32 // guestFeatures
-	_        uint32 // queuePFN
-	queueNUM uint16
-	queueSEL uint16
-	_        uint16 // queueNotify
-	_        uint8  // status
-	isr      uint8
+	hostFeatures uint32
+	_            uint32 // guestFeatures
+	_            uint32 // queuePFN
+	queueNUM     uint16
+	queueSEL     uint16
+	_            uint16 // queueNotify
+	_            uint8  // status
+	isr          uint8
+}
+
+// CheckQueueSize tells if size may be given to the queues of a device,
+// see SetQueueSize of each device.
+func CheckQueueSize(size uint16) error {
+	if size < MinQueueSize || size > MaxQueueSize || size&(size-1) != 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidQueueSize, size)
+	}
+
+	return nil
 }
 
+// descSize is the size of struct virtq_desc.
+const descSize = 16
+
+// desc is a descriptor of a buffer.
+type desc struct {
+	Addr  uint64
+	Len   uint32
+	Flags uint16
+	Next  uint16
+}
+
+// VirtQueue is a split virt queue in guest memory, in the layout of the
+// legacy interface: the descriptor table, the available ring, and the
+// used ring from the next 4096 byte boundary. Its fields are read and
+// written in place, in ring, which newVirtQueue checked to be in guest
+// memory.
+//
 // refs: https://wiki.osdev.org/Virtio#Virtual_Queue_Descriptor
 type VirtQueue struct {
-	DescTable [QueueSize]struct {
-		Addr  uint64
-		Len   uint32
-		Flags uint16
-		Next  uint16
+	mem  *memory.GuestMemory
+	ring []byte
+	size uint16
+
+	// avail and used are the offsets of the rings.
+	avail, used uint64
+}
+
+// queueBytes returns the size of a queue of size entries in memory.
+func queueBytes(size uint16) uint64 {
+	n := uint64(size)
+	avail := descSize * n
+	used := (avail + 6 + 2*n + 4095) &^ 4095
+
+	return used + 6 + 8*n
+}
+
+// newVirtQueue returns the queue of size entries the guest put at the
+// page pfn of mem, or nil for the pfn 0 with which the guest resets it.
+func newVirtQueue(mem *memory.GuestMemory, pfn uint64, size uint16) (*VirtQueue, error) {
+	if pfn == 0 {
+		return nil, nil
 	}
 
-	AvailRing struct {
-		Flags     uint16
-		Idx       uint16
-		Ring      [QueueSize]uint16
-		UsedEvent uint16
+	ring, err := mem.Slice(pfn*4096, queueBytes(size))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrQueueOutOfMemory, err)
 	}
 
-	// padding for 4096 byte alignment
-	_ [4096 - ((16*QueueSize + 6 + 2*QueueSize) % 4096)]uint8
+	avail := descSize * uint64(size)
+
+	return &VirtQueue{
+		mem:   mem,
+		ring:  ring,
+		size:  size,
+		avail: avail,
+		used:  (avail + 6 + 2*uint64(size) + 4095) &^ 4095,
+	}, nil
+}
+
+func (vq *VirtQueue) u16(off uint64) uint16 {
+	return binary.LittleEndian.Uint16(vq.ring[off:])
+}
+
+func (vq *VirtQueue) putU16(off uint64, x uint16) {
+	binary.LittleEndian.PutUint16(vq.ring[off:], x)
+}
+
+// availFlags returns the flags of the available ring.
+func (vq *VirtQueue) availFlags() uint16 {
+	return vq.u16(vq.avail)
+}
 
-	UsedRing struct {
-		Flags uint16
-		Idx   uint16
-		Ring  [QueueSize]struct {
-			Idx uint32
-			Len uint32
+// availIdx returns where the guest puts the next available chain.
+func (vq *VirtQueue) availIdx() uint16 {
+	return vq.u16(vq.avail + 2)
+}
+
+// availHead returns the head of the chain at the index i of the
+// available ring.
+func (vq *VirtQueue) availHead(i uint16) uint16 {
+	return vq.u16(vq.avail + 4 + 2*uint64(i%vq.size))
+}
+
+// usedEvent returns the used index past which the guest wants an
+// interrupt, with ringFEventIdx.
+func (vq *VirtQueue) usedEvent() uint16 {
+	return vq.u16(vq.avail + 4 + 2*uint64(vq.size))
+}
+
+// usedIdx returns where the device puts the next used chain.
+func (vq *VirtQueue) usedIdx() uint16 {
+	return vq.u16(vq.used + 2)
+}
+
+// setAvailEvent tells the guest the available index past which the
+// device wants a notification, with ringFEventIdx.
+func (vq *VirtQueue) setAvailEvent(idx uint16) {
+	vq.putU16(vq.used+4+8*uint64(vq.size), idx)
+}
+
+// descAt reads the descriptor id of table, which the caller checked to
+// hold it.
+func descAt(table []byte, id uint64) desc {
+	b := table[descSize*id : descSize*(id+1)]
+
+	return desc{
+		Addr:  binary.LittleEndian.Uint64(b),
+		Len:   binary.LittleEndian.Uint32(b[8:]),
+		Flags: binary.LittleEndian.Uint16(b[12:]),
+		Next:  binary.LittleEndian.Uint16(b[14:]),
+	}
+}
+
+// pop takes the next chain of buffers the guest made available on vq,
+// whose last seen index is *last, and returns the content of its
+// buffers for the device to read. A chain out of guest memory is
+// returned to the guest unread, with the error.
+func pop(vq *VirtQueue, last *uint16) ([]byte, bool, error) {
+	if *last == vq.availIdx() {
+		return nil, false, nil
+	}
+
+	head := vq.availHead(*last)
+	buf, err := readChain(vq, head)
+
+	complete(vq, last, head, 0)
+
+	return buf, true, err
+}
+
+// push copies b to the next chain of buffers the guest made available
+// on vq, and returns how much of b fits in it. A chain out of guest
+// memory is returned to the guest unwritten, with the error.
+func push(vq *VirtQueue, last *uint16, b []byte) (int, bool, error) {
+	if *last == vq.availIdx() {
+		return 0, false, nil
+	}
+
+	head := vq.availHead(*last)
+	n, err := writeChain(vq, head, b)
+
+	complete(vq, last, head, uint32(n))
+
+	return n, true, err
+}
+
+// walk calls f with each buffer of the chain at head, its address, and
+// whether the device may write to it. A head with descFlagIndirect
+// stands for the chain in the table of descriptors it points to. A chain
+// leaving its table, or longer than it, ends the walk. If the table or
+// a buffer is out of guest memory, walk fails without calling f.
+func walk(vq *VirtQueue, head uint16, f func(addr uint64, b []byte, write bool)) error {
+	table, id := vq.ring[:vq.avail], uint64(head%vq.size)
+
+	if d := descAt(table, id); d.Flags&descFlagIndirect != 0 {
+		var err error
+
+		if table, err = vq.mem.Slice(d.Addr, uint64(d.Len/descSize*descSize)); err != nil {
+			return fmt.Errorf("indirect table of the chain at %d: %w", head, err)
 		}
-		availEvent uint16
+
+		id = 0
 	}
+
+	type buffer struct {
+		addr  uint64
+		b     []byte
+		write bool
+	}
+
+	bufs := []buffer{}
+	n := uint64(len(table)) / descSize
+
+	for i := uint64(0); i < n && id < n; i++ {
+		d := descAt(table, id)
+
+		b, err := vq.mem.Slice(d.Addr, uint64(d.Len))
+		if err != nil {
+			return fmt.Errorf("chain at %d: %w", head, err)
+		}
+
+		bufs = append(bufs, buffer{addr: d.Addr, b: b, write: d.Flags&descFlagWrite != 0})
+
+		if d.Flags&descFlagNext == 0 {
+			break
+		}
+
+		id = uint64(d.Next)
+	}
+
+	for _, b := range bufs {
+		f(b.addr, b.b, b.write)
+	}
+
+	return nil
+}
+
+// readChain returns the content of the buffers of the chain at head
+// for the device to read.
+func readChain(vq *VirtQueue, head uint16) ([]byte, error) {
+	buf := []byte{}
+
+	err := walk(vq, head, func(_ uint64, b []byte, write bool) {
+		if !write {
+			buf = append(buf, b...)
+		}
+	})
+
+	return buf, err
+}
+
+// writeChain copies b to the buffers of the chain at head the device
+// may write to, and returns how much of b fits in them.
+func writeChain(vq *VirtQueue, head uint16, b []byte) (int, error) {
+	n := 0
+
+	err := walk(vq, head, func(_ uint64, buf []byte, write bool) {
+		if write {
+			n += copy(buf, b[n:])
+		}
+	})
+
+	return n, err
+}
+
+// complete returns the chain at head to the guest, with l bytes
+// written to it.
+func complete(vq *VirtQueue, last *uint16, head uint16, l uint32) {
+	release(vq, head, l)
+	*last++
+}
+
+// release returns the chain at head, taken off the available ring
+// earlier, to the guest with l bytes written to it.
+func release(vq *VirtQueue, head uint16, l uint32) {
+	idx := vq.usedIdx()
+	e := vq.ring[vq.used+4+8*uint64(idx%vq.size):]
+
+	binary.LittleEndian.PutUint32(e, uint32(head))
+	binary.LittleEndian.PutUint32(e[4:], l)
+	vq.putU16(vq.used+2, idx+1)
+}
+
+// needEvent tells if the other side, which wants to be notified once
+// the index passes event, must be notified of the index moving from
+// prev to next. It is vring_need_event of the spec.
+func needEvent(event, next, prev uint16) bool {
+	return next-event-1 < next-prev
 }
@@ -0,0 +1,247 @@
+package virtio_test
+
+import (
+	"encoding/binary"
+	"os"
+	"strconv"
+	"testing"
+	"unsafe"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/sched"
+	"golang.org/x/sys/unix"
+)
+
+// ioPolicy returns the policy of the threads of a device in the tests,
+// whose SCHED_FIFO priority sets them apart from the other threads. Each
+// test takes a priority of its own, so as not to count the threads of
+// another one still exiting.
+func ioPolicy(priority int) sched.Policy {
+	return sched.Policy{CPUs: []int{0}, Priority: priority}
+}
+
+// ioThreads counts the threads of the process following p.
+func ioThreads(t *testing.T, p sched.Policy) int {
+	t.Helper()
+
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+
+	for _, task := range tasks {
+		tid, _ := strconv.Atoi(task.Name())
+
+		var set unix.CPUSet
+
+		// The thread may have exited meanwhile.
+		if err := unix.SchedGetaffinity(tid, &set); err != nil {
+			continue
+		}
+
+		var priority int32
+
+		policy, _, errno := unix.RawSyscall(unix.SYS_SCHED_GETSCHEDULER, uintptr(tid), 0, 0)
+		if errno != 0 || policy != 1 {
+			continue
+		}
+
+		_, _, errno = unix.RawSyscall(unix.SYS_SCHED_GETPARAM, uintptr(tid), uintptr(unsafe.Pointer(&priority)), 0)
+		if errno == 0 && int(priority) == p.Priority && set.Count() == 1 && set.IsSet(0) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// guestQueue plays the guest side of the virt queue q of a device,
+// laid out in memory as the legacy interface wants it.
+type guestQueue struct {
+	mem  []byte
+	size uint16
+
+	desc, avail, used uint64
+
+	addr uint64 // of the next buffer
+	seen uint16 // entries of the used ring seen so far
+}
+
+// newGuestQueue sets up the queue q of the device whose registers are
+// at ioport, with the size the device tells. mem must be at least 1MiB.
+func newGuestQueue(t *testing.T, dev interface {
+	Read(uint64, []byte) error
+	Write(uint64, []byte) error
+}, ioport uint64, mem []byte, q uint16,
+) *guestQueue {
+	t.Helper()
+
+	if err := dev.Write(ioport+14, []byte{byte(q), 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	num := make([]byte, 2)
+	if err := dev.Read(ioport+12, num); err != nil {
+		t.Fatal(err)
+	}
+
+	// Eight pages for each queue, enough for the largest one, and
+	// buffers from 0x80000.
+	pfn := 0x10 + 8*uint32(q)
+
+	if err := dev.Write(ioport+8, binary.LittleEndian.AppendUint32(nil, pfn)); err != nil {
+		t.Fatal(err)
+	}
+
+	size := binary.LittleEndian.Uint16(num)
+	desc := uint64(pfn) * 4096
+	avail := desc + 16*uint64(size)
+
+	return &guestQueue{
+		mem:   mem,
+		size:  size,
+		desc:  desc,
+		avail: avail,
+		used:  (avail + 6 + 2*uint64(size) + 4095) &^ 4095,
+		addr:  0x80000 + uint64(q)*0x4000,
+	}
+}
+
+// setDesc fills the descriptor id.
+func (g *guestQueue) setDesc(id uint16, addr uint64, l uint32, flags, next uint16) {
+	putDesc(g.mem[g.desc+16*uint64(id):], addr, l, flags, next)
+}
+
+func putDesc(b []byte, addr uint64, l uint32, flags, next uint16) {
+	binary.LittleEndian.PutUint64(b, addr)
+	binary.LittleEndian.PutUint32(b[8:], l)
+	binary.LittleEndian.PutUint16(b[12:], flags)
+	binary.LittleEndian.PutUint16(b[14:], next)
+}
+
+// publish makes the chains at heads available.
+func (g *guestQueue) publish(heads ...uint16) {
+	idx := binary.LittleEndian.Uint16(g.mem[g.avail+2:])
+
+	for _, head := range heads {
+		binary.LittleEndian.PutUint16(g.mem[g.avail+4+2*uint64(idx%g.size):], head)
+		idx++
+	}
+
+	binary.LittleEndian.PutUint16(g.mem[g.avail+2:], idx)
+}
+
+// setUsedEvent asks for an interrupt once the used index passes idx.
+func (g *guestQueue) setUsedEvent(idx uint16) {
+	binary.LittleEndian.PutUint16(g.mem[g.avail+4+2*uint64(g.size):], idx)
+}
+
+// usedIdx returns the index of the used ring.
+func (g *guestQueue) usedIdx() uint16 {
+	return binary.LittleEndian.Uint16(g.mem[g.used+2:])
+}
+
+// usedEntry returns the head and the length of the entry i of the used
+// ring.
+func (g *guestQueue) usedEntry(i uint16) (uint16, uint32) {
+	e := g.mem[g.used+4+8*uint64(i%g.size):]
+
+	return uint16(binary.LittleEndian.Uint32(e)), binary.LittleEndian.Uint32(e[4:])
+}
+
+// buffer copies b to the next free memory and returns its address.
+func (g *guestQueue) buffer(b []byte) uint64 {
+	addr := g.addr
+
+	copy(g.mem[addr:], b)
+	g.addr += uint64(len(b))
+
+	return addr
+}
+
+// add makes a buffer available, holding b or, if write is set, for
+// the device to write to.
+func (g *guestQueue) add(b []byte, write bool) {
+	id := binary.LittleEndian.Uint16(g.mem[g.avail+2:]) % g.size
+	flags := uint16(0)
+
+	if write {
+		flags = 0x2
+	}
+
+	g.setDesc(id, g.buffer(b), uint32(len(b)), flags, 0)
+	g.publish(id)
+}
+
+// addChain makes a chain of two buffers available, holding out and
+// then in for the device to write to. It returns the address of in.
+func (g *guestQueue) addChain(out, in []byte) uint64 {
+	id := binary.LittleEndian.Uint16(g.mem[g.avail+2:]) % g.size
+	next := (id + 1) % g.size
+
+	g.setDesc(id, g.buffer(out), uint32(len(out)), 0x1, next)
+
+	inAddr := g.buffer(in)
+	g.setDesc(next, inAddr, uint32(len(in)), 0x2, 0)
+	g.publish(id)
+
+	return inAddr
+}
+
+// addIndirect makes the chain of bufs available through a single
+// descriptor pointing to a table of its own. The buffers after the
+// first out ones are for the device to write to. It returns their
+// addresses.
+func (g *guestQueue) addIndirect(out int, bufs ...[]byte) []uint64 {
+	id := binary.LittleEndian.Uint16(g.mem[g.avail+2:]) % g.size
+	table := g.buffer(make([]byte, 16*len(bufs)))
+	addrs := []uint64{}
+
+	for i, b := range bufs {
+		addrs = append(addrs, g.buffer(b))
+
+		flags := uint16(0x1)
+		if i == len(bufs)-1 {
+			flags = 0
+		}
+
+		if i >= out {
+			flags |= 0x2
+		}
+
+		putDesc(g.mem[table+16*uint64(i):], addrs[i], uint32(len(b)), flags, uint16(i+1))
+	}
+
+	g.setDesc(id, table, uint32(16*len(bufs)), 0x4, 0)
+	g.publish(id)
+
+	return addrs
+}
+
+// take returns the content of the buffers used by the device since
+// the last call, from the first buffer of their chain.
+func (g *guestQueue) take() [][]byte {
+	res := [][]byte{}
+
+	for ; g.seen != g.usedIdx(); g.seen++ {
+		head, l := g.usedEntry(g.seen)
+		addr := binary.LittleEndian.Uint64(g.mem[g.desc+16*uint64(head):])
+		res = append(res, g.mem[addr:addr+uint64(l)])
+	}
+
+	return res
+}
+
+// guestMem returns the guest memory backed by mem from the address 0.
+func guestMem(t *testing.T, mem []byte) *memory.GuestMemory {
+	t.Helper()
+
+	m, err := memory.New(memory.Region{GPA: 0, Data: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
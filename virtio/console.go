@@ -0,0 +1,566 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+var ErrInvalidPort = errors.New("virtio console port is invalid")
+
+// ErrConsoleClosed indicates input received by a closed virtio console.
+var ErrConsoleClosed = errors.New("virtio console is closed")
+
+const (
+	ConsoleIOPortStart = 0x6400
+	ConsoleIOPortSize  = 0x100
+
+	// MaxConsolePorts is the number of ports of a console, as in
+	// QEMU's virtio-serial.
+	MaxConsolePorts = 31
+
+	// MaxConsolePending is the number of input bytes a port holds
+	// while the guest has no buffer for them. Receive blocks beyond.
+	MaxConsolePending = 1 << 16
+)
+
+// VIRTIO_CONSOLE_F_MULTIPORT adds the control queues and max_nr_ports.
+const consoleFeatureMultiport = 1 << 1
+
+// Events of the control messages.
+//
+// refs https://github.com/torvalds/linux/blob/v6.1/include/uapi/linux/virtio_console.h
+const (
+	consoleDeviceReady = 0
+	consoleDeviceAdd   = 1
+	consolePortReady   = 3
+	consoleConsolePort = 4
+	consolePortOpen    = 6
+	consolePortName    = 7
+)
+
+// Queues of the console. Port 0 has queues 0 and 1, the control
+// queues come next, and then two for each further port.
+const (
+	consoleCtrlRx = 2
+	consoleCtrlTx = 3
+)
+
+// ConsolePort is a port of a Console. The guest sees a port with
+// Console set as hvcN, and the others as /dev/vportNpM, linked from
+// /dev/virtio-ports/Name if Name is not empty.
+type ConsolePort struct {
+	Name    string
+	Console bool
+
+	// In is read by IOThreadEntry for the guest and may be nil. Out
+	// receives the guest output and should not block.
+	In  io.Reader
+	Out io.Writer
+}
+
+type consolePort struct {
+	ConsolePort
+
+	// guestOpen is set while a program in the guest has the port
+	// open. The guest drops the input of a closed port, so it is
+	// held until then.
+	guestOpen bool
+	pending   []byte
+}
+
+type consoleHdr struct {
+	commonHeader  commonHeader
+	consoleHeader consoleHeader
+}
+
+func (h consoleHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type consoleHeader struct {
+	_          uint16 // cols
+	_          uint16 // rows
+	maxNrPorts uint32
+	_          uint32 // emergWrite
+}
+
+// consoleControl is struct virtio_console_control.
+type consoleControl struct {
+	ID    uint32
+	Event uint16
+	Value uint16
+}
+
+// Console is a virtio console device with multiple ports.
+type Console struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	ioSched
+
+	Hdr consoleHdr
+
+	VirtQueue    []*VirtQueue
+	Mem          *memory.GuestMemory
+	LastAvailIdx []uint16
+
+	ports []consolePort
+
+	// ctrl queues the control messages until the guest gives
+	// buffers for them.
+	ctrl [][]byte
+
+	// err is the first chain out of guest memory since IO last
+	// returned.
+	err error
+
+	kick chan uint16
+
+	// closed makes Receive fail, see Close.
+	closed bool
+
+	ioport      uint64
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *Console) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1003,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 3, // Console
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			uint32(v.ioport) | 0x1,
+		},
+		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
+		InterruptPin: 1,
+		// https://www.webopedia.com/reference/irqnumbers/
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Console) Read(port uint64, bytes []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	offset := int(port - v.ioport)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	// Past the end of the config reads as zero.
+	if offset > len(b) {
+		offset = len(b)
+	}
+
+	l := len(bytes)
+	for i := copy(bytes[:l], b[offset:]); i < l; i++ {
+		bytes[i] = 0
+	}
+
+	return nil
+}
+
+func (v *Console) Write(port uint64, bytes []byte) error {
+	v.mu.Lock()
+
+	offset := int(port - v.ioport)
+
+	switch offset {
+	case 8:
+		sel := int(v.Hdr.commonHeader.queueSEL)
+		if sel >= len(v.VirtQueue) {
+			v.mu.Unlock()
+
+			return ErrInvalidSel
+		}
+
+		// Queue PFN is aligned to page (4096 bytes)
+		vq, err := newVirtQueue(v.Mem, pci.BytesToNum(bytes), v.Hdr.commonHeader.queueNUM)
+		if err != nil {
+			v.mu.Unlock()
+
+			return err
+		}
+
+		v.VirtQueue[sel] = vq
+
+		v.LastAvailIdx[sel] = 0
+	case 14:
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	case 16:
+		v.Hdr.commonHeader.isr = 0x0
+		v.mu.Unlock()
+
+		v.kick <- uint16(pci.BytesToNum(bytes))
+
+		return nil
+	default:
+	}
+
+	v.mu.Unlock()
+
+	return nil
+}
+
+// SetQueueSize sets the size of the queues, which the guest reads before
+// setting them up.
+func (v *Console) SetQueueSize(size uint16) error {
+	if err := CheckQueueSize(size); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.Hdr.commonHeader.queueNUM = size
+
+	return nil
+}
+
+func (v *Console) IOPort() uint64 {
+	return v.ioport
+}
+
+func (v *Console) Size() uint64 {
+	return ConsoleIOPortSize
+}
+
+// rxQueue returns the queue of the input of a port.
+func rxQueue(id int) int {
+	if id == 0 {
+		return 0
+	}
+
+	return 2*id + 2
+}
+
+// IOThreadEntry serves the queues notified by the guest, and feeds the
+// input of each port to it on threads following the policy set by
+// SetIOSched.
+func (v *Console) IOThreadEntry() {
+	for id, p := range v.ports {
+		if p.In == nil {
+			continue
+		}
+
+		id, in := id, p.In
+
+		_ = v.goIO(func() {
+			buf := make([]byte, 4096)
+
+			for {
+				n, err := in.Read(buf)
+				if n > 0 {
+					_ = v.Receive(id, buf[:n])
+				}
+
+				if err != nil {
+					return
+				}
+			}
+		})
+	}
+
+	for q := range v.kick {
+		_ = v.IO(q)
+	}
+}
+
+// Close makes IOThreadEntry return, and Receive fail from now on. The
+// inputs of the ports, which are the caller's to close, are no longer
+// fed to the guest. The guest must not notify the device anymore.
+func (v *Console) Close() error {
+	close(v.kick)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.closed = true
+	v.cond.Broadcast()
+
+	return nil
+}
+
+// IO handles a notification of the queue q.
+func (v *Console) IO(sel uint16) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	q := int(sel)
+	used := false
+
+	switch {
+	case q >= len(v.VirtQueue):
+		return ErrInvalidSel
+	case q == consoleCtrlRx:
+		used = v.flushCtrl()
+	case q == consoleCtrlTx:
+		for {
+			b, ok := v.pop(consoleCtrlTx)
+			if !ok {
+				break
+			}
+
+			used = true
+
+			v.control(b)
+		}
+
+		used = v.flushCtrl() || used
+	case q%2 == 0:
+		// The guest gave buffers for the input of a port.
+		id := (q - 2) / 2
+		if q == 0 {
+			id = 0
+		}
+
+		used = v.fillRx(id)
+	default:
+		id := (q - 3) / 2
+		if q == 1 {
+			id = 0
+		}
+
+		for {
+			b, ok := v.pop(q)
+			if !ok {
+				break
+			}
+
+			used = true
+
+			if out := v.ports[id].Out; out != nil {
+				_, _ = out.Write(b)
+			}
+		}
+	}
+
+	err := v.err
+	v.err = nil
+
+	if used {
+		if e := v.inject(); e != nil {
+			return e
+		}
+	}
+
+	return err
+}
+
+// Receive queues b as input of the port id and passes it to the guest
+// once it is ready for it. It blocks while MaxConsolePending bytes
+// wait for the guest.
+func (v *Console) Receive(id int, b []byte) error {
+	if id < 0 || id >= len(v.ports) {
+		return ErrInvalidPort
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	p := &v.ports[id]
+
+	for !v.closed && len(p.pending) >= MaxConsolePending {
+		v.cond.Wait()
+	}
+
+	if v.closed {
+		return ErrConsoleClosed
+	}
+
+	p.pending = append(p.pending, b...)
+
+	if !v.fillRx(id) {
+		return nil
+	}
+
+	return v.inject()
+}
+
+func (v *Console) inject() error {
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioIRQ(v.irq)
+}
+
+// control handles a control message of the guest.
+func (v *Console) control(b []byte) {
+	var c consoleControl
+
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &c); err != nil {
+		return
+	}
+
+	switch c.Event {
+	case consoleDeviceReady:
+		if c.Value != 1 {
+			return
+		}
+
+		for id := range v.ports {
+			v.sendCtrl(id, consoleDeviceAdd, 1, nil)
+		}
+	case consolePortReady:
+		if c.Value != 1 || int(c.ID) >= len(v.ports) {
+			return
+		}
+
+		p := v.ports[c.ID]
+
+		if p.Console {
+			v.sendCtrl(int(c.ID), consoleConsolePort, 1, nil)
+		}
+
+		if p.Name != "" {
+			v.sendCtrl(int(c.ID), consolePortName, 1, []byte(p.Name))
+		}
+
+		// The host side of a port is always connected.
+		v.sendCtrl(int(c.ID), consolePortOpen, 1, nil)
+	case consolePortOpen:
+		if int(c.ID) >= len(v.ports) {
+			return
+		}
+
+		v.ports[c.ID].guestOpen = c.Value == 1
+		v.fillRx(int(c.ID))
+	}
+}
+
+func (v *Console) sendCtrl(id int, event, value uint16, data []byte) {
+	buf := new(bytes.Buffer)
+
+	_ = binary.Write(buf, binary.LittleEndian, consoleControl{ID: uint32(id), Event: event, Value: value})
+	buf.Write(data)
+
+	v.ctrl = append(v.ctrl, buf.Bytes())
+}
+
+// flushCtrl passes the queued control messages to the guest, one per
+// buffer, and tells whether any was.
+func (v *Console) flushCtrl() bool {
+	used := false
+
+	for len(v.ctrl) > 0 {
+		if _, ok := v.push(consoleCtrlRx, v.ctrl[0]); !ok {
+			break
+		}
+
+		v.ctrl = v.ctrl[1:]
+		used = true
+	}
+
+	return used
+}
+
+// fillRx passes the pending input of the port id to the guest as far
+// as its buffers allow, and tells whether any was.
+func (v *Console) fillRx(id int) bool {
+	p := &v.ports[id]
+	if !p.Console && !p.guestOpen {
+		return false
+	}
+
+	used := false
+
+	for len(p.pending) > 0 {
+		n, ok := v.push(rxQueue(id), p.pending)
+		if !ok {
+			break
+		}
+
+		p.pending = p.pending[n:]
+		used = true
+	}
+
+	if used {
+		v.cond.Broadcast()
+	}
+
+	return used
+}
+
+func (v *Console) pop(q int) ([]byte, bool) {
+	if v.VirtQueue[q] == nil {
+		return nil, false
+	}
+
+	b, ok, err := pop(v.VirtQueue[q], &v.LastAvailIdx[q])
+	v.fail(err)
+
+	return b, ok
+}
+
+func (v *Console) push(q int, b []byte) (int, bool) {
+	if v.VirtQueue[q] == nil {
+		return 0, false
+	}
+
+	n, ok, err := push(v.VirtQueue[q], &v.LastAvailIdx[q], b)
+	v.fail(err)
+
+	return n, ok
+}
+
+// fail keeps err for IO to return, unless an error is kept already.
+func (v *Console) fail(err error) {
+	if v.err == nil {
+		v.err = err
+	}
+}
+
+// NewConsole creates a virtio console device with the given ports,
+// whose registers are mapped at the IO port ioport.
+func NewConsole(ioport uint64, irq uint8, irqInjector IRQInjector, ports []ConsolePort,
+	mem *memory.GuestMemory,
+) (*Console, error) {
+	if len(ports) == 0 || len(ports) > MaxConsolePorts {
+		return nil, ErrInvalidPort
+	}
+
+	nQueues := 2 * (len(ports) + 1)
+
+	res := &Console{
+		Hdr: consoleHdr{
+			commonHeader: commonHeader{
+				hostFeatures: ringFIndirectDesc | consoleFeatureMultiport,
+				queueNUM:     QueueSize,
+				isr:          0x0,
+			},
+			consoleHeader: consoleHeader{
+				maxNrPorts: uint32(len(ports)),
+			},
+		},
+		ioport:       ioport,
+		irq:          irq,
+		IRQInjector:  irqInjector,
+		kick:         make(chan uint16),
+		Mem:          mem,
+		VirtQueue:    make([]*VirtQueue, nQueues),
+		LastAvailIdx: make([]uint16, nQueues),
+	}
+
+	res.cond = sync.NewCond(&res.mu)
+
+	for _, p := range ports {
+		res.ports = append(res.ports, consolePort{ConsolePort: p})
+	}
+
+	return res, nil
+}
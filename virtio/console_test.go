@@ -0,0 +1,183 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func ctrl(id uint32, event, value uint16, name string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, id)
+	b = binary.LittleEndian.AppendUint16(b, event)
+	b = binary.LittleEndian.AppendUint16(b, value)
+
+	return append(b, name...)
+}
+
+func TestConsoleGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v, err := virtio.NewConsole(virtio.ConsoleIOPortStart, 9, &mockInjector{},
+		[]virtio.ConsolePort{{Console: true}, {Name: "agent"}}, guestMem(t, nil))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if actual := v.GetDeviceHeader().DeviceID; actual != 0x1003 {
+		t.Fatalf("expected: %v, actual: %v", 0x1003, actual)
+	}
+
+	// VIRTIO_CONSOLE_F_MULTIPORT, VIRTIO_RING_F_INDIRECT_DESC and
+	// max_nr_ports
+	actual := make([]byte, 4)
+	_ = v.Read(virtio.ConsoleIOPortStart, actual)
+
+	if !bytes.Equal(actual, []byte{0x02, 0, 0, 0x10}) {
+		t.Fatalf("features: expected multiport, actual: %v", actual)
+	}
+
+	_ = v.Read(virtio.ConsoleIOPortStart+24, actual)
+
+	if !bytes.Equal(actual, []byte{2, 0, 0, 0}) {
+		t.Fatalf("max_nr_ports: expected 2, actual: %v", actual)
+	}
+
+	// The BAR ends far past the config, which reads as zero there.
+	actual = []byte{1, 2, 3, 4}
+	if err := v.Read(virtio.ConsoleIOPortStart+virtio.ConsoleIOPortSize-4, actual); err != nil {
+		t.Fatalf("past the config: err: %v", err)
+	}
+
+	if !bytes.Equal(actual, make([]byte, 4)) {
+		t.Fatalf("past the config: expected zeros, actual: %v", actual)
+	}
+
+	if _, err := virtio.NewConsole(virtio.ConsoleIOPortStart, 9, &mockInjector{}, nil, guestMem(t, nil)); err == nil {
+		t.Fatal("expected an error without ports")
+	}
+}
+
+func TestConsolePorts(t *testing.T) {
+	t.Parallel()
+
+	var hvc, agent bytes.Buffer
+
+	mem := make([]byte, 0x100000)
+	irq := &mockInjector{}
+
+	v, err := virtio.NewConsole(virtio.ConsoleIOPortStart, 9, irq,
+		[]virtio.ConsolePort{{Console: true, Out: &hvc}, {Name: "agent", Out: &agent}}, guestMem(t, mem))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	q := make([]*guestQueue, 6)
+	for i := range q {
+		q[i] = newGuestQueue(t, v, virtio.ConsoleIOPortStart, mem, uint16(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q[2].add(make([]byte, 64), true)
+	}
+
+	io := func(sel uint16) {
+		t.Helper()
+
+		if err := v.IO(sel); err != nil {
+			t.Fatalf("IO(%d): %v", sel, err)
+		}
+	}
+
+	// The guest is ready, and gets both ports.
+	q[3].add(ctrl(0, 0, 1, ""), false)
+	io(3)
+
+	added := q[2].take()
+	if len(added) != 2 {
+		t.Fatalf("DEVICE_ADD: got %v, want one per port", added)
+	}
+
+	for i, m := range added {
+		if want := ctrl(uint32(i), 1, 1, ""); !bytes.Equal(m, want) {
+			t.Errorf("DEVICE_ADD: got %v, want %v", m, want)
+		}
+	}
+
+	q[3].add(ctrl(0, 3, 1, ""), false)
+	q[3].add(ctrl(1, 3, 1, ""), false)
+	io(3)
+
+	want := [][]byte{
+		ctrl(0, 4, 1, ""),      // CONSOLE_PORT
+		ctrl(0, 6, 1, ""),      // PORT_OPEN
+		ctrl(1, 7, 1, "agent"), // PORT_NAME
+		ctrl(1, 6, 1, ""),      // PORT_OPEN
+	}
+
+	if got := q[2].take(); len(got) != len(want) {
+		t.Errorf("after PORT_READY: got %v, want %v", got, want)
+	} else {
+		for i := range got {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Errorf("after PORT_READY: got %v, want %v", got[i], want[i])
+			}
+		}
+	}
+
+	if !irq.called {
+		t.Errorf("irqInjected = false")
+	}
+
+	// Output of each port goes to its own writer.
+	q[1].add([]byte("hvc0"), false)
+	io(1)
+	q[5].add([]byte("vport"), false)
+	io(5)
+
+	if hvc.String() != "hvc0" || agent.String() != "vport" {
+		t.Errorf("output: got %q and %q, want %q and %q", hvc.String(), agent.String(), "hvc0", "vport")
+	}
+
+	// The input of a port is held until the guest opens it.
+	if err := v.Receive(1, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	q[4].add(make([]byte, 16), true)
+	io(4)
+
+	if got := q[4].take(); len(got) != 0 {
+		t.Errorf("input before PORT_OPEN: got %q", got)
+	}
+
+	q[3].add(ctrl(1, 6, 1, ""), false)
+	io(3)
+
+	if got := q[4].take(); len(got) != 1 || string(got[0]) != "ping" {
+		t.Errorf("input: got %q, want %q", got, "ping")
+	}
+
+	// Console ports take input right away.
+	q[0].add(make([]byte, 2), true)
+
+	if err := v.Receive(0, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := q[0].take(); len(got) != 1 || string(got[0]) != "ab" {
+		t.Errorf("console input: got %q, want %q", got, "ab")
+	}
+
+	q[0].add(make([]byte, 2), true)
+	io(0)
+
+	if got := q[0].take(); len(got) != 1 || string(got[0]) != "c" {
+		t.Errorf("console input: got %q, want %q", got, "c")
+	}
+
+	if err := v.Receive(2, []byte("x")); err == nil {
+		t.Errorf("Receive on port 2: got nil, want err")
+	}
+}
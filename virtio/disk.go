@@ -0,0 +1,265 @@
+package virtio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var ErrReadOnly = errors.New("disk is read-only")
+
+// DiskMode tells how a disk uses its file.
+type DiskMode int
+
+const (
+	// DiskReadWrite writes the changes of the guest to the file.
+	DiskReadWrite DiskMode = iota
+
+	// DiskReadOnly fails the writes of the guest.
+	DiskReadOnly
+
+	// DiskSnapshot keeps the changes of the guest in an overlay, which
+	// is dropped with the process, so that the file is never written
+	// and can be shared.
+	DiskSnapshot
+)
+
+// overlayBlockSize is the unit in which blocks of the file are copied
+// to the overlay on their first write.
+const overlayBlockSize = 4096
+
+// disk is a file backing a virtio block device or a LUN of a virtio
+// SCSI controller.
+type disk struct {
+	file *os.File
+	mode DiskMode
+
+	// size is the size of the file in bytes.
+	size uint64
+
+	// overlay holds the blocks written in DiskSnapshot mode, whose
+	// indexes are in written. It is unlinked once created, so that it
+	// goes away with the process. mu keeps changes from racing with
+	// the copy of their blocks.
+	mu      sync.RWMutex
+	overlay *os.File
+	written map[int64]bool
+}
+
+func openDisk(path string, mode DiskMode) (*disk, error) {
+	flag := os.O_RDWR
+	if mode != DiskReadWrite {
+		flag = os.O_RDONLY
+	}
+
+	file, err := os.OpenFile(path, flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+
+		return nil, err
+	}
+
+	d := &disk{
+		file: file,
+		mode: mode,
+		size: uint64(fileInfo.Size()),
+	}
+
+	if mode == DiskSnapshot {
+		if d.overlay, err = os.CreateTemp("", "gokvm-snapshot-*"); err != nil {
+			file.Close()
+
+			return nil, err
+		}
+
+		os.Remove(d.overlay.Name())
+
+		// Blocks written in part, or punched, read as zero elsewhere.
+		if err := d.overlay.Truncate(int64(d.size)); err != nil {
+			d.Close()
+
+			return nil, err
+		}
+
+		d.written = map[int64]bool{}
+	}
+
+	return d, nil
+}
+
+// Close closes the file, and drops the overlay if any.
+func (d *disk) Close() error {
+	if d.overlay != nil {
+		d.overlay.Close()
+	}
+
+	return d.file.Close()
+}
+
+// ReadAt reads the disk, as changed by the guest.
+func (d *disk) ReadAt(b []byte, off int64) (int, error) {
+	if d.mode != DiskSnapshot {
+		return d.file.ReadAt(b, off)
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	n := 0
+
+	for n < len(b) {
+		pos := off + int64(n)
+
+		l := int(overlayBlockSize - pos%overlayBlockSize)
+		if l > len(b)-n {
+			l = len(b) - n
+		}
+
+		f := d.file
+		if d.written[pos/overlayBlockSize] {
+			f = d.overlay
+		}
+
+		m, err := f.ReadAt(b[n:n+l], pos)
+		n += m
+
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// WriteAt writes the disk, or its overlay in DiskSnapshot mode.
+func (d *disk) WriteAt(b []byte, off int64) (int, error) {
+	n := 0
+
+	err := d.change(off, int64(len(b)), func(f *os.File) error {
+		var err error
+
+		n, err = f.WriteAt(b, off)
+
+		return err
+	})
+
+	return n, err
+}
+
+// Sync flushes the writes to the file. Those kept in the overlay need
+// not outlive the process.
+func (d *disk) Sync() error {
+	if d.mode != DiskReadWrite {
+		return nil
+	}
+
+	return d.file.Sync()
+}
+
+// punchHole deallocates l bytes from off, which read as zero afterwards.
+func (d *disk) punchHole(off, l int64) error {
+	return d.change(off, l, func(f *os.File) error {
+		return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, l)
+	})
+}
+
+// zeroRange makes l bytes from off read as zero, keeping them allocated.
+// File systems without FALLOC_FL_ZERO_RANGE get zeros written instead.
+func (d *disk) zeroRange(off, l int64) error {
+	return d.change(off, l, func(f *os.File) error {
+		err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_ZERO_RANGE|unix.FALLOC_FL_KEEP_SIZE, off, l)
+		if !errors.Is(err, unix.EOPNOTSUPP) {
+			return err
+		}
+
+		zeros := make([]byte, 1<<16)
+
+		for pos, end := off, off+l; pos < end; pos += int64(len(zeros)) {
+			n := int64(len(zeros))
+			if n > end-pos {
+				n = end - pos
+			}
+
+			if _, err := f.WriteAt(zeros[:n], pos); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// change calls f to change l bytes from off in the file, or in the
+// overlay in DiskSnapshot mode.
+func (d *disk) change(off, l int64, f func(*os.File) error) error {
+	switch d.mode {
+	case DiskReadOnly:
+		return ErrReadOnly
+	case DiskSnapshot:
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		whole, err := d.copyUp(off, l)
+		if err != nil {
+			return err
+		}
+
+		if err := f(d.overlay); err != nil {
+			return err
+		}
+
+		// The blocks changed as a whole are in the overlay only now.
+		for _, blk := range whole {
+			d.written[blk] = true
+		}
+
+		return nil
+	default:
+		return f(d.file)
+	}
+}
+
+// copyUp moves to the overlay the blocks from off to off+l which are
+// not there yet. Only those changed in part need to be copied, and the
+// others are returned for the caller to mark once it changed them.
+func (d *disk) copyUp(off, l int64) ([]int64, error) {
+	var whole []int64
+
+	buf := make([]byte, overlayBlockSize)
+
+	for blk := off / overlayBlockSize; blk*overlayBlockSize < off+l; blk++ {
+		start := blk * overlayBlockSize
+
+		if d.written[blk] {
+			continue
+		}
+
+		if off <= start && start+overlayBlockSize <= off+l {
+			whole = append(whole, blk)
+
+			continue
+		}
+
+		// The last block may be short.
+		n, err := d.file.ReadAt(buf, start)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		if _, err := d.overlay.WriteAt(buf[:n], start); err != nil {
+			return nil, err
+		}
+
+		d.written[blk] = true
+	}
+
+	return whole, nil
+}
@@ -0,0 +1,532 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+const (
+	MemIOPortStart = 0x6a00
+	MemIOPortSize  = 0x100
+
+	// MemBlockSize is the unit in which the guest plugs and unplugs
+	// memory, the memory block size of x86 Linux. Each plugged block
+	// takes a KVM memory slot.
+	MemBlockSize = 128 << 20
+)
+
+var (
+	// ErrInvalidMemRegion indicates a hotpluggable region which is empty
+	// or not made of whole blocks.
+	ErrInvalidMemRegion = fmt.Errorf("virtio-mem region must be a non-zero multiple of %d MiB", MemBlockSize>>20)
+
+	// ErrInvalidMemSize indicates a requested size which is not made of
+	// whole blocks or exceeds the region.
+	ErrInvalidMemSize = errors.New("virtio-mem size must be a multiple of the block size within the region")
+)
+
+// Features offered by the device.
+//
+// refs https://github.com/torvalds/linux/blob/v6.1/include/uapi/linux/virtio_mem.h
+const (
+	// memFUnpluggedInaccessible tells the guest not to touch unplugged
+	// memory, which is not mapped.
+	memFUnpluggedInaccessible = 1 << 1
+)
+
+// Types of the requests of the guest.
+const (
+	memReqPlug = iota
+	memReqUnplug
+	memReqUnplugAll
+	memReqState
+)
+
+// Types of the responses of the device.
+const (
+	memRespAck = iota
+	memRespNack
+	_ // busy
+	memRespError
+)
+
+// States of a range of blocks, in the response to memReqState.
+const (
+	memStatePlugged = iota
+	memStateUnplugged
+	memStateMixed
+)
+
+// memReqSize is the size of struct virtio_mem_req, and memRespSize the
+// one of struct virtio_mem_resp.
+const (
+	memReqSize  = 24
+	memRespSize = 10
+)
+
+// MemPlugger maps the regions a virtio-mem device plugs into the guest,
+// and unmaps the ones it unplugs.
+type MemPlugger interface {
+	PlugMem(r memory.Region) error
+	UnplugMem(r memory.Region) error
+}
+
+type memHdr struct {
+	commonHeader commonHeader
+	memHeader    memHeader
+}
+
+func (h memHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type memHeader struct {
+	blockSize        uint64
+	nodeID           uint16
+	_                [6]uint8
+	addr             uint64
+	regionSize       uint64
+	usableRegionSize uint64
+
+	// pluggedSize is how much the guest has plugged, and requestedSize
+	// how much the host asks it to.
+	pluggedSize   uint64
+	requestedSize uint64
+}
+
+// Mem is a virtio-mem device, which lets the guest plug and unplug the
+// blocks of a region of memory at runtime, as the host asks it to by
+// Resize. The blocks are mapped into the guest by a MemPlugger, and
+// given back to the host with memory.Discard once unplugged, so that the
+// region must be mapped by memory.Alloc.
+type Mem struct {
+	mu sync.Mutex
+
+	Hdr memHdr
+
+	VirtQueue    [1]*VirtQueue
+	Mem          *memory.GuestMemory
+	LastAvailIdx [1]uint16
+
+	// region backs the hotpluggable memory on the host, and plugged
+	// tells which of its blocks are in the guest.
+	region  []byte
+	plugged []bool
+	plugger MemPlugger
+
+	kick chan interface{}
+
+	ioport      uint64
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *Mem) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1017,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 24, // Memory Device
+		Command:     1,  // Enable IO port
+		BAR: [6]uint32{
+			uint32(v.ioport) | 0x1,
+		},
+		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
+		InterruptPin: 1,
+		// https://www.webopedia.com/reference/irqnumbers/
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Mem) Read(port uint64, bytes []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	offset := int(port - v.ioport)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	// Past the end of the config reads as zero.
+	if offset > len(b) {
+		offset = len(b)
+	}
+
+	l := len(bytes)
+	for i := copy(bytes[:l], b[offset:]); i < l; i++ {
+		bytes[i] = 0
+	}
+
+	// Reading the ISR acknowledges the interrupt.
+	if offset <= 19 && 19 < offset+l {
+		v.Hdr.commonHeader.isr = 0x0
+	}
+
+	return nil
+}
+
+func (v *Mem) Write(port uint64, bytes []byte) error {
+	v.mu.Lock()
+
+	offset := int(port - v.ioport)
+
+	switch offset {
+	case 8:
+		sel := v.Hdr.commonHeader.queueSEL
+		if int(sel) >= len(v.VirtQueue) {
+			v.mu.Unlock()
+
+			return ErrInvalidSel
+		}
+
+		// Queue PFN is aligned to page (4096 bytes)
+		vq, err := newVirtQueue(v.Mem, pci.BytesToNum(bytes), v.Hdr.commonHeader.queueNUM)
+		if err != nil {
+			v.mu.Unlock()
+
+			return err
+		}
+
+		v.VirtQueue[sel] = vq
+		v.LastAvailIdx[sel] = 0
+	case 14:
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	case 16:
+		v.mu.Unlock()
+
+		v.kick <- true
+
+		return nil
+	default:
+	}
+
+	v.mu.Unlock()
+
+	return nil
+}
+
+// SetQueueSize sets the size of the queues, which the guest reads before
+// setting them up.
+func (v *Mem) SetQueueSize(size uint16) error {
+	if err := CheckQueueSize(size); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.Hdr.commonHeader.queueNUM = size
+
+	return nil
+}
+
+func (v *Mem) IOPort() uint64 {
+	return v.ioport
+}
+
+func (v *Mem) Size() uint64 {
+	return MemIOPortSize
+}
+
+func (v *Mem) IOThreadEntry() {
+	for range v.kick {
+		_ = v.IO()
+	}
+}
+
+// Close makes IOThreadEntry return. The guest must not notify the device
+// anymore. The region is left mapped, as the guest memory it backs may
+// still be in use.
+func (v *Mem) Close() error {
+	close(v.kick)
+
+	return nil
+}
+
+// IO serves the requests made available by the guest. A failure to map
+// or unmap a block is answered with an error and returned.
+func (v *Mem) IO() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	vq := v.VirtQueue[0]
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	var err error
+
+	used := false
+
+	for v.LastAvailIdx[0] != vq.availIdx() {
+		head := vq.availHead(v.LastAvailIdx[0])
+		n := 0
+
+		req, e := readChain(vq, head)
+		if e == nil {
+			var resp []byte
+
+			resp, e = v.serve(req)
+			if e != nil {
+				err = e
+			}
+
+			n, e = writeChain(vq, head, resp)
+		}
+
+		if e != nil {
+			err = e
+		}
+
+		complete(vq, &v.LastAvailIdx[0], head, uint32(n))
+
+		used = true
+	}
+
+	if used {
+		v.Hdr.commonHeader.isr |= 0x1
+
+		if e := v.IRQInjector.InjectVirtioIRQ(v.irq); e != nil {
+			return e
+		}
+	}
+
+	return err
+}
+
+// serve returns the response to the request req.
+func (v *Mem) serve(req []byte) ([]byte, error) {
+	resp := make([]byte, memRespSize)
+
+	if len(req) < memReqSize {
+		binary.LittleEndian.PutUint16(resp, memRespError)
+
+		return resp, nil
+	}
+
+	addr := binary.LittleEndian.Uint64(req[8:])
+	n := int(binary.LittleEndian.Uint16(req[16:]))
+
+	var (
+		typ uint16
+		err error
+	)
+
+	switch binary.LittleEndian.Uint16(req) {
+	case memReqPlug:
+		typ, err = v.plug(addr, n)
+	case memReqUnplug:
+		typ, err = v.unplug(addr, n)
+	case memReqUnplugAll:
+		typ, err = memRespAck, v.unplugRange(0, len(v.plugged))
+	case memReqState:
+		var state uint16
+
+		typ, state = v.state(addr, n)
+		binary.LittleEndian.PutUint16(resp[8:], state)
+	default:
+		typ = memRespError
+	}
+
+	if err != nil {
+		typ = memRespError
+	}
+
+	binary.LittleEndian.PutUint16(resp, typ)
+
+	return resp, err
+}
+
+// blocks returns the index of the first of the n blocks from addr, if
+// they are within the usable region.
+func (v *Mem) blocks(addr uint64, n int) (int, bool) {
+	h := &v.Hdr.memHeader
+
+	if n <= 0 || addr < h.addr || addr%MemBlockSize != 0 {
+		return 0, false
+	}
+
+	// Counting in blocks keeps a huge addr from wrapping around.
+	first := (addr - h.addr) / MemBlockSize
+	if first >= uint64(len(v.plugged)) || first+uint64(n) > h.usableRegionSize/MemBlockSize {
+		return 0, false
+	}
+
+	return int(first), true
+}
+
+// count returns how many of the n blocks from first are plugged.
+func (v *Mem) count(first, n int) int {
+	c := 0
+
+	for _, p := range v.plugged[first : first+n] {
+		if p {
+			c++
+		}
+	}
+
+	return c
+}
+
+// plug plugs the n unplugged blocks from addr, as long as the guest does
+// not exceed the requested size.
+func (v *Mem) plug(addr uint64, n int) (uint16, error) {
+	first, ok := v.blocks(addr, n)
+	if !ok || v.count(first, n) != 0 {
+		return memRespError, nil
+	}
+
+	h := &v.Hdr.memHeader
+
+	if h.pluggedSize+uint64(n)*MemBlockSize > h.requestedSize {
+		return memRespNack, nil
+	}
+
+	for i := first; i < first+n; i++ {
+		if err := v.plugger.PlugMem(v.block(i)); err != nil {
+			return memRespError, errors.Join(err, v.unplugRange(first, i-first))
+		}
+
+		v.plugged[i] = true
+		h.pluggedSize += MemBlockSize
+	}
+
+	return memRespAck, nil
+}
+
+// unplug unplugs the n plugged blocks from addr.
+func (v *Mem) unplug(addr uint64, n int) (uint16, error) {
+	first, ok := v.blocks(addr, n)
+	if !ok || v.count(first, n) != n {
+		return memRespError, nil
+	}
+
+	return memRespAck, v.unplugRange(first, n)
+}
+
+// unplugRange unplugs the plugged ones of the n blocks from first.
+func (v *Mem) unplugRange(first, n int) error {
+	for i := first; i < first+n; i++ {
+		if !v.plugged[i] {
+			continue
+		}
+
+		r := v.block(i)
+
+		if err := v.plugger.UnplugMem(r); err != nil {
+			return err
+		}
+
+		v.plugged[i] = false
+		v.Hdr.memHeader.pluggedSize -= MemBlockSize
+
+		if err := memory.Discard(r.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// state returns the state of the n blocks from addr.
+func (v *Mem) state(addr uint64, n int) (uint16, uint16) {
+	first, ok := v.blocks(addr, n)
+	if !ok {
+		return memRespError, 0
+	}
+
+	switch v.count(first, n) {
+	case n:
+		return memRespAck, memStatePlugged
+	case 0:
+		return memRespAck, memStateUnplugged
+	default:
+		return memRespAck, memStateMixed
+	}
+}
+
+// block returns the i-th block of the region.
+func (v *Mem) block(i int) memory.Region {
+	off := uint64(i) * MemBlockSize
+
+	return memory.Region{
+		GPA:  v.Hdr.memHeader.addr + off,
+		Data: v.region[off : off+MemBlockSize : off+MemBlockSize],
+	}
+}
+
+// Resize asks the guest to plug or unplug blocks until it has size bytes
+// of the region.
+func (v *Mem) Resize(size uint64) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if size%MemBlockSize != 0 || size > v.Hdr.memHeader.usableRegionSize {
+		return fmt.Errorf("%#x bytes: %w", size, ErrInvalidMemSize)
+	}
+
+	v.Hdr.memHeader.requestedSize = size
+	v.Hdr.commonHeader.isr |= 0x2
+
+	return v.IRQInjector.InjectVirtioIRQ(v.irq)
+}
+
+// Plugged returns how many bytes of the region the guest has plugged.
+func (v *Mem) Plugged() uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.Hdr.memHeader.pluggedSize
+}
+
+// NewMem creates a virtio-mem device whose registers are mapped at the
+// IO port ioport, for the hotpluggable region from the guest physical
+// address addr, backed by region on the host. Both must be made of
+// whole blocks of MemBlockSize.
+func NewMem(ioport uint64, irq uint8, irqInjector IRQInjector, plugger MemPlugger, addr uint64, region []byte,
+	mem *memory.GuestMemory,
+) (*Mem, error) {
+	if len(region) == 0 || len(region)%MemBlockSize != 0 || addr%MemBlockSize != 0 {
+		return nil, fmt.Errorf("%#x bytes at %#x: %w", len(region), addr, ErrInvalidMemRegion)
+	}
+
+	return &Mem{
+		Hdr: memHdr{
+			commonHeader: commonHeader{
+				hostFeatures: ringFIndirectDesc | memFUnpluggedInaccessible,
+				queueNUM:     QueueSize,
+				isr:          0x0,
+			},
+			memHeader: memHeader{
+				blockSize:        MemBlockSize,
+				addr:             addr,
+				regionSize:       uint64(len(region)),
+				usableRegionSize: uint64(len(region)),
+			},
+		},
+		region:       region,
+		plugged:      make([]bool, len(region)/MemBlockSize),
+		plugger:      plugger,
+		ioport:       ioport,
+		irq:          irq,
+		IRQInjector:  irqInjector,
+		kick:         make(chan interface{}),
+		Mem:          mem,
+		VirtQueue:    [1]*VirtQueue{},
+		LastAvailIdx: [1]uint16{},
+	}, nil
+}
@@ -0,0 +1,234 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// mockPlugger records the regions mapped into the guest by their
+// address. The guest writes to a block once plugged, which must be zero
+// by then.
+type mockPlugger struct {
+	plugged map[uint64]int
+}
+
+var errStaleBlock = errors.New("plugged block holds stale data")
+
+func (p *mockPlugger) PlugMem(r memory.Region) error {
+	if r.Data[0] != 0 {
+		return errStaleBlock
+	}
+
+	p.plugged[r.GPA] = len(r.Data)
+	r.Data[0] = 0xff
+
+	return nil
+}
+
+func (p *mockPlugger) UnplugMem(r memory.Region) error {
+	delete(p.plugged, r.GPA)
+
+	return nil
+}
+
+const memRegionAddr = 1 << 32
+
+func newMem(t *testing.T, mem []byte) (*virtio.Mem, *mockPlugger) {
+	t.Helper()
+
+	// Two blocks, mapped as the machine does, never touched unless
+	// plugged, and discarded once unplugged.
+	region, err := memory.Alloc(2*virtio.MemBlockSize, memory.Backing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = syscall.Munmap(region) })
+
+	p := &mockPlugger{plugged: map[uint64]int{}}
+
+	v, err := virtio.NewMem(virtio.MemIOPortStart, 9, &mockInjector{}, p, memRegionAddr, region, guestMem(t, mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return v, p
+}
+
+// memRequest sends a request of type typ for the n blocks from addr, and
+// returns the type of the response and the state it holds.
+func memRequest(t *testing.T, v *virtio.Mem, g *guestQueue, typ uint16, addr uint64, n uint16) (uint16, uint16) {
+	t.Helper()
+
+	req := make([]byte, 24)
+	binary.LittleEndian.PutUint16(req, typ)
+	binary.LittleEndian.PutUint64(req[8:], addr)
+	binary.LittleEndian.PutUint16(req[16:], n)
+
+	g.addChain(req, make([]byte, 10))
+
+	if err := v.IO(); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	resp := g.take()
+	if len(resp) != 1 || len(resp[0]) != 10 {
+		t.Fatalf("expected a response of 10 bytes, actual: %v", resp)
+	}
+
+	// The response follows the request in the memory.
+	b := g.mem[g.addr-10:]
+
+	return binary.LittleEndian.Uint16(b), binary.LittleEndian.Uint16(b[8:])
+}
+
+// memConfig returns the 64 bit field at off of the device config.
+func memConfig(t *testing.T, v *virtio.Mem, off uint64) uint64 {
+	t.Helper()
+
+	b := make([]byte, 8)
+	if err := v.Read(virtio.MemIOPortStart+20+off, b); err != nil {
+		t.Fatal(err)
+	}
+
+	return binary.LittleEndian.Uint64(b)
+}
+
+func TestMemGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v, _ := newMem(t, nil)
+
+	if h := v.GetDeviceHeader(); h.DeviceID != 0x1017 || h.SubsystemID != 24 {
+		t.Fatalf("expected: 0x1017 and 24, actual: %#x and %d", h.DeviceID, h.SubsystemID)
+	}
+
+	if bs := memConfig(t, v, 0); bs != virtio.MemBlockSize {
+		t.Fatalf("block size: expected %#x, actual: %#x", virtio.MemBlockSize, bs)
+	}
+
+	if addr, size := memConfig(t, v, 16), memConfig(t, v, 24); addr != memRegionAddr || size != 2*virtio.MemBlockSize {
+		t.Fatalf("region: expected %#x bytes at %#x, actual: %#x bytes at %#x", 2*virtio.MemBlockSize,
+			memRegionAddr, size, addr)
+	}
+
+	// The BAR ends far past the config, which reads as zero there.
+	past := []byte{1, 2, 3, 4}
+	if err := v.Read(virtio.MemIOPortStart+virtio.MemIOPortSize-4, past); err != nil {
+		t.Fatalf("past the config: err: %v", err)
+	}
+
+	if !bytes.Equal(past, make([]byte, 4)) {
+		t.Fatalf("past the config: expected zeros, actual: %v", past)
+	}
+
+	for _, size := range []int{0, virtio.MemBlockSize + 4096} {
+		if _, err := virtio.NewMem(virtio.MemIOPortStart, 9, &mockInjector{}, &mockPlugger{}, memRegionAddr,
+			make([]byte, size), guestMem(t, nil)); !errors.Is(err, virtio.ErrInvalidMemRegion) {
+			t.Errorf("%#x bytes: expected %v, actual: %v", size, virtio.ErrInvalidMemRegion, err)
+		}
+	}
+}
+
+func TestMemResize(t *testing.T) {
+	t.Parallel()
+
+	v, _ := newMem(t, nil)
+
+	if err := v.Resize(virtio.MemBlockSize); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if size := memConfig(t, v, 48); size != virtio.MemBlockSize {
+		t.Fatalf("requested size: expected %#x, actual: %#x", virtio.MemBlockSize, size)
+	}
+
+	isr := make([]byte, 1)
+	_ = v.Read(virtio.MemIOPortStart+19, isr)
+
+	if isr[0] != 0x2 {
+		t.Fatalf("isr: expected 0x2, actual: %#x", isr[0])
+	}
+
+	for _, size := range []uint64{4096, 3 * virtio.MemBlockSize} {
+		if err := v.Resize(size); !errors.Is(err, virtio.ErrInvalidMemSize) {
+			t.Errorf("%#x bytes: expected %v, actual: %v", size, virtio.ErrInvalidMemSize, err)
+		}
+	}
+}
+
+func TestMemPlug(t *testing.T) {
+	t.Parallel()
+
+	const (
+		plug = iota
+		unplug
+		unplugAll
+		state
+	)
+
+	const (
+		ack = iota
+		nack
+		_
+		fail
+	)
+
+	const (
+		plugged = iota
+		unplugged
+		mixed
+	)
+
+	mem := make([]byte, 0x100000)
+	v, p := newMem(t, mem)
+	g := newGuestQueue(t, v, virtio.MemIOPortStart, mem, 0)
+
+	if err := v.Resize(virtio.MemBlockSize); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	second := uint64(memRegionAddr + virtio.MemBlockSize)
+
+	for _, tt := range []struct {
+		name        string
+		typ         uint16
+		addr        uint64
+		n           uint16
+		resp, state uint16
+		plugged     int
+	}{
+		{name: "plug the first block", typ: plug, addr: memRegionAddr, n: 1, resp: ack, plugged: 1},
+		{name: "plug beyond the requested size", typ: plug, addr: second, n: 1, resp: nack, plugged: 1},
+		{name: "plug a plugged block", typ: plug, addr: memRegionAddr, n: 1, resp: fail, plugged: 1},
+		{name: "plug out of the region", typ: plug, addr: second + virtio.MemBlockSize, n: 1, resp: fail, plugged: 1},
+		{name: "plug unaligned", typ: plug, addr: second + 4096, n: 1, resp: fail, plugged: 1},
+		{name: "state wrapping around", typ: state, addr: 0xffff_ffff_f800_0000, n: 2, resp: fail, plugged: 1},
+		{name: "state of both", typ: state, addr: memRegionAddr, n: 2, resp: ack, state: mixed, plugged: 1},
+		{name: "state of the first", typ: state, addr: memRegionAddr, n: 1, resp: ack, state: plugged, plugged: 1},
+		{name: "unplug an unplugged block", typ: unplug, addr: second, n: 1, resp: fail, plugged: 1},
+		{name: "unplug the first block", typ: unplug, addr: memRegionAddr, n: 1, resp: ack},
+		{name: "state after unplug", typ: state, addr: memRegionAddr, n: 2, resp: ack, state: unplugged},
+		{name: "plug the first block again", typ: plug, addr: memRegionAddr, n: 1, resp: ack, plugged: 1},
+		{name: "unplug all", typ: unplugAll, resp: ack},
+	} {
+		resp, st := memRequest(t, v, g, tt.typ, tt.addr, tt.n)
+		if resp != tt.resp || st != tt.state {
+			t.Errorf("%s: expected response %d state %d, actual: %d and %d", tt.name, tt.resp, tt.state, resp, st)
+		}
+
+		if size := memConfig(t, v, 40); size != uint64(tt.plugged)*virtio.MemBlockSize || v.Plugged() != size {
+			t.Errorf("%s: expected %d blocks plugged, actual: %#x bytes", tt.name, tt.plugged, size)
+		}
+
+		if len(p.plugged) != tt.plugged {
+			t.Errorf("%s: expected %d blocks mapped, actual: %v", tt.name, tt.plugged, p.plugged)
+		}
+	}
+}
@@ -6,11 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
-	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/memory"
 	"github.com/bobuhiro11/gokvm/pci"
 )
 
@@ -28,16 +29,19 @@ const (
 	NetIOPortSize  = 0x100
 )
 
+// VIRTIO_NET_F_MAC tells the guest to use the MAC in netHeader.
+const netFeatureMAC = 1 << 5
+
 type netHdr struct {
 	commonHeader commonHeader
-	_            netHeader
+	netHeader    netHeader
 }
 
 type Net struct {
 	Hdr netHdr
 
 	VirtQueue    [2]*VirtQueue
-	Mem          []byte
+	Mem          *memory.GuestMemory
 	LastAvailIdx [2]uint16
 
 	tap io.ReadWriter
@@ -45,6 +49,7 @@ type Net struct {
 	txKick chan interface{}
 	rxKick chan os.Signal
 
+	ioport      uint64
 	irq         uint8
 	IRQInjector IRQInjector
 }
@@ -60,9 +65,9 @@ func (h netHdr) Bytes() ([]byte, error) {
 }
 
 type netHeader struct {
-	_ [6]uint8 // mac
-	_ uint16   // netStatus
-	_ uint16   // maxVirtQueuePairs
+	mac [6]uint8
+	_   uint16 // netStatus
+	_   uint16 // maxVirtQueuePairs
 }
 
 func (v Net) GetDeviceHeader() pci.DeviceHeader {
@@ -73,7 +78,7 @@ func (v Net) GetDeviceHeader() pci.DeviceHeader {
 		SubsystemID: 1, // Network Card
 		Command:     1, // Enable IO port
 		BAR: [6]uint32{
-			NetIOPortStart | 0x1,
+			uint32(v.ioport) | 0x1,
 		},
 		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
 		InterruptPin: 1,
@@ -83,15 +88,22 @@ func (v Net) GetDeviceHeader() pci.DeviceHeader {
 }
 
 func (v Net) Read(port uint64, bytes []byte) error {
-	offset := int(port - NetIOPortStart)
+	offset := int(port - v.ioport)
 
 	b, err := v.Hdr.Bytes()
 	if err != nil {
 		return err
 	}
 
+	// Past the end of the config reads as zero.
+	if offset > len(b) {
+		offset = len(b)
+	}
+
 	l := len(bytes)
-	copy(bytes[:l], b[offset:offset+l])
+	for i := copy(bytes[:l], b[offset:]); i < l; i++ {
+		bytes[i] = 0
+	}
 
 	return nil
 }
@@ -123,57 +135,20 @@ func (v *Net) Rx() error {
 		return ErrVQNotInit
 	}
 
-	availRing := &v.VirtQueue[sel].AvailRing
-	usedRing := &v.VirtQueue[sel].UsedRing
-
-	if v.LastAvailIdx[sel] == availRing.Idx {
+	// Without VIRTIO_NET_F_MRG_RXBUF, each chain is big enough for a
+	// packet.
+	_, ok, err := push(v.VirtQueue[sel], &v.LastAvailIdx[sel], packet)
+	if !ok {
 		return ErrNoRxBuf
 	}
 
-	const NONE = uint16(256)
-	headDescID := NONE
-	prevDescID := NONE
-
-	for len(packet) > 0 {
-		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
-
-		// head of vring chain
-		if headDescID == NONE {
-			headDescID = descID
-
-			// This structure is holding both the index of the descriptor chain and the
-			// number of bytes that were written to the memory as part of serving the request.
-			usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(headDescID)
-			usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
-		}
-
-		desc := &v.VirtQueue[sel].DescTable[descID]
-		l := uint32(len(packet))
-
-		if l > desc.Len {
-			l = desc.Len
-		}
-
-		copy(v.Mem[desc.Addr:desc.Addr+uint64(l)], packet[:l])
-		packet = packet[l:]
-		desc.Len = l
-
-		usedRing.Ring[usedRing.Idx%QueueSize].Len += l
-
-		if prevDescID != NONE {
-			v.VirtQueue[sel].DescTable[prevDescID].Flags |= 0x1
-			v.VirtQueue[sel].DescTable[prevDescID].Next = descID
-		}
+	v.Hdr.commonHeader.isr = 0x1
 
-		prevDescID = descID
-		v.LastAvailIdx[sel]++
+	if e := v.IRQInjector.InjectVirtioIRQ(v.irq); e != nil {
+		return e
 	}
 
-	usedRing.Idx++
-
-	v.Hdr.commonHeader.isr = 0x1
-
-	return v.IRQInjector.InjectVirtioNetIRQ()
+	return err
 }
 
 func (v *Net) TxThreadEntry() {
@@ -183,68 +158,79 @@ func (v *Net) TxThreadEntry() {
 	}
 }
 
+// Close makes RxThreadEntry and TxThreadEntry return, and closes the tap
+// if it is an io.Closer. The guest must not notify the device anymore.
+func (v *Net) Close() error {
+	signal.Stop(v.rxKick)
+	close(v.rxKick)
+	close(v.txKick)
+
+	if c, ok := v.tap.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
 func (v *Net) Tx() error {
 	sel := v.Hdr.commonHeader.queueSEL
-	if sel == 0 {
+	if sel == 0 || int(sel) >= len(v.VirtQueue) {
 		return ErrInvalidSel
 	}
 
-	availRing := &v.VirtQueue[sel].AvailRing
-	usedRing := &v.VirtQueue[sel].UsedRing
+	vq := v.VirtQueue[sel]
+	if vq == nil {
+		return ErrVQNotInit
+	}
 
-	if v.LastAvailIdx[sel] == availRing.Idx {
+	if v.LastAvailIdx[sel] == vq.availIdx() {
 		return ErrNoTxPacket
 	}
 
-	for v.LastAvailIdx[sel] != availRing.Idx {
-		buf := []byte{}
-		descID := availRing.Ring[v.LastAvailIdx[sel]%QueueSize]
-
-		// This structure is holding both the index of the descriptor chain and the
-		// number of bytes that were written to the memory as part of serving the request.
-		usedRing.Ring[usedRing.Idx%QueueSize].Idx = uint32(descID)
-		usedRing.Ring[usedRing.Idx%QueueSize].Len = 0
-
-		for {
-			desc := v.VirtQueue[sel].DescTable[descID]
+	for v.LastAvailIdx[sel] != vq.availIdx() {
+		head := vq.availHead(v.LastAvailIdx[sel])
 
-			b := make([]byte, desc.Len)
-			copy(b, v.Mem[desc.Addr:desc.Addr+uint64(desc.Len)])
-			buf = append(buf, b...)
+		buf, err := readChain(vq, head)
+		if err != nil {
+			complete(vq, &v.LastAvailIdx[sel], head, 0)
 
-			usedRing.Ring[usedRing.Idx%QueueSize].Len += desc.Len
-
-			if desc.Flags&0x1 != 0 {
-				descID = desc.Next
-			} else {
-				break
-			}
+			return err
 		}
 
 		// Skip struct virtio_net_hdr
 		// refs https://github.com/torvalds/linux/blob/38f80f42/include/uapi/linux/virtio_net.h#L178-L191
-		buf = buf[10:]
-
-		if _, err := v.tap.Write(buf); err != nil {
-			return err
+		if len(buf) >= 10 {
+			if _, err := v.tap.Write(buf[10:]); err != nil {
+				return err
+			}
 		}
-		usedRing.Idx++
-		v.LastAvailIdx[sel]++
+
+		complete(vq, &v.LastAvailIdx[sel], head, 0)
 	}
 
 	v.Hdr.commonHeader.isr = 0x1
 
-	return v.IRQInjector.InjectVirtioNetIRQ()
+	return v.IRQInjector.InjectVirtioIRQ(v.irq)
 }
 
 func (v *Net) Write(port uint64, bytes []byte) error {
-	offset := int(port - NetIOPortStart)
+	offset := int(port - v.ioport)
 
 	switch offset {
 	case 8:
+		sel := v.Hdr.commonHeader.queueSEL
+		if int(sel) >= len(v.VirtQueue) {
+			return ErrInvalidSel
+		}
+
 		// Queue PFN is aligned to page (4096 bytes)
-		physAddr := uint32(pci.BytesToNum(bytes) * 4096)
-		v.VirtQueue[v.Hdr.commonHeader.queueSEL] = (*VirtQueue)(unsafe.Pointer(&v.Mem[physAddr]))
+		vq, err := newVirtQueue(v.Mem, pci.BytesToNum(bytes), v.Hdr.commonHeader.queueNUM)
+		if err != nil {
+			return err
+		}
+
+		v.VirtQueue[sel] = vq
+		v.LastAvailIdx[sel] = 0
 	case 14:
 		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
 	case 16:
@@ -258,22 +244,40 @@ func (v *Net) Write(port uint64, bytes []byte) error {
 	return nil
 }
 
+// SetQueueSize sets the size of the queues, which the guest reads before
+// setting them up.
+func (v *Net) SetQueueSize(size uint16) error {
+	if err := CheckQueueSize(size); err != nil {
+		return err
+	}
+
+	v.Hdr.commonHeader.queueNUM = size
+
+	return nil
+}
+
 func (v Net) IOPort() uint64 {
-	return NetIOPortStart
+	return v.ioport
 }
 
 func (v Net) Size() uint64 {
 	return NetIOPortSize
 }
 
-func NewNet(irq uint8, irqInjector IRQInjector, tap io.ReadWriter, mem []byte) *Net {
+// NewNet creates a virtio net device connected to tap, whose registers are
+// mapped at the IO port ioport. If mac is nil, the guest picks a random MAC.
+func NewNet(ioport uint64, irq uint8, irqInjector IRQInjector, tap io.ReadWriter,
+	mac net.HardwareAddr, mem *memory.GuestMemory,
+) *Net {
 	res := &Net{
 		Hdr: netHdr{
 			commonHeader: commonHeader{
-				queueNUM: QueueSize,
-				isr:      0x0,
+				hostFeatures: ringFIndirectDesc,
+				queueNUM:     QueueSize,
+				isr:          0x0,
 			},
 		},
+		ioport:       ioport,
 		irq:          irq,
 		IRQInjector:  irqInjector,
 		txKick:       make(chan interface{}),
@@ -284,6 +288,11 @@ func NewNet(irq uint8, irqInjector IRQInjector, tap io.ReadWriter, mem []byte) *
 		LastAvailIdx: [2]uint16{0, 0},
 	}
 
+	if len(mac) == len(res.Hdr.netHeader.mac) {
+		res.Hdr.commonHeader.hostFeatures |= netFeatureMAC
+		copy(res.Hdr.netHeader.mac[:], mac)
+	}
+
 	signal.Notify(res.rxKick, syscall.SIGIO)
 
 	return res
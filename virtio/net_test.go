@@ -2,9 +2,11 @@ package virtio_test
 
 import (
 	"bytes"
+	"errors"
+	"net"
 	"testing"
-	"unsafe"
 
+	"github.com/bobuhiro11/gokvm/memory"
 	"github.com/bobuhiro11/gokvm/virtio"
 )
 
@@ -12,13 +14,7 @@ type mockInjector struct {
 	called bool
 }
 
-func (m *mockInjector) InjectVirtioNetIRQ() error {
-	m.called = true
-
-	return nil
-}
-
-func (m *mockInjector) InjectVirtioBlkIRQ() error {
+func (m *mockInjector) InjectVirtioIRQ(irq uint8) error {
 	m.called = true
 
 	return nil
@@ -27,20 +23,31 @@ func (m *mockInjector) InjectVirtioBlkIRQ() error {
 func TestNetGetDeviceHeader(t *testing.T) {
 	t.Parallel()
 
-	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), []byte{})
+	v := virtio.NewNet(virtio.NetIOPortStart, 9, &mockInjector{}, bytes.NewBuffer([]byte{}), nil, guestMem(t, nil))
 	expected := uint16(0x1000)
 	actual := v.GetDeviceHeader().DeviceID
 
 	if actual != expected {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
 	}
+
+	// The BAR ends far past the config, which reads as zero there.
+	past := []byte{1, 2, 3, 4}
+	if err := v.Read(virtio.NetIOPortStart+virtio.NetIOPortSize-4, past); err != nil {
+		t.Fatalf("past the config: err: %v", err)
+	}
+
+	if !bytes.Equal(past, make([]byte, 4)) {
+		t.Fatalf("past the config: expected zeros, actual: %v", past)
+	}
 }
 
 func TestNetGetIORange(t *testing.T) {
 	t.Parallel()
 
 	expected := uint64(virtio.NetIOPortSize)
-	actual := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), []byte{}).Size()
+	actual := virtio.NewNet(virtio.NetIOPortStart, 9, &mockInjector{}, bytes.NewBuffer([]byte{}), nil,
+		guestMem(t, nil)).Size()
 
 	if actual != expected {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
@@ -51,7 +58,7 @@ func TestNetIOInHandler(t *testing.T) {
 	t.Parallel()
 
 	expected := []byte{0x20, 0x00}
-	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), []byte{})
+	v := virtio.NewNet(virtio.NetIOPortStart, 9, &mockInjector{}, bytes.NewBuffer([]byte{}), nil, guestMem(t, nil))
 	actual := make([]byte, 2)
 	_ = v.Read(virtio.NetIOPortStart+12, actual)
 
@@ -64,29 +71,27 @@ func TestSetQueuePhysAddr(t *testing.T) {
 	t.Parallel()
 
 	mem := make([]byte, 0x1000000)
-	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer([]byte{}), mem)
-	base := uint32(uintptr(unsafe.Pointer(&(v.Mem[0]))))
+	v := virtio.NewNet(virtio.NetIOPortStart, 9, &mockInjector{}, bytes.NewBuffer([]byte{}), nil, guestMem(t, mem))
 
-	expected := [2]uint32{
-		base + 0x00345000,
-		base + 0x0089a000,
-	}
+	_ = v.Write(virtio.NetIOPortStart+14, []byte{0x0, 0x0}) // Select Queue #0
 
-	_ = v.Write(virtio.NetIOPortStart+14, []byte{0x0, 0x0})              // Select Queue #0
-	_ = v.Write(virtio.NetIOPortStart+8, []byte{0x45, 0x03, 0x00, 0x00}) // Set Phys Address
+	if err := v.Write(virtio.NetIOPortStart+8, []byte{0x45, 0x03, 0x00, 0x00}); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
 
-	_ = v.Write(virtio.NetIOPortStart+14, []byte{0x1, 0x0})              // Select Queue #1
-	_ = v.Write(virtio.NetIOPortStart+8, []byte{0x9a, 0x08, 0x00, 0x00}) // Set Phys Address
+	_ = v.Write(virtio.NetIOPortStart+14, []byte{0x1, 0x0}) // Select Queue #1
 
-	actual := [2]uint32{
-		uint32(uintptr(unsafe.Pointer(v.VirtQueue[0]))),
-		uint32(uintptr(unsafe.Pointer(v.VirtQueue[1]))),
+	// The queue must fit in the memory.
+	if err := v.Write(virtio.NetIOPortStart+8, []byte{0xff, 0x0f, 0x00, 0x00}); !errors.Is(err,
+		virtio.ErrQueueOutOfMemory) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrQueueOutOfMemory, err)
 	}
 
-	for i := 0; i < 2; i++ {
-		if expected[0] != actual[0] {
-			t.Fatalf("expected[%d]: 0x%x, actual[%d]: 0x%x\n", i, expected[i], i, actual[i])
-		}
+	_ = v.Write(virtio.NetIOPortStart+14, []byte{0x2, 0x0}) // Select Queue #2
+
+	if err := v.Write(virtio.NetIOPortStart+8, []byte{0x9a, 0x08, 0x00, 0x00}); !errors.Is(err,
+		virtio.ErrInvalidSel) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrInvalidSel, err)
 	}
 }
 
@@ -97,7 +102,7 @@ func TestQueueNotifyHandler(t *testing.T) {
 	b := bytes.NewBuffer([]byte{})
 
 	mem := make([]byte, 0x1000000)
-	v := virtio.NewNet(9, &mockInjector{}, b, mem)
+	v := virtio.NewNet(virtio.NetIOPortStart, 9, &mockInjector{}, b, nil, guestMem(t, mem))
 
 	// Size of struct virtio_net_hdr
 	const K = 10
@@ -105,23 +110,12 @@ func TestQueueNotifyHandler(t *testing.T) {
 	copy(mem[0x100+K:0x100+K+2], []byte{0xaa, 0xbb})
 	copy(mem[0x200:0x200+2], []byte{0xcc, 0xdd})
 
-	// Select Queue #1
-	sel := byte(1)
-	_ = v.Write(virtio.NetIOPortStart+14, []byte{sel, 0x0})
-
-	// Init virt queue
-	vq := virtio.VirtQueue{}
-
-	vq.DescTable[0].Addr = 0x100
-	vq.DescTable[0].Len = K + 2
-	vq.DescTable[0].Flags = 0x1
-	vq.DescTable[0].Next = 0x1
-
-	vq.DescTable[1].Addr = 0x200
-	vq.DescTable[1].Len = 2
+	// Init virt queue #1
+	g := newGuestQueue(t, v, virtio.NetIOPortStart, mem, 1)
 
-	vq.AvailRing.Idx = 1
-	v.VirtQueue[sel] = &vq
+	g.setDesc(0, 0x100, K+2, 0x1, 1)
+	g.setDesc(1, 0x200, 2, 0, 0)
+	g.publish(0)
 
 	if err := v.Tx(); err != nil {
 		t.Fatalf("err: %v\n", err)
@@ -136,19 +130,45 @@ func TestQueueNotifyHandler(t *testing.T) {
 	}
 }
 
+func TestTxOutOfRange(t *testing.T) {
+	t.Parallel()
+
+	b := bytes.NewBuffer([]byte{})
+	mem := make([]byte, 0x1000000)
+	v := virtio.NewNet(virtio.NetIOPortStart, 9, &mockInjector{}, b, nil, guestMem(t, mem))
+
+	// Init virt queue #1
+	g := newGuestQueue(t, v, virtio.NetIOPortStart, mem, 1)
+
+	// The buffer runs past the end of the memory.
+	g.setDesc(0, uint64(len(mem))-2, 0x10, 0, 0)
+	g.publish(0)
+
+	if err := v.Tx(); !errors.Is(err, memory.ErrOutOfRange) {
+		t.Fatalf("expected: %v, actual: %v", memory.ErrOutOfRange, err)
+	}
+
+	if g.usedIdx() != 1 {
+		t.Fatalf("expected the bad chain to be used, actual: %d used", g.usedIdx())
+	}
+
+	if b.Len() != 0 {
+		t.Fatalf("expected nothing to be sent, actual: %v", b.Bytes())
+	}
+}
+
 func TestRx(t *testing.T) {
 	t.Parallel()
 
 	expected := []byte{0xaa, 0xbb}
 	mem := make([]byte, 0x1000000)
-	v := virtio.NewNet(9, &mockInjector{}, bytes.NewBuffer(expected), mem)
+	v := virtio.NewNet(virtio.NetIOPortStart, 9, &mockInjector{}, bytes.NewBuffer(expected), nil, guestMem(t, mem))
 
-	// Init virt queue
-	vq := virtio.VirtQueue{}
-	vq.AvailRing.Idx = 1
-	vq.DescTable[0].Addr = 0x100
-	vq.DescTable[0].Len = 0x200
-	v.VirtQueue[0] = &vq
+	// Init virt queue #0
+	g := newGuestQueue(t, v, virtio.NetIOPortStart, mem, 0)
+
+	g.setDesc(0, 0x100, 0x200, 0x2, 0)
+	g.publish(0)
 
 	// Size of struct virtio_net_hdr
 	const K = 10
@@ -166,3 +186,26 @@ func TestRx(t *testing.T) {
 		t.Fatalf("expected: %v, actual: %v", expected, actual)
 	}
 }
+
+func TestNetMAC(t *testing.T) {
+	t.Parallel()
+
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	v := virtio.NewNet(virtio.NetIOPortStart, 9, &mockInjector{}, bytes.NewBuffer([]byte{}), mac, guestMem(t, nil))
+
+	features := make([]byte, 4)
+	_ = v.Read(virtio.NetIOPortStart, features)
+
+	if features[0]&(1<<5) == 0 {
+		t.Fatalf("VIRTIO_NET_F_MAC is not offered: %#x", features)
+	}
+
+	actual := make([]byte, 6)
+	for i := range actual {
+		_ = v.Read(virtio.NetIOPortStart+20+uint64(i), actual[i:i+1])
+	}
+
+	if !bytes.Equal(mac, actual) {
+		t.Fatalf("expected: %v, actual: %v", mac, net.HardwareAddr(actual))
+	}
+}
@@ -0,0 +1,265 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/p9"
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+var ErrInvalidTag = errors.New("9p mount tag is invalid")
+
+const (
+	P9IOPortStart = 0x6800
+	P9IOPortSize  = 0x100
+
+	// P9MaxTagLen bounds the mount tag, which is in the device config
+	// after its 16 bit length.
+	P9MaxTagLen = 64
+
+	// p9FMountTag tells that the config holds the mount tag.
+	p9FMountTag = 1 << 0
+)
+
+type p9Hdr struct {
+	commonHeader commonHeader
+	tag          string
+}
+
+func (h p9Hdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h.commonHeader); err != nil {
+		return []byte{}, err
+	}
+
+	b := binary.LittleEndian.AppendUint16(buf.Bytes(), uint16(len(h.tag)))
+
+	return append(b, h.tag...), nil
+}
+
+// P9 is a virtio 9p device, which serves a host directory to the guest
+// with the 9P2000.L protocol, see the p9 package. The guest mounts it
+// by its tag.
+type P9 struct {
+	mu sync.Mutex
+
+	Hdr p9Hdr
+
+	VirtQueue    [1]*VirtQueue
+	Mem          *memory.GuestMemory
+	LastAvailIdx [1]uint16
+
+	server *p9.Server
+
+	kick chan uint16
+
+	ioport      uint64
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *P9) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1009,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 9, // 9P Transport
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			uint32(v.ioport) | 0x1,
+		},
+		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
+		InterruptPin: 1,
+		// https://www.webopedia.com/reference/irqnumbers/
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *P9) Read(port uint64, bytes []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	offset := int(port - v.ioport)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	// Past the end of the config reads as zero.
+	if offset > len(b) {
+		offset = len(b)
+	}
+
+	l := len(bytes)
+	for i := copy(bytes[:l], b[offset:]); i < l; i++ {
+		bytes[i] = 0
+	}
+
+	return nil
+}
+
+func (v *P9) Write(port uint64, bytes []byte) error {
+	v.mu.Lock()
+
+	offset := int(port - v.ioport)
+
+	switch offset {
+	case 8:
+		if v.Hdr.commonHeader.queueSEL != 0 {
+			v.mu.Unlock()
+
+			return ErrInvalidSel
+		}
+
+		// Queue PFN is aligned to page (4096 bytes)
+		vq, err := newVirtQueue(v.Mem, pci.BytesToNum(bytes), v.Hdr.commonHeader.queueNUM)
+		if err != nil {
+			v.mu.Unlock()
+
+			return err
+		}
+
+		v.VirtQueue[0] = vq
+
+		v.LastAvailIdx[0] = 0
+	case 14:
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	case 16:
+		v.Hdr.commonHeader.isr = 0x0
+		v.mu.Unlock()
+
+		v.kick <- uint16(pci.BytesToNum(bytes))
+
+		return nil
+	default:
+	}
+
+	v.mu.Unlock()
+
+	return nil
+}
+
+// SetQueueSize sets the size of the queues, which the guest reads before
+// setting them up.
+func (v *P9) SetQueueSize(size uint16) error {
+	if err := CheckQueueSize(size); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.Hdr.commonHeader.queueNUM = size
+
+	return nil
+}
+
+func (v *P9) IOPort() uint64 {
+	return v.ioport
+}
+
+func (v *P9) Size() uint64 {
+	return P9IOPortSize
+}
+
+func (v *P9) IOThreadEntry() {
+	for sel := range v.kick {
+		_ = v.IO(sel)
+	}
+}
+
+// Close makes IOThreadEntry return, and closes the files opened by the
+// guest. The guest must not notify the device anymore.
+func (v *P9) Close() error {
+	close(v.kick)
+
+	return v.server.Close()
+}
+
+// IO serves the requests of the guest. Each chain holds a request in
+// the buffers the device reads, followed by buffers for the reply.
+func (v *P9) IO(sel uint16) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if sel != 0 {
+		return ErrInvalidSel
+	}
+
+	vq := v.VirtQueue[0]
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	if v.LastAvailIdx[0] == vq.availIdx() {
+		return ErrNoTxPacket
+	}
+
+	var err error
+
+	for v.LastAvailIdx[0] != vq.availIdx() {
+		head := vq.availHead(v.LastAvailIdx[0])
+		n := 0
+
+		req, e := readChain(vq, head)
+		if e == nil {
+			n, e = writeChain(vq, head, v.server.Handle(req))
+		}
+
+		if e != nil {
+			err = e
+		}
+
+		complete(vq, &v.LastAvailIdx[0], head, uint32(n))
+	}
+
+	v.Hdr.commonHeader.isr = 0x1
+
+	if e := v.IRQInjector.InjectVirtioIRQ(v.irq); e != nil {
+		return e
+	}
+
+	return err
+}
+
+// NewP9 creates a virtio 9p device, whose registers are mapped at the
+// IO port ioport, serving the host directory root to the guest as tag.
+// readOnly makes the guest unable to change the directory.
+func NewP9(ioport uint64, irq uint8, irqInjector IRQInjector, tag, root string, readOnly bool,
+	mem *memory.GuestMemory,
+) (*P9, error) {
+	if tag == "" || len(tag) > P9MaxTagLen {
+		return nil, fmt.Errorf("%w: %q must be 1 to %d bytes", ErrInvalidTag, tag, P9MaxTagLen)
+	}
+
+	server, err := p9.NewServer(root, readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	return &P9{
+		Hdr: p9Hdr{
+			commonHeader: commonHeader{
+				hostFeatures: ringFIndirectDesc | p9FMountTag,
+				queueNUM:     QueueSize,
+				isr:          0x0,
+			},
+			tag: tag,
+		},
+		server:       server,
+		ioport:       ioport,
+		irq:          irq,
+		IRQInjector:  irqInjector,
+		kick:         make(chan uint16),
+		Mem:          mem,
+		VirtQueue:    [1]*VirtQueue{},
+		LastAvailIdx: [1]uint16{},
+	}, nil
+}
@@ -0,0 +1,74 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/p9"
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+func TestP9GetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v, err := virtio.NewP9(virtio.P9IOPortStart, 9, &mockInjector{}, "share", t.TempDir(), false, guestMem(t, nil))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if h := v.GetDeviceHeader(); h.DeviceID != 0x1009 || h.SubsystemID != 9 {
+		t.Fatalf("expected: 0x1009 and 9, actual: %#x and %d", h.DeviceID, h.SubsystemID)
+	}
+
+	// tag_len and the tag.
+	actual := make([]byte, 7)
+	_ = v.Read(virtio.P9IOPortStart+20, actual)
+
+	if !bytes.Equal(actual, []byte{5, 0, 's', 'h', 'a', 'r', 'e'}) {
+		t.Fatalf("config: expected the tag share, actual: %v", actual)
+	}
+
+	if _, err := virtio.NewP9(virtio.P9IOPortStart, 9, &mockInjector{}, "", t.TempDir(), false,
+		guestMem(t, nil)); !errors.Is(err, virtio.ErrInvalidTag) {
+		t.Fatalf("empty tag: expected %v, actual: %v", virtio.ErrInvalidTag, err)
+	}
+}
+
+func TestP9IO(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x100000)
+
+	v, err := virtio.NewP9(virtio.P9IOPortStart, 9, &mockInjector{}, "share", t.TempDir(), false, guestMem(t, mem))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	g := newGuestQueue(t, v, virtio.P9IOPortStart, mem, 0)
+
+	// Tversion with msize 8192, and a buffer for the reply.
+	req := []byte{0, 0, 0, 0, p9.Tversion, 0xff, 0xff}
+	req = binary.LittleEndian.AppendUint32(req, 8192)
+	req = binary.LittleEndian.AppendUint16(req, uint16(len(p9.Version)))
+	req = append(req, p9.Version...)
+	binary.LittleEndian.PutUint32(req, uint32(len(req)))
+
+	in := g.addChain(req, make([]byte, 64))
+
+	if err := v.IO(0); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	// Rversion is as long as Tversion.
+	if _, l := g.usedEntry(0); g.usedIdx() != 1 || l != uint32(len(req)) {
+		t.Fatalf("used: expected 1 reply of %d bytes, actual: %d of %d", len(req), g.usedIdx(), l)
+	}
+
+	reply := mem[in : in+uint64(len(req))]
+
+	if reply[4] != p9.Tversion+1 || binary.LittleEndian.Uint32(reply[7:]) != 8192 {
+		t.Errorf("Rversion: got %v", reply)
+	}
+}
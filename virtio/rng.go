@@ -0,0 +1,267 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+// ErrNoEntropy is returned once the source of an Rng can't fill the
+// buffers of the guest anymore.
+var ErrNoEntropy = errors.New("entropy source is dry")
+
+const RngIOPortSize = 0x100
+
+// Rng is a virtio entropy device, which fills the buffers of the guest
+// with bytes read from its source.
+type Rng struct {
+	mu sync.Mutex
+
+	Hdr rngHdr
+
+	VirtQueue    [1]*VirtQueue
+	Mem          *memory.GuestMemory
+	LastAvailIdx [1]uint16
+
+	source io.Reader
+
+	// dry is set once a read of source fails or falls short, after
+	// which the buffers are left to the guest.
+	dry error
+
+	kick chan interface{}
+
+	ioport      uint64
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+type rngHdr struct {
+	commonHeader commonHeader
+}
+
+func (h rngHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (v *Rng) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1005,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 4, // Entropy Source
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			uint32(v.ioport) | 0x1,
+		},
+		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
+		InterruptPin: 1,
+		// https://www.webopedia.com/reference/irqnumbers/
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Rng) Read(port uint64, bytes []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	offset := int(port - v.ioport)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	// Past the end of the config reads as zero.
+	if offset > len(b) {
+		offset = len(b)
+	}
+
+	l := len(bytes)
+	for i := copy(bytes[:l], b[offset:]); i < l; i++ {
+		bytes[i] = 0
+	}
+
+	return nil
+}
+
+func (v *Rng) IOThreadEntry() {
+	for range v.kick {
+		for v.IO() == nil {
+		}
+	}
+}
+
+// Close makes IOThreadEntry return, and closes the source if it is an
+// io.Closer. The guest must not notify the device anymore.
+func (v *Rng) Close() error {
+	close(v.kick)
+
+	if c, ok := v.source.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// IO fills the buffers made available by the guest. Once the source is
+// dry, e.g. a file at its end, IO returns ErrNoEntropy and leaves the
+// buffers to the guest rather than giving them back empty.
+func (v *Rng) IO() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	sel := uint16(0)
+
+	if v.VirtQueue[sel] == nil {
+		return ErrVQNotInit
+	}
+
+	if v.dry != nil {
+		return v.dry
+	}
+
+	vq := v.VirtQueue[sel]
+
+	if v.LastAvailIdx[sel] == vq.availIdx() {
+		return ErrNoTxPacket
+	}
+
+	var err error
+
+	used := 0
+
+	for v.LastAvailIdx[sel] != vq.availIdx() && v.dry == nil {
+		head := vq.availHead(v.LastAvailIdx[sel])
+		n := 0
+
+		if e := walk(vq, head, func(_ uint64, b []byte, write bool) {
+			// A short read leaves the rest of the chain out.
+			if write && v.dry == nil {
+				m, e := io.ReadFull(v.source, b)
+				if e != nil {
+					v.dry = fmt.Errorf("%w:%w", ErrNoEntropy, e)
+				}
+
+				n += m
+			}
+		}); e != nil {
+			err = e
+		}
+
+		if n == 0 && v.dry != nil {
+			break
+		}
+
+		complete(vq, &v.LastAvailIdx[sel], head, uint32(n))
+		used++
+	}
+
+	if used > 0 {
+		v.Hdr.commonHeader.isr = 0x1
+
+		if e := v.IRQInjector.InjectVirtioIRQ(v.irq); e != nil {
+			return e
+		}
+	}
+
+	return errors.Join(err, v.dry)
+}
+
+func (v *Rng) Write(port uint64, bytes []byte) error {
+	v.mu.Lock()
+
+	offset := int(port - v.ioport)
+
+	switch offset {
+	case 8:
+		sel := v.Hdr.commonHeader.queueSEL
+		if int(sel) >= len(v.VirtQueue) {
+			v.mu.Unlock()
+
+			return ErrInvalidSel
+		}
+
+		// Queue PFN is aligned to page (4096 bytes)
+		vq, err := newVirtQueue(v.Mem, pci.BytesToNum(bytes), v.Hdr.commonHeader.queueNUM)
+		if err != nil {
+			v.mu.Unlock()
+
+			return err
+		}
+
+		v.VirtQueue[sel] = vq
+		v.LastAvailIdx[sel] = 0
+	case 14:
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	case 16:
+		v.Hdr.commonHeader.isr = 0x0
+		v.mu.Unlock()
+
+		v.kick <- true
+
+		return nil
+	default:
+	}
+
+	v.mu.Unlock()
+
+	return nil
+}
+
+// SetQueueSize sets the size of the queues, which the guest reads before
+// setting them up.
+func (v *Rng) SetQueueSize(size uint16) error {
+	if err := CheckQueueSize(size); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.Hdr.commonHeader.queueNUM = size
+
+	return nil
+}
+
+func (v *Rng) IOPort() uint64 {
+	return v.ioport
+}
+
+func (v *Rng) Size() uint64 {
+	return RngIOPortSize
+}
+
+// NewRng creates a virtio entropy device reading source, e.g.
+// crypto/rand.Reader, whose registers are mapped at the IO port ioport.
+func NewRng(ioport uint64, irq uint8, irqInjector IRQInjector, source io.Reader, mem *memory.GuestMemory) *Rng {
+	return &Rng{
+		Hdr: rngHdr{
+			commonHeader: commonHeader{
+				hostFeatures: ringFIndirectDesc,
+				queueNUM:     QueueSize,
+				isr:          0x0,
+			},
+		},
+		source:       source,
+		ioport:       ioport,
+		irq:          irq,
+		IRQInjector:  irqInjector,
+		kick:         make(chan interface{}),
+		Mem:          mem,
+		VirtQueue:    [1]*VirtQueue{},
+		LastAvailIdx: [1]uint16{0},
+	}
+}
@@ -0,0 +1,96 @@
+package virtio_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// rngIOPort is where the registers of the device are in the tests.
+const rngIOPort = 0x6600
+
+func TestRngGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewRng(rngIOPort, 9, &mockInjector{}, strings.NewReader(""), guestMem(t, nil))
+
+	if h := v.GetDeviceHeader(); h.DeviceID != 0x1005 || h.SubsystemID != 4 {
+		t.Fatalf("expected: 0x1005 and 4, actual: %#x and %d", h.DeviceID, h.SubsystemID)
+	}
+
+	if actual := v.Size(); actual != virtio.RngIOPortSize {
+		t.Fatalf("expected: %d, actual: %d", virtio.RngIOPortSize, actual)
+	}
+}
+
+func TestRngReadPastConfig(t *testing.T) {
+	t.Parallel()
+
+	v := virtio.NewRng(rngIOPort, 9, &mockInjector{}, strings.NewReader(""), guestMem(t, nil))
+
+	// The guest may read anywhere in the BAR, which ends far past the
+	// config.
+	for _, port := range []uint64{0x3e, 0x40, virtio.RngIOPortSize - 4} {
+		actual := []byte{1, 2, 3, 4}
+		if err := v.Read(rngIOPort+port, actual); err != nil {
+			t.Fatalf("port %#x: err: %v", port, err)
+		}
+
+		if !bytes.Equal(actual[2:], []byte{0, 0}) {
+			t.Errorf("port %#x: expected zeros past the config, actual: %v", port, actual)
+		}
+	}
+}
+
+func TestRngIO(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x100000)
+	v := virtio.NewRng(rngIOPort, 9, &mockInjector{}, strings.NewReader("0123456789"), guestMem(t, mem))
+
+	if err := v.IO(); !errors.Is(err, virtio.ErrVQNotInit) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrVQNotInit, err)
+	}
+
+	g := newGuestQueue(t, v, rngIOPort, mem, 0)
+
+	if err := v.IO(); !errors.Is(err, virtio.ErrNoTxPacket) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrNoTxPacket, err)
+	}
+
+	g.add(make([]byte, 4), true)
+	g.add(make([]byte, 8), true)
+
+	// The second buffer gets what is left of the source, which is then
+	// dry.
+	if err := v.IO(); !errors.Is(err, virtio.ErrNoEntropy) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrNoEntropy, err)
+	}
+
+	got := g.take()
+	want := [][]byte{[]byte("0123"), []byte("456789")}
+
+	if len(got) != len(want) {
+		t.Fatalf("expected: %q, actual: %q", want, got)
+	}
+
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("buffer %d: expected: %q, actual: %q", i, want[i], got[i])
+		}
+	}
+
+	// The buffers made available afterwards are left to the guest.
+	g.add(make([]byte, 4), true)
+
+	if err := v.IO(); !errors.Is(err, virtio.ErrNoEntropy) {
+		t.Fatalf("expected: %v, actual: %v", virtio.ErrNoEntropy, err)
+	}
+
+	if n := g.usedIdx(); n != 2 {
+		t.Errorf("expected 2 buffers used, actual: %d", n)
+	}
+}
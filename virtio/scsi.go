@@ -0,0 +1,831 @@
+package virtio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+var ErrInvalidLUNs = errors.New("invalid number of SCSI LUNs")
+
+const (
+	SCSIIOPortStart = 0x6900
+	SCSIIOPortSize  = 0x100
+
+	// MaxSCSILUNs is the most LUNs of a controller, those which the
+	// peripheral addressing of REPORT LUNS describes.
+	MaxSCSILUNs = 256
+)
+
+// Queues of the device, with a single request queue.
+const (
+	scsiControl = iota
+	scsiEvent
+	scsiRequest
+)
+
+// Sizes of the requests and responses, with the default sizes of the
+// CDB and the sense data.
+//
+// refs https://github.com/torvalds/linux/blob/v6.1/include/uapi/linux/virtio_scsi.h
+const (
+	scsiCDBSize   = 32
+	scsiSenseSize = 96
+
+	// lun[8] tag[8] task_attr[1] prio[1] crn[1] cdb[32]
+	scsiReqSize = 8 + 8 + 3 + scsiCDBSize
+
+	// sense_len[4] resid[4] status_qualifier[2] status[1] response[1]
+	// sense[96]
+	scsiRespSize = 12 + scsiSenseSize
+)
+
+// Responses of the transport.
+const (
+	scsiSOK        = 0
+	scsiSBadTarget = 3
+)
+
+// SCSI status codes.
+const (
+	scsiGood           = 0x00
+	scsiCheckCondition = 0x02
+)
+
+// SCSI commands.
+//
+// refs https://www.t10.org/lists/op-num.htm
+const (
+	scsiTestUnitReady   = 0x00
+	scsiRequestSense    = 0x03
+	scsiRead6           = 0x08
+	scsiWrite6          = 0x0a
+	scsiInquiry         = 0x12
+	scsiModeSense6      = 0x1a
+	scsiStartStopUnit   = 0x1b
+	scsiPreventAllow    = 0x1e
+	scsiReadCapacity10  = 0x25
+	scsiRead10          = 0x28
+	scsiWrite10         = 0x2a
+	scsiVerify10        = 0x2f
+	scsiSyncCache10     = 0x35
+	scsiUnmap           = 0x42
+	scsiModeSense10     = 0x5a
+	scsiRead16          = 0x88
+	scsiWrite16         = 0x8a
+	scsiSyncCache16     = 0x91
+	scsiServiceActionIn = 0x9e
+	scsiReportLUNs      = 0xa0
+
+	// scsiReadCapacity16 is a service action of scsiServiceActionIn.
+	scsiReadCapacity16 = 0x10
+)
+
+// scsiSense is a sense key with its additional sense code and qualifier.
+type scsiSense struct {
+	key, asc, ascq uint8
+}
+
+var (
+	senseNone           = scsiSense{}
+	senseInvalidOpcode  = scsiSense{key: 0x05, asc: 0x20}
+	senseLBAOutOfRange  = scsiSense{key: 0x05, asc: 0x21}
+	senseInvalidField   = scsiSense{key: 0x05, asc: 0x24}
+	senseLUNNotSupp     = scsiSense{key: 0x05, asc: 0x25}
+	senseInvalidParam   = scsiSense{key: 0x05, asc: 0x26}
+	senseReadError      = scsiSense{key: 0x03, asc: 0x11}
+	senseWriteError     = scsiSense{key: 0x03, asc: 0x0c}
+	senseWriteProtected = scsiSense{key: 0x07, asc: 0x27}
+	senseInternalTarget = scsiSense{key: 0x04, asc: 0x44}
+)
+
+// bytes returns the sense in fixed format.
+func (s scsiSense) bytes() []byte {
+	b := make([]byte, 18)
+	b[0] = 0x70 // current error, fixed format
+	b[2] = s.key
+	b[7] = 10 // additional sense length
+	b[12] = s.asc
+	b[13] = s.ascq
+
+	return b
+}
+
+// scsiMaxUnmapBlocks bounds the blocks of an UNMAP descriptor, and
+// scsiMaxUnmapDescs the descriptors of a command.
+const (
+	scsiMaxUnmapBlocks = 1 << 22
+	scsiMaxUnmapDescs  = 256
+)
+
+type scsiHdr struct {
+	commonHeader commonHeader
+	scsiHeader   scsiHeader
+}
+
+func (h scsiHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// scsiHeader is struct virtio_scsi_config.
+type scsiHeader struct {
+	numQueues     uint32
+	segMax        uint32
+	maxSectors    uint32
+	cmdPerLUN     uint32
+	eventInfoSize uint32
+	senseSize     uint32
+	cdbSize       uint32
+	maxChannel    uint16
+	maxTarget     uint16
+	maxLUN        uint32
+}
+
+// scsiCmd is a command to a LUN and its data-out buffer.
+type scsiCmd struct {
+	cdb  []byte
+	data []byte
+
+	// allocLen is the room for the data-in buffer.
+	allocLen int
+}
+
+// scsiResult is the outcome of a command.
+type scsiResult struct {
+	status uint8
+	sense  scsiSense
+	data   []byte
+}
+
+func scsiCheck(s scsiSense) scsiResult {
+	return scsiResult{status: scsiCheckCondition, sense: s}
+}
+
+// SCSI is a virtio SCSI host adapter with a single target, whose LUNs
+// are backed by files like the disks of Blk.
+type SCSI struct {
+	mu sync.Mutex
+
+	Hdr scsiHdr
+
+	VirtQueue    [3]*VirtQueue
+	Mem          *memory.GuestMemory
+	LastAvailIdx [3]uint16
+
+	luns []*disk
+
+	kick chan uint16
+
+	ioport      uint64
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *SCSI) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		DeviceID:    0x1004,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 8, // SCSI Host
+		Command:     1, // Enable IO port
+		BAR: [6]uint32{
+			uint32(v.ioport) | 0x1,
+		},
+		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
+		InterruptPin: 1,
+		// https://www.webopedia.com/reference/irqnumbers/
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *SCSI) Read(port uint64, bytes []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	offset := int(port - v.ioport)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	// Past the end of the config reads as zero.
+	if offset > len(b) {
+		offset = len(b)
+	}
+
+	l := len(bytes)
+	for i := copy(bytes[:l], b[offset:]); i < l; i++ {
+		bytes[i] = 0
+	}
+
+	return nil
+}
+
+func (v *SCSI) Write(port uint64, bytes []byte) error {
+	v.mu.Lock()
+
+	offset := int(port - v.ioport)
+
+	switch offset {
+	case 8:
+		sel := int(v.Hdr.commonHeader.queueSEL)
+		if sel >= len(v.VirtQueue) {
+			v.mu.Unlock()
+
+			return ErrInvalidSel
+		}
+
+		// Queue PFN is aligned to page (4096 bytes)
+		vq, err := newVirtQueue(v.Mem, pci.BytesToNum(bytes), v.Hdr.commonHeader.queueNUM)
+		if err != nil {
+			v.mu.Unlock()
+
+			return err
+		}
+
+		v.VirtQueue[sel] = vq
+
+		v.LastAvailIdx[sel] = 0
+	case 14:
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	case 16:
+		v.Hdr.commonHeader.isr = 0x0
+		v.mu.Unlock()
+
+		v.kick <- uint16(pci.BytesToNum(bytes))
+
+		return nil
+	default:
+		// The guest writes the sense and CDB sizes it already has.
+	}
+
+	v.mu.Unlock()
+
+	return nil
+}
+
+// SetQueueSize sets the size of the queues, which the guest reads before
+// setting them up.
+func (v *SCSI) SetQueueSize(size uint16) error {
+	if err := CheckQueueSize(size); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.Hdr.commonHeader.queueNUM = size
+	v.Hdr.scsiHeader.segMax = uint32(size) - 2
+	v.Hdr.scsiHeader.cmdPerLUN = uint32(size) / 4
+
+	return nil
+}
+
+func (v *SCSI) IOPort() uint64 {
+	return v.ioport
+}
+
+func (v *SCSI) Size() uint64 {
+	return SCSIIOPortSize
+}
+
+func (v *SCSI) IOThreadEntry() {
+	for q := range v.kick {
+		_ = v.IO(q)
+	}
+}
+
+// Close makes IOThreadEntry return, and closes the disks of the LUNs once
+// the request being served, if any, is done. The guest must not notify
+// the device anymore.
+func (v *SCSI) Close() error {
+	close(v.kick)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var errs []error
+
+	for _, d := range v.luns {
+		errs = append(errs, d.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// IO handles a notification of the queue q.
+func (v *SCSI) IO(q uint16) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if int(q) >= len(v.VirtQueue) {
+		return ErrInvalidSel
+	}
+
+	vq := v.VirtQueue[q]
+	if vq == nil {
+		return ErrVQNotInit
+	}
+
+	// The buffers of the event queue are kept, since no event is sent.
+	if q == scsiEvent {
+		return nil
+	}
+
+	used := false
+
+	var err error
+
+	for v.LastAvailIdx[q] != vq.availIdx() {
+		head := vq.availHead(v.LastAvailIdx[q])
+		used = true
+
+		n, e := v.serve(q, vq, head)
+		if e != nil {
+			err = e
+		}
+
+		complete(vq, &v.LastAvailIdx[q], head, uint32(n))
+	}
+
+	if used {
+		v.Hdr.commonHeader.isr = 0x1
+
+		if e := v.IRQInjector.InjectVirtioIRQ(v.irq); e != nil {
+			return e
+		}
+	}
+
+	return err
+}
+
+// serve serves the chain at head of the queue q, and returns how many
+// bytes of the response it wrote.
+func (v *SCSI) serve(q uint16, vq *VirtQueue, head uint16) (int, error) {
+	req, err := readChain(vq, head)
+	if err != nil {
+		return 0, err
+	}
+
+	if q == scsiControl {
+		return writeChain(vq, head, v.control(req))
+	}
+
+	room := 0
+
+	if err := walk(vq, head, func(_ uint64, b []byte, write bool) {
+		if write {
+			room += len(b)
+		}
+	}); err != nil {
+		return 0, err
+	}
+
+	return writeChain(vq, head, v.request(req, room-scsiRespSize))
+}
+
+// control completes every task management function at once, since
+// commands are served in order, and subscribes to no event.
+func (v *SCSI) control(req []byte) []byte {
+	const (
+		ctrlTMF = 0
+
+		// Reply of type[4] subtype[4] lun[8] tag[8], and of the
+		// asynchronous notification requests.
+		tmfRespSize = 1
+		anRespSize  = 5
+	)
+
+	if len(req) >= 4 && binary.LittleEndian.Uint32(req) == ctrlTMF {
+		return make([]byte, tmfRespSize)
+	}
+
+	return make([]byte, anRespSize)
+}
+
+// lun returns the LUN addressed by the 8 byte lun field, which is 1,
+// the target, then the LUN in flat or peripheral addressing.
+func (v *SCSI) lun(b []byte) (*disk, bool, bool) {
+	if b[0] != 1 || b[1] != 0 {
+		return nil, false, false
+	}
+
+	n := int(binary.BigEndian.Uint16(b[2:]) & 0x3fff)
+	if n >= len(v.luns) {
+		return nil, true, false
+	}
+
+	return v.luns[n], true, true
+}
+
+// request serves a command, whose data-in buffer has room bytes, and
+// returns the response followed by the data-in buffer.
+func (v *SCSI) request(req []byte, room int) []byte {
+	resp := make([]byte, scsiRespSize)
+
+	if len(req) < scsiReqSize || room < 0 {
+		resp[11] = scsiSBadTarget
+
+		return resp
+	}
+
+	d, target, ok := v.lun(req[:8])
+	if !target {
+		resp[11] = scsiSBadTarget
+
+		return resp
+	}
+
+	cmd := scsiCmd{
+		cdb:      req[19:scsiReqSize],
+		data:     req[scsiReqSize:],
+		allocLen: room,
+	}
+
+	var res scsiResult
+
+	switch {
+	case ok:
+		res = v.execute(d, cmd)
+	case cmd.cdb[0] == scsiInquiry:
+		// No LUN is there, but the target answers for it.
+		res = inquiry(nil, cmd)
+	case cmd.cdb[0] == scsiReportLUNs:
+		res = v.reportLUNs(cmd)
+	default:
+		res = scsiCheck(senseLUNNotSupp)
+	}
+
+	data := res.data
+	if len(data) > room {
+		data = data[:room]
+	}
+
+	if res.status == scsiCheckCondition {
+		sense := res.sense.bytes()
+
+		binary.LittleEndian.PutUint32(resp[0:], uint32(len(sense)))
+		copy(resp[12:], sense)
+	}
+
+	binary.LittleEndian.PutUint32(resp[4:], uint32(room-len(data))) // resid
+	resp[10] = res.status
+	resp[11] = scsiSOK
+
+	return append(resp, data...)
+}
+
+func (v *SCSI) execute(d *disk, cmd scsiCmd) scsiResult {
+	cdb := cmd.cdb
+
+	switch cdb[0] {
+	case scsiTestUnitReady, scsiStartStopUnit, scsiPreventAllow, scsiVerify10:
+		return scsiResult{}
+	case scsiRequestSense:
+		return scsiResult{data: senseNone.bytes()}
+	case scsiInquiry:
+		return inquiry(d, cmd)
+	case scsiReportLUNs:
+		return v.reportLUNs(cmd)
+	case scsiReadCapacity10:
+		data := make([]byte, 8)
+		last := d.size/SectorSize - 1
+
+		if last > 0xffffffff {
+			last = 0xffffffff
+		}
+
+		binary.BigEndian.PutUint32(data, uint32(last))
+		binary.BigEndian.PutUint32(data[4:], SectorSize)
+
+		return scsiResult{data: data}
+	case scsiServiceActionIn:
+		if cdb[1]&0x1f != scsiReadCapacity16 {
+			return scsiCheck(senseInvalidField)
+		}
+
+		data := make([]byte, 32)
+		binary.BigEndian.PutUint64(data, d.size/SectorSize-1)
+		binary.BigEndian.PutUint32(data[8:], SectorSize)
+		data[14] = 0x80 // LBPME, UNMAP is supported
+
+		return scsiResult{data: allocated(data, binary.BigEndian.Uint32(cdb[10:]))}
+	case scsiModeSense6, scsiModeSense10:
+		return modeSense(d, cdb)
+	case scsiRead6, scsiRead10, scsiRead16, scsiWrite6, scsiWrite10, scsiWrite16:
+		return readWrite(d, cmd)
+	case scsiSyncCache10, scsiSyncCache16:
+		if err := d.Sync(); err != nil {
+			return scsiCheck(senseWriteError)
+		}
+
+		return scsiResult{}
+	case scsiUnmap:
+		return unmap(d, cmd)
+	default:
+		return scsiCheck(senseInvalidOpcode)
+	}
+}
+
+// allocated truncates data to the allocation length of a command.
+func allocated(data []byte, allocLen uint32) []byte {
+	if uint32(len(data)) > allocLen {
+		return data[:allocLen]
+	}
+
+	return data
+}
+
+// inquiry returns the standard inquiry data or a vital product data
+// page of d, or tells that no LUN is there if d is nil.
+func inquiry(d *disk, cmd scsiCmd) scsiResult {
+	cdb := cmd.cdb
+	allocLen := uint32(binary.BigEndian.Uint16(cdb[3:]))
+
+	if d == nil {
+		// Peripheral qualifier 3, no device type.
+		data := make([]byte, 36)
+		data[0] = 0x7f
+
+		return scsiResult{data: allocated(data, allocLen)}
+	}
+
+	if cdb[1]&0x1 == 0 {
+		if cdb[2] != 0 {
+			return scsiCheck(senseInvalidField)
+		}
+
+		data := make([]byte, 36)
+		data[0] = 0x00 // direct access block device
+		data[2] = 0x05 // SPC-3
+		data[3] = 0x02 // response data format
+		data[4] = byte(len(data) - 5)
+		data[7] = 0x02 // CmdQue
+		copy(data[8:], "GOKVM   ")
+		copy(data[16:], "VIRTUAL DISK    ")
+		copy(data[32:], "1.0 ")
+
+		return scsiResult{data: allocated(data, allocLen)}
+	}
+
+	var page []byte
+
+	switch cdb[2] {
+	case 0x00: // Supported VPD pages
+		page = []byte{0x00, 0x80, 0x83, 0xb0, 0xb1, 0xb2}
+	case 0x80: // Unit serial number
+		page = []byte(fmt.Sprintf("%016x", d.size))
+	case 0x83: // Device identification, a vendor specific designator
+		page = append([]byte{0x02, 0x00, 0x00, 8}, "GOKVM   "...)
+	case 0xb0: // Block limits
+		page = make([]byte, 60)
+		binary.BigEndian.PutUint32(page[16:], scsiMaxUnmapBlocks)
+		binary.BigEndian.PutUint32(page[20:], scsiMaxUnmapDescs)
+	case 0xb1: // Block device characteristics, non-rotating
+		page = make([]byte, 60)
+		binary.BigEndian.PutUint16(page, 1)
+	case 0xb2: // Logical block provisioning
+		page = make([]byte, 4)
+		page[1] = 0x80 // LBPU, UNMAP is supported
+	default:
+		return scsiCheck(senseInvalidField)
+	}
+
+	data := append([]byte{0x00, cdb[2], 0, 0}, page...)
+	binary.BigEndian.PutUint16(data[2:], uint16(len(page)))
+
+	return scsiResult{data: allocated(data, allocLen)}
+}
+
+func (v *SCSI) reportLUNs(cmd scsiCmd) scsiResult {
+	data := make([]byte, 8, 8+8*len(v.luns))
+	binary.BigEndian.PutUint32(data, uint32(8*len(v.luns)))
+
+	for i := range v.luns {
+		// Peripheral addressing of the LUN i.
+		data = append(data, 0, byte(i), 0, 0, 0, 0, 0, 0)
+	}
+
+	return scsiResult{data: allocated(data, binary.BigEndian.Uint32(cmd.cdb[6:]))}
+}
+
+// modeSense returns the caching and control mode pages, telling that
+// writes are cached until SYNCHRONIZE CACHE.
+func modeSense(d *disk, cdb []byte) scsiResult {
+	caching := make([]byte, 20)
+	caching[0], caching[1] = 0x08, 18
+	caching[2] = 0x04 // WCE
+
+	control := make([]byte, 12)
+	control[0], control[1] = 0x0a, 10
+
+	var pages []byte
+
+	switch cdb[2] & 0x3f {
+	case 0x08:
+		pages = caching
+	case 0x0a:
+		pages = control
+	case 0x3f:
+		pages = append(caching, control...)
+	default:
+		return scsiCheck(senseInvalidField)
+	}
+
+	// The device specific parameter tells if the LUN is write
+	// protected, and no block descriptors follow the header.
+	var wp byte
+
+	if d.mode == DiskReadOnly {
+		wp = 0x80
+	}
+
+	if cdb[0] == scsiModeSense6 {
+		data := append([]byte{byte(3 + len(pages)), 0, wp, 0}, pages...)
+
+		return scsiResult{data: allocated(data, uint32(cdb[4]))}
+	}
+
+	data := append(make([]byte, 8), pages...)
+	binary.BigEndian.PutUint16(data, uint16(6+len(pages)))
+	data[3] = wp
+
+	return scsiResult{data: allocated(data, uint32(binary.BigEndian.Uint16(cdb[7:])))}
+}
+
+func readWrite(d *disk, cmd scsiCmd) scsiResult {
+	cdb := cmd.cdb
+
+	var (
+		lba   uint64
+		count uint32
+	)
+
+	switch cdb[0] {
+	case scsiRead6, scsiWrite6:
+		lba = uint64(binary.BigEndian.Uint32(cdb) & 0x1fffff)
+		count = uint32(cdb[4])
+
+		if count == 0 {
+			count = 256
+		}
+	case scsiRead10, scsiWrite10:
+		lba = uint64(binary.BigEndian.Uint32(cdb[2:]))
+		count = uint32(binary.BigEndian.Uint16(cdb[7:]))
+	default:
+		lba = binary.BigEndian.Uint64(cdb[2:])
+		count = binary.BigEndian.Uint32(cdb[10:])
+	}
+
+	blocks := d.size / SectorSize
+	if lba > blocks || uint64(count) > blocks-lba {
+		return scsiCheck(senseLBAOutOfRange)
+	}
+
+	off := int64(lba * SectorSize)
+	l := int(count) * SectorSize
+
+	switch cdb[0] {
+	case scsiRead6, scsiRead10, scsiRead16:
+		if l > cmd.allocLen {
+			l = cmd.allocLen
+		}
+
+		data := make([]byte, l)
+		if _, err := d.ReadAt(data, off); err != nil {
+			return scsiCheck(senseReadError)
+		}
+
+		return scsiResult{data: data}
+	default:
+		data := cmd.data
+		if len(data) > l {
+			data = data[:l]
+		}
+
+		if _, err := d.WriteAt(data, off); err != nil {
+			return writeFailed(err, senseWriteError)
+		}
+
+		return scsiResult{}
+	}
+}
+
+// unmap deallocates the blocks of the descriptors of the parameter list
+// of UNMAP.
+func unmap(d *disk, cmd scsiCmd) scsiResult {
+	p := cmd.data
+	if len(p) < 8 {
+		return scsiResult{}
+	}
+
+	descs := int(binary.BigEndian.Uint16(p[2:])) / 16
+	if 8+descs*16 > len(p) || descs > scsiMaxUnmapDescs {
+		return scsiCheck(senseInvalidParam)
+	}
+
+	blocks := d.size / SectorSize
+
+	for i := 0; i < descs; i++ {
+		desc := p[8+i*16:]
+		lba := binary.BigEndian.Uint64(desc)
+		count := uint64(binary.BigEndian.Uint32(desc[8:]))
+
+		if lba > blocks || count > blocks-lba {
+			return scsiCheck(senseLBAOutOfRange)
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		if err := d.punchHole(int64(lba*SectorSize), int64(count*SectorSize)); err != nil {
+			return writeFailed(err, senseInternalTarget)
+		}
+	}
+
+	return scsiResult{}
+}
+
+// writeFailed tells that a change of a LUN failed with err, with sense
+// unless the LUN is read-only.
+func writeFailed(err error, sense scsiSense) scsiResult {
+	if errors.Is(err, ErrReadOnly) {
+		return scsiCheck(senseWriteProtected)
+	}
+
+	return scsiCheck(sense)
+}
+
+// SCSILUN is a file backing a LUN of a virtio SCSI controller, and the
+// mode it is used in.
+type SCSILUN struct {
+	Path string
+	Mode DiskMode
+}
+
+// NewSCSI creates a virtio SCSI host adapter whose registers are mapped
+// at the IO port ioport, with the LUNs of specs numbered in order.
+func NewSCSI(specs []SCSILUN, ioport uint64, irq uint8, irqInjector IRQInjector,
+	mem *memory.GuestMemory,
+) (*SCSI, error) {
+	if len(specs) == 0 || len(specs) > MaxSCSILUNs {
+		return nil, fmt.Errorf("%w: %d, want 1 to %d", ErrInvalidLUNs, len(specs), MaxSCSILUNs)
+	}
+
+	luns := make([]*disk, 0, len(specs))
+
+	for _, spec := range specs {
+		d, err := openDisk(spec.Path, spec.Mode)
+		if err != nil {
+			for _, l := range luns {
+				l.Close()
+			}
+
+			return nil, err
+		}
+
+		luns = append(luns, d)
+	}
+
+	return &SCSI{
+		Hdr: scsiHdr{
+			commonHeader: commonHeader{
+				hostFeatures: ringFIndirectDesc,
+				queueNUM:     QueueSize,
+				isr:          0x0,
+			},
+			scsiHeader: scsiHeader{
+				numQueues: 1,
+				// The request and the response take a descriptor
+				// each.
+				segMax:     QueueSize - 2,
+				maxSectors: 0xffff,
+				cmdPerLUN:  QueueSize / 4,
+				senseSize:  scsiSenseSize,
+				cdbSize:    scsiCDBSize,
+				maxLUN:     uint32(len(luns) - 1),
+			},
+		},
+		luns:         luns,
+		ioport:       ioport,
+		irq:          irq,
+		IRQInjector:  irqInjector,
+		kick:         make(chan uint16),
+		Mem:          mem,
+		VirtQueue:    [3]*VirtQueue{},
+		LastAvailIdx: [3]uint16{},
+	}, nil
+}
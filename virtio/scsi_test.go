@@ -0,0 +1,185 @@
+package virtio_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobuhiro11/gokvm/virtio"
+)
+
+// newSCSI creates a controller with a LUN for each size, backed by
+// files of that many bytes.
+func newSCSI(t *testing.T, mem []byte, sizes ...int64) *virtio.SCSI {
+	t.Helper()
+
+	luns := []virtio.SCSILUN{}
+
+	for i, size := range sizes {
+		path := filepath.Join(t.TempDir(), "lun")
+
+		if err := os.WriteFile(path, bytes.Repeat([]byte{byte(i + 1)}, int(size)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		luns = append(luns, virtio.SCSILUN{Path: path})
+	}
+
+	v, err := virtio.NewSCSI(luns, virtio.SCSIIOPortStart, 9, &mockInjector{}, guestMem(t, mem))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	return v
+}
+
+// scsiReq returns a request with cdb to the LUN lun of the target 0.
+func scsiReq(lun uint8, cdb ...byte) []byte {
+	req := make([]byte, 51)
+	req[0], req[3] = 1, lun
+	copy(req[19:], cdb)
+
+	return req
+}
+
+// doSCSI passes req on the request queue, with room for in bytes of
+// data after the response, and returns the status and the data.
+func doSCSI(t *testing.T, v *virtio.SCSI, g *guestQueue, req []byte, in int) (uint8, []byte) {
+	t.Helper()
+
+	addr := g.addChain(req, make([]byte, 108+in))
+
+	if err := v.IO(2); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	used := g.take()
+	if len(used) != 1 {
+		t.Fatalf("expected 1 used buffer, actual: %d", len(used))
+	}
+
+	_, l := g.usedEntry(g.seen - 1)
+	resp := g.mem[addr : addr+uint64(l)]
+	if resp[11] != 0 {
+		t.Fatalf("response: expected VIRTIO_SCSI_S_OK, actual: %d", resp[11])
+	}
+
+	return resp[10], resp[108:]
+}
+
+func TestSCSIGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	v := newSCSI(t, []byte{}, 4096, 4096)
+
+	if h := v.GetDeviceHeader(); h.DeviceID != 0x1004 || h.SubsystemID != 8 {
+		t.Fatalf("expected: 0x1004 and 8, actual: %#x and %d", h.DeviceID, h.SubsystemID)
+	}
+
+	// max_lun is at the end of virtio_scsi_config.
+	actual := make([]byte, 4)
+	_ = v.Read(virtio.SCSIIOPortStart+20+32, actual)
+
+	if binary.LittleEndian.Uint32(actual) != 1 {
+		t.Fatalf("max_lun: expected 1, actual: %v", actual)
+	}
+
+	// The BAR ends far past the config, which reads as zero there.
+	past := []byte{1, 2, 3, 4}
+	if err := v.Read(virtio.SCSIIOPortStart+virtio.SCSIIOPortSize-4, past); err != nil {
+		t.Fatalf("past the config: err: %v", err)
+	}
+
+	if !bytes.Equal(past, make([]byte, 4)) {
+		t.Fatalf("past the config: expected zeros, actual: %v", past)
+	}
+
+	if _, err := virtio.NewSCSI(nil, virtio.SCSIIOPortStart, 9, &mockInjector{},
+		guestMem(t, nil)); !errors.Is(err, virtio.ErrInvalidLUNs) {
+		t.Fatalf("no LUN: expected %v, actual: %v", virtio.ErrInvalidLUNs, err)
+	}
+}
+
+func TestSCSIIO(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x100000)
+	v := newSCSI(t, mem, 8*512, 4*512)
+	g := newGuestQueue(t, v, virtio.SCSIIOPortStart, mem, 2)
+
+	// Standard INQUIRY of the LUN 1 and of a LUN which is not there.
+	status, data := doSCSI(t, v, g, scsiReq(1, 0x12, 0, 0, 0, 36), 36)
+	if status != 0 || data[0] != 0x00 || !bytes.HasPrefix(data[8:], []byte("GOKVM")) {
+		t.Errorf("INQUIRY: got status %d and %v", status, data)
+	}
+
+	if _, data = doSCSI(t, v, g, scsiReq(2, 0x12, 0, 0, 0, 36), 36); data[0] != 0x7f {
+		t.Errorf("INQUIRY of no LUN: expected 0x7f, actual: %#x", data[0])
+	}
+
+	// READ CAPACITY(16) of the LUN 1 tells the last LBA.
+	cdb := []byte{0x9e, 0x10}
+	cdb = append(cdb, make([]byte, 8)...)
+	cdb = binary.BigEndian.AppendUint32(cdb, 32)
+
+	if _, data = doSCSI(t, v, g, scsiReq(1, cdb...), 32); binary.BigEndian.Uint64(data) != 3 ||
+		binary.BigEndian.Uint32(data[8:]) != 512 {
+		t.Errorf("READ CAPACITY(16): got %v", data)
+	}
+
+	// WRITE(10) of the block 2 of the LUN 0, then READ(10) of it.
+	block := bytes.Repeat([]byte{0xab}, 512)
+
+	if status, _ = doSCSI(t, v, g, append(scsiReq(0, 0x2a, 0, 0, 0, 0, 2, 0, 0, 1), block...), 0); status != 0 {
+		t.Fatalf("WRITE(10): expected GOOD, actual: %d", status)
+	}
+
+	if status, data = doSCSI(t, v, g, scsiReq(0, 0x28, 0, 0, 0, 0, 2, 0, 0, 1), 512); status != 0 ||
+		!bytes.Equal(data, block) {
+		t.Errorf("READ(10): got status %d and %v", status, data[:8])
+	}
+
+	// REPORT LUNS lists both LUNs.
+	if _, data = doSCSI(t, v, g, scsiReq(0, 0xa0, 0, 0, 0, 0, 0, 0, 0, 0, 64), 64); len(data) != 24 ||
+		data[9] != 0 || data[17] != 1 {
+		t.Errorf("REPORT LUNS: got %v", data)
+	}
+
+	// Reads past the end and unknown commands fail with sense data.
+	for _, cdb := range [][]byte{{0x28, 0, 0, 0, 0, 8, 0, 0, 1}, {0xff}} {
+		addr := g.addChain(scsiReq(0, cdb...), make([]byte, 108))
+		if err := v.IO(2); err != nil {
+			t.Fatalf("err: %v\n", err)
+		}
+
+		g.take()
+
+		resp := mem[addr:]
+		if resp[10] != 2 || binary.LittleEndian.Uint32(resp) != 18 || resp[12+2] != 0x05 {
+			t.Errorf("%#x: expected CHECK CONDITION with ILLEGAL REQUEST, actual: %v", cdb[0], resp[:32])
+		}
+	}
+}
+
+func TestSCSIBadTarget(t *testing.T) {
+	t.Parallel()
+
+	mem := make([]byte, 0x100000)
+	v := newSCSI(t, mem, 512)
+	g := newGuestQueue(t, v, virtio.SCSIIOPortStart, mem, 2)
+
+	req := scsiReq(0, 0x00)
+	req[1] = 1
+
+	addr := g.addChain(req, make([]byte, 108))
+	if err := v.IO(2); err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if mem[addr+11] != 3 {
+		t.Fatalf("expected VIRTIO_SCSI_S_BAD_TARGET, actual: %d", mem[addr+11])
+	}
+}
@@ -0,0 +1,824 @@
+package virtio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/pci"
+)
+
+var ErrInvalidCID = errors.New("vsock guest CID is invalid")
+
+const (
+	VsockIOPortStart = 0x6500
+	VsockIOPortSize  = 0x100
+
+	// VsockHostCID is the address of the host.
+	VsockHostCID = 2
+
+	// vsockBufAlloc is the receive buffer the host advertises for each
+	// connection, which bounds the data held for a slow socket.
+	vsockBufAlloc = 256 << 10
+
+	// vsockMaxPayload is the largest payload sent to the guest at once.
+	vsockMaxPayload = 4096
+
+	// vsockRxMax bounds the packets waiting for buffers of the guest.
+	// Once half of them wait, data waits too and new connections are
+	// refused, which leaves the rest to the packets of the connections.
+	vsockRxMax = 256
+
+	// vsockLocalPortStart is the first host port of the connections
+	// opened by the host.
+	vsockLocalPortStart = 1 << 30
+)
+
+// Queues of the device.
+const (
+	vsockRx = iota
+	vsockTx
+	vsockEvent
+)
+
+// Operations of a packet.
+//
+// refs https://github.com/torvalds/linux/blob/v6.1/include/uapi/linux/virtio_vsock.h
+const (
+	vsockOpRequest       = 1
+	vsockOpResponse      = 2
+	vsockOpRst           = 3
+	vsockOpShutdown      = 4
+	vsockOpRW            = 5
+	vsockOpCreditUpdate  = 6
+	vsockOpCreditRequest = 7
+
+	vsockTypeStream = 1
+
+	vsockShutdownRcv  = 1
+	vsockShutdownSend = 2
+)
+
+// vsockPacketHdr is struct virtio_vsock_hdr.
+type vsockPacketHdr struct {
+	SrcCID   uint64
+	DstCID   uint64
+	SrcPort  uint32
+	DstPort  uint32
+	Len      uint32
+	Type     uint16
+	Op       uint16
+	Flags    uint32
+	BufAlloc uint32
+	FwdCnt   uint32
+}
+
+const vsockPacketHdrSize = 44
+
+type vsockHdr struct {
+	commonHeader commonHeader
+	vsockHeader  vsockHeader
+}
+
+func (h vsockHdr) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+		return []byte{}, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type vsockHeader struct {
+	guestCID uint64
+}
+
+// vsockKey identifies a connection by its host and guest port.
+type vsockKey struct {
+	local, peer uint32
+}
+
+type vsockConn struct {
+	key  vsockKey
+	conn net.Conn
+	in   io.Reader
+
+	// established is cleared while a connection opened by the host
+	// waits for the guest to accept it.
+	established bool
+
+	// The credit of the guest: it can take peerBufAlloc bytes, of
+	// which it has passed on peerFwdCnt, and txCnt were sent to it.
+	peerBufAlloc, peerFwdCnt, txCnt uint32
+
+	// rxCnt counts the bytes of the guest, fwdCnt those written to
+	// conn, and sentFwdCnt is the count last told to the guest.
+	rxCnt, fwdCnt, sentFwdCnt uint32
+
+	// out holds the data of the guest until it is written to conn.
+	out    []byte
+	outEOF bool
+	closed bool
+	cond   *sync.Cond
+}
+
+// Vsock is a virtio socket device, backed like in Firecracker by unix
+// sockets on the host: a connection of the guest to the port P of the
+// host is passed to the socket at udsPath_P, and a client of the socket
+// at udsPath writes "CONNECT P\n" to connect to the port P of the guest,
+// and reads "OK L\n" with the host port L once the guest accepted.
+//
+// refs https://github.com/firecracker-microvm/firecracker/blob/main/docs/vsock.md
+type Vsock struct {
+	mu sync.Mutex
+	ioSched
+
+	Hdr vsockHdr
+
+	VirtQueue    [3]*VirtQueue
+	Mem          *memory.GuestMemory
+	LastAvailIdx [3]uint16
+
+	udsPath string
+	ln      net.Listener
+
+	conns     map[vsockKey]*vsockConn
+	nextLocal uint32
+
+	// dialing holds the connections of the guest whose host socket is
+	// being dialed, see connect.
+	dialing map[vsockKey]bool
+
+	// rx queues the packets until the guest gives buffers for them,
+	// up to vsockRxMax.
+	rx [][]byte
+
+	// err is the first chain out of guest memory since IO last
+	// returned.
+	err error
+
+	kick chan uint16
+
+	// closed keeps connections from being made, see Close.
+	closed bool
+
+	ioport      uint64
+	irq         uint8
+	IRQInjector IRQInjector
+}
+
+func (v *Vsock) GetDeviceHeader() pci.DeviceHeader {
+	return pci.DeviceHeader{
+		// The legacy driver of Linux takes any device ID from 0x1000
+		// to 0x103f, and the device type from the subsystem ID.
+		// refs https://github.com/kvmtool/kvmtool/blob/master/include/kvm/pci.h
+		DeviceID:    0x1012,
+		VendorID:    0x1AF4,
+		HeaderType:  0,
+		SubsystemID: 19, // Socket Device
+		Command:     1,  // Enable IO port
+		BAR: [6]uint32{
+			uint32(v.ioport) | 0x1,
+		},
+		// https://github.com/torvalds/linux/blob/fb3b0673b7d5b477ed104949450cd511337ba3c6/drivers/pci/setup-irq.c#L30-L55
+		InterruptPin: 1,
+		// https://www.webopedia.com/reference/irqnumbers/
+		InterruptLine: v.irq,
+	}
+}
+
+func (v *Vsock) Read(port uint64, bytes []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	offset := int(port - v.ioport)
+
+	b, err := v.Hdr.Bytes()
+	if err != nil {
+		return err
+	}
+
+	// Past the end of the config reads as zero.
+	if offset > len(b) {
+		offset = len(b)
+	}
+
+	l := len(bytes)
+	for i := copy(bytes[:l], b[offset:]); i < l; i++ {
+		bytes[i] = 0
+	}
+
+	return nil
+}
+
+func (v *Vsock) Write(port uint64, bytes []byte) error {
+	v.mu.Lock()
+
+	offset := int(port - v.ioport)
+
+	switch offset {
+	case 8:
+		sel := int(v.Hdr.commonHeader.queueSEL)
+		if sel >= len(v.VirtQueue) {
+			v.mu.Unlock()
+
+			return ErrInvalidSel
+		}
+
+		// Queue PFN is aligned to page (4096 bytes)
+		vq, err := newVirtQueue(v.Mem, pci.BytesToNum(bytes), v.Hdr.commonHeader.queueNUM)
+		if err != nil {
+			v.mu.Unlock()
+
+			return err
+		}
+
+		v.VirtQueue[sel] = vq
+
+		v.LastAvailIdx[sel] = 0
+	case 14:
+		v.Hdr.commonHeader.queueSEL = uint16(pci.BytesToNum(bytes))
+	case 16:
+		v.Hdr.commonHeader.isr = 0x0
+		v.mu.Unlock()
+
+		v.kick <- uint16(pci.BytesToNum(bytes))
+
+		return nil
+	default:
+	}
+
+	v.mu.Unlock()
+
+	return nil
+}
+
+// SetQueueSize sets the size of the queues, which the guest reads before
+// setting them up.
+func (v *Vsock) SetQueueSize(size uint16) error {
+	if err := CheckQueueSize(size); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.Hdr.commonHeader.queueNUM = size
+
+	return nil
+}
+
+func (v *Vsock) IOPort() uint64 {
+	return v.ioport
+}
+
+func (v *Vsock) Size() uint64 {
+	return VsockIOPortSize
+}
+
+// IOThreadEntry serves the queues notified by the guest and the
+// clients of the socket at udsPath.
+func (v *Vsock) IOThreadEntry() {
+	_ = v.goIO(v.accept)
+
+	for q := range v.kick {
+		_ = v.IO(q)
+	}
+}
+
+// Close makes IOThreadEntry return, stops listening at udsPath and closes
+// every connection. The guest must not notify the device anymore.
+func (v *Vsock) Close() error {
+	close(v.kick)
+
+	err := v.ln.Close()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.closed = true
+
+	for _, c := range v.conns {
+		v.remove(c)
+	}
+
+	return err
+}
+
+// IO handles a notification of the queue q, unless the device is closed.
+func (v *Vsock) IO(q uint16) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.closed {
+		return nil
+	}
+
+	used := false
+
+	switch q {
+	case vsockRx:
+		used = v.flushRx()
+	case vsockTx:
+		for {
+			vq := v.VirtQueue[vsockTx]
+			if vq == nil {
+				break
+			}
+
+			b, ok, err := pop(vq, &v.LastAvailIdx[vsockTx])
+			if !ok {
+				break
+			}
+
+			used = true
+
+			if err != nil {
+				v.fail(err)
+
+				continue
+			}
+
+			v.handle(b)
+		}
+
+		used = v.flushRx() || used
+	case vsockEvent:
+		// Buffers for transport events, which are never sent.
+	default:
+		return ErrInvalidSel
+	}
+
+	err := v.err
+	v.err = nil
+
+	if used {
+		if e := v.inject(); e != nil {
+			return e
+		}
+	}
+
+	return err
+}
+
+// fail keeps err for IO to return, unless an error is kept already.
+func (v *Vsock) fail(err error) {
+	if v.err == nil {
+		v.err = err
+	}
+}
+
+func (v *Vsock) inject() error {
+	v.Hdr.commonHeader.isr = 0x1
+
+	return v.IRQInjector.InjectVirtioIRQ(v.irq)
+}
+
+// flushRx passes the queued packets to the guest, one per buffer, and
+// tells whether any was. The connections waiting for room are woken up.
+func (v *Vsock) flushRx() bool {
+	used := false
+	busy := v.rxBusy()
+
+	defer func() {
+		if busy && !v.rxBusy() {
+			for _, c := range v.conns {
+				c.cond.Broadcast()
+			}
+		}
+	}()
+
+	for len(v.rx) > 0 && v.VirtQueue[vsockRx] != nil {
+		_, ok, err := push(v.VirtQueue[vsockRx], &v.LastAvailIdx[vsockRx], v.rx[0])
+		if !ok {
+			break
+		}
+
+		used = true
+
+		// The packet waits for a chain in guest memory.
+		if err != nil {
+			v.fail(err)
+
+			continue
+		}
+
+		v.rx = v.rx[1:]
+	}
+
+	return used
+}
+
+// rxBusy tells whether the guest is behind taking its packets, so that
+// data waits and new connections are refused, see vsockRxMax.
+func (v *Vsock) rxBusy() bool {
+	return len(v.rx) >= vsockRxMax/2
+}
+
+// send queues a packet of the connection key for the guest. The caller
+// flushes it. Once vsockRxMax packets wait, the packet is dropped and so
+// is its connection, which the guest then resets.
+func (v *Vsock) send(key vsockKey, op uint16, flags uint32, payload []byte) {
+	if len(v.rx) >= vsockRxMax {
+		if c, ok := v.conns[key]; ok {
+			v.remove(c)
+		}
+
+		return
+	}
+
+	h := vsockPacketHdr{
+		SrcCID:   VsockHostCID,
+		DstCID:   v.Hdr.vsockHeader.guestCID,
+		SrcPort:  key.local,
+		DstPort:  key.peer,
+		Len:      uint32(len(payload)),
+		Type:     vsockTypeStream,
+		Op:       op,
+		Flags:    flags,
+		BufAlloc: vsockBufAlloc,
+	}
+
+	if c, ok := v.conns[key]; ok {
+		h.FwdCnt = c.fwdCnt
+		c.sentFwdCnt = c.fwdCnt
+		c.txCnt += uint32(len(payload))
+	}
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, h)
+	buf.Write(payload)
+
+	v.rx = append(v.rx, buf.Bytes())
+}
+
+// sendNow sends a packet from outside of IO.
+func (v *Vsock) sendNow(key vsockKey, op uint16, flags uint32, payload []byte) {
+	v.send(key, op, flags, payload)
+
+	if v.flushRx() {
+		_ = v.inject()
+	}
+}
+
+// handle handles a packet of the guest.
+func (v *Vsock) handle(b []byte) {
+	var h vsockPacketHdr
+
+	if len(b) < vsockPacketHdrSize {
+		return
+	}
+
+	_ = binary.Read(bytes.NewReader(b), binary.LittleEndian, &h)
+
+	payload := b[vsockPacketHdrSize:]
+	if uint32(len(payload)) > h.Len {
+		payload = payload[:h.Len]
+	}
+
+	key := vsockKey{local: h.DstPort, peer: h.SrcPort}
+
+	if h.DstCID != VsockHostCID || h.SrcCID != v.Hdr.vsockHeader.guestCID || h.Type != vsockTypeStream {
+		if h.Op != vsockOpRst {
+			v.send(key, vsockOpRst, 0, nil)
+		}
+
+		return
+	}
+
+	c, ok := v.conns[key]
+	if ok {
+		c.peerBufAlloc = h.BufAlloc
+		c.peerFwdCnt = h.FwdCnt
+		c.cond.Broadcast()
+	}
+
+	switch {
+	case h.Op == vsockOpRequest && !ok && v.rxBusy():
+		v.send(key, vsockOpRst, 0, nil)
+	case h.Op == vsockOpRequest && !ok:
+		if !v.dialing[key] {
+			v.dialing[key] = true
+
+			_ = v.goIO(func() { v.connect(key, h) })
+		}
+	case !ok:
+		// The guest gives up a connection being dialed, if any.
+		delete(v.dialing, key)
+
+		if h.Op != vsockOpRst {
+			v.send(key, vsockOpRst, 0, nil)
+		}
+	case h.Op == vsockOpResponse && !c.established:
+		c.established = true
+
+		if _, err := fmt.Fprintf(c.conn, "OK %d\n", key.local); err != nil {
+			v.reset(c)
+
+			return
+		}
+
+		v.serve(c)
+	case h.Op == vsockOpRW:
+		// A guest sending more than the credit it was given would
+		// have out grow without bound.
+		if c.rxCnt-c.fwdCnt+uint32(len(payload)) > vsockBufAlloc {
+			v.reset(c)
+
+			return
+		}
+
+		c.rxCnt += uint32(len(payload))
+		c.out = append(c.out, payload...)
+		c.cond.Broadcast()
+	case h.Op == vsockOpCreditRequest:
+		v.send(key, vsockOpCreditUpdate, 0, nil)
+	case h.Op == vsockOpShutdown:
+		if h.Flags&vsockShutdownSend != 0 {
+			c.outEOF = true
+			c.cond.Broadcast()
+		}
+
+		if h.Flags&(vsockShutdownRcv|vsockShutdownSend) == vsockShutdownRcv|vsockShutdownSend {
+			v.reset(c)
+		}
+	case h.Op == vsockOpRst:
+		v.remove(c)
+	}
+}
+
+// connect passes a connection of the guest to the host socket of the
+// port. It dials without the lock, so that a slow socket does not hold
+// up the device, and drops the connection if the guest gave it up or
+// the device was closed meanwhile.
+func (v *Vsock) connect(key vsockKey, h vsockPacketHdr) {
+	conn, err := net.Dial("unix", v.udsPath+"_"+strconv.FormatUint(uint64(key.local), 10))
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !v.dialing[key] || v.closed {
+		if err == nil {
+			conn.Close()
+		}
+
+		return
+	}
+
+	delete(v.dialing, key)
+
+	if err != nil {
+		v.sendNow(key, vsockOpRst, 0, nil)
+
+		return
+	}
+
+	c := v.add(key, conn, conn)
+	c.established = true
+	c.peerBufAlloc = h.BufAlloc
+	c.peerFwdCnt = h.FwdCnt
+
+	v.sendNow(key, vsockOpResponse, 0, nil)
+
+	v.serve(c)
+}
+
+func (v *Vsock) add(key vsockKey, conn net.Conn, in io.Reader) *vsockConn {
+	c := &vsockConn{key: key, conn: conn, in: in, cond: sync.NewCond(&v.mu)}
+	v.conns[key] = c
+
+	return c
+}
+
+// reset tells the guest the connection is gone, and closes it.
+func (v *Vsock) reset(c *vsockConn) {
+	v.send(c.key, vsockOpRst, 0, nil)
+	v.remove(c)
+}
+
+func (v *Vsock) remove(c *vsockConn) {
+	if v.conns[c.key] == c {
+		delete(v.conns, c.key)
+	}
+
+	c.closed = true
+	c.conn.Close()
+	c.cond.Broadcast()
+}
+
+// serve starts passing the data of c both ways, on threads following
+// the policy set by SetIOSched.
+func (v *Vsock) serve(c *vsockConn) {
+	_ = v.goIO(func() { v.reader(c) })
+	_ = v.goIO(func() { v.writer(c) })
+}
+
+// reader passes the data of the host socket to the guest, as far as
+// the credit of the guest and the room in rx allow.
+func (v *Vsock) reader(c *vsockConn) {
+	buf := make([]byte, vsockMaxPayload)
+
+	for {
+		v.mu.Lock()
+
+		for !c.closed && (c.peerBufAlloc-(c.txCnt-c.peerFwdCnt) == 0 || v.rxBusy()) {
+			c.cond.Wait()
+		}
+
+		free := c.peerBufAlloc - (c.txCnt - c.peerFwdCnt)
+		closed := c.closed
+		v.mu.Unlock()
+
+		if closed {
+			return
+		}
+
+		if free > uint32(len(buf)) {
+			free = uint32(len(buf))
+		}
+
+		n, err := c.in.Read(buf[:free])
+
+		v.mu.Lock()
+
+		if c.closed {
+			v.mu.Unlock()
+
+			return
+		}
+
+		if n > 0 {
+			v.sendNow(c.key, vsockOpRW, 0, buf[:n])
+		}
+
+		if err != nil {
+			// The host is done, and the guest is to reset the
+			// connection once it is done too.
+			v.sendNow(c.key, vsockOpShutdown, vsockShutdownRcv|vsockShutdownSend, nil)
+			v.mu.Unlock()
+
+			return
+		}
+
+		v.mu.Unlock()
+	}
+}
+
+// writer passes the data of the guest to the host socket, and returns
+// the credit to the guest.
+func (v *Vsock) writer(c *vsockConn) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for {
+		for !c.closed && !c.outEOF && len(c.out) == 0 {
+			c.cond.Wait()
+		}
+
+		if c.closed {
+			return
+		}
+
+		if len(c.out) == 0 {
+			// The guest shut down its side.
+			if uc, ok := c.conn.(*net.UnixConn); ok {
+				_ = uc.CloseWrite()
+			}
+
+			return
+		}
+
+		b := c.out
+		c.out = nil
+
+		v.mu.Unlock()
+		_, err := c.conn.Write(b)
+		v.mu.Lock()
+
+		if c.closed {
+			return
+		}
+
+		if err != nil {
+			v.reset(c)
+
+			if v.flushRx() {
+				_ = v.inject()
+			}
+
+			return
+		}
+
+		c.fwdCnt += uint32(len(b))
+
+		// Tell the guest about the room made once it runs low.
+		if len(c.out) == 0 || c.fwdCnt-c.sentFwdCnt >= vsockBufAlloc/2 {
+			v.sendNow(c.key, vsockOpCreditUpdate, 0, nil)
+		}
+	}
+}
+
+// accept serves the clients connecting to the guest through udsPath.
+func (v *Vsock) accept() {
+	for {
+		conn, err := v.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		_ = v.goIO(func() { v.connectGuest(conn) })
+	}
+}
+
+// connectGuest reads the CONNECT line of a client, and asks the guest
+// to accept the connection, unless the guest is behind, see rxBusy.
+func (v *Vsock) connectGuest(conn net.Conn) {
+	in := bufio.NewReader(conn)
+
+	line, err := in.ReadString('\n')
+	if err != nil {
+		conn.Close()
+
+		return
+	}
+
+	port, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT "), 10, 32)
+	if err != nil || !strings.HasPrefix(line, "CONNECT ") {
+		conn.Close()
+
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.closed || v.rxBusy() {
+		conn.Close()
+
+		return
+	}
+
+	key := vsockKey{local: v.nextLocal, peer: uint32(port)}
+	v.nextLocal++
+
+	v.add(key, conn, in)
+	v.sendNow(key, vsockOpRequest, 0, nil)
+}
+
+// NewVsock creates a virtio socket device for the guest at cid, whose
+// registers are mapped at the IO port ioport. The host side listens at
+// udsPath, see Vsock.
+func NewVsock(ioport uint64, irq uint8, irqInjector IRQInjector, cid uint64, udsPath string,
+	mem *memory.GuestMemory,
+) (*Vsock, error) {
+	// CIDs 0 to 2 are reserved, and -1 is VMADDR_CID_ANY.
+	if cid <= VsockHostCID || cid >= 0xffffffff {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidCID, cid)
+	}
+
+	if err := os.Remove(udsPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", udsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Vsock{
+		Hdr: vsockHdr{
+			commonHeader: commonHeader{
+				hostFeatures: ringFIndirectDesc,
+				queueNUM:     QueueSize,
+				isr:          0x0,
+			},
+			vsockHeader: vsockHeader{
+				guestCID: cid,
+			},
+		},
+		udsPath:      udsPath,
+		ln:           ln,
+		conns:        map[vsockKey]*vsockConn{},
+		dialing:      map[vsockKey]bool{},
+		nextLocal:    vsockLocalPortStart,
+		ioport:       ioport,
+		irq:          irq,
+		IRQInjector:  irqInjector,
+		kick:         make(chan uint16),
+		Mem:          mem,
+		VirtQueue:    [3]*VirtQueue{},
+		LastAvailIdx: [3]uint16{},
+	}
+
+	return res, nil
+}
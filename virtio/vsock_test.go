@@ -0,0 +1,386 @@
+package virtio_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bobuhiro11/gokvm/sched"
+	"github.com/bobuhiro11/gokvm/virtio"
+	"golang.org/x/sys/unix"
+)
+
+// vsockPacket builds a packet of the guest at CID 3 to the host.
+func vsockPacket(src, dst uint32, op uint16, flags uint32, payload string) []byte {
+	b := binary.LittleEndian.AppendUint64(nil, 3)
+	b = binary.LittleEndian.AppendUint64(b, virtio.VsockHostCID)
+	b = binary.LittleEndian.AppendUint32(b, src)
+	b = binary.LittleEndian.AppendUint32(b, dst)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(payload)))
+	b = binary.LittleEndian.AppendUint16(b, 1) // VIRTIO_VSOCK_TYPE_STREAM
+	b = binary.LittleEndian.AppendUint16(b, op)
+	b = binary.LittleEndian.AppendUint32(b, flags)
+	b = binary.LittleEndian.AppendUint32(b, 64<<10) // buf_alloc
+	b = binary.LittleEndian.AppendUint32(b, 0)      // fwd_cnt
+
+	return append(b, payload...)
+}
+
+type vsockRx struct {
+	src, dst uint32
+	op       uint16
+	payload  string
+}
+
+// vsockGuest takes the packets the device passes to the guest on rx
+// when it interrupts the guest, so that guest memory is read while the
+// device holds its lock.
+type vsockGuest struct {
+	rx      *guestQueue
+	packets chan []byte
+}
+
+func (g *vsockGuest) InjectVirtioIRQ(uint8) error {
+	for _, b := range g.rx.take() {
+		g.packets <- bytes.Clone(b)
+	}
+
+	return nil
+}
+
+// waitRx waits for the next packet the device passes to the guest.
+func waitRx(t *testing.T, g *vsockGuest) vsockRx {
+	t.Helper()
+
+	var b []byte
+
+	select {
+	case b = <-g.packets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet for the guest")
+	}
+
+	if dst := binary.LittleEndian.Uint64(b[8:]); dst != 3 {
+		t.Errorf("dst_cid: got %d, want 3", dst)
+	}
+
+	n := binary.LittleEndian.Uint32(b[24:])
+
+	return vsockRx{
+		src:     binary.LittleEndian.Uint32(b[16:]),
+		dst:     binary.LittleEndian.Uint32(b[20:]),
+		op:      binary.LittleEndian.Uint16(b[30:]),
+		payload: string(b[44 : 44+n]),
+	}
+}
+
+func TestVsockGetDeviceHeader(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "vsock.sock")
+
+	v, err := virtio.NewVsock(virtio.VsockIOPortStart, 9, &mockInjector{}, 3, path, guestMem(t, nil))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	if h := v.GetDeviceHeader(); h.DeviceID != 0x1012 || h.SubsystemID != 19 {
+		t.Fatalf("expected: 0x1012 and 19, actual: %#x and %d", h.DeviceID, h.SubsystemID)
+	}
+
+	// guest_cid
+	actual := make([]byte, 4)
+	_ = v.Read(virtio.VsockIOPortStart+20, actual)
+
+	if !bytes.Equal(actual, []byte{3, 0, 0, 0}) {
+		t.Fatalf("guest_cid: expected 3, actual: %v", actual)
+	}
+
+	// The BAR ends far past the config, which reads as zero there.
+	past := []byte{1, 2, 3, 4}
+	if err := v.Read(virtio.VsockIOPortStart+virtio.VsockIOPortSize-4, past); err != nil {
+		t.Fatalf("past the config: err: %v", err)
+	}
+
+	if !bytes.Equal(past, make([]byte, 4)) {
+		t.Fatalf("past the config: expected zeros, actual: %v", past)
+	}
+
+	if _, err := virtio.NewVsock(virtio.VsockIOPortStart, 9, &mockInjector{}, 2, path, guestMem(t, nil)); !errors.Is(err,
+		virtio.ErrInvalidCID) {
+		t.Fatalf("CID 2: expected %v, actual: %v", virtio.ErrInvalidCID, err)
+	}
+}
+
+func TestVsock(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "vsock.sock")
+	mem := make([]byte, 0x100000)
+
+	// The guest gives the device 16 buffers to receive packets.
+	g := &vsockGuest{packets: make(chan []byte, 16)}
+
+	v, err := virtio.NewVsock(virtio.VsockIOPortStart, 9, g, 3, path, guestMem(t, mem))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+
+	g.rx = newGuestQueue(t, v, virtio.VsockIOPortStart, mem, 0)
+	tx := newGuestQueue(t, v, virtio.VsockIOPortStart, mem, 1)
+
+	for i := 0; i < 16; i++ {
+		g.rx.add(make([]byte, 44+64), true)
+	}
+
+	go v.IOThreadEntry()
+
+	send := func(b []byte) {
+		t.Helper()
+
+		tx.add(b, false)
+
+		if err := v.IO(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := func(want vsockRx) {
+		t.Helper()
+
+		if got := waitRx(t, g); got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	// The guest connects to port 52 of the host.
+	ln, err := net.Listen("unix", path+"_52")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	send(vsockPacket(1000, 52, 1, 0, "")) // REQUEST
+	expect(vsockRx{src: 52, dst: 1000, op: 2})
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	send(vsockPacket(1000, 52, 5, 0, "ping")) // RW
+
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Errorf("host: got %q, %v, want %q", got, err, "ping")
+	}
+
+	// The data written to the host socket is credited back.
+	expect(vsockRx{src: 52, dst: 1000, op: 6})
+
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(vsockRx{src: 52, dst: 1000, op: 5, payload: "pong"})
+
+	// The guest shuts the connection down, and the host closes it.
+	send(vsockPacket(1000, 52, 4, 3, "")) // SHUTDOWN
+	expect(vsockRx{src: 52, dst: 1000, op: 3})
+
+	if n, err := conn.Read(got); !errors.Is(err, io.EOF) {
+		t.Errorf("host after SHUTDOWN: got %d, %v, want %v", n, err, io.EOF)
+	}
+
+	// Nobody listens at port 53.
+	send(vsockPacket(1001, 53, 1, 0, ""))
+	expect(vsockRx{src: 53, dst: 1001, op: 3})
+
+	// The host connects to port 1234 of the guest.
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte("CONNECT 1234\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	req := waitRx(t, g)
+	if req.op != 1 || req.dst != 1234 {
+		t.Fatalf("got %+v, want a REQUEST to 1234", req)
+	}
+
+	send(vsockPacket(1234, req.src, 2, 0, "")) // RESPONSE
+
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) == "" || !strings.HasPrefix(line, "OK ") {
+		t.Errorf("host: got %q, %v, want OK", line, err)
+	}
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(vsockRx{src: req.src, dst: 1234, op: 5, payload: "hello"})
+
+	// The guest sends more than the 256KiB of credit it was given.
+	send(vsockPacket(1002, 52, 1, 0, "")) // REQUEST
+	expect(vsockRx{src: 52, dst: 1002, op: 2})
+
+	conn2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+
+	send(vsockPacket(1002, 52, 5, 0, strings.Repeat("x", 256<<10+1)))
+	expect(vsockRx{src: 52, dst: 1002, op: 3})
+}
+
+func TestVsockIOSched(t *testing.T) { // nolint:paralleltest
+	if err := sched.Go(ioPolicy(3), func() {}); errors.Is(err, unix.EPERM) {
+		t.Skipf("no real-time scheduling: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "vsock.sock")
+	mem := make([]byte, 0x100000)
+	g := &vsockGuest{packets: make(chan []byte, 16)}
+
+	v, err := virtio.NewVsock(virtio.VsockIOPortStart, 9, g, 3, path, guestMem(t, mem))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+	defer v.Close()
+
+	policy := ioPolicy(2)
+	v.SetIOSched(policy)
+
+	g.rx = newGuestQueue(t, v, virtio.VsockIOPortStart, mem, 0)
+	tx := newGuestQueue(t, v, virtio.VsockIOPortStart, mem, 1)
+
+	for i := 0; i < 16; i++ {
+		g.rx.add(make([]byte, 44+64), true)
+	}
+
+	ln, err := net.Listen("unix", path+"_52")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	before := ioThreads(t, policy)
+
+	go v.IOThreadEntry()
+
+	tx.add(vsockPacket(1000, 52, 1, 0, ""), false) // REQUEST
+
+	if err := v.IO(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if rx := waitRx(t, g); rx.op != 2 {
+		t.Fatalf("got %+v, want a RESPONSE", rx)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The listener and the reader and writer of the connection follow
+	// the policy.
+	deadline := time.Now().Add(5 * time.Second)
+
+	for ioThreads(t, policy)-before < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 threads following the policy, actual: %d", ioThreads(t, policy)-before)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestVsockRxMax(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "vsock.sock")
+	mem := make([]byte, 0x100000)
+	g := &vsockGuest{packets: make(chan []byte, virtio.QueueSize)}
+
+	v, err := virtio.NewVsock(virtio.VsockIOPortStart, 9, g, 3, path, guestMem(t, mem))
+	if err != nil {
+		t.Fatalf("err: %v\n", err)
+	}
+	defer v.Close()
+
+	g.rx = newGuestQueue(t, v, virtio.VsockIOPortStart, mem, 0)
+	tx := newGuestQueue(t, v, virtio.VsockIOPortStart, mem, 1)
+
+	go v.IOThreadEntry()
+
+	// The guest gives no buffers, and sends packets to connections which
+	// do not exist, each of which is to be reset.
+	for i := uint32(0); i < 1000; i++ {
+		tx.add(vsockPacket(2000+i, 60, 5, 0, ""), false) // RW
+
+		if err := v.IO(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A client of the host is refused meanwhile.
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte("CONNECT 1234\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := c.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("CONNECT: got %d, %v, want %v", n, err, io.EOF)
+	}
+
+	// Only the first 256 packets were kept.
+	n := 0
+
+	for {
+		for i := 0; i < virtio.QueueSize; i++ {
+			g.rx.add(make([]byte, 44), true)
+		}
+
+		if err := v.IO(0); err != nil {
+			t.Fatal(err)
+		}
+
+		got := len(g.packets)
+		for i := 0; i < got; i++ {
+			<-g.packets
+		}
+
+		if n += got; got < virtio.QueueSize {
+			break
+		}
+	}
+
+	if n != 256 {
+		t.Errorf("got %d packets, want 256", n)
+	}
+}
@@ -2,14 +2,22 @@ package vmm
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"sync/atomic"
 
+	"github.com/bobuhiro11/gokvm/cpuid"
 	"github.com/bobuhiro11/gokvm/machine"
-	"github.com/bobuhiro11/gokvm/pvh"
+	"github.com/bobuhiro11/gokvm/memory"
+	"github.com/bobuhiro11/gokvm/qmp"
+	"github.com/bobuhiro11/gokvm/sched"
+	"github.com/bobuhiro11/gokvm/serial"
 	"github.com/bobuhiro11/gokvm/term"
-	"golang.org/x/sync/errgroup"
+	"github.com/bobuhiro11/gokvm/virtio"
 )
 
 // Config defines the configuration of the
@@ -20,16 +28,136 @@ type Config struct {
 	Kernel     string
 	Initrd     string
 	Params     string
-	TapIfName  string
-	Disk       string
+	Disks      []Disk
+	NICs       []NIC
 	NCPUs      int
 	MemSize    int
 	TraceCount int
+	QMPSocket  string
+	CPUID      []cpuid.Tweak
+
+	// Serials are the backend specs of COM1 onwards, see
+	// serial.ParseSpec. COM1 defaults to stdio.
+	Serials []string
+
+	// VPorts are the ports of the virtio console, if any.
+	VPorts []VPort
+
+	// VsockPath is where the host side of the virtio socket device of
+	// the guest at VsockCID listens. It is empty for no device.
+	VsockPath string
+	VsockCID  uint64
+
+	// Rng adds a virtio entropy device reading RngSource, or
+	// crypto/rand if it is empty.
+	Rng       bool
+	RngSource string
+
+	// Balloon adds a virtio memory balloon device, resized through the
+	// control socket.
+	Balloon bool
+
+	// Shares are the host directories served to the guest.
+	Shares []Share
+
+	// SCSI are the LUNs of a virtio SCSI controller, if any.
+	SCSI []Disk
+
+	// QueueSize is the size of the queues of the virtio devices, or 0
+	// for virtio.QueueSize.
+	QueueSize uint16
+
+	// MemPath, MemHugepages and MemPrealloc back the guest memory, see
+	// memory.Backing.
+	MemPath      string
+	MemHugepages bool
+	MemPrealloc  bool
+
+	// MemHotplug is the size of the region of a virtio-mem device,
+	// resized through the control socket, or 0 for none.
+	MemHotplug uint64
+
+	// MaxCPUs is the number of vCPUs the guest can have, those beyond
+	// NCPUs being added through the control socket.
+	MaxCPUs int
+
+	// Topology lays out the MaxCPUs vCPUs in sockets, cores and
+	// threads, or is the zero value for a socket per vCPU.
+	Topology cpuid.Topology
+
+	// NUMA are the NUMA nodes of the guest, if any.
+	NUMA []machine.NUMANode
+
+	// CPUModel is the CPU the guest sees, or the zero value for
+	// cpuid.DefaultModel.
+	CPUModel cpuid.Model
+
+	// VCPUAffinity pins the threads of the vCPUs to host CPUs, which
+	// VCPUPriority runs with SCHED_FIFO if not 0, and IOAffinity pins
+	// the IO threads of the devices, see sched.Policy.
+	VCPUAffinity map[int][]int
+	VCPUPriority int
+	IOAffinity   []int
+}
+
+// cpuDriver is the driver of device_add which adds a vCPU.
+const cpuDriver = "host-x86_64-cpu"
+
+// Disk defines a virtio block device, or a LUN of the virtio SCSI
+// controller. ReadOnly and Snapshot keep the guest from changing the
+// file at Path, see virtio.DiskMode.
+type Disk struct {
+	Path     string
+	ReadOnly bool
+	Snapshot bool
+}
+
+func (d Disk) mode() virtio.DiskMode {
+	switch {
+	case d.ReadOnly:
+		return virtio.DiskReadOnly
+	case d.Snapshot:
+		return virtio.DiskSnapshot
+	default:
+		return virtio.DiskReadWrite
+	}
+}
+
+// NIC defines a virtio net device. A nil MAC lets the guest choose one.
+type NIC struct {
+	TapIfName string
+	MAC       net.HardwareAddr
+}
+
+// Share defines a host directory served to the guest by a virtio 9p
+// device, which the guest mounts by Tag.
+type Share struct {
+	Tag      string
+	Path     string
+	ReadOnly bool
+}
+
+// VPort defines a port of the virtio console. Backend is a spec like
+// the ones of Serials.
+type VPort struct {
+	Name    string
+	Console bool
+	Backend string
 }
 
 type VMM struct {
 	*machine.Machine
 	Config
+
+	// shutdown is set once the guest was powered off, reset or quit
+	// through the control socket.
+	shutdown atomic.Bool
+
+	// vports holds the backends of the virtio console ports, opened
+	// by Init and closed once Boot returns. vportStdio is set if one
+	// of them is stdio.
+	vports     []io.Closer
+	vportStdio bool
 }
 
 func New(c Config) *VMM {
@@ -41,21 +169,95 @@ func New(c Config) *VMM {
 
 // Init instantiates a machine.
 func (v *VMM) Init() error {
-	m, err := machine.New(v.Dev, v.NCPUs, v.MemSize)
-	if err != nil {
-		return err
+	opts := []machine.Option{
+		machine.WithDevice(v.Dev),
+		machine.WithCPUs(v.NCPUs),
+		machine.WithMemory(v.MemSize),
+		machine.WithMemoryBacking(memory.Backing{Path: v.MemPath, Hugepages: v.MemHugepages, Prealloc: v.MemPrealloc}),
+		machine.WithCPUID(v.CPUID...),
 	}
 
-	if len(v.TapIfName) > 0 {
-		if err := m.AddTapIf(v.TapIfName); err != nil {
-			return err
+	if v.CPUModel.Name != "" {
+		opts = append(opts, machine.WithCPUModel(v.CPUModel))
+	}
+
+	if v.MaxCPUs > v.NCPUs {
+		opts = append(opts, machine.WithMaxCPUs(v.MaxCPUs))
+	}
+
+	if v.Config.Topology.CPUs() != 0 {
+		opts = append(opts, machine.WithTopology(v.Config.Topology))
+	}
+
+	if len(v.NUMA) > 0 {
+		opts = append(opts, machine.WithNUMA(v.NUMA...))
+	}
+
+	for cpu := 0; cpu < max(v.MaxCPUs, v.NCPUs); cpu++ {
+		if p := (sched.Policy{CPUs: v.VCPUAffinity[cpu], Priority: v.VCPUPriority}); !p.IsZero() {
+			opts = append(opts, machine.WithVCPUSched(cpu, p))
+		}
+	}
+
+	if len(v.IOAffinity) > 0 {
+		opts = append(opts, machine.WithIOSched(sched.Policy{CPUs: v.IOAffinity}))
+	}
+
+	if v.QueueSize != 0 {
+		opts = append(opts, machine.WithQueueSize(v.QueueSize))
+	}
+
+	for _, n := range v.NICs {
+		opts = append(opts, machine.WithNIC(n.TapIfName, n.MAC))
+	}
+
+	for _, d := range v.Disks {
+		opts = append(opts, machine.WithDisk(d.Path, d.mode()))
+	}
+
+	if len(v.SCSI) > 0 {
+		luns := make([]virtio.SCSILUN, len(v.SCSI))
+		for i, d := range v.SCSI {
+			luns[i] = virtio.SCSILUN{Path: d.Path, Mode: d.mode()}
 		}
+
+		opts = append(opts, machine.WithSCSI(luns...))
+	}
+
+	if v.VsockPath != "" {
+		opts = append(opts, machine.WithVsock(v.VsockCID, v.VsockPath))
+	}
+
+	if v.Rng {
+		opts = append(opts, machine.WithRng(v.RngSource))
+	}
+
+	for _, sh := range v.Shares {
+		opts = append(opts, machine.WithShare(sh.Tag, sh.Path, sh.ReadOnly))
+	}
+
+	if v.Balloon {
+		opts = append(opts, machine.WithBalloon())
+	}
+
+	if v.MemHotplug != 0 {
+		opts = append(opts, machine.WithMemHotplug(v.MemHotplug))
 	}
 
-	if len(v.Disk) > 0 {
-		if err := m.AddDisk(v.Disk); err != nil {
+	if len(v.VPorts) > 0 {
+		ports, err := v.openVPorts()
+		if err != nil {
 			return err
 		}
+
+		opts = append(opts, machine.WithVirtioConsole(ports...))
+	}
+
+	m, err := machine.Build(opts...)
+	if err != nil {
+		v.closeVPorts()
+
+		return err
 	}
 
 	v.Machine = m
@@ -63,95 +265,361 @@ func (v *VMM) Init() error {
 	return nil
 }
 
+// Close releases the machine and the virtio console ports, once the
+// machine is done running.
+func (v *VMM) Close() error {
+	v.closeVPorts()
+
+	if v.Machine == nil {
+		return nil
+	}
+
+	return v.Machine.Close()
+}
+
+// Setup loads the kernel or firmware image, and the initrd if any.
 func (v *VMM) Setup() error {
-	var initrd *os.File
-	// Kernel arg required to load kernel or firmware image
-	kern, err := os.Open(v.Kernel)
-	if err != nil {
-		return err
+	return v.LoadKernel(v.Kernel, v.Initrd, v.Params)
+}
+
+// Boot runs the guest until it exits, ctx is done or the machine is
+// stopped through the control socket, and reports how it ended.
+func (v *VMM) Boot(ctx context.Context) (machine.Exit, error) {
+	if err := v.SetTrace(os.Stderr, v.TraceCount); err != nil {
+		return machine.Exit{}, fmt.Errorf("setting trace to %v:%w", v.TraceCount > 0, err)
+	}
+
+	if len(v.QMPSocket) > 0 {
+		s := qmp.New(v)
+		if v.Balloon {
+			s.SetBalloonHandler(v)
+		}
+
+		if v.MemHotplug != 0 {
+			s.SetMemoryHandler(v)
+		}
+
+		if v.MaxCPUs > v.NCPUs {
+			s.SetHotplugHandler(v)
+			s.SetCPUHotplugHandler(v)
+		}
+
+		if err := s.Listen(v.QMPSocket); err != nil {
+			return machine.Exit{}, err
+		}
+
+		defer s.Close()
+
+		go func() {
+			if err := s.Serve(); err != nil {
+				log.Printf("QMP server exits: %v", err)
+			}
+		}()
 	}
 
-	isPVH, err := pvh.CheckPVH(kern)
+	restore, err := v.connectSerial()
 	if err != nil {
-		return err
+		return machine.Exit{}, err
+	}
+
+	defer restore()
+
+	for cpu := 0; cpu < v.NCPUs; cpu++ {
+		fmt.Printf("Start CPU %d of %d\r\n", cpu, v.NCPUs)
 	}
 
-	if v.Initrd != "" {
-		initrd, err = os.Open(v.Initrd)
+	fmt.Printf("Waiting for CPUs to exit\r\n")
+
+	exit, err := v.Start(ctx)
+
+	fmt.Printf("All cpus done: %v\n\r", exit.Reason)
+
+	return exit, err
+}
+
+// openVPorts opens the backends of the virtio console ports.
+func (v *VMM) openVPorts() ([]virtio.ConsolePort, error) {
+	ports := make([]virtio.ConsolePort, 0, len(v.VPorts))
+
+	for i, p := range v.VPorts {
+		spec, err := serial.ParseSpec(p.Backend)
 		if err != nil {
-			return err
+			v.closeVPorts()
+
+			return nil, err
 		}
-	}
 
-	if isPVH {
-		if err := v.Machine.LoadPVH(kern, initrd, v.Params); err != nil {
-			return err
+		b, err := spec.Open()
+		if err != nil {
+			v.closeVPorts()
+
+			return nil, err
 		}
-	} else {
-		if err := v.Machine.LoadLinux(kern, initrd, v.Params); err != nil {
-			return err
+
+		if addr := b.Addr(); addr != "" {
+			fmt.Fprintf(os.Stderr, "vport: port %d %s backend at %s\r\n", i, spec.Kind, addr)
+		}
+
+		out := serial.NewOutput(b, spec.Timestamps)
+		v.vports = append(v.vports, out, b)
+
+		var in io.Reader = b
+
+		if spec.Kind == serial.KindStdio {
+			// Like on a serial port, Ctrl-a x stops the guest.
+			in = &escapeReader{r: b, escape: func() { v.Stop() }}
+			v.vportStdio = true
 		}
+
+		ports = append(ports, virtio.ConsolePort{Name: p.Name, Console: p.Console, In: in, Out: out})
 	}
 
-	return nil
+	return ports, nil
+}
+
+func (v *VMM) closeVPorts() {
+	for _, c := range v.vports {
+		c.Close()
+	}
+
+	v.vports = nil
 }
 
-func (v *VMM) Boot() error {
-	var err error
+// escapeReader reads r until Ctrl-a x, upon which it calls escape.
+type escapeReader struct {
+	r      io.Reader
+	before byte
+	escape func()
+}
+
+func (e *escapeReader) Read(b []byte) (int, error) {
+	n, err := e.r.Read(b)
+
+	for i := 0; i < n; i++ {
+		if e.before == 0x1 && b[i] == 'x' {
+			e.escape()
 
-	trace := v.TraceCount > 0
-	if err := v.SingleStep(trace); err != nil {
-		return fmt.Errorf("setting trace to %v:%w", trace, err)
+			return i + 1, io.EOF
+		}
+
+		e.before = b[i]
 	}
 
-	g := new(errgroup.Group)
+	return n, err
+}
 
-	for cpu := 0; cpu < v.NCPUs; cpu++ {
-		fmt.Printf("Start CPU %d of %d\r\n", cpu, v.NCPUs)
+// connectSerial connects each serial port to its backend, and the
+// terminal to the virtio console port using it if any. It returns a
+// function undoing the setup, and closing the virtio console ports,
+// once the guest is done.
+func (v *VMM) connectSerial() (func(), error) {
+	specs := v.Serials
+	if len(specs) == 0 {
+		specs = []string{serial.KindStdio}
+	}
 
-		i := cpu
+	var undo []func()
 
-		f := func() error {
-			return v.VCPU(os.Stderr, i, v.TraceCount)
+	restore := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
 		}
+	}
+
+	for port, s := range specs {
+		spec, err := serial.ParseSpec(s)
+		if err != nil {
+			restore()
+
+			return nil, err
+		}
+
+		var f func()
+
+		if spec.Kind == serial.KindStdio {
+			f, err = v.connectStdio(port, spec)
+		} else {
+			f, err = v.connectBackend(port, spec)
+		}
+
+		if err != nil {
+			restore()
+
+			return nil, err
+		}
+
+		undo = append(undo, f)
+	}
+
+	undo = append([]func(){v.closeVPorts}, undo...)
+
+	if v.vportStdio && term.IsTerminal() {
+		restoreMode, err := term.SetRawMode()
+		if err != nil {
+			restore()
+
+			return nil, err
+		}
+
+		undo = append(undo, restoreMode)
+	}
+
+	return restore, nil
+}
+
+func (v *VMM) connectBackend(port int, spec serial.Spec) (func(), error) {
+	b, err := spec.Open()
+	if err != nil {
+		return nil, err
+	}
 
-		g.Go(f)
+	if addr := b.Addr(); addr != "" {
+		fmt.Fprintf(os.Stderr, "serial: COM%d %s backend at %s\r\n", port+1, spec.Kind, addr)
+	}
+
+	out := serial.NewOutput(b, spec.Timestamps)
+
+	if err := v.SetSerial(port, b, out); err != nil {
+		out.Close()
+		b.Close()
+
+		return nil, err
+	}
+
+	return func() {
+		out.Close()
+		b.Close()
+	}, nil
+}
+
+// connectStdio connects the port to the terminal. Ctrl-a x typed on it
+// stops the guest.
+func (v *VMM) connectStdio(port int, spec serial.Spec) (func(), error) {
+	out := serial.NewOutput(os.Stdout, spec.Timestamps)
+
+	if err := v.SetSerial(port, nil, out); err != nil {
+		out.Close()
+
+		return nil, err
 	}
 
 	if !term.IsTerminal() {
 		fmt.Fprintln(os.Stderr, "this is not terminal and does not accept input")
-		select {}
+
+		return func() { out.Close() }, nil
 	}
 
 	restoreMode, err := term.SetRawMode()
 	if err != nil {
-		return err
+		out.Close()
+
+		return nil, err
 	}
 
-	defer restoreMode()
+	in := bufio.NewReader(os.Stdin)
+	uart := v.GetSerial(port)
+
+	// The serial input is not waited for, since reading stdin
+	// would block the VMM from exiting after a quit command.
+	// Ctrl-a x ends the input and stops the guest.
+	go func() {
+		err := uart.Start(*in, restoreMode)
+		log.Printf("Serial exits: %v", err)
+		v.Stop()
+	}()
 
-	if err := v.SingleStep(trace); err != nil {
-		log.Printf("SingleStep(%v): %v", trace, err)
+	return func() {
+		out.Close()
+		restoreMode()
+	}, nil
+}
 
-		return err
+// Status implements qmp.VM.
+func (v *VMM) Status() qmp.Status {
+	switch {
+	case v.shutdown.Load():
+		return qmp.StatusShutdown
+	case v.Paused():
+		return qmp.StatusPaused
+	default:
+		return qmp.StatusRunning
 	}
+}
 
-	in := bufio.NewReader(os.Stdin)
+// Powerdown implements qmp.VM. It presses the ACPI power button, so
+// that the guest shuts down and powers itself off.
+func (v *VMM) Powerdown() error {
+	return v.PowerButton()
+}
 
-	g.Go(func() error {
-		err := v.GetSerial().Start(*in, restoreMode, v.InjectSerialIRQ)
-		log.Printf("Serial exits: %v", err)
+// Reset implements qmp.VM. Like a write to port 0xcf9, a reset
+// ends the VMM.
+func (v *VMM) Reset() error {
+	return v.halt(machine.ExitReset)
+}
 
-		return err
-	})
+// Quit implements qmp.VM.
+func (v *VMM) Quit() error {
+	return v.halt(machine.ExitStopped)
+}
 
-	fmt.Printf("Waiting for CPUs to exit\r\n")
+func (v *VMM) halt(reason machine.ExitReason) error {
+	fmt.Printf("guest %v via QMP\r\n", reason)
+
+	v.shutdown.Store(true)
+	v.Shutdown(reason)
+
+	return nil
+}
 
-	if err := g.Wait(); err != nil {
-		log.Print(err)
+// DeviceAdd implements qmp.HotplugHandler for vCPUs, the only devices
+// which can be added at runtime. They are added in order, so that the
+// socket-id, core-id and thread-id given must be the ones of the next
+// vCPU, which must still be next when it is added.
+func (v *VMM) DeviceAdd(driver, id string, props map[string]interface{}) error {
+	if driver != cpuDriver {
+		return fmt.Errorf("%s: %w", driver, qmp.ErrHotplugUnsupported)
 	}
 
-	fmt.Printf("All cpus done\n\r")
+	cpu := v.NumCPUs()
+	socket, core, thread := v.Machine.Topology().Location(cpu)
+
+	for prop, want := range map[string]int{"socket-id": socket, "core-id": core, "thread-id": thread} {
+		if got, ok := props[prop]; ok {
+			if n, _ := got.(float64); int(n) != want {
+				return fmt.Errorf("%s %v, want %d:%w", prop, got, want, machine.ErrBadCPU)
+			}
+		}
+	}
+
+	if err := v.AddCPUAt(cpu); err != nil {
+		return err
+	}
+
+	fmt.Printf("Start CPU %d of %d\r\n", cpu, v.PossibleCPUs())
 
 	return nil
 }
+
+// DeviceDel implements qmp.HotplugHandler. vCPUs can not be removed.
+func (v *VMM) DeviceDel(id string) error {
+	return fmt.Errorf("%s: %w", id, qmp.ErrHotplugUnsupported)
+}
+
+// HotpluggableCPUs implements qmp.CPUHotplugHandler. Each vCPU is a
+// thread of the topology.
+func (v *VMM) HotpluggableCPUs() ([]qmp.HotpluggableCPU, error) {
+	cpus := make([]qmp.HotpluggableCPU, v.PossibleCPUs())
+
+	for i := range cpus {
+		socket, core, thread := v.Machine.Topology().Location(i)
+		props := qmp.CPUProps{SocketID: socket, CoreID: core, ThreadID: thread}
+		cpus[i] = qmp.HotpluggableCPU{Type: cpuDriver, VCPUsCount: 1, Props: props}
+
+		if i < v.NumCPUs() {
+			cpus[i].QOMPath = fmt.Sprintf("/machine/cpu[%d]", i)
+		}
+	}
+
+	return cpus, nil
+}